@@ -0,0 +1,486 @@
+// Package jsonpatch turns partial updates of a JSON document into
+// RedisJSON commands.  Partial updates come in two standard formats:
+//
+//   - A JSON Merge Patch (RFC 7396) looks like the document itself, with
+//     only the fields to change.  A null removes a field.  For example
+//     {"done": true} marks a todo done.
+//   - A JSON Patch (RFC 6902) is a list of operations, each one naming a
+//     part of the document with a JSON Pointer, for example
+//     [{"op": "add", "path": "/voterHistory/-", "value": {...}}].
+//
+// Instead of reading the whole document, changing it in Go and writing
+// it back, Apply turns a patch into commands that change only the paths
+// it touches, for example JSON.SET todo:1 $.done true.  It also applies
+// the patch to a copy of the document.  That checks the operations can
+// be applied (a JSON Patch is all or nothing, and the "test" operation
+// compares values), and Decode checks the result is still a valid
+// document.  The caller then runs the commands in a MULTI/EXEC
+// transaction while the key is WATCHed, so nobody can change the
+// document between the check and the write.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The content types of the two patch formats
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrInvalidPatch is returned for a patch that is not well formed
+	ErrInvalidPatch = errors.New("invalid patch")
+	// ErrPatchFailed is returned for a well formed patch that cannot be
+	// applied to the document, for example one whose test fails or that
+	// removes a field that is not there
+	ErrPatchFailed = errors.New("patch cannot be applied")
+)
+
+// Op is one operation of a JSON Patch
+type Op struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Command is a RedisJSON command that changes one path of a document,
+// Args are the arguments after the key
+type Command struct {
+	Name string
+	Args []interface{}
+}
+
+// ForKey returns the command with its arguments, to run on the document
+// stored under key
+func (c Command) ForKey(key string) []interface{} {
+	return append([]interface{}{c.Name, key}, c.Args...)
+}
+
+// Apply applies a patch in either format, named by its content type, to
+// a decoded document.  It returns the patched document and the commands
+// that make the same change in redis.
+func Apply(doc interface{}, contentType string, patch []byte) (interface{}, []Command, error) {
+	switch contentType {
+	case MergePatchType:
+		var p interface{}
+		if err := json.Unmarshal(patch, &p); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		var cmds []Command
+		doc, err := mergePatch(doc, p, "$", &cmds)
+		return doc, cmds, err
+	case JSONPatchType:
+		var ops []Op
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		return jsonPatch(doc, ops)
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported content type %q", ErrInvalidPatch, contentType)
+	}
+}
+
+// mergePatch applies an RFC 7396 merge patch to the value at path.  A
+// patch that is an object is merged member by member into an object,
+// anything else replaces the value.
+func mergePatch(target, patch interface{}, path string, cmds *[]Command) (interface{}, error) {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		cmd, err := setCmd(path, patch)
+		*cmds = append(*cmds, cmd)
+		return patch, err
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		//The target is not an object, so it is replaced by the patch
+		//with its nulls removed, which is the patch merged into {}
+		var ignored []Command
+		merged, _ := mergePatch(map[string]interface{}{}, p, path, &ignored)
+		cmd, err := setCmd(path, merged)
+		*cmds = append(*cmds, cmd)
+		return merged, err
+	}
+
+	out := copyObject(t)
+	for _, name := range sortedKeys(p) {
+		childPath := path + memberPath(name)
+		if p[name] == nil {
+			if _, exists := out[name]; exists {
+				delete(out, name)
+				*cmds = append(*cmds, Command{Name: "JSON.DEL", Args: []interface{}{childPath}})
+			}
+			continue
+		}
+		merged, err := mergePatch(out[name], p[name], childPath, cmds)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = merged
+	}
+	return out, nil
+}
+
+// jsonPatch applies the operations of an RFC 6902 JSON Patch in order.
+// If any of them fails the error is returned and nothing is applied.
+func jsonPatch(doc interface{}, ops []Op) (interface{}, []Command, error) {
+	var cmds []Command
+	for i, op := range ops {
+		var err error
+		doc, cmds, err = jsonPatchOp(doc, op, cmds)
+		if err != nil {
+			return nil, nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, cmds, nil
+}
+
+func jsonPatchOp(doc interface{}, op Op, cmds []Command) (interface{}, []Command, error) {
+	tokens, err := splitPointer(op.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, nil, fmt.Errorf("%w: %s needs a value", ErrInvalidPatch, op.Op)
+		}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+	case "move", "copy":
+		from, err := splitPointer(op.From)
+		if err != nil {
+			return nil, nil, err
+		}
+		if value, err = getValue(doc, from); err != nil {
+			return nil, nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, nil, fmt.Errorf("%w: cannot move a value into itself", ErrInvalidPatch)
+			}
+			fromPath, err := redisPath(doc, from)
+			if err != nil {
+				return nil, nil, err
+			}
+			if doc, err = removeValue(doc, from); err != nil {
+				return nil, nil, err
+			}
+			cmds = append(cmds, Command{Name: "JSON.DEL", Args: []interface{}{fromPath}})
+		}
+	}
+
+	switch op.Op {
+	case "test":
+		current, err := getValue(doc, tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, nil, fmt.Errorf("%w: test failed", ErrPatchFailed)
+		}
+		return doc, cmds, nil
+
+	case "remove":
+		if len(tokens) == 0 {
+			return nil, nil, fmt.Errorf("%w: the whole document cannot be removed", ErrPatchFailed)
+		}
+		path, err := redisPath(doc, tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		if doc, err = removeValue(doc, tokens); err != nil {
+			return nil, nil, err
+		}
+		return doc, append(cmds, Command{Name: "JSON.DEL", Args: []interface{}{path}}), nil
+
+	case "replace":
+		if _, err := getValue(doc, tokens); err != nil {
+			return nil, nil, err
+		}
+		path, err := redisPath(doc, tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd, err := setCmd(path, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if doc, err = setValue(doc, tokens, value, false); err != nil {
+			return nil, nil, err
+		}
+		return doc, append(cmds, cmd), nil
+
+	case "add", "move", "copy":
+		cmd, err := addCmd(doc, tokens, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if doc, err = setValue(doc, tokens, value, true); err != nil {
+			return nil, nil, err
+		}
+		return doc, append(cmds, cmd), nil
+	}
+	return nil, nil, fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, op.Op)
+}
+
+// addCmd returns the command for an add.  Adding to an array inserts,
+// or appends for the "-" index, adding to an object sets the member.
+func addCmd(doc interface{}, tokens []string, value interface{}) (Command, error) {
+	if len(tokens) == 0 {
+		return setCmd("$", value)
+	}
+	parent, err := getValue(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return Command{}, err
+	}
+	parentPath, err := redisPath(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return Command{}, err
+	}
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case []interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return Command{}, err
+		}
+		if last == "-" {
+			return Command{Name: "JSON.ARRAPPEND", Args: []interface{}{parentPath, string(data)}}, nil
+		}
+		i, err := arrayIndex(last, len(p), true)
+		if err != nil {
+			return Command{}, err
+		}
+		return Command{Name: "JSON.ARRINSERT", Args: []interface{}{parentPath, i, string(data)}}, nil
+	case map[string]interface{}:
+		return setCmd(parentPath+memberPath(last), value)
+	}
+	return Command{}, fmt.Errorf("%w: %s is not an object or an array", ErrPatchFailed, parentPath)
+}
+
+// setCmd returns a JSON.SET of a value at a path
+func setCmd(path string, value interface{}) (Command, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{Name: "JSON.SET", Args: []interface{}{path, string(data)}}, nil
+}
+
+// splitPointer splits a JSON Pointer (RFC 6901) into its reference
+// tokens, the empty pointer is the whole document
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with /", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for i, token := range tokens {
+		tokens[i] = unescape.Replace(token)
+	}
+	return tokens, nil
+}
+
+// identifier matches the member names a RedisJSON path can use after a dot
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// memberPath returns the part of a RedisJSON path that selects a member
+// of an object, .name or ["name"] for names that need quoting
+func memberPath(name string) string {
+	if identifier.MatchString(name) {
+		return "." + name
+	}
+	quoted, _ := json.Marshal(name)
+	return "[" + string(quoted) + "]"
+}
+
+// redisPath turns the tokens of a pointer into a RedisJSON path like
+// $.voterHistory[0].pollId.  The document is needed to know which
+// tokens are array indexes and which are member names.
+func redisPath(doc interface{}, tokens []string) (string, error) {
+	path := "$"
+	current := doc
+	for _, token := range tokens {
+		switch c := current.(type) {
+		case map[string]interface{}:
+			path += memberPath(token)
+			current = c[token]
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return "", err
+			}
+			path += "[" + strconv.Itoa(i) + "]"
+			current = c[i]
+		default:
+			return "", fmt.Errorf("%w: %s does not exist", ErrPatchFailed, path+"/"+token)
+		}
+	}
+	return path, nil
+}
+
+// arrayIndex reads an array index token.  An insert can use the index
+// one past the end.
+func arrayIndex(token string, length int, insert bool) (int, error) {
+	max := length - 1
+	if insert {
+		max = length
+	}
+	if token == "-" && insert {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: array index %q is out of range", ErrPatchFailed, token)
+	}
+	return i, nil
+}
+
+// getValue returns the value a pointer points at
+func getValue(doc interface{}, tokens []string) (interface{}, error) {
+	current := doc
+	for _, token := range tokens {
+		switch c := current.(type) {
+		case map[string]interface{}:
+			value, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: member %q does not exist", ErrPatchFailed, token)
+			}
+			current = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			current = c[i]
+		default:
+			return nil, fmt.Errorf("%w: %q is not inside an object or an array", ErrPatchFailed, token)
+		}
+	}
+	return current, nil
+}
+
+// setValue returns a copy of the document with a value set at the
+// pointer.  With insert set, a value added to an array is inserted
+// before the index, otherwise it replaces the element.
+func setValue(doc interface{}, tokens []string, value interface{}, insert bool) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	last := len(tokens) == 1
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		out := copyObject(c)
+		if last {
+			out[tokens[0]] = value
+			return out, nil
+		}
+		child, ok := c[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("%w: member %q does not exist", ErrPatchFailed, tokens[0])
+		}
+		child, err := setValue(child, tokens[1:], value, insert)
+		out[tokens[0]] = child
+		return out, err
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(c), last && insert)
+		if err != nil {
+			return nil, err
+		}
+		out := append([]interface{}{}, c...)
+		switch {
+		case last && insert:
+			out = append(out[:i], append([]interface{}{value}, out[i:]...)...)
+		case last:
+			out[i] = value
+		default:
+			if out[i], err = setValue(c[i], tokens[1:], value, insert); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%w: %q is not inside an object or an array", ErrPatchFailed, tokens[0])
+}
+
+// removeValue returns a copy of the document without the value at the
+// pointer
+func removeValue(doc interface{}, tokens []string) (interface{}, error) {
+	last := len(tokens) == 1
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("%w: member %q does not exist", ErrPatchFailed, tokens[0])
+		}
+		out := copyObject(c)
+		if last {
+			delete(out, tokens[0])
+			return out, nil
+		}
+		child, err := removeValue(child, tokens[1:])
+		out[tokens[0]] = child
+		return out, err
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		out := append([]interface{}{}, c...)
+		if last {
+			return append(out[:i], out[i+1:]...), nil
+		}
+		out[i], err = removeValue(c[i], tokens[1:])
+		return out, err
+	}
+	return nil, fmt.Errorf("%w: %q is not inside an object or an array", ErrPatchFailed, tokens[0])
+}
+
+func copyObject(object map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(object))
+	for name, value := range object {
+		out[name] = value
+	}
+	return out
+}
+
+// sortedKeys keeps the commands of a merge patch in a stable order
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for name := range object {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Decode turns a patched document back into a struct.  Fields the
+// struct does not have and values of the wrong type are rejected, so a
+// patch cannot leave a document the API cannot read.
+func Decode(doc interface{}, v interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: the patched document is not valid: %v", ErrPatchFailed, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+
+	"drexel.edu/jsonpatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover how a patch is turned into RedisJSON commands,
+// without redis
+
+// todoItem is a document like the todo items the patches are used on
+type todoItem struct {
+	Id     int    `json:"id"`
+	Title  string `json:"title"`
+	IsDone bool   `json:"done"`
+}
+
+func decodeDoc(t *testing.T, data string) interface{} {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(data), &doc))
+	return doc
+}
+
+func encodeDoc(t *testing.T, doc interface{}) string {
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+const patchDoc = `{"id": 1, "title": "Learn Go", "done": false, "tags": ["go", "cli"], "meta": {"odd key": 1}}`
+
+func TestMergePatchPaths(t *testing.T) {
+	doc, cmds, err := jsonpatch.Apply(decodeDoc(t, patchDoc), jsonpatch.MergePatchType,
+		[]byte(`{"done": true, "meta": {"odd key": null, "owner": "sam"}, "tags": ["k8s"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []jsonpatch.Command{
+		{Name: "JSON.SET", Args: []interface{}{"$.done", "true"}},
+		{Name: "JSON.DEL", Args: []interface{}{`$.meta["odd key"]`}},
+		{Name: "JSON.SET", Args: []interface{}{"$.meta.owner", `"sam"`}},
+		{Name: "JSON.SET", Args: []interface{}{"$.tags", `["k8s"]`}},
+	}, cmds, "Only the touched paths should be written, arrays are replaced whole")
+	assert.JSONEq(t, `{"id": 1, "title": "Learn Go", "done": true, "tags": ["k8s"], "meta": {"owner": "sam"}}`, encodeDoc(t, doc))
+
+	_, cmds, err = jsonpatch.Apply(decodeDoc(t, patchDoc), jsonpatch.MergePatchType, []byte(`{"missing": null}`))
+	require.NoError(t, err)
+	assert.Empty(t, cmds, "Removing a field that is not there does nothing")
+
+	_, _, err = jsonpatch.Apply(decodeDoc(t, patchDoc), jsonpatch.MergePatchType, []byte(`{"done": `))
+	assert.ErrorIs(t, err, jsonpatch.ErrInvalidPatch)
+}
+
+func TestJSONPatchPaths(t *testing.T) {
+	doc, cmds, err := jsonpatch.Apply(decodeDoc(t, patchDoc), jsonpatch.JSONPatchType, []byte(`[
+		{"op": "test", "path": "/title", "value": "Learn Go"},
+		{"op": "replace", "path": "/done", "value": true},
+		{"op": "add", "path": "/tags/-", "value": "redis"},
+		{"op": "add", "path": "/tags/0", "value": "first"},
+		{"op": "remove", "path": "/tags/1"},
+		{"op": "add", "path": "/meta/a~1b", "value": 2},
+		{"op": "move", "from": "/meta/odd key", "path": "/meta/moved"}
+	]`))
+	require.NoError(t, err)
+	assert.Equal(t, []jsonpatch.Command{
+		{Name: "JSON.SET", Args: []interface{}{"$.done", "true"}},
+		{Name: "JSON.ARRAPPEND", Args: []interface{}{"$.tags", `"redis"`}},
+		{Name: "JSON.ARRINSERT", Args: []interface{}{"$.tags", 0, `"first"`}},
+		{Name: "JSON.DEL", Args: []interface{}{"$.tags[1]"}},
+		{Name: "JSON.SET", Args: []interface{}{`$.meta["a/b"]`, "2"}},
+		{Name: "JSON.DEL", Args: []interface{}{`$.meta["odd key"]`}},
+		{Name: "JSON.SET", Args: []interface{}{"$.meta.moved", "1"}},
+	}, cmds)
+	assert.JSONEq(t, `{"id": 1, "title": "Learn Go", "done": true, "tags": ["first", "cli", "redis"], "meta": {"a/b": 2, "moved": 1}}`, encodeDoc(t, doc))
+}
+
+func TestJSONPatchIsAllOrNothing(t *testing.T) {
+	for name, patch := range map[string]string{
+		"failed test":    `[{"op": "replace", "path": "/done", "value": true}, {"op": "test", "path": "/title", "value": "Other"}]`,
+		"missing member": `[{"op": "replace", "path": "/missing", "value": 1}]`,
+		"bad index":      `[{"op": "remove", "path": "/tags/01"}]`,
+		"past the end":   `[{"op": "add", "path": "/tags/3", "value": "x"}]`,
+		"whole document": `[{"op": "remove", "path": ""}]`,
+	} {
+		_, cmds, err := jsonpatch.Apply(decodeDoc(t, patchDoc), jsonpatch.JSONPatchType, []byte(patch))
+		assert.ErrorIs(t, err, jsonpatch.ErrPatchFailed, name)
+		assert.Nil(t, cmds, name)
+	}
+	for name, patch := range map[string]string{
+		"no slash":    `[{"op": "replace", "path": "done", "value": true}]`,
+		"no value":    `[{"op": "add", "path": "/done"}]`,
+		"unknown op":  `[{"op": "flip", "path": "/done"}]`,
+		"into itself": `[{"op": "move", "from": "/meta", "path": "/meta/inner"}]`,
+	} {
+		_, _, err := jsonpatch.Apply(decodeDoc(t, patchDoc), jsonpatch.JSONPatchType, []byte(patch))
+		assert.ErrorIs(t, err, jsonpatch.ErrInvalidPatch, name)
+	}
+	_, _, err := jsonpatch.Apply(decodeDoc(t, patchDoc), "application/json", []byte(`{}`))
+	assert.ErrorIs(t, err, jsonpatch.ErrInvalidPatch, "Only the two patch types are accepted")
+}
+
+func TestDecode(t *testing.T) {
+	var decoded todoItem
+	require.NoError(t, jsonpatch.Decode(decodeDoc(t, `{"id": 1, "title": "Learn Go", "done": true}`), &decoded))
+	assert.Equal(t, todoItem{Id: 1, Title: "Learn Go", IsDone: true}, decoded)
+
+	assert.ErrorIs(t, jsonpatch.Decode(decodeDoc(t, `{"id": 1, "title": "Learn Go", "extra": 1}`), &todoItem{}), jsonpatch.ErrPatchFailed,
+		"A patch cannot add fields the item does not have")
+	assert.ErrorIs(t, jsonpatch.Decode(decodeDoc(t, `{"id": 1, "done": "yes"}`), &todoItem{}), jsonpatch.ErrPatchFailed,
+		"A patch cannot change the type of a field")
+}
+
+func TestCommandForKey(t *testing.T) {
+	cmd := jsonpatch.Command{Name: "JSON.ARRINSERT", Args: []interface{}{"$.tags", 0, `"first"`}}
+	assert.Equal(t, []interface{}{"JSON.ARRINSERT", "todo:1", "$.tags", 0, `"first"`}, cmd.ForKey("todo:1"))
+}
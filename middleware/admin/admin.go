@@ -0,0 +1,203 @@
+// Package admin guards the operations that are not part of the normal
+// API, like deleting every item, turning eventing off or crashing the
+// process on purpose.  They are served by their own gin router on a
+// separate listener, so the public port does not expose them at all and
+// the admin port can be kept on localhost or a private network.
+//
+// Every admin route is wrapped by Admin.Allow or Admin.Chaos, which
+//
+//   - checks the caller may run the action, using the RBAC policy loaded
+//     from a YAML file, see policy.go
+//   - requires an X-Audit-Reason header saying why
+//   - logs the call, whether it was allowed or not, and how it ended
+//
+// Chaos actions, the ones that crash or kill the process, are turned off
+// unless the service was started with --enable-chaos, and return 404.
+//
+// Who the caller is comes from Options.Identify, which the services
+// answer from their auth middleware.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Identity is who is calling an admin route
+type Identity struct {
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes,omitempty"`
+}
+
+// Anonymous is the caller when there is no authentication
+var Anonymous = Identity{Subject: "anonymous"}
+
+// Default options
+const (
+	DefaultReasonHeader = "X-Audit-Reason"
+	MaxReasonLength     = 500
+)
+
+// Options configures Admin, the zero values are replaced by the
+// defaults.  Policy is who may do what, the DefaultPolicy with
+// authentication on when it is nil.
+// EnableChaos turns the chaos actions on.  Identify returns the caller
+// of a request, Anonymous when it is nil.  Every call is logged to
+// Logger as a json line.
+type Options struct {
+	Policy       *Policy
+	EnableChaos  bool
+	Identify     func(c *gin.Context) Identity
+	ReasonHeader string
+	Logger       *log.Logger
+}
+
+// Admin checks and logs the calls to the admin routes
+type Admin struct {
+	options Options
+}
+
+// New returns an Admin for the options
+func New(options Options) *Admin {
+	if options.Policy == nil {
+		options.Policy = DefaultPolicy(true)
+	}
+	if options.Identify == nil {
+		options.Identify = func(*gin.Context) Identity { return Anonymous }
+	}
+	if options.ReasonHeader == "" {
+		options.ReasonHeader = DefaultReasonHeader
+	}
+	if options.Logger == nil {
+		options.Logger = log.Default()
+	}
+	return &Admin{options: options}
+}
+
+// ChaosEnabled reports whether the chaos actions are on
+func (a *Admin) ChaosEnabled() bool {
+	return a.options.EnableChaos
+}
+
+// Decisions logged for a call
+const (
+	Allowed       = "allowed"
+	Denied        = "denied"
+	NoReason      = "no-reason"
+	ChaosDisabled = "chaos-disabled"
+	Completed     = "completed"
+)
+
+// Entry is one line of the admin log.  A call that is let through is
+// logged twice, when it is allowed and when it completes, so a call that
+// kills the process is still logged.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Decision string    `json:"decision"`
+	Subject  string    `json:"subject"`
+	Role     string    `json:"role,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	ClientIP string    `json:"clientIp"`
+	Status   int       `json:"status,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Panic    string    `json:"panic,omitempty"`
+}
+
+func (a *Admin) log(entry Entry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		a.options.Logger.Println("admin: error logging call: ", err)
+		return
+	}
+	a.options.Logger.Println("admin:", string(data))
+}
+
+// Allow returns a middleware that lets the route run only if the caller
+// may run the action and gave a reason
+func (a *Admin) Allow(action string) gin.HandlerFunc {
+	return a.guard(action, false)
+}
+
+// Chaos is Allow for an action that breaks the service on purpose.  It
+// returns 404 unless chaos is enabled.
+func (a *Admin) Chaos(action string) gin.HandlerFunc {
+	return a.guard(action, true)
+}
+
+func (a *Admin) guard(action string, chaos bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity := a.options.Identify(c)
+		entry := Entry{
+			Time:     time.Now().UTC(),
+			Action:   action,
+			Subject:  identity.Subject,
+			Reason:   strings.TrimSpace(c.GetHeader(a.options.ReasonHeader)),
+			Method:   c.Request.Method,
+			Path:     c.Request.URL.Path,
+			ClientIP: c.ClientIP(),
+		}
+
+		if chaos && !a.options.EnableChaos {
+			entry.Decision = ChaosDisabled
+			a.log(entry)
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "chaos endpoints are off, start the service with --enable-chaos"})
+			return
+		}
+		role, ok := a.options.Policy.Allows(identity, action)
+		if !ok {
+			entry.Decision = Denied
+			a.log(entry)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s may not run %s", identity.Subject, action)})
+			return
+		}
+		entry.Role = role
+		if entry.Reason == "" || len(entry.Reason) > MaxReasonLength {
+			entry.Decision = NoReason
+			entry.Reason = ""
+			a.log(entry)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("the %s header must say why, in at most %d characters", a.options.ReasonHeader, MaxReasonLength)})
+			return
+		}
+
+		entry.Decision = Allowed
+		a.log(entry)
+
+		//The completion is logged even when the handler panics, the
+		//panic is passed on to gin's recovery
+		defer func() {
+			done := entry
+			done.Time = time.Now().UTC()
+			done.Decision = Completed
+			done.Duration = time.Since(entry.Time).String()
+			done.Status = c.Writer.Status()
+			if p := recover(); p != nil {
+				done.Panic = fmt.Sprint(p)
+				done.Status = http.StatusInternalServerError
+				a.log(done)
+				panic(p)
+			}
+			a.log(done)
+		}()
+		c.Next()
+	}
+}
+
+// implementation for GET /admin/whoami
+// returns the caller and the actions the policy lets them run
+func (a *Admin) WhoAmI(c *gin.Context) {
+	identity := a.options.Identify(c)
+	c.JSON(http.StatusOK, gin.H{
+		"identity":     identity,
+		"roles":        a.options.Policy.RolesOf(identity),
+		"chaosEnabled": a.options.EnableChaos,
+	})
+}
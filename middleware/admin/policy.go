@@ -0,0 +1,155 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A policy says who may run which admin actions.  Roles name a set of
+// actions, and bindings give roles to subjects, the users or API key
+// names, or to everyone with a scope.  For example
+//
+//	roles:
+//	  operator: [todo:delete-all, events:toggle]
+//	  chaos-engineer: ["chaos:*"]
+//	bindings:
+//	  - role: operator
+//	    subjects: [alice]
+//	  - role: chaos-engineer
+//	    scopes: [admin]
+//
+// Actions can use the wildcards of path.Match, "*" is every action.  A
+// subject of "*" is every caller, including Anonymous when
+// authentication is off.  Nothing is allowed unless a binding allows it.
+
+// Actions of the admin routes
+const (
+	ActionDeleteAll    = "todo:delete-all"
+	ActionToggleEvents = "events:toggle"
+	ActionDeleteVoters = "voter:delete-all"
+	ActionCrash        = "chaos:crash"
+	ActionKill         = "chaos:kill"
+)
+
+// ErrInvalidPolicy is returned for a policy that does not make sense
+var ErrInvalidPolicy = errors.New("invalid admin policy")
+
+// Policy is the RBAC policy of the admin routes
+type Policy struct {
+	Roles    map[string][]string `yaml:"roles" json:"roles"`
+	Bindings []Binding           `yaml:"bindings" json:"bindings"`
+}
+
+// Binding gives a role to subjects and to anyone with one of the scopes
+type Binding struct {
+	Role     string   `yaml:"role" json:"role"`
+	Subjects []string `yaml:"subjects,omitempty" json:"subjects,omitempty"`
+	Scopes   []string `yaml:"scopes,omitempty" json:"scopes,omitempty"`
+}
+
+// DefaultPolicy is used when there is no policy file.  Admins may run
+// every action.  When authentication is off so may anyone, since the
+// admin listener is then only protected by where it listens.  The
+// anonymous caller is only bound then, with authentication on a token or
+// a key with anonymous as its subject is no one special.
+func DefaultPolicy(authEnabled bool) *Policy {
+	policy := &Policy{
+		Roles:    map[string][]string{"admin": {"*"}},
+		Bindings: []Binding{{Role: "admin", Scopes: []string{"admin"}}},
+	}
+	if !authEnabled {
+		policy.Bindings = append(policy.Bindings, Binding{Role: "admin", Subjects: []string{Anonymous.Subject}})
+	}
+	return policy
+}
+
+// LoadPolicy reads a policy from a YAML file
+func LoadPolicy(fileName string) (*Policy, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// ParsePolicy reads a policy from YAML and checks it
+func ParsePolicy(data []byte) (*Policy, error) {
+	var policy Policy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Validate checks the bindings name roles that exist and the actions are
+// valid patterns
+func (p *Policy) Validate() error {
+	for role, actions := range p.Roles {
+		for _, action := range actions {
+			if _, err := path.Match(action, ""); err != nil {
+				return fmt.Errorf("%w: role %s has a bad action %q", ErrInvalidPolicy, role, action)
+			}
+		}
+	}
+	for i, binding := range p.Bindings {
+		if _, ok := p.Roles[binding.Role]; !ok {
+			return fmt.Errorf("%w: binding %d has the unknown role %q", ErrInvalidPolicy, i, binding.Role)
+		}
+		if len(binding.Subjects) == 0 && len(binding.Scopes) == 0 {
+			return fmt.Errorf("%w: binding %d of %s has no subjects or scopes", ErrInvalidPolicy, i, binding.Role)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the binding is for the identity
+func (b Binding) matches(identity Identity) bool {
+	for _, subject := range b.Subjects {
+		if subject == "*" || subject == identity.Subject {
+			return true
+		}
+	}
+	for _, scope := range b.Scopes {
+		for _, has := range identity.Scopes {
+			if scope == has {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RolesOf returns the roles the policy gives the identity
+func (p *Policy) RolesOf(identity Identity) []string {
+	seen := map[string]bool{}
+	roles := []string{}
+	for _, binding := range p.Bindings {
+		if !seen[binding.Role] && binding.matches(identity) {
+			seen[binding.Role] = true
+			roles = append(roles, binding.Role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Allows returns the first role of the identity that allows the action,
+// and false if none does
+func (p *Policy) Allows(identity Identity, action string) (string, bool) {
+	for _, role := range p.RolesOf(identity) {
+		for _, pattern := range p.Roles[role] {
+			if ok, _ := path.Match(pattern, action); ok {
+				return role, true
+			}
+		}
+	}
+	return "", false
+}
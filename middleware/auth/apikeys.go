@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// An API key is a long random string a service or a script sends in the
+// X-API-Key header.  Only the SHA-256 hash of a key is stored, the key
+// itself is shown once when it is made, so someone who can read redis
+// cannot use the keys they find there.  A slow password hash is not
+// needed because the keys are random, not picked by people.
+//
+// In redis a key is the string apikey:<hash> holding the APIKey as json.
+// One can be added without the API, for example
+//
+//	key=ak_$(openssl rand -hex 24)
+//	redis-cli SET apikey:$(printf %s $key | sha256sum | cut -d' ' -f1) '{"name": "ops", "scopes": ["admin"]}'
+
+// APIKeyPrefix starts every key made by Issue, so they are easy to spot
+// in logs and by secret scanners
+const APIKeyPrefix = "ak_"
+
+// APIKey is what is stored for a key.  Id is the start of the hash, it
+// names the key without giving it away.
+type APIKey struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []Scope    `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// KeyStore keeps the API keys by their hash
+type KeyStore interface {
+	Add(hash string, key APIKey) error
+	Lookup(hash string) (APIKey, error)
+	List() ([]APIKey, error)
+	Delete(id string) error
+}
+
+// Compile time checks that each key store satisfies the interface
+var (
+	_ KeyStore = (*MemoryKeyStore)(nil)
+	_ KeyStore = (*RedisKeyStore)(nil)
+)
+
+// keyIdLength is how much of the hash is used as the id
+const keyIdLength = 16
+
+// HashKey returns the hex SHA-256 of an API key
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue makes a new random API key with the scopes and adds it to the
+// store.  It returns the key, which is not kept anywhere, and what was
+// stored.  A ttl of 0 is a key that does not expire.
+func Issue(store KeyStore, name string, scopes []Scope, ttl time.Duration) (string, APIKey, error) {
+	if strings.EqualFold(strings.TrimSpace(name), AnonymousSubject) {
+		return "", APIKey{}, fmt.Errorf("%w: %q", ErrReservedName, name)
+	}
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", APIKey{}, err
+	}
+	key := APIKeyPrefix + hex.EncodeToString(random)
+	hash := HashKey(key)
+
+	apiKey := APIKey{Id: idOf(hash), Name: name, Scopes: scopes, CreatedAt: time.Now().UTC()}
+	if ttl > 0 {
+		expires := apiKey.CreatedAt.Add(ttl)
+		apiKey.ExpiresAt = &expires
+	}
+	if err := store.Add(hash, apiKey); err != nil {
+		return "", APIKey{}, err
+	}
+	return key, apiKey, nil
+}
+
+//------------------------------------------------------------
+// IN MEMORY
+//------------------------------------------------------------
+
+// MemoryKeyStore keeps the keys in a map, for tests and for running
+// without redis
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+// NewMemoryKeyStore returns an empty in memory key store
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[string]APIKey)}
+}
+
+// Add stores a key under its hash
+func (m *MemoryKeyStore) Add(hash string, key APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[hash] = withId(hash, key)
+	return nil
+}
+
+// Lookup returns the key with the hash, or ErrKeyNotFound
+func (m *MemoryKeyStore) Lookup(hash string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, ok := m.keys[hash]
+	if !ok {
+		return APIKey{}, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// List returns the keys sorted by name
+func (m *MemoryKeyStore) List() ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]APIKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+	return keys, nil
+}
+
+// Delete removes the key with the id, or returns ErrKeyNotFound
+func (m *MemoryKeyStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, key := range m.keys {
+		if key.Id == id {
+			delete(m.keys, hash)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+}
+
+//------------------------------------------------------------
+// REDIS
+//------------------------------------------------------------
+
+// RedisKeyStore keeps each key as a json string under <prefix><hash>
+type RedisKeyStore struct {
+	client  *redis.Client
+	context context.Context
+	prefix  string
+}
+
+// NewRedisKeyStore connects to the redis at location.  The keys are kept
+// under prefix, apikey: when it is empty.
+func NewRedisKeyStore(location string, prefix string) (*RedisKeyStore, error) {
+	if prefix == "" {
+		prefix = DefaultKeyPrefix
+	}
+	client := redis.NewClient(&redis.Options{Addr: location})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisKeyStore{client: client, context: ctx, prefix: prefix}, nil
+}
+
+// Add stores a key under its hash, redis expires it with the key
+func (r *RedisKeyStore) Add(hash string, key APIKey) error {
+	data, err := json.Marshal(withId(hash, key))
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if key.ExpiresAt != nil {
+		ttl = time.Until(*key.ExpiresAt)
+	}
+	return r.client.Set(r.context, r.prefix+hash, data, ttl).Err()
+}
+
+// Lookup returns the key with the hash, or ErrKeyNotFound
+func (r *RedisKeyStore) Lookup(hash string) (APIKey, error) {
+	data, err := r.client.Get(r.context, r.prefix+hash).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, ErrKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	var key APIKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return APIKey{}, fmt.Errorf("corrupt api key %s: %w", idOf(hash), err)
+	}
+	//Keys added with redis-cli have no id
+	return withId(hash, key), nil
+}
+
+// scan calls fn with each hash stored under the prefix that starts with
+// the id, every hash when it is empty
+func (r *RedisKeyStore) scan(id string, fn func(hash string) error) error {
+	iter := r.client.Scan(r.context, 0, r.prefix+id+"*", 100).Iterator()
+	for iter.Next(r.context) {
+		if err := fn(iter.Val()[len(r.prefix):]); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// List returns the keys sorted by name
+func (r *RedisKeyStore) List() ([]APIKey, error) {
+	keys := []APIKey{}
+	err := r.scan("", func(hash string) error {
+		key, err := r.Lookup(hash)
+		if errors.Is(err, ErrKeyNotFound) {
+			//It expired while we were listing
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	sortKeys(keys)
+	return keys, err
+}
+
+// Delete removes the key with the id, or returns ErrKeyNotFound
+func (r *RedisKeyStore) Delete(id string) error {
+	//The id goes in a SCAN pattern, so it must not have * or ? in it
+	if _, err := hex.DecodeString(id); err != nil || len(id) != keyIdLength {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	deleted := int64(0)
+	err := r.scan(id, func(hash string) error {
+		n, err := r.client.Del(r.context, r.prefix+hash).Result()
+		deleted += n
+		return err
+	})
+	if err == nil && deleted == 0 {
+		err = fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	return err
+}
+
+// idOf returns the id of the key with the hash
+func idOf(hash string) string {
+	if len(hash) < keyIdLength {
+		return hash
+	}
+	return hash[:keyIdLength]
+}
+
+func withId(hash string, key APIKey) APIKey {
+	key.Id = idOf(hash)
+	return key
+}
+
+func sortKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].Id < keys[j].Id
+	})
+}
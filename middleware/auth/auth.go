@@ -0,0 +1,369 @@
+// Package auth is the authentication middleware shared by the gin
+// services.  A request proves who it is with either
+//
+//   - a JWT in an Authorization: Bearer header, signed with HS256 or
+//     RS256 by a key in a local JWKS file, or
+//   - an API key in an X-API-Key header, or Authorization: ApiKey, which
+//     is looked up by its SHA-256 hash in redis.
+//
+// Either way the request ends up with a Principal, who it is and the
+// scopes it has.  Each route declares the scope it needs with Require,
+// for example
+//
+//	r.GET("/todo", authn.Require(auth.TodoRead), apiHandler.ListAllTodos)
+//
+// A request without credentials gets a 401, one without the scope a 403.
+//
+// Scopes are <resource>:read, <resource>:write and admin.  Write includes
+// read, and admin includes everything.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scope is something a principal is allowed to do
+type Scope string
+
+// Admin is allowed everything
+const Admin Scope = "admin"
+
+// The scopes of the todo service
+var (
+	TodoRead  = ReadScope("todo")
+	TodoWrite = WriteScope("todo")
+)
+
+// ReadScope returns the scope to read a resource, like todo:read
+func ReadScope(resource string) Scope {
+	return Scope(resource + ":read")
+}
+
+// WriteScope returns the scope to change a resource, like todo:write
+func WriteScope(resource string) Scope {
+	return Scope(resource + ":write")
+}
+
+// Method says how a principal was authenticated
+type Method string
+
+const (
+	MethodJWT    Method = "jwt"
+	MethodAPIKey Method = "apikey"
+)
+
+// Principal is who made a request and what they may do
+type Principal struct {
+	Subject string  `json:"subject"`
+	Scopes  []Scope `json:"scopes"`
+	Method  Method  `json:"method"`
+}
+
+// Has reports whether the principal has a scope.  Admin has every scope
+// and <resource>:write includes <resource>:read.
+func (p Principal) Has(need Scope) bool {
+	for _, scope := range p.Scopes {
+		if scope == need || scope == Admin {
+			return true
+		}
+		if resource, ok := strings.CutSuffix(string(scope), ":write"); ok && need == ReadScope(resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// The errors of the package.  ErrUnauthenticated is a request whose
+// credentials are missing or not valid, ErrForbidden one that is missing
+// a scope.  ErrReservedName is an API key named after AnonymousSubject.
+// ErrNotConfigured is an Authenticator with nothing to check credentials
+// against that was not told to let every request through.
+var (
+	ErrNotConfigured   = errors.New("authentication is not configured, give a JWKS file or an api key redis, or turn it off with --insecure-no-auth")
+	ErrUnauthenticated = errors.New("not authenticated")
+	ErrForbidden       = errors.New("not allowed")
+	ErrKeyNotFound     = errors.New("api key does not exist")
+	ErrReservedName    = errors.New("api key name is reserved")
+)
+
+// AnonymousSubject is who the services say made a request when
+// authentication is off.  No API key may have it as its name, or the key
+// would be mistaken for the anonymous caller.
+const AnonymousSubject = "anonymous"
+
+// The headers the credentials are read from
+const (
+	AuthorizationHeader = "Authorization"
+	APIKeyHeader        = "X-API-Key"
+)
+
+// principalKey is the key of the Principal in the gin context, and
+// errorKey the key of the error authenticating the request
+const (
+	principalKey = "auth.principal"
+	errorKey     = "auth.error"
+)
+
+// Default options
+const (
+	DefaultResource  = "todo"
+	DefaultKeyPrefix = "apikey:"
+	DefaultLeeway    = time.Minute
+)
+
+// Options configures an Authenticator, the zero values are replaced by
+// the defaults.
+//
+// JWKSFile is the JSON Web Key Set the tokens are checked against, it is
+// read again when it changes.  RedisLocation is the redis the API keys
+// are kept in.  With neither set there is nothing to check credentials
+// against, and New fails unless Insecure is set.  With Insecure
+// authentication is off and every request is let through, admin routes
+// included, so it has to be asked for.
+//
+// Issuer and Audience, when set, must match the iss and aud claims.
+// Leeway allows for clocks that are a little apart when checking exp and
+// nbf.  RoleScopes maps the roles claim of a token to scopes, the
+// default maps admin, writer and reader to admin and the write and read
+// scopes of Resource.
+type Options struct {
+	JWKSFile      string
+	RedisLocation string
+	KeyPrefix     string
+	Issuer        string
+	Audience      string
+	Leeway        time.Duration
+	Resource      string
+	RoleScopes    map[string][]Scope
+	Insecure      bool
+}
+
+// OptionsFromEnv fills the empty options from the AUTH_JWKS_FILE,
+// AUTH_REDIS_URL, AUTH_ISSUER and AUTH_AUDIENCE environment variables.
+// AUTH_INSECURE_NO_AUTH=true sets Insecure.
+func OptionsFromEnv(options Options) Options {
+	if insecure, err := strconv.ParseBool(os.Getenv("AUTH_INSECURE_NO_AUTH")); err == nil && insecure {
+		options.Insecure = true
+	}
+	for env, value := range map[string]*string{
+		"AUTH_JWKS_FILE": &options.JWKSFile,
+		"AUTH_REDIS_URL": &options.RedisLocation,
+		"AUTH_ISSUER":    &options.Issuer,
+		"AUTH_AUDIENCE":  &options.Audience,
+	} {
+		if *value == "" {
+			*value = os.Getenv(env)
+		}
+	}
+	return options
+}
+
+// DefaultRoleScopes returns the roles a token can have for a resource
+func DefaultRoleScopes(resource string) map[string][]Scope {
+	return map[string][]Scope{
+		"admin":  {Admin},
+		"writer": {WriteScope(resource)},
+		"reader": {ReadScope(resource)},
+	}
+}
+
+// Authenticator checks the credentials of requests
+type Authenticator struct {
+	options Options
+	keys    *jwks
+	apiKeys KeyStore
+}
+
+// New returns an Authenticator for the options.  The JWKS file is loaded
+// and redis is connected to now, so a bad configuration fails at start
+// up rather than on the first request.
+func New(options Options) (*Authenticator, error) {
+	var apiKeys KeyStore
+	if options.RedisLocation != "" {
+		store, err := NewRedisKeyStore(options.RedisLocation, options.KeyPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to the api key store: %w", err)
+		}
+		apiKeys = store
+	}
+	return NewWithKeyStore(options, apiKeys)
+}
+
+// NewWithKeyStore returns an Authenticator that keeps its API keys in an
+// existing store, nil for no API keys.  This is handy for tests.
+func NewWithKeyStore(options Options, apiKeys KeyStore) (*Authenticator, error) {
+	if options.Leeway <= 0 {
+		options.Leeway = DefaultLeeway
+	}
+	if options.Resource == "" {
+		options.Resource = DefaultResource
+	}
+	if options.RoleScopes == nil {
+		options.RoleScopes = DefaultRoleScopes(options.Resource)
+	}
+
+	a := &Authenticator{options: options, apiKeys: apiKeys}
+	if options.JWKSFile != "" {
+		keys, err := loadJWKS(options.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	if !a.Enabled() {
+		if !options.Insecure {
+			return nil, ErrNotConfigured
+		}
+		log.Println("WARNING: authentication is off, every route is open, admin routes included")
+	}
+	return a, nil
+}
+
+// Enabled reports whether there is anything to check credentials
+// against.  When there is not, which New only allows with
+// Options.Insecure, Require lets every request through.
+func (a *Authenticator) Enabled() bool {
+	return a.keys != nil || a.apiKeys != nil
+}
+
+// KeyStore returns where the API keys are kept, nil if there are none
+func (a *Authenticator) KeyStore() KeyStore {
+	return a.apiKeys
+}
+
+// Authenticate returns the principal of a request
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return a.authenticateKey(key)
+	}
+	scheme, credentials, _ := strings.Cut(r.Header.Get(AuthorizationHeader), " ")
+	credentials = strings.TrimSpace(credentials)
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && credentials != "":
+		return a.authenticateToken(credentials)
+	case strings.EqualFold(scheme, "ApiKey") && credentials != "":
+		return a.authenticateKey(credentials)
+	}
+	return Principal{}, fmt.Errorf("%w: no bearer token or api key", ErrUnauthenticated)
+}
+
+func (a *Authenticator) authenticateToken(token string) (Principal, error) {
+	if a.keys == nil {
+		return Principal{}, fmt.Errorf("%w: tokens are not accepted", ErrUnauthenticated)
+	}
+	claims, err := a.keys.verify(token, a.options)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{Subject: claims.Subject, Scopes: claims.scopes(a.options.RoleScopes), Method: MethodJWT}, nil
+}
+
+func (a *Authenticator) authenticateKey(key string) (Principal, error) {
+	if a.apiKeys == nil {
+		return Principal{}, fmt.Errorf("%w: api keys are not accepted", ErrUnauthenticated)
+	}
+	apiKey, err := a.apiKeys.Lookup(HashKey(key))
+	if errors.Is(err, ErrKeyNotFound) {
+		return Principal{}, fmt.Errorf("%w: unknown api key", ErrUnauthenticated)
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+		return Principal{}, fmt.Errorf("%w: the api key has expired", ErrUnauthenticated)
+	}
+	return Principal{Subject: apiKey.Name, Scopes: apiKey.Scopes, Method: MethodAPIKey}, nil
+}
+
+// principalOf authenticates a request and keeps the answer in the gin
+// context, so the credentials of a request are only checked once however
+// many middlewares ask
+func (a *Authenticator) principalOf(c *gin.Context) (Principal, error) {
+	if principal, ok := PrincipalFrom(c); ok {
+		return principal, nil
+	}
+	if value, ok := c.Get(errorKey); ok {
+		return Principal{}, value.(error)
+	}
+	principal, err := a.Authenticate(c.Request)
+	if err != nil {
+		c.Set(errorKey, err)
+		return Principal{}, err
+	}
+	c.Set(principalKey, principal)
+	return principal, nil
+}
+
+// Identify returns a middleware that works out who made a request, for
+// the middlewares that run before the routes' Require, like the rate
+// limiter.  It never turns a request away, one without credentials or
+// with bad ones goes on without a principal, and Require answers it.
+func (a *Authenticator) Identify() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.Enabled() {
+			a.principalOf(c)
+		}
+		c.Next()
+	}
+}
+
+// Subject returns the subject of the principal in the gin context, false
+// when the request was not authenticated.  It is what the rate limiter
+// counts requests by, see ratelimit.Options.
+func Subject(c *gin.Context) (string, bool) {
+	principal, ok := PrincipalFrom(c)
+	return principal.Subject, ok
+}
+
+// Require returns a middleware that lets a request through only if it
+// has all of the scopes.  The principal is put in the gin context, see
+// PrincipalFrom, and is only worked out once when a route has more than
+// one Require or the router uses Identify.
+func (a *Authenticator) Require(scopes ...Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.Enabled() {
+			c.Next()
+			return
+		}
+		principal, err := a.principalOf(c)
+		if errors.Is(err, ErrUnauthenticated) {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println("Error authenticating request: ", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		for _, scope := range scopes {
+			if !principal.Has(scope) {
+				err := fmt.Errorf("%w: %s needs the %s scope", ErrForbidden, c.Request.URL.Path, scope)
+				c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// PrincipalFrom returns the principal Require put in the context, false
+// when the request was not authenticated
+func PrincipalFrom(c *gin.Context) (Principal, bool) {
+	value, ok := c.Get(principalKey)
+	if !ok {
+		return Principal{}, false
+	}
+	principal, ok := value.(Principal)
+	return principal, ok
+}
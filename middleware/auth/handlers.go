@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The handlers below are the /apikeys endpoints, to make, list and
+// delete API keys.  They are methods on the Authenticator so any API that
+// has one can add the routes behind Require(Admin), see main.go.
+
+// keyRequest is the body of POST /apikeys.  ExpiresIn is a duration like
+// 720h, a key without one does not expire.
+type keyRequest struct {
+	Name      string  `json:"name" binding:"required"`
+	Scopes    []Scope `json:"scopes" binding:"required"`
+	ExpiresIn string  `json:"expiresIn"`
+}
+
+// issuedKey is the answer to POST /apikeys.  It is the only time the key
+// is returned.
+type issuedKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// keyStoreFor returns the key store, it aborts the request with a 404
+// when the service has no API keys
+func (a *Authenticator) keyStoreFor(c *gin.Context) (KeyStore, bool) {
+	if a.apiKeys == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "api keys are not turned on"})
+		return nil, false
+	}
+	return a.apiKeys, true
+}
+
+// implementation for POST /apikeys
+// makes an API key, the body is {"name": ..., "scopes": [...], "expiresIn": "720h"}
+func (a *Authenticator) CreateAPIKey(c *gin.Context) {
+	store, ok := a.keyStoreFor(c)
+	if !ok {
+		return
+	}
+	var body keyRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var ttl time.Duration
+	if body.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(body.ExpiresIn); err != nil || ttl <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "expiresIn must be a duration like 720h"})
+			return
+		}
+	}
+
+	key, apiKey, err := Issue(store, body.Name, body.Scopes, ttl)
+	if errors.Is(err, ErrReservedName) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println("Error making api key: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Location", "/apikeys/"+apiKey.Id)
+	c.JSON(http.StatusCreated, issuedKey{APIKey: apiKey, Key: key})
+}
+
+// implementation for GET /apikeys
+// lists the API keys, without the keys themselves
+func (a *Authenticator) ListAPIKeys(c *gin.Context) {
+	store, ok := a.keyStoreFor(c)
+	if !ok {
+		return
+	}
+	keys, err := store.List()
+	if err != nil {
+		log.Println("Error listing api keys: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// implementation for DELETE /apikeys/:id
+// deletes an API key, requests using it fail from then on
+func (a *Authenticator) DeleteAPIKey(c *gin.Context) {
+	store, ok := a.keyStoreFor(c)
+	if !ok {
+		return
+	}
+	if err := store.Delete(c.Param("id")); err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		log.Println("Error deleting api key: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// implementation for GET /whoami
+// returns the principal of the request, handy to check a token or key
+func (a *Authenticator) WhoAmI(c *gin.Context) {
+	principal, ok := PrincipalFrom(c)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"authenticated": false})
+		return
+	}
+	c.JSON(http.StatusOK, principal)
+}
@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A JWT is three base64url parts, header.payload.signature.  Only the
+// HS256 and RS256 algorithms are accepted, and the key must be of the
+// kind the algorithm uses, so a token cannot pick "none" or pass an RSA
+// public key off as an HMAC secret.
+
+// The algorithms the tokens can be signed with
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+)
+
+// JWK is one key of a JSON Web Key Set, RFC 7517.  An HS256 key has kty
+// oct and the secret in k, an RS256 key has kty RSA and the public key
+// in n and e.  All of them are base64url.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	K   string `json:"k,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// verifyKey is a JWK decoded and ready to check signatures with
+type verifyKey struct {
+	kid    string
+	alg    string
+	secret []byte
+	public *rsa.PublicKey
+}
+
+func (k verifyKey) verify(alg string, signed, signature []byte) bool {
+	switch alg {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case RS256:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k.public, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// parseJWK decodes a key, the keys that are not for signing with HS256
+// or RS256 are skipped
+func parseJWK(jwk JWK) (verifyKey, bool, error) {
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return verifyKey{}, false, nil
+	}
+	key := verifyKey{kid: jwk.Kid}
+	switch jwk.Kty {
+	case "oct":
+		if jwk.Alg != "" && jwk.Alg != HS256 {
+			return verifyKey{}, false, nil
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.K, "="))
+		if err != nil || len(secret) < 32 {
+			return verifyKey{}, false, fmt.Errorf("key %q: an HS256 secret must be at least 32 base64url bytes", jwk.Kid)
+		}
+		key.alg, key.secret = HS256, secret
+	case "RSA":
+		if jwk.Alg != "" && jwk.Alg != RS256 {
+			return verifyKey{}, false, nil
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.N, "="))
+		e, errE := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.E, "="))
+		if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return verifyKey{}, false, fmt.Errorf("key %q: n and e must be base64url", jwk.Kid)
+		}
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if public.N.BitLen() < 2048 {
+			return verifyKey{}, false, fmt.Errorf("key %q: an RS256 key must be at least 2048 bits", jwk.Kid)
+		}
+		key.alg, key.public = RS256, public
+	default:
+		return verifyKey{}, false, nil
+	}
+	return key, true, nil
+}
+
+// jwks is the key set in a file.  The file is read again when its
+// modification time changes, so keys can be rotated without a restart.
+type jwks struct {
+	fileName string
+
+	mu      sync.Mutex
+	modTime time.Time
+	keys    []verifyKey
+}
+
+func loadJWKS(fileName string) (*jwks, error) {
+	set := &jwks{fileName: fileName}
+	if _, err := set.current(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// current returns the keys, reading the file again if it has changed.
+// If it cannot be read, or is half written, the keys it had are kept.
+func (s *jwks) current() ([]verifyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(s.fileName)
+	if err == nil && s.keys != nil && info.ModTime().Equal(s.modTime) {
+		return s.keys, nil
+	}
+	if err == nil {
+		var keys []verifyKey
+		if keys, err = readJWKS(s.fileName); err == nil {
+			s.keys, s.modTime = keys, info.ModTime()
+			return keys, nil
+		}
+	}
+	if s.keys != nil {
+		log.Println("Error reloading the JWKS, keeping the keys it had: ", err)
+		return s.keys, nil
+	}
+	return nil, err
+}
+
+func readJWKS(fileName string) ([]verifyKey, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var set JWKS
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("reading the JWKS %s: %w", fileName, err)
+	}
+	keys := make([]verifyKey, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, ok, err := parseJWK(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("reading the JWKS %s: %w", fileName, err)
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the JWKS %s has no HS256 or RS256 keys", fileName)
+	}
+	return keys, nil
+}
+
+// audience is the aud claim, which can be a string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// scopeList is the scp claim, a list or a space separated string
+type scopeList []string
+
+func (s *scopeList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = strings.Fields(one)
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*s = many
+	return nil
+}
+
+// Claims are the claims of a token that are used.  Times are seconds
+// since the epoch.
+type Claims struct {
+	Subject   string    `json:"sub"`
+	Issuer    string    `json:"iss,omitempty"`
+	Audience  audience  `json:"aud,omitempty"`
+	ExpiresAt int64     `json:"exp"`
+	NotBefore int64     `json:"nbf,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
+	Scp       scopeList `json:"scp,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+}
+
+// scopes returns the scopes of the scope and scp claims and of the roles
+func (c Claims) scopes(roleScopes map[string][]Scope) []Scope {
+	var scopes []Scope
+	for _, scope := range append(strings.Fields(c.Scope), c.Scp...) {
+		scopes = append(scopes, Scope(scope))
+	}
+	for _, role := range c.Roles {
+		scopes = append(scopes, roleScopes[role]...)
+	}
+	return scopes
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// verify checks the signature and the claims of a token
+func (s *jwks) verify(token string, options Options) (Claims, error) {
+	invalid := func(format string, args ...any) (Claims, error) {
+		return Claims{}, fmt.Errorf("%w: %s", ErrUnauthenticated, fmt.Sprintf(format, args...))
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return invalid("a token has three parts")
+	}
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return invalid("bad token header")
+	}
+	if header.Alg != HS256 && header.Alg != RS256 {
+		return invalid("the %q algorithm is not accepted", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return invalid("bad token signature")
+	}
+
+	keys, err := s.current()
+	if err != nil {
+		return Claims{}, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if key.alg != header.Alg || (header.Kid != "" && key.kid != "" && key.kid != header.Kid) {
+			continue
+		}
+		if key.verify(header.Alg, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return invalid("the token signature does not match a key")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return invalid("bad token claims")
+	}
+	now := time.Now()
+	switch {
+	case claims.ExpiresAt == 0:
+		return invalid("the token has no exp claim")
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(options.Leeway)):
+		return invalid("the token has expired")
+	case claims.NotBefore != 0 && now.Add(options.Leeway).Before(time.Unix(claims.NotBefore, 0)):
+		return invalid("the token is not valid yet")
+	case options.Issuer != "" && claims.Issuer != options.Issuer:
+		return invalid("the token was not issued by %s", options.Issuer)
+	case options.Audience != "" && !claims.Audience.has(options.Audience):
+		return invalid("the token is not for %s", options.Audience)
+	}
+	return claims, nil
+}
+
+func (a audience) has(want string) bool {
+	for _, aud := range a {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ErrNoKey is returned by Sign when there is no key to sign with
+var ErrNoKey = errors.New("no key to sign with")
+
+// Sign makes an HS256 token with the claims, signed with an oct key from
+// a JWKS.  It is for development and tests, a real issuer would sign the
+// tokens with RS256 and publish only the public key.
+func Sign(claims Claims, jwk JWK) (string, error) {
+	key, ok, err := parseJWK(jwk)
+	if err != nil {
+		return "", err
+	}
+	if !ok || key.alg != HS256 {
+		return "", fmt.Errorf("%w: Sign needs an HS256 oct key", ErrNoKey)
+	}
+	header, err := json.Marshal(tokenHeader{Alg: HS256, Kid: jwk.Kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
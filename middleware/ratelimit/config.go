@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config has the limits of the routes.  Routes are keyed by a method and
+// the gin route, like "GET /todo/:id", or by the route alone for every
+// method.  A route that is not listed has the Default limit, counted on
+// its own.  Requests gin has no route for share one count.  In YAML
+//
+//	default: 600/m
+//	routes:
+//	  GET /todo: 60/m
+//	  GET /v2/todo:
+//	    limit: 120/m
+//	    algorithm: sliding-window
+//	  POST /todo:
+//	    limit: 10/s
+//	    burst: 50
+//	  GET /health: none
+//
+// A limit is a number of requests per s, m, h or a duration like 10s,
+// and none turns limiting off.  The algorithm is token-bucket unless
+// it is given.
+type Config struct {
+	Default Rule            `yaml:"default"`
+	Routes  map[string]Rule `yaml:"routes"`
+}
+
+// ParseLimit reads a limit like 60/m or 5/10s as a token bucket rule,
+// none is a rule that does not limit
+func ParseLimit(s string) (Rule, error) {
+	s = strings.TrimSpace(s)
+	if s == "none" {
+		return Rule{}, nil
+	}
+	requests, per, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(requests)
+	if !ok || err != nil || n <= 0 {
+		return Rule{}, fmt.Errorf("%w: %q is not <requests>/<period>", ErrInvalidConfig, s)
+	}
+	rule := Rule{Requests: n, Algorithm: TokenBucket}
+	switch per {
+	case "s":
+		rule.Per = time.Second
+	case "m":
+		rule.Per = time.Minute
+	case "h":
+		rule.Per = time.Hour
+	default:
+		if rule.Per, err = time.ParseDuration(per); err != nil || rule.Per <= 0 {
+			return Rule{}, fmt.Errorf("%w: %q is not a period", ErrInvalidConfig, per)
+		}
+	}
+	return rule, nil
+}
+
+// MustParseLimit is ParseLimit for the limits written in code
+func MustParseLimit(s string) Rule {
+	rule, err := ParseLimit(s)
+	if err != nil {
+		panic(err)
+	}
+	return rule
+}
+
+// UnmarshalYAML reads a rule from a limit like 60/m, or from a mapping
+// with the limit, the algorithm and the burst
+func (r *Rule) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		rule, err := ParseLimit(value.Value)
+		if err != nil {
+			return err
+		}
+		*r = rule
+		return nil
+	}
+	var fields struct {
+		Limit     string    `yaml:"limit"`
+		Algorithm Algorithm `yaml:"algorithm"`
+		Burst     int       `yaml:"burst"`
+	}
+	if err := value.Decode(&fields); err != nil {
+		return err
+	}
+	rule, err := ParseLimit(fields.Limit)
+	if err != nil {
+		return err
+	}
+	if fields.Algorithm != "" {
+		rule.Algorithm = fields.Algorithm
+	}
+	rule.Burst = fields.Burst
+	*r = rule
+	return rule.Validate()
+}
+
+// LoadConfig reads the limits from a YAML file
+func LoadConfig(fileName string) (Config, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return Config{}, err
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return config, config.Validate()
+}
+
+// Validate checks every rule of the config
+func (c Config) Validate() error {
+	if err := c.Default.Validate(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for route, rule := range c.Routes {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", route, err)
+		}
+	}
+	return nil
+}
+
+// RuleFor returns the rule of a request and the name it is counted
+// under.  fullPath is the gin route, which is empty when gin has no
+// route, those are looked up by their path and otherwise counted
+// together.
+func (c Config) RuleFor(method, fullPath, path string) (string, Rule) {
+	route := fullPath
+	if route == "" {
+		route = path
+	}
+	for _, name := range []string{method + " " + route, route} {
+		if rule, ok := c.Routes[name]; ok {
+			return name, rule
+		}
+	}
+	if fullPath == "" {
+		return "*", c.Default
+	}
+	return method + " " + fullPath, c.Default
+}
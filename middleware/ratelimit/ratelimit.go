@@ -0,0 +1,308 @@
+// Package ratelimit is a gin middleware that stops a noisy client from
+// hammering an API.  Every request is counted against a limit for its
+// route and its client, and once the client is over the limit it gets a
+// 429 with a Retry-After header until it is under again.
+//
+// The client is who made the request when Options.Identify knows, and
+// its address otherwise.  The limits are configured per route,
+// see Config, with one of two algorithms:
+//
+//   - TokenBucket lets a client burst up to Burst requests, and refills
+//     the bucket at Requests per Per
+//   - SlidingWindow allows Requests in any window of Per, estimated from
+//     the counts of the current and the previous fixed windows
+//
+// The counts are kept in redis when Options.RedisLocation is set, so the
+// limits hold across the replicas of a service, and in memory otherwise.
+// Every limited response has the RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy headers of the IETF draft.
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Algorithm is how a limit is counted
+type Algorithm string
+
+const (
+	TokenBucket   Algorithm = "token-bucket"
+	SlidingWindow Algorithm = "sliding-window"
+)
+
+// Headers set on the responses
+const (
+	LimitHeader      = "RateLimit-Limit"
+	RemainingHeader  = "RateLimit-Remaining"
+	ResetHeader      = "RateLimit-Reset"
+	PolicyHeader     = "RateLimit-Policy"
+	RetryAfterHeader = "Retry-After"
+)
+
+// DefaultKeyPrefix starts the redis keys of the counts
+const DefaultKeyPrefix = "ratelimit:"
+
+// ErrInvalidConfig is returned for a limit or config that does not make
+// sense
+var ErrInvalidConfig = errors.New("invalid rate limit")
+
+// Rule is the limit of a route.  A rule with no Requests does not limit
+// anything.  Burst is the size of a token bucket, Requests when it is 0.
+// The Algorithm is TokenBucket unless it is given.
+type Rule struct {
+	Requests  int
+	Per       time.Duration
+	Burst     int
+	Algorithm Algorithm
+}
+
+// Unlimited reports whether the rule lets every request through
+func (r Rule) Unlimited() bool {
+	return r.Requests <= 0
+}
+
+// capacity is the most requests a client can make at once
+func (r Rule) capacity() int {
+	if r.Algorithm != SlidingWindow && r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Requests
+}
+
+// Validate checks the rule can be counted
+func (r Rule) Validate() error {
+	if r.Unlimited() {
+		return nil
+	}
+	if r.Per <= 0 {
+		return fmt.Errorf("%w: %d requests per %v", ErrInvalidConfig, r.Requests, r.Per)
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("%w: negative burst %d", ErrInvalidConfig, r.Burst)
+	}
+	switch r.Algorithm {
+	case "", TokenBucket, SlidingWindow:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown algorithm %q", ErrInvalidConfig, r.Algorithm)
+}
+
+// Policy is the RateLimit-Policy header of the rule, like 60;w=60
+func (r Rule) Policy() string {
+	policy := fmt.Sprintf("%d;w=%d", r.Requests, int64(math.Ceil(r.Per.Seconds())))
+	if r.Algorithm != SlidingWindow && r.Burst > 0 {
+		policy += fmt.Sprintf(";burst=%d", r.Burst)
+	}
+	return policy
+}
+
+// Result is what counting a request came to
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Store keeps the counts.  Take counts a request of the client key
+// against the rule.
+type Store interface {
+	Take(ctx context.Context, key string, rule Rule) (Result, error)
+}
+
+// Options configures a Limiter.  Config has the limits.  The counts are
+// kept in the redis at RedisLocation, under keys that start with
+// KeyPrefix, or in memory when there is no redis.
+//
+// Identify returns who made a request, and the request is counted for
+// them, wherever they send it from.  It must only answer for checked
+// credentials, or a client could make up new ones for every request and
+// never be limited, auth.Subject after auth.Identify does that.  When it
+// is nil, or does not know, the request is counted for its address.
+type Options struct {
+	Config        Config
+	RedisLocation string
+	KeyPrefix     string
+	Identify      func(c *gin.Context) (string, bool)
+}
+
+// OptionsFromEnv fills the empty options from the RATELIMIT_REDIS_URL
+// and RATELIMIT_FILE environment variables.  The file is read with
+// LoadConfig and replaces Config.
+func OptionsFromEnv(options Options) (Options, error) {
+	if options.RedisLocation == "" {
+		options.RedisLocation = os.Getenv("RATELIMIT_REDIS_URL")
+	}
+	if file := os.Getenv("RATELIMIT_FILE"); file != "" {
+		config, err := LoadConfig(file)
+		if err != nil {
+			return options, err
+		}
+		options.Config = config
+	}
+	return options, nil
+}
+
+// Limiter counts the requests and turns away the ones over the limit
+type Limiter struct {
+	options Options
+	store   Store
+}
+
+// New returns a Limiter for the options.  It connects to redis if there
+// is one, without one the limits only hold per replica, which is logged.
+func New(options Options) (*Limiter, error) {
+	if options.RedisLocation == "" {
+		log.Println("WARNING: rate limits are kept in memory, each replica counts on its own")
+		return NewWithStore(options, NewMemoryStore())
+	}
+	store, err := NewRedisStore(options.RedisLocation, options.KeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the rate limit store: %w", err)
+	}
+	return NewWithStore(options, store)
+}
+
+// NewWithStore returns a Limiter that keeps its counts in store
+func NewWithStore(options Options, store Store) (*Limiter, error) {
+	if err := options.Config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Limiter{options: options, store: store}, nil
+}
+
+// clientOf returns who a request is counted for, the hash of who made it
+// or its address
+func (l *Limiter) clientOf(c *gin.Context) string {
+	if l.options.Identify != nil {
+		if subject, ok := l.options.Identify(c); ok {
+			sum := sha256.Sum256([]byte(subject))
+			return "sub:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// Middleware returns the middleware that limits every route of a router,
+// add it with Use before the routes, after whatever Options.Identify
+// needs to have run
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, rule := l.options.Config.RuleFor(c.Request.Method, c.FullPath(), c.Request.URL.Path)
+		if rule.Unlimited() {
+			c.Next()
+			return
+		}
+
+		key := route + " " + l.clientOf(c)
+		result, err := l.store.Take(c.Request.Context(), key, rule)
+		if err != nil {
+			//Failing open, an outage of the store should not take the
+			//API down with it
+			log.Println("Error counting request, letting it through: ", err)
+			c.Next()
+			return
+		}
+
+		c.Header(LimitHeader, strconv.Itoa(result.Limit))
+		c.Header(RemainingHeader, strconv.Itoa(result.Remaining))
+		c.Header(ResetHeader, strconv.FormatInt(seconds(result.Reset), 10))
+		c.Header(PolicyHeader, rule.Policy())
+		if !result.Allowed {
+			retryAfter := seconds(result.RetryAfter)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			c.Header(RetryAfterHeader, strconv.FormatInt(retryAfter, 10))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":      fmt.Sprintf("too many requests to %s, %s", route, rule.Policy()),
+				"retryAfter": retryAfter,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// seconds rounds a duration up to whole seconds
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
+
+//------------------------------------------------------------
+// The algorithms, shared by the stores.  The stores keep the state and
+// these turn it into a Result.
+
+// refillRate is the tokens a bucket gets back per nanosecond
+func refillRate(rule Rule) float64 {
+	return float64(rule.Requests) / float64(rule.Per)
+}
+
+// tokenBucketResult is the result of a take that left tokens in the
+// bucket
+func tokenBucketResult(rule Rule, tokens float64, allowed bool) Result {
+	rate := refillRate(rule)
+	result := Result{
+		Allowed:   allowed,
+		Limit:     rule.capacity(),
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(rule.capacity()) - tokens) / rate),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / rate)
+	}
+	return result
+}
+
+// slidingWindowResult is the result of a take with prev requests in the
+// previous window, cur in this one, elapsed into it
+func slidingWindowResult(rule Rule, prev, cur int, elapsed time.Duration, allowed bool) Result {
+	window := float64(rule.Per)
+	e := float64(elapsed)
+	limit := float64(rule.Requests)
+	estimate := float64(prev)*(window-e)/window + float64(cur)
+
+	result := Result{
+		Allowed:   allowed,
+		Limit:     rule.Requests,
+		Remaining: int(math.Max(0, math.Floor(limit-estimate))),
+		Reset:     rule.Per - elapsed,
+	}
+	if allowed {
+		return result
+	}
+
+	//The wait until the estimate has room for one more request, in this
+	//window while the previous one fades out if it can, else in the next
+	//one while this one does
+	room := limit - 1
+	if prev > 0 && float64(cur) <= room {
+		wait := window*(1-(room-float64(cur))/float64(prev)) - e
+		if wait < window-e {
+			result.RetryAfter = time.Duration(math.Max(wait, 0))
+			return result
+		}
+	}
+	if cur > 0 {
+		result.RetryAfter = time.Duration(window - e + window*math.Max(0, 1-room/float64(cur)))
+	} else {
+		result.RetryAfter = time.Duration(window - e)
+	}
+	return result
+}
@@ -0,0 +1,228 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+//------------------------------------------------------------
+// MemoryStore keeps the counts of one replica
+
+// sweepEvery is how many takes the memory store makes between looking
+// for clients that have been quiet long enough to forget
+const sweepEvery = 1024
+
+// bucket is the state of a client, the tokens of a token bucket or the
+// counts of a sliding window
+type bucket struct {
+	tokens  float64
+	updated time.Time
+
+	window    int64
+	prev, cur int
+
+	expires time.Time
+}
+
+// MemoryStore is a Store that keeps the counts in memory.  Now is the
+// clock, tests can set it.
+type MemoryStore struct {
+	Now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// Take counts a request against the rule
+func (m *MemoryStore) Take(_ context.Context, key string, rule Rule) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.Now()
+
+	m.takes++
+	if m.takes%sweepEvery == 0 {
+		for k, b := range m.buckets {
+			if now.After(b.expires) {
+				delete(m.buckets, k)
+			}
+		}
+	}
+
+	b, ok := m.buckets[key]
+	if !ok || now.After(b.expires) {
+		b = &bucket{tokens: float64(rule.capacity()), updated: now}
+		m.buckets[key] = b
+	}
+	//Kept for two periods, long enough for a bucket to fill up and for
+	//a window to stop counting as the previous one
+	b.expires = now.Add(2 * rule.Per)
+
+	if rule.Algorithm == SlidingWindow {
+		index := now.UnixNano() / int64(rule.Per)
+		elapsed := time.Duration(now.UnixNano() - index*int64(rule.Per))
+		switch b.window {
+		case index:
+		case index - 1:
+			b.prev, b.cur = b.cur, 0
+		default:
+			b.prev, b.cur = 0, 0
+		}
+		b.window = index
+		allowed := float64(b.prev)*float64(rule.Per-elapsed)/float64(rule.Per)+float64(b.cur)+1 <= float64(rule.Requests)
+		if allowed {
+			b.cur++
+		}
+		return slidingWindowResult(rule, b.prev, b.cur, elapsed, allowed), nil
+	}
+
+	if now.After(b.updated) {
+		b.tokens = math.Min(float64(rule.capacity()), b.tokens+float64(now.Sub(b.updated))*refillRate(rule))
+		b.updated = now
+	}
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return tokenBucketResult(rule, b.tokens, allowed), nil
+}
+
+//------------------------------------------------------------
+// RedisStore keeps the counts in redis, shared by every replica.  Each
+// take is one script, so two replicas cannot both take the last token,
+// and the scripts use the clock of redis, so the clocks of the replicas
+// do not have to agree.
+
+// tokenBucketScript refills the bucket for the time since it was last
+// used and takes a token if there is one.  ARGV is the capacity, the
+// tokens per millisecond and how long to keep the bucket.
+var tokenBucketScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+  tokens = capacity
+  updated = now
+end
+if now > updated then
+  tokens = math.min(capacity, tokens + (now - updated) * rate)
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {allowed, tostring(tokens)}
+`)
+
+// slidingWindowScript counts the request in the current window if the
+// estimate over the sliding window has room for it.  ARGV is the limit
+// and the window in milliseconds.
+var slidingWindowScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local index = math.floor(now / window)
+local elapsed = now - index * window
+local state = redis.call('HMGET', KEYS[1], 'window', 'prev', 'cur')
+local stored = tonumber(state[1])
+local prev, cur = 0, 0
+if stored == index then
+  prev = tonumber(state[2]) or 0
+  cur = tonumber(state[3]) or 0
+elseif stored == index - 1 then
+  prev = tonumber(state[3]) or 0
+end
+local allowed = 0
+if prev * (window - elapsed) / window + cur + 1 <= limit then
+  cur = cur + 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'window', tostring(index), 'prev', prev, 'cur', cur)
+redis.call('PEXPIRE', KEYS[1], window * 2)
+return {allowed, prev, cur, elapsed}
+`)
+
+// RedisStore is a Store that keeps the counts in redis
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+var _ Store = (*RedisStore)(nil)
+
+// NewRedisStore connects to the redis at location, the keys start with
+// prefix, DefaultKeyPrefix when it is empty
+func NewRedisStore(location string, prefix string) (*RedisStore, error) {
+	if prefix == "" {
+		prefix = DefaultKeyPrefix
+	}
+	client := redis.NewClient(&redis.Options{Addr: location})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisStore{client: client, prefix: prefix}, nil
+}
+
+// Take counts a request against the rule
+func (r *RedisStore) Take(ctx context.Context, key string, rule Rule) (Result, error) {
+	keys := []string{r.prefix + key}
+	if rule.Algorithm == SlidingWindow {
+		windowMs := rule.Per.Milliseconds()
+		if windowMs < 1 {
+			windowMs = 1
+		}
+		values, err := slidingWindowScript.Run(ctx, r.client, keys, rule.Requests, windowMs).Int64Slice()
+		if err != nil {
+			return Result{}, err
+		}
+		if len(values) != 4 {
+			return Result{}, fmt.Errorf("unexpected reply from the sliding window script: %v", values)
+		}
+		return slidingWindowResult(rule, int(values[1]), int(values[2]), time.Duration(values[3])*time.Millisecond, values[0] == 1), nil
+	}
+
+	perMs := refillRate(rule) * float64(time.Millisecond)
+	ttl := time.Duration(float64(rule.capacity())/refillRate(rule)) + time.Second
+	values, err := tokenBucketScript.Run(ctx, r.client, keys, rule.capacity(),
+		strconv.FormatFloat(perMs, 'g', -1, 64), ttl.Milliseconds()).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(values) != 2 {
+		return Result{}, fmt.Errorf("unexpected reply from the token bucket script: %v", values)
+	}
+	allowed, _ := values[0].(int64)
+	tokenS, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(tokenS, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("unexpected tokens from the token bucket script: %v", values[1])
+	}
+	return tokenBucketResult(rule, tokens, allowed == 1), nil
+}
+
+// Close closes the connection to redis
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
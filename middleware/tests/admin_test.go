@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"drexel.edu/middleware/admin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the admin package, which guards the routes of the
+// admin listener.
+
+const testPolicy = `
+roles:
+  operator: [todo:delete-all, events:toggle]
+  chaos-engineer: ["chaos:*"]
+bindings:
+  - role: operator
+    subjects: [alice]
+  - role: chaos-engineer
+    scopes: [admin]
+`
+
+// adminRouter has a route and a chaos route, the caller is the X-Test-User
+// header and an admin when X-Test-Admin is set
+func adminRouter(t *testing.T, policy *admin.Policy, chaos bool) (*gin.Engine, *bytes.Buffer) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	var logs bytes.Buffer
+	adm := admin.New(admin.Options{
+		Policy:      policy,
+		EnableChaos: chaos,
+		Logger:      log.New(&logs, "", 0),
+		Identify: func(c *gin.Context) admin.Identity {
+			identity := admin.Identity{Subject: c.GetHeader("X-Test-User")}
+			if c.GetHeader("X-Test-Admin") != "" {
+				identity.Scopes = []string{"admin"}
+			}
+			return identity
+		},
+	})
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.DELETE("/admin/todo", adm.Allow(admin.ActionDeleteAll), func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/admin/crash", adm.Chaos(admin.ActionCrash), func(c *gin.Context) { panic("crash") })
+	return r, &logs
+}
+
+func adminCall(r http.Handler, method, path string, headers map[string]string) int {
+	req := httptest.NewRequest(method, path, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+// logEntries reads the json lines the admin package logged
+func logEntries(t *testing.T, logs *bytes.Buffer) []admin.Entry {
+	t.Helper()
+	var entries []admin.Entry
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry admin.Entry
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "admin: ")), &entry), line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAdminPolicy(t *testing.T) {
+	policy, err := admin.ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	role, ok := policy.Allows(admin.Identity{Subject: "alice"}, admin.ActionDeleteAll)
+	assert.True(t, ok)
+	assert.Equal(t, "operator", role)
+	_, ok = policy.Allows(admin.Identity{Subject: "alice"}, admin.ActionCrash)
+	assert.False(t, ok)
+	_, ok = policy.Allows(admin.Identity{Subject: "bob", Scopes: []string{"admin"}}, admin.ActionKill)
+	assert.True(t, ok, "Wildcards match actions")
+	_, ok = policy.Allows(admin.Anonymous, admin.ActionDeleteAll)
+	assert.False(t, ok, "Nothing is allowed unless a binding allows it")
+	assert.Equal(t, []string{"chaos-engineer", "operator"}, policy.RolesOf(admin.Identity{Subject: "alice", Scopes: []string{"admin"}}))
+
+	_, ok = admin.DefaultPolicy(false).Allows(admin.Anonymous, admin.ActionCrash)
+	assert.True(t, ok, "Without a policy file anyone may when authentication is off")
+	_, ok = admin.DefaultPolicy(true).Allows(admin.Anonymous, admin.ActionCrash)
+	assert.False(t, ok, "A caller named anonymous is no one special when authentication is on")
+	_, ok = admin.DefaultPolicy(true).Allows(admin.Identity{Subject: "ops", Scopes: []string{"admin"}}, admin.ActionCrash)
+	assert.True(t, ok)
+
+	for name, bad := range map[string]string{
+		"unknown role": "roles: {a: [x]}\nbindings: [{role: b, subjects: [alice]}]",
+		"no subjects":  "roles: {a: [x]}\nbindings: [{role: a}]",
+		"bad pattern":  "roles: {a: [\"[\"]}",
+		"not yaml":     "roles: [",
+	} {
+		_, err := admin.ParsePolicy([]byte(bad))
+		assert.ErrorIs(t, err, admin.ErrInvalidPolicy, name)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	policy, err := admin.ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+	r, logs := adminRouter(t, policy, false)
+
+	reason := map[string]string{admin.DefaultReasonHeader: "clearing the demo data"}
+	alice := map[string]string{"X-Test-User": "alice"}
+	aliceWithReason := map[string]string{"X-Test-User": "alice", admin.DefaultReasonHeader: "clearing the demo data"}
+
+	assert.Equal(t, http.StatusForbidden, adminCall(r, http.MethodDelete, "/admin/todo", reason))
+	assert.Equal(t, http.StatusBadRequest, adminCall(r, http.MethodDelete, "/admin/todo", alice))
+	assert.Equal(t, http.StatusOK, adminCall(r, http.MethodDelete, "/admin/todo", aliceWithReason))
+	assert.Equal(t, http.StatusNotFound, adminCall(r, http.MethodGet, "/admin/crash", map[string]string{"X-Test-Admin": "yes"}),
+		"Chaos routes are off unless chaos is enabled")
+
+	//Every call is logged, the allowed one when it starts and ends
+	entries := logEntries(t, logs)
+	require.Len(t, entries, 5)
+	decisions := []string{}
+	for _, entry := range entries {
+		decisions = append(decisions, entry.Decision)
+	}
+	assert.Equal(t, []string{admin.Denied, admin.NoReason, admin.Allowed, admin.Completed, admin.ChaosDisabled}, decisions)
+	assert.Equal(t, "alice", entries[3].Subject)
+	assert.Equal(t, "operator", entries[3].Role)
+	assert.Equal(t, "clearing the demo data", entries[3].Reason)
+	assert.Equal(t, http.StatusOK, entries[3].Status)
+}
+
+func TestAdminChaos(t *testing.T) {
+	r, logs := adminRouter(t, admin.DefaultPolicy(true), true)
+	headers := map[string]string{"X-Test-Admin": "yes", admin.DefaultReasonHeader: "game day"}
+	assert.Equal(t, http.StatusInternalServerError, adminCall(r, http.MethodGet, "/admin/crash", headers))
+
+	//The panic is logged before it is passed on to the recovery
+	entries := logEntries(t, logs)
+	require.Len(t, entries, 2)
+	assert.Equal(t, admin.Completed, entries[1].Decision)
+	assert.Equal(t, "crash", entries[1].Panic)
+	assert.Equal(t, admin.ActionCrash, entries[1].Action)
+}
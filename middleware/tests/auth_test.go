@@ -0,0 +1,261 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"drexel.edu/middleware/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the auth middleware shared by the gin services.
+
+var hsKey = auth.JWK{Kty: "oct", Kid: "hs", Alg: auth.HS256,
+	K: base64.RawURLEncoding.EncodeToString([]byte("a secret that is at least 32 bytes long"))}
+
+// writeJWKS writes a key set to a file in a temp directory
+func writeJWKS(t *testing.T, fileName string, keys ...auth.JWK) {
+	t.Helper()
+	data, err := json.Marshal(auth.JWKS{Keys: keys})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fileName, data, 0644))
+}
+
+// signRS256 makes an RS256 token, auth.Sign only makes HS256 ones
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims auth.Claims) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": auth.RS256, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) auth.JWK {
+	return auth.JWK{Kty: "RSA", Kid: kid, Alg: auth.RS256,
+		N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())}
+}
+
+// router has a route per scope, like the services do
+func router(authn *auth.Authenticator) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/todo", authn.Require(auth.TodoRead), authn.WhoAmI)
+	r.POST("/todo", authn.Require(auth.TodoWrite), authn.WhoAmI)
+	r.DELETE("/todo", authn.Require(auth.Admin), authn.WhoAmI)
+	return r
+}
+
+func send(r http.Handler, method string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/todo", nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{auth.AuthorizationHeader: "Bearer " + token}
+}
+
+func TestScopes(t *testing.T) {
+	writer := auth.Principal{Scopes: []auth.Scope{auth.TodoWrite}}
+	assert.True(t, writer.Has(auth.TodoRead), "Write includes read")
+	assert.False(t, writer.Has(auth.Admin))
+	assert.False(t, writer.Has(auth.ReadScope("voter")))
+	admin := auth.Principal{Scopes: []auth.Scope{auth.Admin}}
+	assert.True(t, admin.Has(auth.WriteScope("voter")), "Admin has every scope")
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksFile, hsKey, rsaJWK("rs", &rsaKey.PublicKey))
+	authn, err := auth.NewWithKeyStore(auth.Options{JWKSFile: jwksFile, Issuer: "https://idp.example", Audience: "todo-api"}, nil)
+	require.NoError(t, err)
+	r := router(authn)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := auth.Claims{Subject: "alice", Issuer: "https://idp.example", Audience: []string{"todo-api"}, ExpiresAt: exp}
+
+	//Roles and scopes in the claims become scopes
+	reader := valid
+	reader.Roles = []string{"reader"}
+	token, err := auth.Sign(reader, hsKey)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, send(r, http.MethodGet, bearer(token)).Code)
+	denied := send(r, http.MethodPost, bearer(token))
+	assert.Equal(t, http.StatusForbidden, denied.Code)
+	assert.Contains(t, denied.Header().Get("WWW-Authenticate"), "insufficient_scope")
+
+	writer := valid
+	writer.Scope = "todo:write profile"
+	token = signRS256(t, rsaKey, "rs", writer)
+	w := send(r, http.MethodPost, bearer(token))
+	require.Equal(t, http.StatusOK, w.Code)
+	var principal auth.Principal
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &principal))
+	assert.Equal(t, "alice", principal.Subject)
+	assert.Equal(t, auth.MethodJWT, principal.Method)
+	assert.Equal(t, http.StatusForbidden, send(r, http.MethodDelete, bearer(token)).Code)
+
+	admin := valid
+	admin.Scp = []string{"admin"}
+	token, _ = auth.Sign(admin, hsKey)
+	assert.Equal(t, http.StatusOK, send(r, http.MethodDelete, bearer(token)).Code)
+
+	//Tokens that must be turned away
+	expired := reader
+	expired.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+	wrongAudience := reader
+	wrongAudience.Audience = []string{"voter-api"}
+	noExpiry := reader
+	noExpiry.ExpiresAt = 0
+	otherKey := hsKey
+	otherKey.K = base64.RawURLEncoding.EncodeToString([]byte("some other secret of 32 bytes or more"))
+	forged, _ := auth.Sign(reader, otherKey)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice","roles":["admin"]}`)) + "."
+
+	rejected := map[string]string{"forged": forged, "none": none, "garbage": "not.a.token"}
+	for name, claims := range map[string]auth.Claims{"expired": expired, "audience": wrongAudience, "no exp": noExpiry} {
+		rejected[name], _ = auth.Sign(claims, hsKey)
+	}
+	for name, token := range rejected {
+		w := send(r, http.MethodGet, bearer(token))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, name)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token", name)
+	}
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, nil).Code)
+
+	//An RS256 token cannot be checked with the HMAC key, even if it
+	//names it
+	token = signRS256(t, rsaKey, "hs", writer)
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, bearer(token)).Code)
+}
+
+func TestJWKSIsReloaded(t *testing.T) {
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksFile, hsKey)
+	authn, err := auth.NewWithKeyStore(auth.Options{JWKSFile: jwksFile}, nil)
+	require.NoError(t, err)
+	r := router(authn)
+
+	rotated := auth.JWK{Kty: "oct", Kid: "hs2", K: base64.RawURLEncoding.EncodeToString([]byte("the next secret, also 32 bytes or more"))}
+	token, _ := auth.Sign(auth.Claims{Subject: "alice", ExpiresAt: time.Now().Add(time.Hour).Unix(), Roles: []string{"reader"}}, rotated)
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, bearer(token)).Code)
+
+	writeJWKS(t, jwksFile, hsKey, rotated)
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(jwksFile, later, later))
+	assert.Equal(t, http.StatusOK, send(r, http.MethodGet, bearer(token)).Code)
+
+	//A broken file keeps the keys that were loaded
+	require.NoError(t, os.WriteFile(jwksFile, []byte("{"), 0644))
+	later = later.Add(time.Second)
+	require.NoError(t, os.Chtimes(jwksFile, later, later))
+	assert.Equal(t, http.StatusOK, send(r, http.MethodGet, bearer(token)).Code)
+}
+
+func TestAPIKeys(t *testing.T) {
+	store := auth.NewMemoryKeyStore()
+	authn, err := auth.NewWithKeyStore(auth.Options{}, store)
+	require.NoError(t, err)
+	r := router(authn)
+
+	key, apiKey, err := auth.Issue(store, "deploy-bot", []auth.Scope{auth.TodoWrite}, 0)
+	require.NoError(t, err)
+	assert.Contains(t, key, auth.APIKeyPrefix)
+	stored, err := store.Lookup(auth.HashKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, apiKey, stored, "Only the hash of the key is stored")
+
+	assert.Equal(t, http.StatusOK, send(r, http.MethodPost, map[string]string{auth.APIKeyHeader: key}).Code)
+	assert.Equal(t, http.StatusOK, send(r, http.MethodGet, map[string]string{auth.AuthorizationHeader: "ApiKey " + key}).Code)
+	assert.Equal(t, http.StatusForbidden, send(r, http.MethodDelete, map[string]string{auth.APIKeyHeader: key}).Code)
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, map[string]string{auth.APIKeyHeader: key + "x"}).Code)
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, bearer("a.b.c")).Code, "Tokens are not accepted without a JWKS")
+
+	require.NoError(t, store.Delete(apiKey.Id))
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, map[string]string{auth.APIKeyHeader: key}).Code)
+	assert.ErrorIs(t, store.Delete(apiKey.Id), auth.ErrKeyNotFound)
+
+	expired := time.Now().Add(-time.Minute)
+	key, _, _ = auth.Issue(store, "old", []auth.Scope{auth.Admin}, time.Hour)
+	stored, _ = store.Lookup(auth.HashKey(key))
+	stored.ExpiresAt = &expired
+	require.NoError(t, store.Add(auth.HashKey(key), stored))
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, map[string]string{auth.APIKeyHeader: key}).Code)
+
+	_, _, err = auth.Issue(store, "Anonymous", []auth.Scope{auth.Admin}, 0)
+	assert.ErrorIs(t, err, auth.ErrReservedName, "A key cannot pass for the anonymous caller")
+}
+
+// countingKeyStore counts the lookups of the keys
+type countingKeyStore struct {
+	*auth.MemoryKeyStore
+	lookups int
+}
+
+func (s *countingKeyStore) Lookup(hash string) (auth.APIKey, error) {
+	s.lookups++
+	return s.MemoryKeyStore.Lookup(hash)
+}
+
+func TestIdentify(t *testing.T) {
+	store := &countingKeyStore{MemoryKeyStore: auth.NewMemoryKeyStore()}
+	authn, err := auth.NewWithKeyStore(auth.Options{}, store)
+	require.NoError(t, err)
+	key, _, _ := auth.Issue(store, "deploy-bot", []auth.Scope{auth.TodoRead}, 0)
+
+	r := gin.New()
+	r.Use(authn.Identify())
+	r.GET("/todo", authn.Require(auth.TodoRead), authn.WhoAmI)
+	r.GET("/health", func(c *gin.Context) {
+		subject, _ := auth.Subject(c)
+		c.String(http.StatusOK, subject)
+	})
+
+	assert.Equal(t, http.StatusOK, send(r, http.MethodGet, map[string]string{auth.APIKeyHeader: key}).Code)
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, map[string]string{auth.APIKeyHeader: "ak_made_up"}).Code)
+	assert.Equal(t, 2, store.lookups, "A key is looked up once a request")
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set(auth.APIKeyHeader, key)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "deploy-bot", w.Body.String(), "Routes without Require still know who called")
+	req.Header.Set(auth.APIKeyHeader, "ak_made_up")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "Identify turns no one away")
+}
+
+func TestAuthenticationOff(t *testing.T) {
+	_, err := auth.NewWithKeyStore(auth.Options{}, nil)
+	assert.ErrorIs(t, err, auth.ErrNotConfigured, "Nothing to check credentials against is not a way to turn authentication off")
+
+	authn, err := auth.NewWithKeyStore(auth.Options{Insecure: true}, nil)
+	require.NoError(t, err)
+	assert.False(t, authn.Enabled())
+	assert.Equal(t, http.StatusOK, send(router(authn), http.MethodDelete, nil).Code)
+}
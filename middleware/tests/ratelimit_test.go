@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the rate limit middleware, with the memory store and
+// a clock the tests move.
+
+// clock is a MemoryStore with a clock that only moves when told to
+func clock() (*ratelimit.MemoryStore, func(time.Duration)) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := ratelimit.NewMemoryStore()
+	store.Now = func() time.Time { return now }
+	return store, func(d time.Duration) { now = now.Add(d) }
+}
+
+// limitedRouter limits the routes, the requests are counted per subject
+// when authn is given
+func limitedRouter(t *testing.T, config ratelimit.Config, store ratelimit.Store, authn *auth.Authenticator) *gin.Engine {
+	t.Helper()
+	options := ratelimit.Options{Config: config}
+	if authn != nil {
+		options.Identify = auth.Subject
+	}
+	limiter, err := ratelimit.NewWithStore(options, store)
+	require.NoError(t, err)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if authn != nil {
+		r.Use(authn.Identify())
+	}
+	r.Use(limiter.Middleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/todo", ok)
+	r.GET("/todo/:id", ok)
+	r.GET("/health", ok)
+	return r
+}
+
+func get(r http.Handler, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestParseLimit(t *testing.T) {
+	rule, err := ratelimit.ParseLimit("60/m")
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.Rule{Requests: 60, Per: time.Minute, Algorithm: ratelimit.TokenBucket}, rule)
+	rule, _ = ratelimit.ParseLimit("5/10s")
+	assert.Equal(t, 10*time.Second, rule.Per)
+	rule, _ = ratelimit.ParseLimit("none")
+	assert.True(t, rule.Unlimited())
+	for _, bad := range []string{"60", "x/m", "0/m", "10/fortnight", "10/-1s"} {
+		_, err := ratelimit.ParseLimit(bad)
+		assert.ErrorIs(t, err, ratelimit.ErrInvalidConfig, bad)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "limits.yaml")
+	require.NoError(t, os.WriteFile(fileName, []byte(`
+default: 600/m
+routes:
+  GET /todo: 60/m
+  GET /v2/todo:
+    limit: 120/m
+    algorithm: sliding-window
+  POST /todo:
+    limit: 10/s
+    burst: 50
+  /health: none
+`), 0644))
+	config, err := ratelimit.LoadConfig(fileName)
+	require.NoError(t, err)
+
+	route, rule := config.RuleFor(http.MethodGet, "/todo", "/todo")
+	assert.Equal(t, "GET /todo", route)
+	assert.Equal(t, 60, rule.Requests)
+	_, rule = config.RuleFor(http.MethodGet, "/v2/todo", "/v2/todo")
+	assert.Equal(t, ratelimit.SlidingWindow, rule.Algorithm)
+	_, rule = config.RuleFor(http.MethodPost, "/todo", "/todo")
+	assert.Equal(t, "10;w=1;burst=50", rule.Policy())
+	_, rule = config.RuleFor(http.MethodHead, "/health", "/health")
+	assert.True(t, rule.Unlimited(), "A route without a method is every method")
+	route, rule = config.RuleFor(http.MethodGet, "/todo/:id", "/todo/3")
+	assert.Equal(t, "GET /todo/:id", route)
+	assert.Equal(t, 600, rule.Requests)
+	route, _ = config.RuleFor(http.MethodPost, "", "/todo:bulk")
+	assert.Equal(t, "*", route, "Requests without a route share a count")
+
+	require.NoError(t, os.WriteFile(fileName, []byte("routes:\n  GET /todo: {limit: 1/s, algorithm: leaky}\n"), 0644))
+	_, err = ratelimit.LoadConfig(fileName)
+	assert.ErrorIs(t, err, ratelimit.ErrInvalidConfig)
+}
+
+func TestTokenBucket(t *testing.T) {
+	store, advance := clock()
+	config := ratelimit.Config{
+		Default: ratelimit.MustParseLimit("100/m"),
+		Routes: map[string]ratelimit.Rule{
+			"GET /todo": {Requests: 2, Per: time.Second, Burst: 3},
+			"/health":   {},
+		},
+	}
+	r := limitedRouter(t, config, store, nil)
+
+	for i := 2; i >= 0; i-- {
+		w := get(r, "/todo", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "3", w.Header().Get(ratelimit.LimitHeader))
+		assert.Equal(t, strconv.Itoa(i), w.Header().Get(ratelimit.RemainingHeader))
+		assert.Equal(t, "2;w=1;burst=3", w.Header().Get(ratelimit.PolicyHeader))
+	}
+	w := get(r, "/todo", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get(ratelimit.RetryAfterHeader))
+	assert.Equal(t, "2", w.Header().Get(ratelimit.ResetHeader), "The bucket is full again in 1.5s")
+
+	//Each route and each client is counted on its own, and unlimited
+	//routes have no headers
+	assert.Equal(t, http.StatusOK, get(r, "/todo/1", nil).Code)
+	other := httptest.NewRequest(http.MethodGet, "/todo", nil)
+	other.RemoteAddr = "10.0.0.2:5000"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, other)
+	assert.Equal(t, http.StatusOK, w.Code)
+	health := get(r, "/health", nil)
+	assert.Equal(t, http.StatusOK, health.Code)
+	assert.Empty(t, health.Header().Get(ratelimit.LimitHeader))
+
+	//Tokens come back at 2 a second
+	advance(500 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, get(r, "/todo", nil).Code)
+	assert.Equal(t, http.StatusTooManyRequests, get(r, "/todo", nil).Code)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	store, advance := clock()
+	rule := ratelimit.Rule{Requests: 4, Per: time.Minute, Algorithm: ratelimit.SlidingWindow}
+	r := limitedRouter(t, ratelimit.Config{Default: rule}, store, nil)
+
+	for i := 0; i < 4; i++ {
+		require.Equal(t, http.StatusOK, get(r, "/todo", nil).Code)
+	}
+	w := get(r, "/todo", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get(ratelimit.RemainingHeader))
+	assert.Equal(t, "75", w.Header().Get(ratelimit.RetryAfterHeader), "A request fits once a quarter of this window has slid out")
+
+	//Half way through the next window half of the last one still counts
+	advance(90 * time.Second)
+	assert.Equal(t, http.StatusOK, get(r, "/todo", nil).Code)
+	assert.Equal(t, http.StatusOK, get(r, "/todo", nil).Code)
+	w = get(r, "/todo", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "15", w.Header().Get(ratelimit.RetryAfterHeader))
+}
+
+func TestLimitBySubject(t *testing.T) {
+	store, _ := clock()
+	keys := auth.NewMemoryKeyStore()
+	authn, err := auth.NewWithKeyStore(auth.Options{}, keys)
+	require.NoError(t, err)
+	one, _, _ := auth.Issue(keys, "one", []auth.Scope{auth.TodoRead}, 0)
+	two, _, _ := auth.Issue(keys, "two", []auth.Scope{auth.TodoRead}, 0)
+	config := ratelimit.Config{Default: ratelimit.Rule{Requests: 1, Per: time.Minute}}
+	r := limitedRouter(t, config, store, authn)
+
+	assert.Equal(t, http.StatusOK, get(r, "/todo", map[string]string{auth.APIKeyHeader: one}).Code)
+	assert.Equal(t, http.StatusTooManyRequests, get(r, "/todo", map[string]string{auth.AuthorizationHeader: "ApiKey " + one}).Code)
+	assert.Equal(t, http.StatusOK, get(r, "/todo", map[string]string{auth.APIKeyHeader: two}).Code,
+		"Keys from the same address are counted on their own")
+
+	//Made up keys do not check out, so they are counted for the address
+	assert.Equal(t, http.StatusOK, get(r, "/todo", map[string]string{auth.APIKeyHeader: "ak_made_up_1"}).Code)
+	assert.Equal(t, http.StatusTooManyRequests, get(r, "/todo", map[string]string{auth.APIKeyHeader: "ak_made_up_2"}).Code)
+	assert.Equal(t, http.StatusTooManyRequests, get(r, "/todo", nil).Code)
+}
+
+// failingStore stands in for redis being down
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, ratelimit.Rule) (ratelimit.Result, error) {
+	return ratelimit.Result{}, context.DeadlineExceeded
+}
+
+func TestLimiterFailsOpen(t *testing.T) {
+	r := limitedRouter(t, ratelimit.Config{Default: ratelimit.MustParseLimit("1/h")}, failingStore{}, nil)
+	assert.Equal(t, http.StatusOK, get(r, "/todo", nil).Code)
+	assert.Equal(t, http.StatusOK, get(r, "/todo", nil).Code)
+}
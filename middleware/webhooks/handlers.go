@@ -0,0 +1,137 @@
+package webhooks
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The handlers below are the /webhooks endpoints.  They are methods on
+// the Manager so any API that has one can add the routes, see main.go.
+
+// registration is the body of POST /webhooks
+type registration struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// registered is the answer to POST /webhooks.  It is the only time the
+// secret is returned.
+type registered struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// webhookIdFromRequest reads the :id parameter, it aborts the request
+// with a 400 if it is not a number
+func webhookIdFromRequest(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println("Error converting webhook id to int: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// implementation for POST /webhooks
+// registers a webhook, the body is {"url": ..., "events": [...], "secret": ...}
+// events and secret can be left out, a secret is made if there is none
+func (m *Manager) RegisterWebhook(c *gin.Context) {
+	var body registration
+	if err := c.ShouldBindJSON(&body); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	webhook, err := m.Register(body.URL, body.Events, body.Secret)
+	if err != nil {
+		log.Println("Error registering webhook: ", err)
+		if errors.Is(err, ErrInvalidWebhook) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "eventTypes": m.EventTypes()})
+			return
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, registered{Webhook: webhook, Secret: webhook.Secret})
+}
+
+// implementation for GET /webhooks
+// returns all webhooks, without their secrets
+func (m *Manager) ListWebhooks(c *gin.Context) {
+	c.JSON(http.StatusOK, m.List())
+}
+
+// implementation for GET /webhooks/:id
+func (m *Manager) GetWebhook(c *gin.Context) {
+	id, ok := webhookIdFromRequest(c)
+	if !ok {
+		return
+	}
+	webhook, err := m.Get(id)
+	if err != nil {
+		log.Println("Webhook not found: ", err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+// implementation for DELETE /webhooks/:id
+func (m *Manager) DeleteWebhook(c *gin.Context) {
+	id, ok := webhookIdFromRequest(c)
+	if !ok {
+		return
+	}
+	if err := m.Unregister(id); err != nil {
+		log.Println("Webhook not found: ", err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// implementation for GET /webhooks/:id/deliveries
+// returns the delivery attempts of a webhook, oldest first
+func (m *Manager) ListDeliveries(c *gin.Context) {
+	id, ok := webhookIdFromRequest(c)
+	if !ok {
+		return
+	}
+	history, err := m.History(id)
+	if err != nil {
+		log.Println("Webhook not found: ", err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+// implementation for GET /webhooks/dead-letters
+// returns the deliveries that failed every attempt
+func (m *Manager) ListDeadLetters(c *gin.Context) {
+	c.JSON(http.StatusOK, m.DeadLetters())
+}
+
+// implementation for POST /webhooks/dead-letters/:deliveryId/retry
+// sends a dead letter again
+func (m *Manager) RetryDelivery(c *gin.Context) {
+	err := m.RetryDeadLetter(c.Param("deliveryId"))
+	switch {
+	case err == nil:
+		c.Status(http.StatusAccepted)
+	case errors.Is(err, ErrDeadLetterNotFound), errors.Is(err, ErrWebhookNotFound):
+		log.Println("Error retrying delivery: ", err)
+		c.AbortWithStatus(http.StatusNotFound)
+	default:
+		log.Println("Error retrying delivery: ", err)
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+	}
+}
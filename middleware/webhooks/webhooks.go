@@ -0,0 +1,707 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A webhook is a URL that is sent an HTTP POST every time one of the
+// events it asked for happens, so other teams do not have to poll the
+// API to find out that something changed.
+//
+// Each delivery is signed with the secret of the webhook.  The receiver
+// computes the same HMAC over the timestamp and the body and compares it
+// with the X-Webhook-Signature header, see Sign and Verify.
+//
+// A delivery that fails, because the receiver is down, times out or
+// answers with a 5xx, 408 or 429, is tried again with exponential
+// backoff.  Other 4xx answers will not get better by retrying.  When a
+// delivery runs out of attempts it is put on the dead-letter list, from
+// where it can be sent again by hand.  Every attempt is kept in the
+// history of its webhook.
+//
+// The deliveries wait in a queue for one of a fixed number of workers,
+// so a burst of events does not start a goroutine and a connection per
+// delivery.  A delivery that does not fit in the queue goes straight to
+// the dead-letter list.
+//
+// The webhooks, the history and the dead letters are kept in memory, so
+// they are lost when the API restarts.
+//
+// A webhook can not point at this machine or a private network unless
+// the manager allows it, or anyone who can register one could make the
+// API call its own admin listener or other internal services.  URLs with
+// such an address are refused when they are registered, and since a name
+// can resolve to anything, the addresses are checked again when the
+// deliveries connect.
+
+// The headers sent with every delivery
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// The defaults for Options
+const (
+	DefaultMaxAttempts = 5
+	DefaultBaseBackoff = time.Second
+	DefaultMaxBackoff  = time.Minute
+	DefaultTimeout     = 10 * time.Second
+	DefaultHistorySize = 100
+	DefaultDeadLetters = 1000
+	DefaultWorkers     = 16
+	DefaultQueueSize   = 1000
+)
+
+var (
+	// ErrInvalidWebhook is returned for a webhook with a bad URL or an
+	// event type that does not exist
+	ErrInvalidWebhook = errors.New("invalid webhook")
+	// ErrWebhookNotFound is returned for a webhook id that is not registered
+	ErrWebhookNotFound = errors.New("webhook does not exist")
+	// ErrDeadLetterNotFound is returned for a delivery that is not on the
+	// dead-letter list
+	ErrDeadLetterNotFound = errors.New("dead letter does not exist")
+	// ErrClosed is returned when the manager has been closed
+	ErrClosed = errors.New("webhook manager is closed")
+	// ErrQueueFull is returned when a dead letter can not be sent again
+	// because every worker is busy and the queue is full
+	ErrQueueFull = errors.New("webhook delivery queue is full")
+)
+
+// Event is what is sent to a webhook.  Type is one of the event types
+// the manager was made with, Data is anything that marshals to JSON.
+type Event struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      any       `json:"data"`
+}
+
+// Webhook is a registered target.  Events lists the event types it is
+// sent, all of them when it is empty.  The secret is never returned
+// after the webhook is registered.
+type Webhook struct {
+	Id        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Attempt is one try at delivering an event to a webhook
+type Attempt struct {
+	DeliveryId string        `json:"deliveryId"`
+	WebhookId  int           `json:"webhookId"`
+	EventId    string        `json:"eventId"`
+	EventType  string        `json:"eventType"`
+	Attempt    int           `json:"attempt"`
+	Time       time.Time     `json:"time"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"-"`
+	DurationMs int64         `json:"durationMs"`
+	Delivered  bool          `json:"delivered"`
+}
+
+// DeadLetter is a delivery that failed every attempt
+type DeadLetter struct {
+	DeliveryId string    `json:"deliveryId"`
+	WebhookId  int       `json:"webhookId"`
+	Event      Event     `json:"event"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"lastError"`
+	FailedAt   time.Time `json:"failedAt"`
+}
+
+// Options configure a Manager.  Zero values use the defaults.
+type Options struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Timeout is how long one attempt can take
+	Timeout time.Duration
+	// HistorySize is how many attempts are kept per webhook
+	HistorySize int
+	// DeadLetters is how many dead letters are kept, the oldest go first
+	DeadLetters int
+	// Client sends the deliveries, tests can replace it.  The default
+	// client refuses to connect to private addresses.
+	Client *http.Client
+	// AllowPrivateTargets lets webhooks point at loopback, link-local
+	// and private addresses
+	AllowPrivateTargets bool
+	// Workers is how many deliveries are sent at the same time
+	Workers int
+	// QueueSize is how many deliveries can wait for a worker
+	QueueSize int
+}
+
+// Manager keeps the webhooks and delivers events to them
+type Manager struct {
+	options    Options
+	eventTypes []string
+
+	mu          sync.Mutex
+	closed      bool
+	nextId      int
+	webhooks    map[int]Webhook
+	history     map[int][]Attempt
+	deadLetters []DeadLetter
+
+	queue  chan delivery
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// delivery is an event on its way to one webhook
+type delivery struct {
+	webhook    Webhook
+	deliveryId string
+	event      Event
+	body       []byte
+}
+
+// New returns a manager for the event types with the default options
+func New(eventTypes []string) *Manager {
+	return NewWithOptions(eventTypes, Options{})
+}
+
+// NewWithOptions returns a manager for the event types
+func NewWithOptions(eventTypes []string, options Options) *Manager {
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = DefaultMaxAttempts
+	}
+	if options.BaseBackoff <= 0 {
+		options.BaseBackoff = DefaultBaseBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DefaultMaxBackoff
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.HistorySize <= 0 {
+		options.HistorySize = DefaultHistorySize
+	}
+	if options.DeadLetters <= 0 {
+		options.DeadLetters = DefaultDeadLetters
+	}
+	if options.Workers <= 0 {
+		options.Workers = DefaultWorkers
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: options.Timeout}
+		if !options.AllowPrivateTargets {
+			dialer := &net.Dialer{Timeout: options.Timeout, Control: publicOnly}
+			options.Client.Transport = &http.Transport{DialContext: dialer.DialContext}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		options:    options,
+		eventTypes: eventTypes,
+		nextId:     1,
+		webhooks:   make(map[int]Webhook),
+		history:    make(map[int][]Attempt),
+		queue:      make(chan delivery, options.QueueSize),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	m.wg.Add(options.Workers)
+	for i := 0; i < options.Workers; i++ {
+		go m.work()
+	}
+	return m
+}
+
+// EventTypes returns the event types a webhook can ask for
+func (m *Manager) EventTypes() []string {
+	return m.eventTypes
+}
+
+//------------------------------------------------------------
+// REGISTERING WEBHOOKS
+//------------------------------------------------------------
+
+// Register adds a webhook.  If the secret is empty a random one is made,
+// it is returned so it can be given to the caller once.
+// Preconditions:   (1) The URL must be an absolute http or https URL
+//
+//	(2) Every event type must be one the manager knows
+//	(3) The host must not be a private address, unless they are allowed
+//
+// Postconditions:
+//
+//	 (1) The webhook gets the next id and starts getting events
+//		(2) The webhook is returned with its secret
+func (m *Manager) Register(target string, eventTypes []string, secret string) (Webhook, error) {
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: %q is not an http or https URL", ErrInvalidWebhook, target)
+	}
+	if !m.options.AllowPrivateTargets && privateHost(parsed.Hostname()) {
+		return Webhook{}, fmt.Errorf("%w: %s is a private address", ErrInvalidWebhook, parsed.Hostname())
+	}
+	for _, eventType := range eventTypes {
+		if !m.knownType(eventType) {
+			return Webhook{}, fmt.Errorf("%w: unknown event type %q, use one of %v", ErrInvalidWebhook, eventType, m.eventTypes)
+		}
+	}
+	if secret == "" {
+		if secret, err = randomHex(32); err != nil {
+			return Webhook{}, err
+		}
+	}
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhook := Webhook{
+		Id:        m.nextId,
+		URL:       target,
+		Events:    eventTypes,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	m.webhooks[webhook.Id] = webhook
+	m.nextId++
+	return webhook, nil
+}
+
+// Unregister removes a webhook and its history.  Deliveries already on
+// their way are still finished.
+func (m *Manager) Unregister(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	delete(m.webhooks, id)
+	delete(m.history, id)
+	return nil
+}
+
+// Get returns a webhook
+func (m *Manager) Get(id int) (Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhook, ok := m.webhooks[id]
+	if !ok {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	return webhook, nil
+}
+
+// List returns the webhooks ordered by id
+func (m *Manager) List() []Webhook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Webhook, 0, len(m.webhooks))
+	for _, webhook := range m.webhooks {
+		list = append(list, webhook)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// History returns the delivery attempts of a webhook, oldest first
+func (m *Manager) History(id int) ([]Attempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[id]; !ok {
+		return nil, ErrWebhookNotFound
+	}
+	return append([]Attempt{}, m.history[id]...), nil
+}
+
+// DeadLetters returns the deliveries that failed, oldest first
+func (m *Manager) DeadLetters() []DeadLetter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DeadLetter{}, m.deadLetters...)
+}
+
+// knownType reports whether the manager has the event type
+func (m *Manager) knownType(eventType string) bool {
+	for _, known := range m.eventTypes {
+		if known == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// wants reports whether the webhook asked for the event type
+func (w Webhook) wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, want := range w.Events {
+		if want == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------
+// DELIVERING EVENTS
+//------------------------------------------------------------
+
+// Dispatch queues the event for every webhook that asked for its type.
+// It does not wait for the deliveries.
+func (m *Manager) Dispatch(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	//The deliveries are queued while mu is held, so Shutdown either sees
+	//them or they see that the manager is closed
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	var dropped []delivery
+	for _, webhook := range m.webhooks {
+		if !webhook.wants(event.Type) {
+			continue
+		}
+		deliveryId, err := randomHex(8)
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		next := delivery{webhook: webhook, deliveryId: deliveryId, event: event, body: body}
+		if !m.enqueue(next) {
+			dropped = append(dropped, next)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, d := range dropped {
+		m.deadLetter(d.webhook, d.deliveryId, d.event, 0, "not sent, the delivery queue is full")
+	}
+	return nil
+}
+
+// enqueue hands the delivery to the workers without waiting, it reports
+// false when the queue is full.  The caller holds mu.
+func (m *Manager) enqueue(d delivery) bool {
+	select {
+	case m.queue <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryDeadLetter takes a delivery off the dead-letter list and starts
+// it again with a fresh set of attempts.  The webhook must still exist.
+func (m *Manager) RetryDeadLetter(deliveryId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	index := -1
+	for i, letter := range m.deadLetters {
+		if letter.DeliveryId == deliveryId {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return ErrDeadLetterNotFound
+	}
+	letter := m.deadLetters[index]
+	webhook, ok := m.webhooks[letter.WebhookId]
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	body, err := json.Marshal(letter.Event)
+	if err != nil {
+		return err
+	}
+	if !m.enqueue(delivery{webhook: webhook, deliveryId: letter.DeliveryId, event: letter.Event, body: body}) {
+		return ErrQueueFull
+	}
+	m.deadLetters = append(m.deadLetters[:index], m.deadLetters[index+1:]...)
+	return nil
+}
+
+// Shutdown stops taking new deliveries and waits for the queued ones and
+// the ones in flight, retries included, until ctx is done.  Then the rest
+// are cancelled and put on the dead-letter list, and ctx's error is
+// returned.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		m.cancel()
+		return nil
+	case <-ctx.Done():
+		m.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close stops at once, like Shutdown with a context that is already done
+func (m *Manager) Close() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Shutdown(ctx)
+}
+
+// work sends the queued deliveries until the queue is closed.  Once the
+// manager is cancelled the deliveries left in the queue are not tried.
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for d := range m.queue {
+		if m.ctx.Err() != nil {
+			m.deadLetter(d.webhook, d.deliveryId, d.event, 0, "not sent, the server is shutting down")
+			continue
+		}
+		m.deliver(d.webhook, d.deliveryId, d.event, d.body)
+	}
+}
+
+// deliver tries the delivery until it works or runs out of attempts
+func (m *Manager) deliver(webhook Webhook, deliveryId string, event Event, body []byte) {
+	var lastError string
+	attempts := 0
+	for {
+		attempts++
+		result := m.attempt(webhook, deliveryId, event, body, attempts)
+		m.record(result)
+		if result.Delivered {
+			return
+		}
+		lastError = result.Error
+		if !retryable(result.StatusCode) || attempts >= m.options.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(m.backoff(attempts)):
+			continue
+		case <-m.ctx.Done():
+			lastError = "not retried, the server is shutting down: " + lastError
+		}
+		break
+	}
+	m.deadLetter(webhook, deliveryId, event, attempts, lastError)
+}
+
+// attempt sends the delivery once
+func (m *Manager) attempt(webhook Webhook, deliveryId string, event Event, body []byte, attempt int) Attempt {
+	result := Attempt{
+		DeliveryId: deliveryId,
+		WebhookId:  webhook.Id,
+		EventId:    event.Id,
+		EventType:  event.Type,
+		Attempt:    attempt,
+		Time:       time.Now().UTC(),
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, m.options.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	timestamp := strconv.FormatInt(result.Time.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderEvent, event.Type)
+	request.Header.Set(HeaderDelivery, deliveryId)
+	request.Header.Set(HeaderTimestamp, timestamp)
+	request.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, body))
+
+	response, err := m.options.Client.Do(request)
+	result.Duration = time.Since(result.Time)
+	result.DurationMs = result.Duration.Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	//Read the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	response.Body.Close()
+
+	result.StatusCode = response.StatusCode
+	result.Delivered = response.StatusCode >= 200 && response.StatusCode < 300
+	if !result.Delivered {
+		result.Error = response.Status
+	}
+	return result
+}
+
+// retryable reports whether an attempt that got the status code should
+// be tried again.  Zero is no answer at all, like a refused connection.
+func retryable(statusCode int) bool {
+	switch {
+	case statusCode == 0, statusCode >= 500:
+		return true
+	case statusCode == http.StatusRequestTimeout, statusCode == http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait after the attempt failed, it doubles
+// every attempt up to MaxBackoff
+func (m *Manager) backoff(attempt int) time.Duration {
+	wait := m.options.BaseBackoff << (attempt - 1)
+	if wait <= 0 || wait > m.options.MaxBackoff {
+		return m.options.MaxBackoff
+	}
+	return wait
+}
+
+// record adds an attempt to the history of its webhook
+func (m *Manager) record(attempt Attempt) {
+	if attempt.Delivered {
+		log.Printf("Webhook %d: delivered %s event %s", attempt.WebhookId, attempt.EventType, attempt.EventId)
+	} else {
+		log.Printf("Webhook %d: attempt %d of %s event %s failed: %s", attempt.WebhookId, attempt.Attempt, attempt.EventType, attempt.EventId, attempt.Error)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[attempt.WebhookId]; !ok {
+		return
+	}
+	history := append(m.history[attempt.WebhookId], attempt)
+	if len(history) > m.options.HistorySize {
+		history = history[len(history)-m.options.HistorySize:]
+	}
+	m.history[attempt.WebhookId] = history
+}
+
+// deadLetter puts a delivery that gave up on the dead-letter list
+func (m *Manager) deadLetter(webhook Webhook, deliveryId string, event Event, attempts int, lastError string) {
+	log.Printf("Webhook %d: giving up on %s event %s after %d attempts: %s", webhook.Id, event.Type, event.Id, attempts, lastError)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadLetters = append(m.deadLetters, DeadLetter{
+		DeliveryId: deliveryId,
+		WebhookId:  webhook.Id,
+		Event:      event,
+		Attempts:   attempts,
+		LastError:  lastError,
+		FailedAt:   time.Now().UTC(),
+	})
+	if len(m.deadLetters) > m.options.DeadLetters {
+		m.deadLetters = m.deadLetters[len(m.deadLetters)-m.options.DeadLetters:]
+	}
+}
+
+// privateHost reports whether the host of a URL is this machine or on a
+// private network.  Names other than localhost are only known to be
+// private once they are resolved, see publicOnly.
+func privateHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && privateIP(ip)
+}
+
+// privateIP reports whether an address is loopback, link-local, private
+// or unspecified
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// publicOnly is the Control of the dialer of the default client, it
+// refuses to connect to a private address whatever name it came from
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+		return fmt.Errorf("webhook target %s is a private address", host)
+	}
+	return nil
+}
+
+//------------------------------------------------------------
+// SIGNATURES
+//------------------------------------------------------------
+
+// Sign returns the signature of a delivery, "sha256=" and the hex
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the
+// secret.  The timestamp is signed too so an old delivery cannot be
+// sent again later as a new one.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery, and that its timestamp is
+// no older than maxAge.  Receivers written in go can use it as is.
+func Verify(secret string, timestamp string, body []byte, signature string, maxAge time.Duration) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(seconds, 0)) > maxAge {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -11,6 +11,7 @@ cat pubs.json | jq -c '.[]' |\
         rediscmd="redis-cli JSON.set pubs:$pubid . '$json_object'"; \
         echo $rediscmd; \
         eval $rediscmd; \
+        redis-cli SADD pubs:ids $pubid > /dev/null; \
     done 
 
 #load reading list
@@ -21,5 +22,6 @@ cat readinglist.json | jq -c '.[]' |\
         rediscmd="redis-cli JSON.set publist:$rlid . '$json_object'"; \
         echo $rediscmd; \
         eval $rediscmd; \
+        redis-cli SADD publist:ids $rlid > /dev/null; \
     done 
 
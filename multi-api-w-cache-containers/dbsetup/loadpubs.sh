@@ -6,4 +6,5 @@ cat pubs.json | jq -c '.[]' |\
         rediscmd="redis-cli JSON.set pubs:$pubid . '$json_object'"; \
         echo $rediscmd; \
         eval $rediscmd; \
+        redis-cli SADD pubs:ids $pubid > /dev/null; \
     done 
\ No newline at end of file
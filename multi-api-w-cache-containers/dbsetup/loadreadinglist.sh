@@ -6,4 +6,5 @@ cat readinglist.json | jq -c '.[]' |\
         rediscmd="redis-cli JSON.set publist:$rlid . '$json_object'"; \
         echo $rediscmd; \
         eval $rediscmd; \
+        redis-cli SADD publist:ids $rlid > /dev/null; \
     done 
\ No newline at end of file
@@ -15,6 +15,7 @@ cat /data/pubs.json | jq -c '.[]' |\
         rediscmd="redis-cli -h $1 JSON.set pubs:$pubid . '$json_object'"; \
         echo $rediscmd; \
         eval $rediscmd; \
+        redis-cli -h $1 SADD pubs:ids $pubid > /dev/null; \
     done 
 
 #load reading list
@@ -25,5 +26,6 @@ cat /data/readinglist.json | jq -c '.[]' |\
         rediscmd="redis-cli -h $1 JSON.set publist:$rlid . '$json_object'"; \
         echo $rediscmd; \
         eval $rediscmd; \
+        redis-cli -h $1 SADD publist:ids $rlid > /dev/null; \
     done 
 
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 
 	"architectingsoftware.com/pub-api/schema"
 	"github.com/gin-gonic/gin"
@@ -12,6 +13,19 @@ import (
 	"github.com/nitishm/go-rejson/v4"
 )
 
+const (
+	//pubsKeyPrefix is the start of every pubs key, pubsIdsKey is a set
+	//holding the ids of all of them.  Listing walks the set rather than
+	//running KEYS, which blocks redis while it reads the whole keyspace.
+	//The load scripts in dbsetup and docker/dbdata fill in the set.
+	pubsKeyPrefix = "pubs:"
+	pubsIdsKey    = pubsKeyPrefix + "ids"
+
+	//redisBatchSize is the COUNT hint for SCAN and SSCAN, and the most
+	//documents fetched with one JSON.MGET
+	redisBatchSize = 100
+)
+
 type cache struct {
 	client  *redis.Client
 	helper  *rejson.Handler
@@ -51,14 +65,26 @@ func NewPubAPI(location string) (*PubAPI, error) {
 	jsonHelper := rejson.NewReJSONHandler()
 	jsonHelper.SetGoRedisClientWithContext(ctx, client)
 
-	//Return a pointer to a new ToDo struct
-	return &PubAPI{
+	api := &PubAPI{
 		cache: cache{
 			client:  client,
 			helper:  jsonHelper,
 			context: ctx,
 		},
-	}, nil
+	}
+
+	//Documents loaded by an older script are not in the id set, so
+	//build it from the keys if it is missing
+	if n, err := client.Exists(ctx, pubsIdsKey).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if err := api.rebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	//Return a pointer to a new API struct
+	return api, nil
 }
 
 func (p *PubAPI) GetPublication(c *gin.Context) {
@@ -69,7 +95,7 @@ func (p *PubAPI) GetPublication(c *gin.Context) {
 		return
 	}
 
-	cacheKey := "pubs:" + pubid
+	cacheKey := pubsKeyPrefix + pubid
 	pubBytes, err := p.helper.JSONGet(cacheKey, ".")
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Could not find publication in cache with id=" + cacheKey})
@@ -88,22 +114,106 @@ func (p *PubAPI) GetPublication(c *gin.Context) {
 
 func (p *PubAPI) GetPublications(c *gin.Context) {
 
-	var pubList []schema.Publication
-	var pubItem schema.Publication
-
 	//Lets query redis for all of the items
-	pattern := "pubs:*"
-	ks, _ := p.client.Keys(p.context, pattern).Result()
-	for _, key := range ks {
-		err := p.getItemFromRedis(key, &pubItem)
+	pubList, err := p.getAllFromRedis()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read publications from cache: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, pubList)
+}
+
+// Helper that calls fn with batches of the pubs:<id> keys found with SCAN.
+// SCAN looks at a few keys per call, so redis is never blocked for long.
+// The id set itself is skipped.
+func (p *PubAPI) scanKeys(fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := p.client.Scan(p.context, cursor, pubsKeyPrefix+"*", redisBatchSize).Result()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not find publication in cache with id=" + key})
-			return
+			return err
+		}
+		var docKeys []string
+		for _, key := range keys {
+			if key != pubsIdsKey {
+				docKeys = append(docKeys, key)
+			}
+		}
+		if len(docKeys) > 0 {
+			if err := fn(docKeys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
 		}
-		pubList = append(pubList, pubItem)
+		cursor = next
 	}
+}
 
-	c.JSON(http.StatusOK, pubList)
+// Helper that adds the id of every pubs:<id> key to the id set
+func (p *PubAPI) rebuildIndex() error {
+	return p.scanKeys(func(keys []string) error {
+		var ids []interface{}
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, pubsKeyPrefix))
+		}
+		return p.client.SAdd(p.context, pubsIdsKey, ids...).Err()
+	})
+}
+
+// Helper to return every publication in the id set.  The set is walked with
+// SSCAN and each batch is fetched with a single JSON.MGET rather than a
+// JSON.GET per key.  Ids whose document is gone are removed from the set.
+func (p *PubAPI) getAllFromRedis() ([]schema.Publication, error) {
+	var list []schema.Publication
+	seen := make(map[int]bool)
+	var cursor uint64
+	for {
+		ids, next, err := p.client.SScan(p.context, pubsIdsKey, cursor, "", redisBatchSize).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) > 0 {
+			args := []interface{}{"JSON.MGET"}
+			for _, id := range ids {
+				args = append(args, pubsKeyPrefix+id)
+			}
+			args = append(args, ".")
+			docs, err := p.client.Do(p.context, args...).Slice()
+			if err != nil {
+				return nil, err
+			}
+
+			var missing []interface{}
+			for i, doc := range docs {
+				data, ok := doc.(string)
+				if !ok {
+					missing = append(missing, ids[i])
+					continue
+				}
+				var item schema.Publication
+				if err := json.Unmarshal([]byte(data), &item); err != nil {
+					return nil, err
+				}
+				//SSCAN can return an id twice if the set changes
+				if !seen[item.ID] {
+					seen[item.ID] = true
+					list = append(list, item)
+				}
+			}
+			if len(missing) > 0 {
+				if err := p.client.SRem(p.context, pubsIdsKey, missing...).Err(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if next == 0 {
+			return list, nil
+		}
+		cursor = next
+	}
 }
 
 // Helper to return a ToDoItem from redis provided a key
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultRateLimits are the limits when there is no -rate-limits file.
+// GET /pubs reads every publication, so it has a lower limit than the
+// rest.
+func DefaultRateLimits() ratelimit.Config {
+	return ratelimit.Config{
+		Default: ratelimit.MustParseLimit("600/m"),
+		Routes: map[string]ratelimit.Rule{
+			"GET /pubs": ratelimit.MustParseLimit("60/m"),
+		},
+	}
+}
+
+// Routes adds the routes of the API to r.  Every route is rate limited,
+// per caller when the request has credentials that check out and per
+// client address otherwise.  The publications need pubs:read and the
+// API keys need admin.
+func (p *PubAPI) Routes(r *gin.Engine, authn *auth.Authenticator, limiter *ratelimit.Limiter) {
+	r.Use(authn.Identify(), limiter.Middleware())
+
+	read := authn.Require(auth.ReadScope("pubs"))
+	r.GET("/pubs", read, p.GetPublications)
+	r.GET("/pubs/:id", read, p.GetPublication)
+
+	//API keys are made and deleted by admins
+	admin := authn.Require(auth.Admin)
+	r.POST("/apikeys", admin, authn.CreateAPIKey)
+	r.GET("/apikeys", admin, authn.ListAPIKeys)
+	r.DELETE("/apikeys/:id", admin, authn.DeleteAPIKey)
+}
@@ -7,14 +7,21 @@ import (
 	"strconv"
 
 	"architectingsoftware.com/pub-api/api"
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
 var (
-	hostFlag string
-	portFlag uint
-	cacheURL string
+	hostFlag  string
+	portFlag  uint
+	cacheURL  string
+	jwksFile  string
+	apiKeyURL string
+	noAuth    bool
+	rateFile  string
+	rateURL   string
 )
 
 func processCmdLineFlags() {
@@ -22,6 +29,12 @@ func processCmdLineFlags() {
 	flag.StringVar(&cacheURL, "c", "0.0.0.0:6379", "Default cache location")
 	flag.UintVar(&portFlag, "p", 2080, "Default Port")
 
+	flag.StringVar(&jwksFile, "jwks", "", "JWKS file with the keys tokens are signed with")
+	flag.StringVar(&apiKeyURL, "auth-redis", "", "Location of the redis the API keys are kept in")
+	flag.BoolVar(&noAuth, "insecure-no-auth", false, "Run without authentication, every route is open")
+	flag.StringVar(&rateFile, "rate-limits", "", "YAML file with the rate limits of the routes")
+	flag.StringVar(&rateURL, "ratelimit-redis", "", "Location of the redis the rate limit counts are kept in")
+
 	flag.Parse()
 }
 
@@ -40,6 +53,11 @@ func setupParms() {
 	//now process any environment variables
 	cacheURL = envVarOrDefault("PUBAPI_CACHE_URL", cacheURL)
 	hostFlag = envVarOrDefault("PUBAPI_HOST", hostFlag)
+	jwksFile = envVarOrDefault("PUBAPI_JWKS_FILE", jwksFile)
+	apiKeyURL = envVarOrDefault("PUBAPI_AUTH_REDIS_URL", apiKeyURL)
+	noAuth, _ = strconv.ParseBool(envVarOrDefault("PUBAPI_INSECURE_NO_AUTH", strconv.FormatBool(noAuth)))
+	rateFile = envVarOrDefault("PUBAPI_RATELIMIT_FILE", rateFile)
+	rateURL = envVarOrDefault("PUBAPI_RATELIMIT_REDIS_URL", rateURL)
 	pfNew, err := strconv.Atoi(envVarOrDefault("PUBAPI_PORT", fmt.Sprintf("%d", portFlag)))
 	//only update the port if we were able to convert the env var to an int, else
 	//we will use the default we got from the command line, or command line defaults
@@ -59,14 +77,46 @@ func main() {
 		panic(err)
 	}
 
+	//Authentication is on when there is a JWKS to check tokens against
+	//or a redis to look API keys up in, every route needs pubs:read.
+	//Without either the API does not start, unless -insecure-no-auth
+	//is given
+	authn, err := auth.New(auth.Options{JWKSFile: jwksFile, RedisLocation: apiKeyURL, Resource: "pubs", Insecure: noAuth})
+	if err != nil {
+		panic(err)
+	}
+
+	//Every route is rate limited, per caller when the request has
+	//credentials that check out and per client address otherwise
+	limiter, err := newRateLimiter()
+	if err != nil {
+		panic(err)
+	}
+
 	r := gin.Default()
 	r.Use(cors.Default())
-
-	r.GET("/pubs", apiHandler.GetPublications)
-	r.GET("/pubs/:id", apiHandler.GetPublication)
+	apiHandler.Routes(r, authn, limiter)
 
 	//For now we will just support gets
 	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
 	r.Run(serverPath)
 
 }
+
+// newRateLimiter returns the rate limiter, with the limits in the
+// -rate-limits file or api.DefaultRateLimits.
+func newRateLimiter() (*ratelimit.Limiter, error) {
+	options := ratelimit.Options{
+		Config:        api.DefaultRateLimits(),
+		RedisLocation: rateURL,
+		Identify:      auth.Subject,
+	}
+	if rateFile != "" {
+		config, err := ratelimit.LoadConfig(rateFile)
+		if err != nil {
+			return nil, err
+		}
+		options.Config = config
+	}
+	return ratelimit.New(options)
+}
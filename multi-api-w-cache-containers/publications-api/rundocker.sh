@@ -1,2 +1,2 @@
 #!/bin/bash
-docker run --name cnse-pub-api --rm -p 2080:2080 architectingsoftware/cnse-pub-api:v1
+docker run --name cnse-pub-api --rm -e PUBAPI_INSECURE_NO_AUTH=true -p 2080:2080 architectingsoftware/cnse-pub-api:v1
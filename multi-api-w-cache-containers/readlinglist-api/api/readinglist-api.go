@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 
 	"architectingsoftware.com/reading-list-api/schema"
+	"drexel.edu/middleware/auth"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/nitishm/go-rejson/v4"
@@ -14,6 +16,19 @@ import (
 	"github.com/go-resty/resty/v2"
 )
 
+const (
+	//publistKeyPrefix is the start of every publist key, publistIdsKey is a set
+	//holding the ids of all of them.  Listing walks the set rather than
+	//running KEYS, which blocks redis while it reads the whole keyspace.
+	//The load scripts in dbsetup and docker/dbdata fill in the set.
+	publistKeyPrefix = "publist:"
+	publistIdsKey    = publistKeyPrefix + "ids"
+
+	//redisBatchSize is the COUNT hint for SCAN and SSCAN, and the most
+	//documents fetched with one JSON.MGET
+	redisBatchSize = 100
+)
+
 type cache struct {
 	client  *redis.Client
 	helper  *rejson.Handler
@@ -26,6 +41,12 @@ type ReadingListAPI struct {
 	apiClient *resty.Client
 }
 
+// UsePubAPIKey sends an API key with every call to the publications
+// API, for when that API requires authentication
+func (r *ReadingListAPI) UsePubAPIKey(key string) {
+	r.apiClient.SetHeader(auth.APIKeyHeader, key)
+}
+
 func NewReadingListAPI(location string, pubAPIurl string) (*ReadingListAPI, error) {
 
 	apiClient := resty.New()
@@ -56,8 +77,7 @@ func NewReadingListAPI(location string, pubAPIurl string) (*ReadingListAPI, erro
 	jsonHelper := rejson.NewReJSONHandler()
 	jsonHelper.SetGoRedisClientWithContext(ctx, client)
 
-	//Return a pointer to a new ToDo struct
-	return &ReadingListAPI{
+	api := &ReadingListAPI{
 		cache: cache{
 			client:  client,
 			helper:  jsonHelper,
@@ -65,7 +85,20 @@ func NewReadingListAPI(location string, pubAPIurl string) (*ReadingListAPI, erro
 		},
 		pubAPIURL: pubAPIurl,
 		apiClient: apiClient,
-	}, nil
+	}
+
+	//Documents loaded by an older script are not in the id set, so
+	//build it from the keys if it is missing
+	if n, err := client.Exists(ctx, publistIdsKey).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if err := api.rebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	//Return a pointer to a new API struct
+	return api, nil
 }
 
 func (r *ReadingListAPI) GetReadingList(c *gin.Context) {
@@ -76,7 +109,7 @@ func (r *ReadingListAPI) GetReadingList(c *gin.Context) {
 		return
 	}
 
-	cacheKey := "publist:" + rlId
+	cacheKey := publistKeyPrefix + rlId
 	rlBytes, err := r.helper.JSONGet(cacheKey, ".")
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Could not find reading list in cache with id=" + cacheKey})
@@ -106,7 +139,7 @@ func (r *ReadingListAPI) GetPubFromReadingList(c *gin.Context) {
 		return
 	}
 
-	cacheKey := "publist:" + rlId
+	cacheKey := publistKeyPrefix + rlId
 	var rl schema.ReadingList
 	err := r.getItemFromRedis(cacheKey, &rl)
 	if err != nil {
@@ -146,7 +179,7 @@ func (r *ReadingListAPI) RedirectWithPublication(c *gin.Context) {
 		return
 	}
 
-	cacheKey := "publist:" + rlId
+	cacheKey := publistKeyPrefix + rlId
 	var rl schema.ReadingList
 	err := r.getItemFromRedis(cacheKey, &rl)
 	if err != nil {
@@ -179,22 +212,106 @@ func (r *ReadingListAPI) RedirectWithPublication(c *gin.Context) {
 
 func (r *ReadingListAPI) GetReadingLists(c *gin.Context) {
 
-	var readList []schema.ReadingList
-	var readItem schema.ReadingList
-
 	//Lets query redis for all of the items
-	pattern := "publist:*"
-	ks, _ := r.client.Keys(r.context, pattern).Result()
-	for _, key := range ks {
-		err := r.getItemFromRedis(key, &readItem)
+	readList, err := r.getAllFromRedis()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read reading lists from cache: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, readList)
+}
+
+// Helper that calls fn with batches of the publist:<id> keys found with SCAN.
+// SCAN looks at a few keys per call, so redis is never blocked for long.
+// The id set itself is skipped.
+func (r *ReadingListAPI) scanKeys(fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(r.context, cursor, publistKeyPrefix+"*", redisBatchSize).Result()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not find reading list in cache with id=" + key})
-			return
+			return err
+		}
+		var docKeys []string
+		for _, key := range keys {
+			if key != publistIdsKey {
+				docKeys = append(docKeys, key)
+			}
+		}
+		if len(docKeys) > 0 {
+			if err := fn(docKeys); err != nil {
+				return err
+			}
 		}
-		readList = append(readList, readItem)
+		if next == 0 {
+			return nil
+		}
+		cursor = next
 	}
+}
 
-	c.JSON(http.StatusOK, readList)
+// Helper that adds the id of every publist:<id> key to the id set
+func (r *ReadingListAPI) rebuildIndex() error {
+	return r.scanKeys(func(keys []string) error {
+		var ids []interface{}
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, publistKeyPrefix))
+		}
+		return r.client.SAdd(r.context, publistIdsKey, ids...).Err()
+	})
+}
+
+// Helper to return every reading list in the id set.  The set is walked with
+// SSCAN and each batch is fetched with a single JSON.MGET rather than a
+// JSON.GET per key.  Ids whose document is gone are removed from the set.
+func (r *ReadingListAPI) getAllFromRedis() ([]schema.ReadingList, error) {
+	var list []schema.ReadingList
+	seen := make(map[int]bool)
+	var cursor uint64
+	for {
+		ids, next, err := r.client.SScan(r.context, publistIdsKey, cursor, "", redisBatchSize).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) > 0 {
+			args := []interface{}{"JSON.MGET"}
+			for _, id := range ids {
+				args = append(args, publistKeyPrefix+id)
+			}
+			args = append(args, ".")
+			docs, err := r.client.Do(r.context, args...).Slice()
+			if err != nil {
+				return nil, err
+			}
+
+			var missing []interface{}
+			for i, doc := range docs {
+				data, ok := doc.(string)
+				if !ok {
+					missing = append(missing, ids[i])
+					continue
+				}
+				var item schema.ReadingList
+				if err := json.Unmarshal([]byte(data), &item); err != nil {
+					return nil, err
+				}
+				//SSCAN can return an id twice if the set changes
+				if !seen[item.ID] {
+					seen[item.ID] = true
+					list = append(list, item)
+				}
+			}
+			if len(missing) > 0 {
+				if err := r.client.SRem(r.context, publistIdsKey, missing...).Err(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if next == 0 {
+			return list, nil
+		}
+		cursor = next
+	}
 }
 
 // Helper to return a ToDoItem from redis provided a key
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultRateLimits are the limits when there is no -rate-limits file.
+// GET /publists reads every list, so it has a lower limit than the
+// rest.
+func DefaultRateLimits() ratelimit.Config {
+	return ratelimit.Config{
+		Default: ratelimit.MustParseLimit("600/m"),
+		Routes: map[string]ratelimit.Rule{
+			"GET /publists": ratelimit.MustParseLimit("60/m"),
+		},
+	}
+}
+
+// Routes adds the routes of the API to router.  Every route is rate limited,
+// per caller when the request has credentials that check out and per
+// client address otherwise.  The reading lists need publists:read and
+// the API keys need admin.
+func (r *ReadingListAPI) Routes(router *gin.Engine, authn *auth.Authenticator, limiter *ratelimit.Limiter) {
+	router.Use(authn.Identify(), limiter.Middleware())
+
+	read := authn.Require(auth.ReadScope("publists"))
+	router.GET("/publists", read, r.GetReadingLists)
+	router.GET("/publists/:id", read, r.GetReadingList)
+	router.GET("/publists/:id/:idx", read, r.GetPubFromReadingList)
+	router.GET("/publists/:id/:idx/paper", read, r.RedirectWithPublication)
+
+	//API keys are made and deleted by admins
+	admin := authn.Require(auth.Admin)
+	router.POST("/apikeys", admin, authn.CreateAPIKey)
+	router.GET("/apikeys", admin, authn.ListAPIKeys)
+	router.DELETE("/apikeys/:id", admin, authn.DeleteAPIKey)
+}
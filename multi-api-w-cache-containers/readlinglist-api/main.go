@@ -8,6 +8,8 @@ import (
 	"strconv"
 
 	"architectingsoftware.com/reading-list-api/api"
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -16,7 +18,13 @@ var (
 	hostFlag  string
 	portFlag  uint
 	cacheURL  string
+	jwksFile  string
+	apiKeyURL string
+	noAuth    bool
+	rateFile  string
+	rateURL   string
 	pubAPIURL string
+	pubAPIKey string
 )
 
 func processCmdLineFlags() {
@@ -25,6 +33,13 @@ func processCmdLineFlags() {
 	flag.StringVar(&cacheURL, "c", "0.0.0.0:6379", "Default cache location")
 	flag.UintVar(&portFlag, "p", 3080, "Default Port")
 
+	flag.StringVar(&jwksFile, "jwks", "", "JWKS file with the keys tokens are signed with")
+	flag.StringVar(&apiKeyURL, "auth-redis", "", "Location of the redis the API keys are kept in")
+	flag.BoolVar(&noAuth, "insecure-no-auth", false, "Run without authentication, every route is open")
+	flag.StringVar(&rateFile, "rate-limits", "", "YAML file with the rate limits of the routes")
+	flag.StringVar(&rateURL, "ratelimit-redis", "", "Location of the redis the rate limit counts are kept in")
+	flag.StringVar(&pubAPIKey, "pubapi-key", "", "API key to call the publication API with")
+
 	flag.Parse()
 }
 
@@ -44,6 +59,12 @@ func setupParms() {
 	cacheURL = envVarOrDefault("RLAPI_CACHE_URL", cacheURL)
 	pubAPIURL = envVarOrDefault("RLAPI_PUB_API_URL", pubAPIURL)
 	hostFlag = envVarOrDefault("RLAPI_HOST", hostFlag)
+	jwksFile = envVarOrDefault("RLAPI_JWKS_FILE", jwksFile)
+	apiKeyURL = envVarOrDefault("RLAPI_AUTH_REDIS_URL", apiKeyURL)
+	noAuth, _ = strconv.ParseBool(envVarOrDefault("RLAPI_INSECURE_NO_AUTH", strconv.FormatBool(noAuth)))
+	rateFile = envVarOrDefault("RLAPI_RATELIMIT_FILE", rateFile)
+	rateURL = envVarOrDefault("RLAPI_RATELIMIT_REDIS_URL", rateURL)
+	pubAPIKey = envVarOrDefault("RLAPI_PUB_API_KEY", pubAPIKey)
 
 	pfNew, err := strconv.Atoi(envVarOrDefault("RLAPI_PORT", fmt.Sprintf("%d", portFlag)))
 	//only update the port if we were able to convert the env var to an int, else
@@ -68,16 +89,51 @@ func main() {
 		panic(err)
 	}
 
+	//The publication API may need an API key with pubs:read
+	if pubAPIKey != "" {
+		apiHandler.UsePubAPIKey(pubAPIKey)
+	}
+
+	//Authentication is on when there is a JWKS to check tokens against
+	//or a redis to look API keys up in, every route needs publists:read.
+	//Without either the API does not start, unless -insecure-no-auth
+	//is given
+	authn, err := auth.New(auth.Options{JWKSFile: jwksFile, RedisLocation: apiKeyURL, Resource: "publists", Insecure: noAuth})
+	if err != nil {
+		panic(err)
+	}
+
+	//Every route is rate limited, per caller when the request has
+	//credentials that check out and per client address otherwise
+	limiter, err := newRateLimiter()
+	if err != nil {
+		panic(err)
+	}
+
 	r := gin.Default()
 	r.Use(cors.Default())
-
-	r.GET("/publists", apiHandler.GetReadingLists)
-	r.GET("/publists/:id", apiHandler.GetReadingList)
-	r.GET("/publists/:id/:idx", apiHandler.GetPubFromReadingList)
-	r.GET("/publists/:id/:idx/paper", apiHandler.RedirectWithPublication)
+	apiHandler.Routes(r, authn, limiter)
 
 	//For now we will just support gets
 	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
 	r.Run(serverPath)
 
 }
+
+// newRateLimiter returns the rate limiter, with the limits in the
+// -rate-limits file or api.DefaultRateLimits.
+func newRateLimiter() (*ratelimit.Limiter, error) {
+	options := ratelimit.Options{
+		Config:        api.DefaultRateLimits(),
+		RedisLocation: rateURL,
+		Identify:      auth.Subject,
+	}
+	if rateFile != "" {
+		config, err := ratelimit.LoadConfig(rateFile)
+		if err != nil {
+			return nil, err
+		}
+		options.Config = config
+	}
+	return ratelimit.New(options)
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"architectingsoftware.com/reading-list-api/api"
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover how the routes are guarded and limited.  The keys
+// and the rate limit counts are kept in memory, and the requests that
+// would reach redis are not sent, so redis does not have to be running.
+
+func newRouter(t *testing.T) (*gin.Engine, *auth.MemoryKeyStore) {
+	t.Helper()
+	keys := auth.NewMemoryKeyStore()
+	authn, err := auth.NewWithKeyStore(auth.Options{Resource: "publists"}, keys)
+	require.NoError(t, err)
+	options := ratelimit.Options{Config: api.DefaultRateLimits(), Identify: auth.Subject}
+	limiter, err := ratelimit.NewWithStore(options, ratelimit.NewMemoryStore())
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	(&api.ReadingListAPI{}).Routes(r, authn, limiter)
+	return r, keys
+}
+
+func issue(t *testing.T, keys auth.KeyStore, name string, scopes ...auth.Scope) map[string]string {
+	t.Helper()
+	key, _, err := auth.Issue(keys, name, scopes, 0)
+	require.NoError(t, err)
+	return map[string]string{auth.APIKeyHeader: key}
+}
+
+func send(r http.Handler, method string, path string, headers map[string]string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRoutesNeedReadScope(t *testing.T) {
+	r, keys := newRouter(t)
+	pubs := issue(t, keys, "pubs", auth.ReadScope("pubs"))
+
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, "/publists", nil))
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, "/publists/1", map[string]string{auth.APIKeyHeader: "ak_made_up"}))
+	for _, path := range []string{"/publists", "/publists/1", "/publists/1/0", "/publists/1/0/paper"} {
+		assert.Equal(t, http.StatusForbidden, send(r, http.MethodGet, path, pubs), "A key for the publications does not read %s", path)
+	}
+}
+
+func TestAPIKeysNeedAdmin(t *testing.T) {
+	r, keys := newRouter(t)
+	reader := issue(t, keys, "reader", auth.ReadScope("publists"))
+	admin := issue(t, keys, "admin", auth.Admin)
+
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, "/apikeys", nil))
+	assert.Equal(t, http.StatusForbidden, send(r, http.MethodGet, "/apikeys", reader))
+	assert.Equal(t, http.StatusForbidden, send(r, http.MethodPost, "/apikeys", reader))
+	assert.Equal(t, http.StatusForbidden, send(r, http.MethodDelete, "/apikeys/1", reader))
+	assert.Equal(t, http.StatusOK, send(r, http.MethodGet, "/apikeys", admin))
+}
+
+func TestRateLimitPerCaller(t *testing.T) {
+	r, keys := newRouter(t)
+	one := issue(t, keys, "one", auth.ReadScope("pubs"))
+	two := issue(t, keys, "two", auth.ReadScope("pubs"))
+
+	//Refused requests still count, so the limit is reached without
+	//going to redis
+	for i := 0; i < 60; i++ {
+		require.Equal(t, http.StatusForbidden, send(r, http.MethodGet, "/publists", one))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send(r, http.MethodGet, "/publists", one), "GET /publists allows 60 a minute")
+	assert.Equal(t, http.StatusForbidden, send(r, http.MethodGet, "/publists", two), "Each key has a limit of its own")
+	assert.Equal(t, http.StatusUnauthorized, send(r, http.MethodGet, "/publists", nil), "Callers without a key are counted by address")
+	assert.Equal(t, http.StatusForbidden, send(r, http.MethodGet, "/publists/1", one), "The other routes have the default limit")
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
@@ -224,6 +225,172 @@ func (td *ToDoAPI) DeleteAllToDo(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+/*   STEP HANDLERS - THE STEPS OF A SINGLE TODO UNDER /todo/:id/steps */
+
+// stepIdsFromRequest reads the item id, and the step number if the route
+// has one, from the path.  It aborts the request with a 400 if they are
+// not numbers.
+func stepIdsFromRequest(c *gin.Context) (int, int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println("Error converting id to int: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return 0, 0, false
+	}
+	stepNum := 0
+	if stepS := c.Param("step"); stepS != "" {
+		if stepNum, err = strconv.Atoi(stepS); err != nil {
+			log.Println("Error converting step to int: ", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	return id, stepNum, true
+}
+
+// stepResponse returns the item after a change to its steps, or the
+// status that matches the error
+func stepResponse(c *gin.Context, item db.ToDoItem, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, item)
+	case errors.Is(err, db.ErrItemNotFound), errors.Is(err, db.ErrStepNotFound):
+		log.Println("Step not found: ", err)
+		c.AbortWithStatus(http.StatusNotFound)
+	case errors.Is(err, db.ErrInvalidStep):
+		log.Println("Invalid step: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrContention):
+		log.Println("Error changing steps: ", err)
+		c.AbortWithStatus(http.StatusConflict)
+	default:
+		log.Println("Error changing steps: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
+
+// implementation for GET /todo/:id/steps
+// returns the steps of a todo in order
+func (td *ToDoAPI) ListSteps(c *gin.Context) {
+	id, _, ok := stepIdsFromRequest(c)
+	if !ok {
+		return
+	}
+
+	steps, err := td.db.GetSteps(id)
+	if err != nil {
+		log.Println("Item not found: ", err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	//Like the list of todos, an item without steps returns []
+	if steps == nil {
+		steps = make([]db.ToDoStep, 0)
+	}
+
+	c.JSON(http.StatusOK, steps)
+}
+
+// implementation for POST /todo/:id/steps
+// adds a step to a todo, at the end or at ?position=<n> where 0 is first.
+// The step number is picked by the database.
+func (td *ToDoAPI) AddStep(c *gin.Context) {
+	id, _, ok := stepIdsFromRequest(c)
+	if !ok {
+		return
+	}
+
+	position := -1
+	if positionS := c.Query("position"); positionS != "" {
+		var err error
+		if position, err = strconv.Atoi(positionS); err != nil || position < 0 {
+			log.Println("Error converting position to int: ", positionS)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var step db.ToDoStep
+	if err := c.ShouldBindJSON(&step); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	item, err := td.db.AddStep(id, step, position)
+	stepResponse(c, item, err)
+}
+
+// implementation for PUT /todo/:id/steps/:step
+// changes the description and done status of a step
+func (td *ToDoAPI) UpdateStep(c *gin.Context) {
+	id, stepNum, ok := stepIdsFromRequest(c)
+	if !ok {
+		return
+	}
+
+	var step db.ToDoStep
+	if err := c.ShouldBindJSON(&step); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	//The step number comes from the path, a different one in the
+	//body would be confusing
+	if step.StepNum != 0 && step.StepNum != stepNum {
+		log.Println("Step number in the body does not match the path")
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	step.StepNum = stepNum
+
+	item, err := td.db.UpdateStep(id, step)
+	stepResponse(c, item, err)
+}
+
+// implementation for POST /todo/:id/steps/:step/complete
+// marks a step done
+func (td *ToDoAPI) CompleteStep(c *gin.Context) {
+	id, stepNum, ok := stepIdsFromRequest(c)
+	if !ok {
+		return
+	}
+
+	item, err := td.db.CompleteStep(id, stepNum)
+	stepResponse(c, item, err)
+}
+
+// implementation for POST /todo/:id/steps/:step/move?to=<n>
+// moves a step to position n in the list, 0 is first
+func (td *ToDoAPI) MoveStep(c *gin.Context) {
+	id, stepNum, ok := stepIdsFromRequest(c)
+	if !ok {
+		return
+	}
+
+	position, err := strconv.Atoi(c.Query("to"))
+	if err != nil {
+		log.Println("Error converting to to int: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	item, err := td.db.MoveStep(id, stepNum, position)
+	stepResponse(c, item, err)
+}
+
+// implementation for DELETE /todo/:id/steps/:step
+// removes a step from a todo
+func (td *ToDoAPI) DeleteStep(c *gin.Context) {
+	id, stepNum, ok := stepIdsFromRequest(c)
+	if !ok {
+		return
+	}
+
+	item, err := td.db.DeleteStep(id, stepNum)
+	stepResponse(c, item, err)
+}
+
 /*   SPECIAL HANDLERS FOR DEMONSTRATION - CRASH SIMULATION AND HEALTH CHECK */
 
 // implementation for GET /crash
@@ -0,0 +1,359 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The steps of an item are stored as a JSON array inside the item, so
+// instead of reading the whole item, changing it and writing it back,
+// each change is made with a RedisJSON array command on just the steps:
+//
+//	JSON.ARRAPPEND todo:1 $.steps <step>           add a step at the end
+//	JSON.ARRINSERT todo:1 $.steps <index> <step>   add a step in the middle
+//	JSON.ARRPOP    todo:1 $.steps <index>          remove a step
+//	JSON.SET       todo:1 $.steps[<index>] <step>  change a step
+//
+// Moving a step is an ARRPOP followed by an ARRINSERT.  A change can also
+// flip the done status of the item, which is one more JSON.SET.  The
+// item is WATCHed while the change is worked out, and the commands are
+// sent together in one MULTI/EXEC transaction, so another client never
+// sees a step half moved or a done status that does not match the steps.
+
+// watchRetries is how many times a change to the steps is retried when
+// another client changes the item while it is being applied
+const watchRetries = 5
+
+var (
+	// ErrItemNotFound is returned when the item does not exist
+	ErrItemNotFound = errors.New("item does not exist")
+	// ErrStepNotFound is returned when the item does not have the step
+	ErrStepNotFound = errors.New("step does not exist")
+	// ErrInvalidStep is returned for a step without a description or a
+	// position that is outside of the list
+	ErrInvalidStep = errors.New("invalid step")
+	// ErrContention is returned when the item kept changing while a
+	// change to its steps was being applied, and it failed after
+	// several tries
+	ErrContention = errors.New("the item kept changing, try again")
+)
+
+// StepCmd is one RedisJSON command that changes the item, the key is
+// added when it is sent
+type StepCmd struct {
+	Name string
+	Args []interface{}
+}
+
+// DeriveDone sets the item done when it has steps and all of them are
+// done, and not done when any of them is not.  An item without steps
+// keeps its own done status.  It returns true if the status changed.
+func (item *ToDoItem) DeriveDone() bool {
+	if len(item.Steps) == 0 {
+		return false
+	}
+	done := true
+	for _, step := range item.Steps {
+		done = done && step.IsDone
+	}
+	changed := item.IsDone != done
+	item.IsDone = done
+	return changed
+}
+
+// stepIndex returns where the step is in the list of steps
+func (item *ToDoItem) stepIndex(stepNum int) (int, error) {
+	for i, step := range item.Steps {
+		if step.StepNum == stepNum {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: item %d has no step %d", ErrStepNotFound, item.Id, stepNum)
+}
+
+// nextStepNum returns a step number that is not used by the item
+func (item *ToDoItem) nextStepNum() int {
+	next := 1
+	for _, step := range item.Steps {
+		if step.StepNum >= next {
+			next = step.StepNum + 1
+		}
+	}
+	return next
+}
+
+// stepJson returns the step as a JSON string for a RedisJSON command
+func stepJson(step ToDoStep) (string, error) {
+	data, err := json.Marshal(step)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// insertCmd returns the command that puts the step at position in a
+// list that has length steps.  ARRINSERT cannot insert past the last
+// step, so adding at the end is an ARRAPPEND.
+func insertCmd(step ToDoStep, position, length int) (StepCmd, error) {
+	data, err := stepJson(step)
+	if err != nil {
+		return StepCmd{}, err
+	}
+	if position == length {
+		return StepCmd{"JSON.ARRAPPEND", []interface{}{"$.steps", data}}, nil
+	}
+	return StepCmd{"JSON.ARRINSERT", []interface{}{"$.steps", position, data}}, nil
+}
+
+// changeSteps applies a change to the steps of an item.  The change
+// updates the item it is given the same way the commands it returns
+// update redis, then the done status is derived from the new steps.
+// Preconditions:   (1) The item must exist in the DB
+//
+// Postconditions:
+//
+//	 (1) The commands and the done status are written in one transaction,
+//			or nothing is written if the change returns an error
+//		(2) The item is returned as it is after the change
+//		(3) ErrContention is returned if the item kept changing
+func (t *ToDo) changeSteps(id int, change func(item *ToDoItem) ([]StepCmd, error)) (ToDoItem, error) {
+	redisKey := redisKeyFromId(id)
+
+	var item ToDoItem
+	for try := 0; try < watchRetries; try++ {
+		err := t.cacheClient.Watch(t.context, func(tx *redis.Tx) error {
+			//Reads made after WATCH are safe, the transaction fails if the
+			//item changes before EXEC
+			item = ToDoItem{}
+			if err := t.getItemFromRedis(redisKey, &item); err != nil {
+				if isRedisNilError(err) {
+					return ErrItemNotFound
+				}
+				return err
+			}
+
+			cmds, err := change(&item)
+			if err != nil {
+				return err
+			}
+			if item.DeriveDone() {
+				//The value is JSON, go-redis would send a bool as 1 or 0
+				cmds = append(cmds, StepCmd{"JSON.SET", []interface{}{"$.done", strconv.FormatBool(item.IsDone)}})
+			}
+
+			_, err = tx.TxPipelined(t.context, func(pipe redis.Pipeliner) error {
+				for _, cmd := range cmds {
+					args := append([]interface{}{cmd.Name, redisKey}, cmd.Args...)
+					pipe.Do(t.context, args...)
+				}
+				return nil
+			})
+			return err
+		}, redisKey)
+
+		//TxFailedErr means the item changed before EXEC, so the change
+		//may have been worked out from an old copy, start over
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return ToDoItem{}, err
+		}
+		return item, nil
+	}
+	return ToDoItem{}, ErrContention
+}
+
+// GetSteps returns the steps of an item, in order
+func (t *ToDo) GetSteps(id int) ([]ToDoStep, error) {
+	var item ToDoItem
+	if err := t.getItemFromRedis(redisKeyFromId(id), &item); err != nil {
+		if isRedisNilError(err) {
+			return nil, ErrItemNotFound
+		}
+		return nil, err
+	}
+	return item.Steps, nil
+}
+
+// AddStep adds a step to an item.  The step gets the next unused step
+// number, any number it was sent with is ignored.  Position is where
+// the step goes in the list, 0 is first, a negative position adds it at
+// the end.
+// Preconditions:   (1) The item must exist in the DB
+//
+//	(2) The step must have a description
+//	(3) The position must not be past the end of the list
+//
+// Postconditions:
+//
+//	 (1) The step is added and the item is returned
+//		(2) Adding a step that is not done to a done item makes it not done
+func (t *ToDo) AddStep(id int, step ToDoStep, position int) (ToDoItem, error) {
+	if step.Description == "" {
+		return ToDoItem{}, fmt.Errorf("%w: a step needs a description", ErrInvalidStep)
+	}
+
+	return t.changeSteps(id, func(item *ToDoItem) ([]StepCmd, error) {
+		return item.AddStep(step, position)
+	})
+}
+
+// AddStep is the change made by ToDo.AddStep.  It changes the item in
+// memory and returns the RedisJSON commands that make the same change
+// in redis.
+func (item *ToDoItem) AddStep(step ToDoStep, position int) ([]StepCmd, error) {
+	length := len(item.Steps)
+	at := position
+	if at < 0 {
+		at = length
+	}
+	if at > length {
+		return nil, fmt.Errorf("%w: position %d is past the end of the %d steps", ErrInvalidStep, at, length)
+	}
+	step.StepNum = item.nextStepNum()
+
+	//An item that does not have steps yet may have no steps array, or
+	//a null one, that ARRAPPEND cannot add to, so the array is set
+	var cmd StepCmd
+	if length == 0 {
+		data, err := json.Marshal([]ToDoStep{step})
+		if err != nil {
+			return nil, err
+		}
+		cmd = StepCmd{"JSON.SET", []interface{}{"$.steps", string(data)}}
+	} else {
+		var err error
+		if cmd, err = insertCmd(step, at, length); err != nil {
+			return nil, err
+		}
+	}
+
+	item.Steps = append(item.Steps[:at], append([]ToDoStep{step}, item.Steps[at:]...)...)
+	return []StepCmd{cmd}, nil
+}
+
+// UpdateStep changes the description and the done status of the step
+// with the same step number, its place in the list does not change
+// Preconditions:   (1) The item must exist in the DB and have the step
+//
+//	(2) The step must have a description
+//
+// Postconditions:
+//
+//	 (1) The step is changed and the item is returned
+//		(2) The done status of the item follows its steps
+func (t *ToDo) UpdateStep(id int, step ToDoStep) (ToDoItem, error) {
+	if step.Description == "" {
+		return ToDoItem{}, fmt.Errorf("%w: a step needs a description", ErrInvalidStep)
+	}
+
+	return t.changeSteps(id, func(item *ToDoItem) ([]StepCmd, error) {
+		return item.UpdateStep(step)
+	})
+}
+
+// UpdateStep is the change made by ToDo.UpdateStep.  It changes the item in
+// memory and returns the RedisJSON commands that make the same change
+// in redis.
+func (item *ToDoItem) UpdateStep(step ToDoStep) ([]StepCmd, error) {
+	i, err := item.stepIndex(step.StepNum)
+	if err != nil {
+		return nil, err
+	}
+	data, err := stepJson(step)
+	if err != nil {
+		return nil, err
+	}
+	item.Steps[i] = step
+	return []StepCmd{{"JSON.SET", []interface{}{fmt.Sprintf("$.steps[%d]", i), data}}}, nil
+}
+
+// CompleteStep marks a step done.  When it is the last step that was
+// not done, the item is marked done as well.
+func (t *ToDo) CompleteStep(id int, stepNum int) (ToDoItem, error) {
+	return t.changeSteps(id, func(item *ToDoItem) ([]StepCmd, error) {
+		return item.CompleteStep(stepNum)
+	})
+}
+
+// CompleteStep is the change made by ToDo.CompleteStep.  It changes the item in
+// memory and returns the RedisJSON commands that make the same change
+// in redis.
+func (item *ToDoItem) CompleteStep(stepNum int) ([]StepCmd, error) {
+	i, err := item.stepIndex(stepNum)
+	if err != nil {
+		return nil, err
+	}
+	item.Steps[i].IsDone = true
+	return []StepCmd{{"JSON.SET", []interface{}{fmt.Sprintf("$.steps[%d].done", i), "true"}}}, nil
+}
+
+// MoveStep moves a step to a new position in the list, 0 is first.  The
+// other steps keep their order.
+// Preconditions:   (1) The item must exist in the DB and have the step
+//
+//	(2) The position must be in the list
+//
+// Postconditions:
+//
+//	 (1) The step is moved with an ARRPOP and an ARRINSERT in one
+//			transaction, and the item is returned
+func (t *ToDo) MoveStep(id int, stepNum int, position int) (ToDoItem, error) {
+	return t.changeSteps(id, func(item *ToDoItem) ([]StepCmd, error) {
+		return item.MoveStep(stepNum, position)
+	})
+}
+
+// MoveStep is the change made by ToDo.MoveStep.  It changes the item in
+// memory and returns the RedisJSON commands that make the same change
+// in redis.
+func (item *ToDoItem) MoveStep(stepNum int, position int) ([]StepCmd, error) {
+	from, err := item.stepIndex(stepNum)
+	if err != nil {
+		return nil, err
+	}
+	if position < 0 || position >= len(item.Steps) {
+		return nil, fmt.Errorf("%w: position %d is not in the %d steps", ErrInvalidStep, position, len(item.Steps))
+	}
+	if position == from {
+		return nil, nil
+	}
+
+	step := item.Steps[from]
+	item.Steps = append(item.Steps[:from], item.Steps[from+1:]...)
+	insert, err := insertCmd(step, position, len(item.Steps))
+	if err != nil {
+		return nil, err
+	}
+	item.Steps = append(item.Steps[:position], append([]ToDoStep{step}, item.Steps[position:]...)...)
+
+	return []StepCmd{
+		{"JSON.ARRPOP", []interface{}{"$.steps", from}},
+		insert,
+	}, nil
+}
+
+// DeleteStep removes a step from an item.  Removing the last step that
+// was not done marks the item done.
+func (t *ToDo) DeleteStep(id int, stepNum int) (ToDoItem, error) {
+	return t.changeSteps(id, func(item *ToDoItem) ([]StepCmd, error) {
+		return item.DeleteStep(stepNum)
+	})
+}
+
+// DeleteStep is the change made by ToDo.DeleteStep.  It changes the item in
+// memory and returns the RedisJSON commands that make the same change
+// in redis.
+func (item *ToDoItem) DeleteStep(stepNum int) ([]StepCmd, error) {
+	i, err := item.stepIndex(stepNum)
+	if err != nil {
+		return nil, err
+	}
+	item.Steps = append(item.Steps[:i], item.Steps[i+1:]...)
+	return []StepCmd{{"JSON.ARRPOP", []interface{}{"$.steps", i}}}, nil
+}
@@ -7,28 +7,44 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/nitishm/go-rejson/v4"
 )
 
-type todoSteps struct {
+// ToDoStep is one of the smaller pieces of work a ToDo item is broken
+// into.  StepNum identifies the step within its item and does not change
+// when the steps are reordered, the order is the order of the list.
+type ToDoStep struct {
 	StepNum     int    `json:"step"`
 	Description string `json:"description"`
+	IsDone      bool   `json:"done"`
 }
 
-// ToDoItem is the struct that represents a single ToDo item
+// ToDoItem is the struct that represents a single ToDo item.  When an
+// item has steps, it is done when all of its steps are done.
 type ToDoItem struct {
-	Id     int         `json:"id"`
-	Title  string      `json:"title"`
-	IsDone bool        `json:"done"`
-	Steps  []todoSteps `json:"steps"`
+	Id     int        `json:"id"`
+	Title  string     `json:"title"`
+	IsDone bool       `json:"done"`
+	Steps  []ToDoStep `json:"steps"`
 }
 
 const (
 	RedisNilError        = "redis: nil"
 	RedisDefaultLocation = "0.0.0.0:6379"
 	RedisKeyPrefix       = "todo:"
+
+	//RedisIdsKey is a redis set holding the id of every item.  Listing
+	//the items walks this set instead of running KEYS, which blocks
+	//redis while it looks at every key in the database
+	RedisIdsKey = RedisKeyPrefix + "ids"
+
+	//redisBatchSize is the COUNT hint given to SCAN and SSCAN, and the
+	//most items fetched with one JSON.MGET
+	redisBatchSize = 100
 )
 
 type cache struct {
@@ -92,14 +108,26 @@ func NewWithCacheInstance(location string) (*ToDo, error) {
 	jsonHelper := rejson.NewReJSONHandler()
 	jsonHelper.SetGoRedisClientWithContext(ctx, client)
 
-	//Return a pointer to a new ToDo struct
-	return &ToDo{
+	todo := &ToDo{
 		cache: cache{
 			cacheClient: client,
 			jsonHelper:  jsonHelper,
 			context:     ctx,
 		},
-	}, nil
+	}
+
+	//Items loaded with redis-cli, for example by an older load script,
+	//may not be in the id set yet, so build it if it is missing
+	if n, err := client.Exists(ctx, RedisIdsKey).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if err := todo.RebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	//Return a pointer to a new ToDo struct
+	return todo, nil
 }
 
 //------------------------------------------------------------
@@ -141,6 +169,123 @@ func (t *ToDo) getItemFromRedis(key string, item *ToDoItem) error {
 	return nil
 }
 
+// Helper that walks the todo:<id> keys with SCAN and calls fn with
+// each batch of keys.  SCAN returns a few keys per call so redis is
+// never blocked for long, unlike KEYS.  Other keys that start with
+// the prefix, like the id set, are skipped.
+func (t *ToDo) scanItemKeys(fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := t.cacheClient.Scan(t.context, cursor, RedisKeyPrefix+"*", redisBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		var itemKeys []string
+		for _, key := range keys {
+			if _, err := strconv.Atoi(strings.TrimPrefix(key, RedisKeyPrefix)); err == nil {
+				itemKeys = append(itemKeys, key)
+			}
+		}
+		if len(itemKeys) > 0 {
+			if err := fn(itemKeys); err != nil {
+				return err
+			}
+		}
+		//A cursor of 0 means the scan is complete
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Helper to return the items for a batch of ids with a single
+// JSON.MGET, rather than a round trip to redis for every item.  Ids
+// whose item is gone are removed from the id set.
+func (t *ToDo) getItemsFromRedis(ids []string) ([]ToDoItem, error) {
+	args := []interface{}{"JSON.MGET"}
+	for _, id := range ids {
+		args = append(args, RedisKeyPrefix+id)
+	}
+	args = append(args, ".")
+	reply, err := t.cacheClient.Do(t.context, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	docs, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.New("unexpected reply from JSON.MGET")
+	}
+
+	var items []ToDoItem
+	var missing []interface{}
+	for i, doc := range docs {
+		//A missing key comes back as nil instead of a string
+		data, ok := doc.(string)
+		if !ok {
+			missing = append(missing, ids[i])
+			continue
+		}
+		var item ToDoItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(missing) > 0 {
+		if err := t.cacheClient.SRem(t.context, RedisIdsKey, missing...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// RebuildIndex adds the id of every todo:<id> key to the id set.  It
+// is run by the constructor when the set does not exist.
+func (t *ToDo) RebuildIndex() error {
+	return t.scanItemKeys(func(keys []string) error {
+		var ids []interface{}
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, RedisKeyPrefix))
+		}
+		return t.cacheClient.SAdd(t.context, RedisIdsKey, ids...).Err()
+	})
+}
+
+// deleteAllScript deletes every item listed in the id set, KEYS[1],
+// and then the set.  ARGV[1] is the key prefix and ARGV[2] how many
+// keys to pass to one DEL, Lua can only unpack so many values at once.
+var deleteAllScript = redis.NewScript(`
+local ids = redis.call('SMEMBERS', KEYS[1])
+local batch = {}
+for _, id in ipairs(ids) do
+	table.insert(batch, ARGV[1] .. id)
+	if #batch >= tonumber(ARGV[2]) then
+		redis.call('DEL', unpack(batch))
+		batch = {}
+	end
+end
+if #batch > 0 then
+	redis.call('DEL', unpack(batch))
+end
+redis.call('DEL', KEYS[1])
+return #ids
+`)
+
+// Helper that writes an item and adds its id to the id set in one
+// MULTI/EXEC transaction, so the set never misses an item
+func (t *ToDo) setItem(redisKey string, item ToDoItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = t.cacheClient.TxPipelined(t.context, func(pipe redis.Pipeliner) error {
+		pipe.Do(t.context, "JSON.SET", redisKey, ".", string(data))
+		return pipe.SAdd(t.context, RedisIdsKey, item.Id).Err()
+	})
+	return err
+}
+
 //------------------------------------------------------------
 // THESE ARE THE PUBLIC FUNCTIONS THAT SUPPORT OUR TODO APP
 //------------------------------------------------------------
@@ -168,8 +313,12 @@ func (t *ToDo) AddItem(item ToDoItem) error {
 		return errors.New("item already exists")
 	}
 
-	//Add item to database with JSON Set
-	if _, err := t.jsonHelper.JSONSet(redisKey, ".", item); err != nil {
+	//The done status of an item with steps comes from its steps
+	item.DeriveDone()
+
+	//Add item to database with JSON Set, along with its id in the
+	//id set
+	if err := t.setItem(redisKey, item); err != nil {
 		return err
 	}
 
@@ -192,12 +341,18 @@ func (t *ToDo) AddItem(item ToDoItem) error {
 //		(3) If there is an error, it will be returned
 func (t *ToDo) DeleteItem(id int) error {
 
+	//The item and its id in the id set are removed together in a
+	//MULTI/EXEC transaction
 	pattern := redisKeyFromId(id)
-	numDeleted, err := t.cacheClient.Del(t.context, pattern).Result()
+	var del *redis.IntCmd
+	_, err := t.cacheClient.TxPipelined(t.context, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(t.context, pattern)
+		return pipe.SRem(t.context, RedisIdsKey, id).Err()
+	})
 	if err != nil {
 		return err
 	}
-	if numDeleted == 0 {
+	if del.Val() == 0 {
 		return errors.New("attempted to delete non-existent item")
 	}
 
@@ -208,21 +363,18 @@ func (t *ToDo) DeleteItem(id int) error {
 // It will be exposed via a DELETE /todo endpoint
 func (t *ToDo) DeleteAll() error {
 
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := t.cacheClient.Keys(t.context, pattern).Result()
-	//Note delete can take a collection of keys.  In go we can
-	//expand a slice into individual arguments by using the ...
-	//operator
-	numDeleted, err := t.cacheClient.Del(t.context, ks...).Result()
-	if err != nil {
+	//Items that were never added to the id set, for example ones
+	//loaded with redis-cli, are found with SCAN and indexed first
+	if err := t.RebuildIndex(); err != nil {
 		return err
 	}
 
-	if numDeleted != int64(len(ks)) {
-		return errors.New("one or more items could not be deleted")
-	}
-
-	return nil
+	//Then a Lua script deletes every item in the id set and the set
+	//itself.  Redis runs a script from start to finish without running
+	//any other command, so no other request sees some of the items
+	//deleted and others not, or adds an item half way through.
+	return deleteAllScript.Run(t.context, t.cacheClient,
+		[]string{RedisIdsKey}, RedisKeyPrefix, redisBatchSize).Err()
 }
 
 // UpdateItem accepts a ToDoItem and updates it in the DB.
@@ -245,12 +397,15 @@ func (t *ToDo) UpdateItem(item ToDoItem) error {
 	redisKey := redisKeyFromId(item.Id)
 	var existingItem ToDoItem
 	if err := t.getItemFromRedis(redisKey, &existingItem); err != nil {
-		return errors.New("item does not exist")
+		return ErrItemNotFound
 	}
 
+	//The done status of an item with steps comes from its steps
+	item.DeriveDone()
+
 	//Add item to database with JSON Set.  Note there is no update
 	//functionality, so we just overwrite the existing item
-	if _, err := t.jsonHelper.JSONSet(redisKey, ".", item); err != nil {
+	if err := t.setItem(redisKey, item); err != nil {
 		return err
 	}
 
@@ -327,17 +482,33 @@ func (t *ToDo) GetAllItems() ([]ToDoItem, error) {
 
 	//Now that we have the DB loaded, lets crate a slice
 	var toDoList []ToDoItem
-	var toDoItem ToDoItem
 
-	//Lets query redis for all of the items
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := t.cacheClient.Keys(t.context, pattern).Result()
-	for _, key := range ks {
-		err := t.getItemFromRedis(key, &toDoItem)
+	//Lets walk the id set a batch at a time with SSCAN and fetch the
+	//items of each batch with one JSON.MGET.  SSCAN can return an id
+	//twice if the set changes while we walk it, so skip repeats.
+	seen := make(map[int]bool)
+	var cursor uint64
+	for {
+		ids, next, err := t.cacheClient.SScan(t.context, RedisIdsKey, cursor, "", redisBatchSize).Result()
 		if err != nil {
 			return nil, err
 		}
-		toDoList = append(toDoList, toDoItem)
+		if len(ids) > 0 {
+			items, err := t.getItemsFromRedis(ids)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				if !seen[item.Id] {
+					seen[item.Id] = true
+					toDoList = append(toDoList, item)
+				}
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
 	}
 
 	return toDoList, nil
@@ -72,6 +72,14 @@ func main() {
 	r.DELETE("/todo/:id", apiHandler.DeleteToDo)
 	r.GET("/todo/:id", apiHandler.GetToDo)
 
+	//The steps of a todo are managed under the todo they belong to
+	r.GET("/todo/:id/steps", apiHandler.ListSteps)
+	r.POST("/todo/:id/steps", apiHandler.AddStep)
+	r.PUT("/todo/:id/steps/:step", apiHandler.UpdateStep)
+	r.DELETE("/todo/:id/steps/:step", apiHandler.DeleteStep)
+	r.POST("/todo/:id/steps/:step/complete", apiHandler.CompleteStep)
+	r.POST("/todo/:id/steps/:step/move", apiHandler.MoveStep)
+
 	r.GET("/crash", apiHandler.CrashSim)
 	r.GET("/health", apiHandler.HealthCheck)
 
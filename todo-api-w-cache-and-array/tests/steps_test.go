@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the changes to the steps of an item without redis,
+// the commands they return and how they change the item
+
+func newStepsItem() *db.ToDoItem {
+	return &db.ToDoItem{Id: 1, Title: "Learn Go", Steps: []db.ToDoStep{
+		{StepNum: 1, Description: "Install Go", IsDone: true},
+		{StepNum: 2, Description: "Tour of Go"},
+		{StepNum: 3, Description: "Write a CLI"},
+	}}
+}
+
+func stepNums(item *db.ToDoItem) []int {
+	nums := []int{}
+	for _, step := range item.Steps {
+		nums = append(nums, step.StepNum)
+	}
+	return nums
+}
+
+func TestDeriveDone(t *testing.T) {
+	item := db.ToDoItem{IsDone: true}
+	assert.False(t, item.DeriveDone(), "An item without steps keeps its status")
+	assert.True(t, item.IsDone)
+
+	item = *newStepsItem()
+	assert.False(t, item.DeriveDone(), "Not every step is done")
+	assert.False(t, item.IsDone)
+
+	item.IsDone = true
+	assert.True(t, item.DeriveDone(), "A done item with a step left is not done")
+	assert.False(t, item.IsDone)
+
+	for i := range item.Steps {
+		item.Steps[i].IsDone = true
+	}
+	assert.True(t, item.DeriveDone())
+	assert.True(t, item.IsDone, "An item is done when all of its steps are")
+}
+
+func TestAddStep(t *testing.T) {
+	item := &db.ToDoItem{Id: 1}
+	cmds, err := item.AddStep(db.ToDoStep{StepNum: 9, Description: "Install Go"}, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []db.StepCmd{{Name: "JSON.SET", Args: []interface{}{"$.steps", `[{"step":1,"description":"Install Go","done":false}]`}}}, cmds,
+		"The first step sets the array, the step number is given by the item")
+
+	item = newStepsItem()
+	cmds, err = item.AddStep(db.ToDoStep{Description: "Read the spec"}, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []db.StepCmd{{Name: "JSON.ARRAPPEND", Args: []interface{}{"$.steps", `{"step":4,"description":"Read the spec","done":false}`}}}, cmds)
+	assert.Equal(t, []int{1, 2, 3, 4}, stepNums(item))
+
+	cmds, err = item.AddStep(db.ToDoStep{Description: "Buy a book"}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []db.StepCmd{{Name: "JSON.ARRINSERT", Args: []interface{}{"$.steps", 1, `{"step":5,"description":"Buy a book","done":false}`}}}, cmds)
+	assert.Equal(t, []int{1, 5, 2, 3, 4}, stepNums(item))
+
+	_, err = item.AddStep(db.ToDoStep{Description: "Too far"}, 9)
+	assert.ErrorIs(t, err, db.ErrInvalidStep)
+}
+
+func TestUpdateAndCompleteStep(t *testing.T) {
+	item := newStepsItem()
+	cmds, err := item.UpdateStep(db.ToDoStep{StepNum: 2, Description: "Tour of Go, again", IsDone: true})
+	require.NoError(t, err)
+	assert.Equal(t, []db.StepCmd{{Name: "JSON.SET", Args: []interface{}{"$.steps[1]", `{"step":2,"description":"Tour of Go, again","done":true}`}}}, cmds)
+
+	cmds, err = item.CompleteStep(3)
+	require.NoError(t, err)
+	assert.Equal(t, []db.StepCmd{{Name: "JSON.SET", Args: []interface{}{"$.steps[2].done", "true"}}}, cmds)
+	assert.True(t, item.DeriveDone(), "Completing the last step marks the item done")
+
+	_, err = item.CompleteStep(7)
+	assert.ErrorIs(t, err, db.ErrStepNotFound)
+	_, err = item.UpdateStep(db.ToDoStep{StepNum: 7, Description: "Missing"})
+	assert.ErrorIs(t, err, db.ErrStepNotFound)
+}
+
+func TestMoveStep(t *testing.T) {
+	item := newStepsItem()
+	cmds, err := item.MoveStep(3, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []db.StepCmd{
+		{Name: "JSON.ARRPOP", Args: []interface{}{"$.steps", 2}},
+		{Name: "JSON.ARRINSERT", Args: []interface{}{"$.steps", 0, `{"step":3,"description":"Write a CLI","done":false}`}},
+	}, cmds)
+	assert.Equal(t, []int{3, 1, 2}, stepNums(item))
+
+	//Moving to the end is an append, ARRINSERT cannot insert past the end
+	cmds, err = item.MoveStep(3, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "JSON.ARRAPPEND", cmds[1].Name)
+	assert.Equal(t, []int{1, 2, 3}, stepNums(item))
+
+	cmds, err = item.MoveStep(2, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, cmds, "A step that does not move needs no commands")
+
+	_, err = item.MoveStep(2, 3)
+	assert.ErrorIs(t, err, db.ErrInvalidStep)
+	_, err = item.MoveStep(7, 0)
+	assert.ErrorIs(t, err, db.ErrStepNotFound)
+}
+
+func TestDeleteStep(t *testing.T) {
+	item := newStepsItem()
+	cmds, err := item.DeleteStep(2)
+	require.NoError(t, err)
+	assert.Equal(t, []db.StepCmd{{Name: "JSON.ARRPOP", Args: []interface{}{"$.steps", 1}}}, cmds)
+	assert.Equal(t, []int{1, 3}, stepNums(item))
+
+	//The step numbers are not reused
+	_, err = item.AddStep(db.ToDoStep{Description: "Another"}, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3, 4}, stepNums(item))
+
+	_, err = item.DeleteStep(2)
+	assert.ErrorIs(t, err, db.ErrStepNotFound)
+}
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
 
+	"drexel.edu/jsonpatch"
 	"drexel.edu/todo/db"
 	"github.com/gin-gonic/gin"
 )
@@ -196,6 +200,101 @@ func (td *ToDoAPI) UpdateToDo(c *gin.Context) {
 	c.JSON(http.StatusOK, todoItem)
 }
 
+// implementation for PATCH /todo/:id
+// changes part of a todo.  The body is either a JSON Merge Patch, sent
+// as application/merge-patch+json, for example {"done": true}, or a
+// JSON Patch, sent as application/json-patch+json, for example
+// [{"op": "replace", "path": "/title", "value": "Learn Lua"}].  A body
+// sent as plain application/json is taken as a JSON Patch if it is an
+// array and a merge patch otherwise.  The patched todo is returned.
+func (td *ToDoAPI) PatchToDo(c *gin.Context) {
+	id64, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		log.Println("Error converting id to int64: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	contentType := c.ContentType()
+	if contentType == "application/json" {
+		contentType = jsonpatch.MergePatchType
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+			contentType = jsonpatch.JSONPatchType
+		}
+	}
+	if contentType != jsonpatch.MergePatchType && contentType != jsonpatch.JSONPatchType {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "use " + jsonpatch.MergePatchType + " or " + jsonpatch.JSONPatchType})
+		return
+	}
+
+	todoItem, err := td.db.PatchItem(int(id64), contentType, body)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, todoItem)
+	case errors.Is(err, db.ErrItemNotFound):
+		c.AbortWithStatus(http.StatusNotFound)
+	case errors.Is(err, jsonpatch.ErrInvalidPatch):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, jsonpatch.ErrPatchFailed):
+		//RFC 5789 suggests 422 for a patch that is fine on its own but
+		//cannot be applied to this document
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrContention):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Println("Error patching item: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
+
+// batchRequest is the body of POST /todo/batch
+type batchRequest struct {
+	Operations []db.BatchOp `json:"operations"`
+}
+
+// implementation for POST /todo/batch
+// applies a list of add, update and delete operations all-or-nothing,
+// for example:
+//
+//	{"operations": [
+//	    {"op": "add", "item": {"id": 5, "title": "Learn Lua"}},
+//	    {"op": "update", "item": {"id": 2, "title": "Learn Redis", "done": true}},
+//	    {"op": "delete", "id": 3}
+//	]}
+//
+// The response has a result for every operation.  If any of them fail
+// nothing is changed, the status is 409 and the failed results have an
+// error saying why.
+func (td *ToDoAPI) BatchToDo(c *gin.Context) {
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	results, err := td.db.ApplyBatch(req.Operations)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"applied": true, "results": results})
+	case errors.Is(err, db.ErrInvalidBatch):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrBatchFailed):
+		c.JSON(http.StatusConflict, gin.H{"applied": false, "results": results})
+	case errors.Is(err, db.ErrContention):
+		c.JSON(http.StatusConflict, gin.H{"applied": false, "error": err.Error()})
+	default:
+		log.Println("Error applying batch: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
+
 // implementation for DELETE /todo/:id
 // deletes a todo
 func (td *ToDoAPI) DeleteToDo(c *gin.Context) {
@@ -1,2 +1,2 @@
 #!/bin/bash
-docker build --tag todo-api-basic:v3  -f ./dockerfile.scratch .
+docker build --tag todo-api-basic:v3  -f ./dockerfile.scratch ..
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A batch is a list of add, update and delete operations that are
+// applied all-or-nothing.  Either every operation succeeds, or none of
+// them change the database.
+//
+// This is done with optimistic locking.  Redis WATCHes the keys of all
+// of the items in the batch, we then check each operation against the
+// current state of the database, and if they all pass the writes are
+// sent in a single MULTI/EXEC transaction.  If another client changes
+// one of the watched keys before EXEC, redis refuses to run the
+// transaction and we try the whole batch again.
+
+// The kinds of batch operations
+const (
+	BatchAdd    = "add"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// MaxBatchSize is the most operations allowed in one batch
+const MaxBatchSize = 100
+
+// watchRetries is how many times a batch or a patch is retried when
+// another client changes one of its items while it is being applied
+const watchRetries = 5
+
+var (
+	// ErrInvalidBatch is returned for a batch that cannot be run at all,
+	// for example one with an unknown operation
+	ErrInvalidBatch = errors.New("invalid batch")
+	// ErrBatchFailed is returned when at least one operation could not
+	// be applied, so none of them were.  The results say which ones.
+	ErrBatchFailed = errors.New("batch was not applied")
+	// ErrContention is returned when the items kept changing while a
+	// batch or a patch was being applied, and it failed after several
+	// tries
+	ErrContention = errors.New("the items kept changing, try again")
+)
+
+// BatchOp is a single operation in a batch.  Add and update take an
+// item, delete takes the id of the item to delete.
+type BatchOp struct {
+	Op   string    `json:"op"`
+	Id   int       `json:"id,omitempty"`
+	Item *ToDoItem `json:"item,omitempty"`
+}
+
+// BatchResult reports what happened to one operation of a batch.  When
+// the batch fails, Error is set on the operations that caused it and
+// Applied is false for all of them.
+type BatchResult struct {
+	Op      string `json:"op"`
+	Id      int    `json:"id"`
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// id returns the id of the item the operation works on
+func (op BatchOp) id() int {
+	if op.Item != nil {
+		return op.Item.Id
+	}
+	return op.Id
+}
+
+// validate checks an operation on its own, before the database is read
+func (op BatchOp) validate() error {
+	switch op.Op {
+	case BatchAdd, BatchUpdate:
+		if op.Item == nil {
+			return fmt.Errorf("%w: %s needs an item", ErrInvalidBatch, op.Op)
+		}
+	case BatchDelete:
+		if op.Item != nil && op.Id != 0 && op.Item.Id != op.Id {
+			return fmt.Errorf("%w: delete has two different ids", ErrInvalidBatch)
+		}
+	default:
+		return fmt.Errorf("%w: unknown op %q, use add, update or delete", ErrInvalidBatch, op.Op)
+	}
+	return nil
+}
+
+// ApplyBatch applies the operations in order, all or nothing.
+// Preconditions:   (1) The operations must be add, update or delete,
+//
+//	(2) There must be between 1 and MaxBatchSize of them
+//
+// Postconditions:
+//
+//	 (1) If every operation can be applied they all are, atomically,
+//		(2) Otherwise nothing is changed and ErrBatchFailed is returned,
+//			the results say which operations failed and why
+//		(3) There is one result per operation, in the same order
+func (t *ToDo) ApplyBatch(ops []BatchOp) ([]BatchResult, error) {
+	if len(ops) == 0 || len(ops) > MaxBatchSize {
+		return nil, fmt.Errorf("%w: a batch has 1 to %d operations", ErrInvalidBatch, MaxBatchSize)
+	}
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+
+	//Every key the batch touches is watched
+	var ids []int
+	var keys []string
+	watched := make(map[int]bool)
+	for _, op := range ops {
+		if id := op.id(); !watched[id] {
+			watched[id] = true
+			ids = append(ids, id)
+			keys = append(keys, redisKeyFromId(id))
+		}
+	}
+
+	var results []BatchResult
+	for try := 0; try < watchRetries; try++ {
+		err := t.cacheClient.Watch(t.context, func(tx *redis.Tx) error {
+			var err error
+			results, err = t.applyBatch(tx, ops, ids)
+			return err
+		}, keys...)
+
+		//TxFailedErr means a watched key changed before EXEC, so the
+		//checks we made may be out of date, start over
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return results, err
+	}
+	return nil, ErrContention
+}
+
+// applyBatch runs inside WATCH.  It checks the operations against the
+// items that exist now, and writes them in a MULTI/EXEC transaction
+// only if they all pass.
+func (t *ToDo) applyBatch(tx *redis.Tx, ops []BatchOp, ids []int) ([]BatchResult, error) {
+	//Find out which of the items exist.  Reads made after WATCH are
+	//safe, the transaction fails if any of these keys change.
+	exists := make(map[int]bool)
+	for _, id := range ids {
+		n, err := tx.Exists(t.context, redisKeyFromId(id)).Result()
+		if err != nil {
+			return nil, err
+		}
+		exists[id] = n == 1
+	}
+
+	//Check the operations in order, an earlier operation in the batch
+	//can make a later one valid, for example add then update
+	results := make([]BatchResult, len(ops))
+	failed := false
+	for i, op := range ops {
+		id := op.id()
+		results[i] = BatchResult{Op: op.Op, Id: id}
+		switch {
+		case op.Op == BatchAdd && exists[id]:
+			results[i].Error = ErrItemExists.Error()
+		case op.Op != BatchAdd && !exists[id]:
+			results[i].Error = ErrItemNotFound.Error()
+		}
+		if results[i].Error != "" {
+			failed = true
+			continue
+		}
+		exists[id] = op.Op != BatchDelete
+	}
+	if failed {
+		return results, ErrBatchFailed
+	}
+
+	//Everything checks out, queue the writes and run them with EXEC
+	_, err := tx.TxPipelined(t.context, func(pipe redis.Pipeliner) error {
+		for _, op := range ops {
+			id := op.id()
+			if op.Op == BatchDelete {
+				pipe.Del(t.context, redisKeyFromId(id))
+				pipe.SRem(t.context, RedisIdsKey, id)
+				continue
+			}
+			data, err := json.Marshal(op.Item)
+			if err != nil {
+				return err
+			}
+			pipe.Do(t.context, "JSON.SET", redisKeyFromId(id), ".", string(data))
+			pipe.SAdd(t.context, RedisIdsKey, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		results[i].Applied = true
+	}
+	return results, nil
+}
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
+	"drexel.edu/jsonpatch"
 	"github.com/go-redis/redis/v8"
 	"github.com/nitishm/go-rejson/v4"
 )
@@ -23,6 +26,22 @@ const (
 	RedisNilError        = "redis: nil"
 	RedisDefaultLocation = "0.0.0.0:6379"
 	RedisKeyPrefix       = "todo:"
+
+	//RedisIdsKey is a redis set holding the id of every item.  Listing
+	//the items walks this set instead of running KEYS, which blocks
+	//redis while it looks at every key in the database
+	RedisIdsKey = RedisKeyPrefix + "ids"
+
+	//redisBatchSize is the COUNT hint given to SCAN and SSCAN, and the
+	//most items fetched with one JSON.MGET
+	redisBatchSize = 100
+)
+
+// Errors returned by the ToDo functions, callers can check for them
+// with errors.Is
+var (
+	ErrItemExists   = errors.New("item already exists")
+	ErrItemNotFound = errors.New("item does not exist")
 )
 
 type cache struct {
@@ -86,14 +105,26 @@ func NewWithCacheInstance(location string) (*ToDo, error) {
 	jsonHelper := rejson.NewReJSONHandler()
 	jsonHelper.SetGoRedisClientWithContext(ctx, client)
 
-	//Return a pointer to a new ToDo struct
-	return &ToDo{
+	todo := &ToDo{
 		cache: cache{
 			cacheClient: client,
 			jsonHelper:  jsonHelper,
 			context:     ctx,
 		},
-	}, nil
+	}
+
+	//Items loaded with redis-cli, for example by an older load script,
+	//may not be in the id set yet, so build it if it is missing
+	if n, err := client.Exists(ctx, RedisIdsKey).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if err := todo.RebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	//Return a pointer to a new ToDo struct
+	return todo, nil
 }
 
 //------------------------------------------------------------
@@ -135,6 +166,139 @@ func (t *ToDo) getItemFromRedis(key string, item *ToDoItem) error {
 	return nil
 }
 
+// Helper that walks the todo:<id> keys with SCAN and calls fn with
+// each batch of keys.  SCAN returns a few keys per call so redis is
+// never blocked for long, unlike KEYS.  Other keys that start with
+// the prefix, like the id set, are skipped.
+func (t *ToDo) scanItemKeys(fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := t.cacheClient.Scan(t.context, cursor, RedisKeyPrefix+"*", redisBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		var itemKeys []string
+		for _, key := range keys {
+			if _, err := strconv.Atoi(strings.TrimPrefix(key, RedisKeyPrefix)); err == nil {
+				itemKeys = append(itemKeys, key)
+			}
+		}
+		if len(itemKeys) > 0 {
+			if err := fn(itemKeys); err != nil {
+				return err
+			}
+		}
+		//A cursor of 0 means the scan is complete
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Helper to return the items for a batch of ids with a single
+// JSON.MGET, rather than a round trip to redis for every item.  Ids
+// whose item is gone are removed from the id set.
+func (t *ToDo) getItemsFromRedis(ids []string) ([]ToDoItem, error) {
+	args := []interface{}{"JSON.MGET"}
+	for _, id := range ids {
+		args = append(args, RedisKeyPrefix+id)
+	}
+	args = append(args, ".")
+	reply, err := t.cacheClient.Do(t.context, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	docs, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.New("unexpected reply from JSON.MGET")
+	}
+
+	var items []ToDoItem
+	var missing []interface{}
+	for i, doc := range docs {
+		//A missing key comes back as nil instead of a string
+		data, ok := doc.(string)
+		if !ok {
+			missing = append(missing, ids[i])
+			continue
+		}
+		var item ToDoItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(missing) > 0 {
+		if err := t.cacheClient.SRem(t.context, RedisIdsKey, missing...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// RebuildIndex adds the id of every todo:<id> key to the id set.  It
+// is run by the constructor when the set does not exist.
+func (t *ToDo) RebuildIndex() error {
+	return t.scanItemKeys(func(keys []string) error {
+		var ids []interface{}
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, RedisKeyPrefix))
+		}
+		return t.cacheClient.SAdd(t.context, RedisIdsKey, ids...).Err()
+	})
+}
+
+// Helper that writes an item with JSON.SET and adds its id to the id
+// set.  The condition is NX, only write a new key, or XX, only
+// overwrite an existing key.  It returns false if redis did not write
+// the item because of the condition.
+func (t *ToDo) setItem(item ToDoItem, condition string) (bool, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return false, err
+	}
+
+	set, err := setItemScript.Run(t.context, t.cacheClient,
+		[]string{redisKeyFromId(item.Id), RedisIdsKey},
+		string(data), condition, item.Id).Int()
+	if err != nil {
+		return false, err
+	}
+	return set == 1, nil
+}
+
+// setItemScript runs JSON.SET on KEYS[1] with the value ARGV[1] and the
+// condition ARGV[2], and only if that wrote the item adds the id ARGV[3]
+// to the id set KEYS[2].  A nil reply from redis becomes false in Lua.
+var setItemScript = redis.NewScript(`
+if not redis.call('JSON.SET', KEYS[1], '.', ARGV[1], ARGV[2]) then
+	return 0
+end
+redis.call('SADD', KEYS[2], ARGV[3])
+return 1
+`)
+
+// deleteAllScript deletes every item listed in the id set, KEYS[1],
+// and then the set.  ARGV[1] is the key prefix and ARGV[2] how many
+// keys to pass to one DEL, Lua can only unpack so many values at once.
+var deleteAllScript = redis.NewScript(`
+local ids = redis.call('SMEMBERS', KEYS[1])
+local batch = {}
+for _, id in ipairs(ids) do
+	table.insert(batch, ARGV[1] .. id)
+	if #batch >= tonumber(ARGV[2]) then
+		redis.call('DEL', unpack(batch))
+		batch = {}
+	end
+end
+if #batch > 0 then
+	redis.call('DEL', unpack(batch))
+end
+redis.call('DEL', KEYS[1])
+return #ids
+`)
+
 //------------------------------------------------------------
 // THESE ARE THE PUBLIC FUNCTIONS THAT SUPPORT OUR TODO APP
 //------------------------------------------------------------
@@ -154,18 +318,19 @@ func (t *ToDo) getItemFromRedis(key string, item *ToDoItem) error {
 //		(3) If there is an error, it will be returned
 func (t *ToDo) AddItem(item ToDoItem) error {
 
-	//Before we add an item to the DB, lets make sure
-	//it does not exist, if it does, return an error
-	redisKey := redisKeyFromId(item.Id)
-	var existingItem ToDoItem
-	if err := t.getItemFromRedis(redisKey, &existingItem); err == nil {
-		return errors.New("item already exists")
-	}
-
-	//Add item to database with JSON Set
-	if _, err := t.jsonHelper.JSONSet(redisKey, ".", item); err != nil {
+	//Checking that the item does not exist and then adding it is
+	//a race, two requests can both pass the check before either of
+	//them writes.  Instead the NX option of JSON.SET only sets the key
+	//if it does not exist yet, so the check and the write are a single
+	//redis command.  Both run in a Lua script that also adds the id to
+	//the id set, see setItem.
+	set, err := t.setItem(item, "NX")
+	if err != nil {
 		return err
 	}
+	if !set {
+		return ErrItemExists
+	}
 
 	//If everything is ok, return nil for the error
 	return nil
@@ -186,13 +351,19 @@ func (t *ToDo) AddItem(item ToDoItem) error {
 //		(3) If there is an error, it will be returned
 func (t *ToDo) DeleteItem(id int) error {
 
+	//The item and its id in the id set are removed together in a
+	//MULTI/EXEC transaction
 	pattern := redisKeyFromId(id)
-	numDeleted, err := t.cacheClient.Del(t.context, pattern).Result()
+	var del *redis.IntCmd
+	_, err := t.cacheClient.TxPipelined(t.context, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(t.context, pattern)
+		return pipe.SRem(t.context, RedisIdsKey, id).Err()
+	})
 	if err != nil {
 		return err
 	}
-	if numDeleted == 0 {
-		return errors.New("attempted to delete non-existent item")
+	if del.Val() == 0 {
+		return ErrItemNotFound
 	}
 
 	return nil
@@ -202,21 +373,18 @@ func (t *ToDo) DeleteItem(id int) error {
 // It will be exposed via a DELETE /todo endpoint
 func (t *ToDo) DeleteAll() error {
 
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := t.cacheClient.Keys(t.context, pattern).Result()
-	//Note delete can take a collection of keys.  In go we can
-	//expand a slice into individual arguments by using the ...
-	//operator
-	numDeleted, err := t.cacheClient.Del(t.context, ks...).Result()
-	if err != nil {
+	//Items that were never added to the id set, for example ones
+	//loaded with redis-cli, are found with SCAN and indexed first
+	if err := t.RebuildIndex(); err != nil {
 		return err
 	}
 
-	if numDeleted != int64(len(ks)) {
-		return errors.New("one or more items could not be deleted")
-	}
-
-	return nil
+	//Then a Lua script deletes every item in the id set and the set
+	//itself.  Redis runs a script from start to finish without running
+	//any other command, so no other request sees some of the items
+	//deleted and others not, or adds an item half way through.
+	return deleteAllScript.Run(t.context, t.cacheClient,
+		[]string{RedisIdsKey}, RedisKeyPrefix, redisBatchSize).Err()
 }
 
 // UpdateItem accepts a ToDoItem and updates it in the DB.
@@ -234,19 +402,17 @@ func (t *ToDo) DeleteAll() error {
 //		(3) If there is an error, it will be returned
 func (t *ToDo) UpdateItem(item ToDoItem) error {
 
-	//Before we add an item to the DB, lets make sure
-	//it does not exist, if it does, return an error
-	redisKey := redisKeyFromId(item.Id)
-	var existingItem ToDoItem
-	if err := t.getItemFromRedis(redisKey, &existingItem); err != nil {
-		return errors.New("item does not exist")
-	}
-
-	//Add item to database with JSON Set.  Note there is no update
-	//functionality, so we just overwrite the existing item
-	if _, err := t.jsonHelper.JSONSet(redisKey, ".", item); err != nil {
+	//This is the opposite of AddItem, the XX option of JSON.SET only
+	//overwrites a key that already exists, so an item deleted by
+	//another request between a check and the write is not brought
+	//back to life
+	set, err := t.setItem(item, "XX")
+	if err != nil {
 		return err
 	}
+	if !set {
+		return ErrItemNotFound
+	}
 
 	//If everything is ok, return nil for the error
 	return nil
@@ -297,14 +463,87 @@ func (t *ToDo) GetItem(id int) (ToDoItem, error) {
 //
 //	 (1) The items status in the database will be updated
 //		(2) If there is an error, it will be returned.
-//		(3) This function MUST use existing functionality for most of its
-//			work.  For example, it should call GetItem() to get the item
-//			from the DB, then it should call UpdateItem() to update the
-//			item in the DB (after the status is changed).
+//		(3) Only the done field is written, with a RedisJSON path
+//			update, the rest of the item is not read or rewritten
 func (t *ToDo) ChangeItemDoneStatus(id int, value bool) error {
 
+	//JSON.SET can set a single path inside a document.  The XX option
+	//makes it fail, with a nil reply, if the key does not exist rather
+	//than create a document that only has a done field.
+	err := t.cacheClient.Do(t.context, "JSON.SET", redisKeyFromId(id), "$.done", strconv.FormatBool(value), "XX").Err()
+	if err != nil {
+		if isRedisNilError(err) {
+			return ErrItemNotFound
+		}
+		return err
+	}
+
 	//update was successful
-	return errors.New("not implemented")
+	return nil
+}
+
+// PatchItem applies a partial update to an item and returns the item
+// as it is after the patch.  The patch is either a JSON Merge Patch or
+// a JSON Patch, named by its content type, see the jsonpatch module.
+// Preconditions:   (1) The item must exist in the DB
+//
+//	(2) The patch must not change the id of the item
+//
+// Postconditions:
+//
+//	 (1) Only the paths the patch touches are written
+//		(2) Either the whole patch is applied or none of it is
+//		(3) If there is an error, it will be returned
+func (t *ToDo) PatchItem(id int, contentType string, patch []byte) (ToDoItem, error) {
+	key := redisKeyFromId(id)
+	var patched ToDoItem
+
+	//The document is read while the key is WATCHed, if anyone changes
+	//it before EXEC the transaction fails and the patch is tried again
+	for try := 0; try < watchRetries; try++ {
+		err := t.cacheClient.Watch(t.context, func(tx *redis.Tx) error {
+			//Tx has no Do, so the command is built and run by hand
+			get := redis.NewCmd(t.context, "JSON.GET", key, ".")
+			_ = tx.Process(t.context, get)
+			data, err := get.Text()
+			if err != nil {
+				if isRedisNilError(err) {
+					return ErrItemNotFound
+				}
+				return err
+			}
+			var doc interface{}
+			if err := json.Unmarshal([]byte(data), &doc); err != nil {
+				return err
+			}
+
+			newDoc, cmds, err := jsonpatch.Apply(doc, contentType, patch)
+			if err != nil {
+				return err
+			}
+			patched = ToDoItem{}
+			if err := jsonpatch.Decode(newDoc, &patched); err != nil {
+				return err
+			}
+			if patched.Id != id {
+				return fmt.Errorf("%w: the id of an item cannot be changed", jsonpatch.ErrPatchFailed)
+			}
+
+			_, err = tx.TxPipelined(t.context, func(pipe redis.Pipeliner) error {
+				for _, cmd := range cmds {
+					pipe.Do(t.context, cmd.ForKey(key)...)
+				}
+				return nil
+			})
+			return err
+		}, key)
+
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return patched, err
+	}
+	return ToDoItem{}, ErrContention
 }
 
 // GetAllItems returns all items from the DB.  If successful it
@@ -321,17 +560,33 @@ func (t *ToDo) GetAllItems() ([]ToDoItem, error) {
 
 	//Now that we have the DB loaded, lets crate a slice
 	var toDoList []ToDoItem
-	var toDoItem ToDoItem
 
-	//Lets query redis for all of the items
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := t.cacheClient.Keys(t.context, pattern).Result()
-	for _, key := range ks {
-		err := t.getItemFromRedis(key, &toDoItem)
+	//Lets walk the id set a batch at a time with SSCAN and fetch the
+	//items of each batch with one JSON.MGET.  SSCAN can return an id
+	//twice if the set changes while we walk it, so skip repeats.
+	seen := make(map[int]bool)
+	var cursor uint64
+	for {
+		ids, next, err := t.cacheClient.SScan(t.context, RedisIdsKey, cursor, "", redisBatchSize).Result()
 		if err != nil {
 			return nil, err
 		}
-		toDoList = append(toDoList, toDoItem)
+		if len(ids) > 0 {
+			items, err := t.getItemsFromRedis(ids)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				if !seen[item.Id] {
+					seen[item.Id] = true
+					toDoList = append(toDoList, item)
+				}
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
 	}
 
 	return toDoList, nil
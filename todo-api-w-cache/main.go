@@ -68,9 +68,11 @@ func main() {
 	r.GET("/todo", apiHandler.ListAllTodos)
 	r.POST("/todo", apiHandler.AddToDo)
 	r.PUT("/todo", apiHandler.UpdateToDo)
+	r.POST("/todo/batch", apiHandler.BatchToDo)
 	r.DELETE("/todo", apiHandler.DeleteAllToDo)
 	r.DELETE("/todo/:id", apiHandler.DeleteToDo)
 	r.GET("/todo/:id", apiHandler.GetToDo)
+	r.PATCH("/todo/:id", apiHandler.PatchToDo)
 
 	r.GET("/crash", apiHandler.CrashSim)
 	r.GET("/health", apiHandler.HealthCheck)
@@ -0,0 +1,41 @@
+package tests
+
+import (
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// These tests cover the checks made on a batch before redis is used, so
+// the ToDo does not need a connection
+
+func TestApplyBatchRejectsBadBatches(t *testing.T) {
+	todo := &db.ToDo{}
+	_, err := todo.ApplyBatch(nil)
+	assert.ErrorIs(t, err, db.ErrInvalidBatch, "An empty batch")
+
+	ops := make([]db.BatchOp, db.MaxBatchSize+1)
+	for i := range ops {
+		ops[i] = db.BatchOp{Op: db.BatchDelete, Id: i + 1}
+	}
+	_, err = todo.ApplyBatch(ops)
+	assert.ErrorIs(t, err, db.ErrInvalidBatch, "A batch that is too big")
+}
+
+func TestApplyBatchRejectsBadOperations(t *testing.T) {
+	todo := &db.ToDo{}
+	item := &db.ToDoItem{Id: 1, Title: "Learn Go"}
+	bad := map[string]db.BatchOp{
+		"add needs an item":    {Op: db.BatchAdd},
+		"update needs an item": {Op: db.BatchUpdate, Id: 1},
+		"delete with two ids":  {Op: db.BatchDelete, Id: 2, Item: item},
+		"unknown op":           {Op: "upsert", Item: item},
+	}
+	for name, op := range bad {
+		//The good operation in front shows the error names the bad one
+		_, err := todo.ApplyBatch([]db.BatchOp{{Op: db.BatchDelete, Id: 1, Item: item}, op})
+		assert.ErrorIs(t, err, db.ErrInvalidBatch, name)
+		assert.Contains(t, err.Error(), "operation 1", name)
+	}
+}
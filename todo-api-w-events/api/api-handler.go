@@ -1,55 +1,219 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
-	"drexel.edu/todo-events/db"
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/webhooks"
 	"drexel.edu/todo-events/events"
+	"drexel.edu/todo-events/live"
+	"drexel.edu/todo/db"
+	"drexel.edu/todo/schedule"
 	"github.com/gin-gonic/gin"
 )
 
 // The api package creates and maintains a reference to the data handler
 // this is a good design practice
+//
+// Like on the base API every change goes through an AuditedStore, so the
+// audit history of an item has the changes made through either API.
 type ToDoAPI struct {
-	db           *db.ToDo
+	db           *db.AuditedStore
 	eventHandler *events.ToDoEventManager
 }
 
-func New() (*ToDoAPI, error) {
+// ActorHeader names who is making a request, it is recorded with each
+// change in the audit history
+const ActorHeader = "X-Actor"
 
-	dbHandler, err := db.New()
+// SchedulerActor is who the audit history says added the next item of a
+// recurring series
+const SchedulerActor = "scheduler"
+
+// New returns an API handler that keeps its todos in the backend named
+// in the config, and their audit history next to them
+func New(cfg db.Config) (*ToDoAPI, error) {
+
+	dbHandler, err := db.NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := db.NewAuditLog(cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	return NewWithAuditLog(dbHandler, auditLog), nil
+}
+
+// NewWithStore returns an API handler that uses an existing storage
+// backend, tests use it to provide their own store.  The audit history
+// is kept in memory.
+func NewWithStore(store db.Store) *ToDoAPI {
+	return NewWithAuditLog(store, db.NewMemoryAuditLog())
+}
+
+// NewWithAuditLog returns an API handler that uses an existing storage
+// backend and audit log
+func NewWithAuditLog(store db.Store, auditLog db.AuditLog) *ToDoAPI {
 	//By default we will not be doing eventing
 	return &ToDoAPI{
-		db:           dbHandler,
+		db:           db.NewAuditedStore(store, auditLog),
 		eventHandler: nil,
-	}, nil
+	}
+}
+
+// storeFor returns the store to make the changes of a request with, so
+// they are recorded as made by whoever sent it.  That is the caller the
+// auth middleware found, then the X-Actor header, or the client address
+// when there is neither.
+func (td *ToDoAPI) storeFor(c *gin.Context) *db.AuditedStore {
+	var actor string
+	if principal, ok := auth.PrincipalFrom(c); ok {
+		actor = principal.Subject
+	}
+	if actor == "" {
+		actor = c.GetHeader(ActorHeader)
+	}
+	if actor == "" {
+		actor = c.ClientIP()
+	}
+	return td.db.As(actor)
 }
 
+// AddEventListener creates an event manager that logs every event and
+// starts it
 func (td *ToDoAPI) AddEventListener() {
 	td.eventHandler = events.NewToDoEventManager()
+	td.eventHandler.SubscribeAll(events.LogEvent)
 	td.eventHandler.Start()
 }
 
+// ConnectEventListener uses an event manager made somewhere else, with
+// its own options and subscribers
 func (td *ToDoAPI) ConnectEventListener(eventManager *events.ToDoEventManager) {
 	td.eventHandler = eventManager
 }
 
-func (td *ToDoAPI) StopEventListener() {
-	td.eventHandler.Stop()
+// PublishToStream also writes the add, update and delete events to a
+// redis stream, so other services can read them.  The event listener
+// must be added first.
+func (td *ToDoAPI) PublishToStream(stream *events.Stream) error {
+	if td.eventHandler == nil {
+		return errors.New("add an event listener before publishing to a stream")
+	}
+	stream.PublishTo(td.eventHandler)
+	return nil
+}
+
+// WebhookEventTypes are the event types a webhook can ask for
+var WebhookEventTypes = []string{"todo.add", "todo.update", "todo.delete", "todo.reminder"}
+
+// AddWebhooks sends the add, update, delete and reminder events to the
+// webhooks registered with the manager.  The event listener must be added first.
+func (td *ToDoAPI) AddWebhooks(hooks *webhooks.Manager) error {
+	if td.eventHandler == nil {
+		return errors.New("add an event listener before adding webhooks")
+	}
+	dispatch := func(event *events.ToDoEvent) error {
+		return hooks.Dispatch(webhooks.Event{
+			Id:        event.Id,
+			Type:      "todo." + event.EventID.String(),
+			Timestamp: event.Timestamp,
+			Data:      event.Payload,
+		})
+	}
+	td.eventHandler.Subscribe(events.ToDoAddEvent, dispatch)
+	td.eventHandler.Subscribe(events.ToDoUpdateEvent, dispatch)
+	td.eventHandler.Subscribe(events.ToDoDeleteEvent, dispatch)
+	td.eventHandler.Subscribe(events.ToDoReminderEvent, dispatch)
+	return nil
+}
+
+// AddLiveUpdates pushes the add, update and delete events to the
+// clients connected to the hub.  The event listener must be added first.
+func (td *ToDoAPI) AddLiveUpdates(hub *live.Hub) error {
+	if td.eventHandler == nil {
+		return errors.New("add an event listener before adding live updates")
+	}
+	hub.PublishTo(td.eventHandler)
+	return nil
+}
+
+// AddScheduler returns a scheduler for the recurring items and the
+// reminders, keeping its state in states.  The next item of a series is
+// sent as an add event, and an overdue item as a reminder event.  A
+// reminder that cannot be queued, for example while eventing is turned
+// off, is tried again on the next run.  The event listener must be added
+// first, and the caller starts and stops the scheduler.
+func (td *ToDoAPI) AddScheduler(states db.StateStore, options schedule.Options) (*schedule.Scheduler, error) {
+	if td.eventHandler == nil {
+		return nil, errors.New("add an event listener before adding the scheduler")
+	}
+	options.OnReminder = func(reminder schedule.Reminder) error {
+		return td.eventHandler.Notify(events.NewEvent(events.ReminderPayload{
+			Item:      reminder.Item,
+			DueDate:   reminder.DueDate,
+			OverdueBy: reminder.OverdueBy.Round(time.Second).String(),
+		}))
+	}
+	options.OnRecur = func(previous, next db.ToDoItem) {
+		td.Notify(events.NewEvent(events.AddPayload{Item: next}))
+	}
+	return schedule.New(td.db.As(SchedulerActor), states, options)
+}
+
+// StopEventListener stops taking events and waits until the queued ones
+// are delivered, or until the context is done
+func (td *ToDoAPI) StopEventListener(ctx context.Context) error {
+	if td.eventHandler == nil {
+		return nil
+	}
+	return td.eventHandler.Shutdown(ctx)
 }
 
+// Notify sends an event if eventing is set up.  It never fails the
+// request, an event that cannot be queued is only logged.
 func (td *ToDoAPI) Notify(event *events.ToDoEvent) {
 	if td.eventHandler == nil {
-		td.eventHandler.Notify(event)
+		return
+	}
+	err := td.eventHandler.Notify(event)
+	if err != nil && !errors.Is(err, events.ErrNotActive) {
+		log.Printf("Error sending %s event %s: %v", event.EventID, event.Id, err)
 	}
 }
 
+// statusFor picks the HTTP status for an error from the database
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidItem) || errors.Is(err, db.ErrInvalidQuery):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrItemNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrItemExists):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrVersionConflict):
+		return http.StatusPreconditionFailed
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// notifyError sends an error event for a request that failed
+func (td *ToDoAPI) notifyError(operation string, err error) {
+	td.Notify(events.NewEvent(events.ErrorPayload{Operation: operation, Error: err.Error()}))
+}
+
 //Below we implement the API functions.  Some of the framework
 //things you will see include:
 //   1) How to extract a parameter from the URL, for example
@@ -62,8 +226,13 @@ func (td *ToDoAPI) Notify(event *events.ToDoEvent) {
 //	  done using the c.AbortWithStatus() function
 
 // implementation for GET /todo
-// returns all todos
+// returns all todos.  With query parameters it is the same as GET
+// /v2/todo and returns the todos that match.
 func (td *ToDoAPI) ListAllTodos(c *gin.Context) {
+	if c.Request.URL.RawQuery != "" {
+		td.ListSelectTodos(c)
+		return
+	}
 
 	todoList, err := td.db.GetAllItems()
 	if err != nil {
@@ -79,71 +248,136 @@ func (td *ToDoAPI) ListAllTodos(c *gin.Context) {
 		todoList = make([]db.ToDoItem, 0)
 	}
 
-	evnt := events.NewEvent(events.ToDoQueryEvent, "todoList", todoList)
-	td.eventHandler.Notify(evnt)
+	td.Notify(events.NewEvent(events.QueryPayload{Items: todoList}))
 
 	c.JSON(http.StatusOK, todoList)
 }
 
 // implementation for GET /v2/todo
-// returns todos that are either done or not done
-// depending on the value of the done query parameter
-// for example, /v2/todo?done=true will return all
-// todos that are done.  Note you can have multiple
-// query parameters, for example /v2/todo?done=true&foo=bar
+// returns the todos that match a query, with the same query parameters
+// as the base API, so the two front ends of a store answer a query the
+// same way.  All of them are optional and can be combined, for example
+// /v2/todo?done=false&title=go&sort=-priority,dueDate&limit=10
+//
+//	done=true|false        only done or not done items
+//	title=<text>           title contains the text, ignoring case
+//	title_prefix=<text>    title starts with the text, ignoring case
+//	priority=<priority>    only items with this priority
+//	tag=<tag>              only items with this tag
+//	sort=<field>,-<field>  sort order, - for descending, default id
+//	limit=<n>              at most n items
+//	offset=<n>             skip the first n items
+//	cursor=<cursor>        the page after the cursor from a Link header
+//
+// The number of items that matched across all pages is in the
+// X-Total-Count header and the next, previous and first pages are in the
+// Link header.
 func (td *ToDoAPI) ListSelectTodos(c *gin.Context) {
-	//lets first load the data
-	todoList, err := td.db.GetAllItems()
+	query, err := queryFromRequest(c)
 	if err != nil {
-		log.Println("Error Getting Database Items: ", err)
-		c.AbortWithStatus(http.StatusNotFound)
+		log.Println("Error in query: ", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	//If the database is empty, make an empty slice so that the
-	//JSON marshalling works correctly
-	if todoList == nil {
-		todoList = make([]db.ToDoItem, 0)
+
+	//The db package pushes the filters down to the backend when it
+	//can, for example to RediSearch, instead of loading every item
+	result, err := db.QueryItems(td.db, query)
+	if err != nil {
+		log.Println("Error querying items: ", err)
+		c.AbortWithStatus(statusFor(err))
+		return
 	}
 
-	//Note that the query parameter is a string, so we
-	//need to convert it to a bool
-	doneS := c.Query("done")
+	c.Header("X-Total-Count", strconv.Itoa(result.Total))
+	if links := pageLinks(c.Request.URL, query, result); links != "" {
+		c.Header("Link", links)
+	}
 
-	//if the doneS is empty, then we will return all items
-	if doneS == "" {
-		c.JSON(http.StatusOK, todoList)
-		return
+	//If nothing matched, make an empty slice so that the JSON
+	//marshalling returns [] instead of null
+	if result.Items == nil {
+		result.Items = make([]db.ToDoItem, 0)
 	}
 
-	//Now we can handle the case where doneS is not empty
-	//and we need to filter the list based on the doneS value
+	td.Notify(events.NewEvent(events.QueryPayload{Items: result.Items}))
+	c.JSON(http.StatusOK, result.Items)
+}
 
-	done, err := strconv.ParseBool(doneS)
-	if err != nil {
-		log.Println("Error converting done to bool: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+// queryFromRequest reads the query parameters of GET /v2/todo
+func queryFromRequest(c *gin.Context) (db.Query, error) {
+	query := db.Query{
+		TitleSearch: c.Query("title"),
+		TitlePrefix: c.Query("title_prefix"),
+		Priority:    db.Priority(c.Query("priority")),
+		Tag:         c.Query("tag"),
+		Cursor:      c.Query("cursor"),
 	}
 
-	//Now we need to filter the list based on the done value
-	//that was passed in.  We will create a new slice and
-	//only add items that match the done value
-	var filteredList []db.ToDoItem
-	for _, item := range todoList {
-		if item.IsDone == done {
-			filteredList = append(filteredList, item)
+	//Note that the query parameters are strings, so we
+	//need to convert them to the right types
+	if doneS := c.Query("done"); doneS != "" {
+		done, err := strconv.ParseBool(doneS)
+		if err != nil {
+			return query, fmt.Errorf("done must be true or false, got %q", doneS)
 		}
+		query.Done = &done
 	}
+	for name, value := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		if s := c.Query(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return query, fmt.Errorf("%s must be a number that is 0 or more, got %q", name, s)
+			}
+			*value = n
+		}
+	}
+	sortKeys, err := db.ParseSort(c.Query("sort"))
+	if err != nil {
+		return query, err
+	}
+	query.Sort = sortKeys
+	return query, query.Validate()
+}
 
-	//Note that the database returns a nil slice if there are no items
-	//in the database.  We need to convert this to an empty slice
-	//so that the JSON marshalling works correctly.  We want to return
-	//an empty slice, not a nil slice. This will result in the json being []
-	if filteredList == nil {
-		filteredList = make([]db.ToDoItem, 0)
+// pageLinks builds an RFC 8288 Link header for the pages around this
+// one.  Clients that sent an offset get offset links, everyone else gets
+// a cursor link to the next page, which does not skip or repeat items
+// when the list changes between requests.
+func pageLinks(u *url.URL, query db.Query, result db.QueryResult) string {
+	if query.Limit == 0 {
+		return ""
+	}
+	link := func(rel string, set map[string]string) string {
+		params := u.Query()
+		for _, name := range []string{"offset", "cursor"} {
+			params.Del(name)
+		}
+		for name, value := range set {
+			params.Set(name, value)
+		}
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, params.Encode(), rel)
 	}
 
-	c.JSON(http.StatusOK, filteredList)
+	var links []string
+	usesOffset := u.Query().Has("offset")
+	if !usesOffset && result.NextCursor != "" {
+		links = append(links, link("next", map[string]string{"cursor": result.NextCursor}))
+	}
+	if next := query.Offset + query.Limit; usesOffset && next < result.Total {
+		links = append(links, link("next", map[string]string{"offset": strconv.Itoa(next)}))
+	}
+	if query.Offset > 0 {
+		prev := query.Offset - query.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link("prev", map[string]string{"offset": strconv.Itoa(prev)}))
+	}
+	if query.Offset > 0 || query.Cursor != "" {
+		links = append(links, link("first", nil))
+	}
+	return strings.Join(links, ", ")
 }
 
 // implementation for GET /todo/:id
@@ -170,8 +404,12 @@ func (td *ToDoAPI) GetToDo(c *gin.Context) {
 		return
 	}
 
-	evnt := events.NewEvent(events.ToDoQueryEvent, "todoItem", todoItem)
-	td.eventHandler.Notify(evnt)
+	td.Notify(events.NewEvent(events.QueryPayload{Items: []db.ToDoItem{todoItem}}))
+
+	//The ETag lets a client send the item back with If-Match, so a
+	//PUT fails instead of overwriting a change made by someone else
+	c.Header("ETag", etagFor(todoItem))
+
 	//Git will automatically convert the struct to JSON
 	//and set the content-type header to application/json
 	c.JSON(http.StatusOK, todoItem)
@@ -199,19 +437,37 @@ func (td *ToDoAPI) AddToDo(c *gin.Context) {
 		return
 	}
 
-	if err := td.db.AddItem(todoItem); err != nil {
+	//Clients do not have to invent ids, an item posted without one
+	//gets the next id from the database, like on the base API
+	store := td.storeFor(c)
+	if todoItem.Id == 0 {
+		created, err := store.CreateItem(todoItem)
+		if err != nil {
+			log.Println("Error creating item: ", err)
+			td.notifyError("add", err)
+			c.AbortWithStatus(statusFor(err))
+			return
+		}
+		todoItem = created
+	} else if err := store.AddItem(todoItem); err != nil {
 		log.Println("Error adding item: ", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		td.notifyError("add", err)
+		c.AbortWithStatus(statusFor(err))
 		return
 	}
-	evnt := events.NewEvent(events.ToDoAddEvent, "todoItem", todoItem)
-	td.eventHandler.Notify(evnt)
 
-	c.JSON(http.StatusOK, todoItem)
+	//The database sets the timestamps, send back what it stored
+	c.Header("Location", path.Join(c.Request.URL.Path, strconv.Itoa(todoItem.Id)))
+	if stored, ok := td.respondWithItem(c, http.StatusCreated, todoItem.Id); ok {
+		td.Notify(events.NewEvent(events.AddPayload{Item: stored}))
+	}
 }
 
 // implementation for PUT /todo
-// Web api standards use PUT for Updates
+// Web api standards use PUT for Updates.  Like on the base API the item
+// is only replaced if the client saw the latest version of it, sent in
+// the body or as the ETag from GET /todo/:id in an If-Match header.  A
+// stale version returns 412 Precondition Failed.
 func (td *ToDoAPI) UpdateToDo(c *gin.Context) {
 	var todoItem db.ToDoItem
 	if err := c.ShouldBindJSON(&todoItem); err != nil {
@@ -220,54 +476,115 @@ func (td *ToDoAPI) UpdateToDo(c *gin.Context) {
 		return
 	}
 
-	if err := td.db.UpdateItem(todoItem); err != nil {
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" && ifMatch != "*" {
+		version, ok := versionFromETag(ifMatch)
+		if !ok || (todoItem.Version != 0 && todoItem.Version != version) {
+			log.Println("If-Match does not match the item version: ", ifMatch)
+			c.AbortWithStatus(http.StatusPreconditionFailed)
+			return
+		}
+		//The database checks the version in the same step as the
+		//write, so nothing can change in between
+		todoItem.Version = version
+	}
+
+	if err := td.storeFor(c).UpdateItem(todoItem); err != nil {
 		log.Println("Error updating item: ", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		td.notifyError("update", err)
+		c.AbortWithStatus(statusFor(err))
 		return
 	}
 
-	evnt := events.NewEvent(events.ToDoUpdateEvent, "todoItem", todoItem)
-	td.eventHandler.Notify(evnt)
-	c.JSON(http.StatusOK, todoItem)
+	if stored, ok := td.respondWithItem(c, http.StatusOK, todoItem.Id); ok {
+		td.Notify(events.NewEvent(events.UpdatePayload{Item: stored}))
+	}
+}
+
+// respondWithItem reads an item back from the database and returns it,
+// so the response has the timestamps and version the database manages
+func (td *ToDoAPI) respondWithItem(c *gin.Context, status int, id int) (db.ToDoItem, bool) {
+	todoItem, err := td.db.GetItem(id)
+	if err != nil {
+		log.Println("Error reading item back: ", err)
+		c.AbortWithStatus(statusFor(err))
+		return todoItem, false
+	}
+	c.Header("ETag", etagFor(todoItem))
+	c.JSON(status, todoItem)
+	return todoItem, true
+}
+
+// etagFor returns the ETag of an item, its version in quotes
+func etagFor(item db.ToDoItem) string {
+	return fmt.Sprintf("%q", strconv.Itoa(item.Version))
+}
+
+// versionFromETag reads the version back out of an If-Match header.  A
+// weak ETag (W/"3") is accepted the same as a strong one.
+func versionFromETag(etag string) (int, bool) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil {
+		return 0, false
+	}
+	version, err := strconv.Atoi(unquoted)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// idFromRequest reads the :id parameter, it aborts the request with a
+// 400 if it is not a number
+func idFromRequest(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println("Error converting id to int: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
 }
 
 // implementation for DELETE /todo/:id
 // deletes a todo
 func (td *ToDoAPI) DeleteToDo(c *gin.Context) {
-	idS := c.Param("id")
-	id64, _ := strconv.ParseInt(idS, 10, 32)
+	id, ok := idFromRequest(c)
+	if !ok {
+		return
+	}
 
-	if err := td.db.DeleteItem(int(id64)); err != nil {
+	if err := td.storeFor(c).DeleteItem(id); err != nil {
 		log.Println("Error deleting item: ", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		td.notifyError("delete", err)
+		c.AbortWithStatus(statusFor(err))
 		return
 	}
 
-	evnt := events.NewEvent(events.ToDoDeleteEvent, "id", id64)
-	td.eventHandler.Notify(evnt)
+	td.Notify(events.NewEvent(events.DeletePayload{Id: id}))
 
 	c.Status(http.StatusOK)
 }
 
-// implementation for DELETE /todo
+// implementation for DELETE /admin/todo
 // deletes all todos
 func (td *ToDoAPI) DeleteAllToDo(c *gin.Context) {
 
-	if err := td.db.DeleteAll(); err != nil {
+	if err := td.storeFor(c).DeleteAll(); err != nil {
 		log.Println("Error deleting all items: ", err)
+		td.notifyError("delete all", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	evnt := events.NewEvent(events.ToDoDeleteEvent, "id", "all")
-	td.eventHandler.Notify(evnt)
+	td.Notify(events.NewEvent(events.DeletePayload{All: true}))
 
 	c.Status(http.StatusOK)
 }
 
 /*   SPECIAL HANDLERS FOR DEMONSTRATION - CRASH SIMULATION AND HEALTH CHECK */
 
-// implementation for GET /crash
+// implementation for GET /admin/crash
 // This simulates a crash to show some of the benefits of the
 // gin framework
 func (td *ToDoAPI) CrashSim(c *gin.Context) {
@@ -290,7 +607,7 @@ func (td *ToDoAPI) HealthCheck(c *gin.Context) {
 		})
 }
 
-// implementation for GET /events/:enableFlag
+// implementation for GET /admin/event/:enableFlag
 // Controls if eventing is enabled or disabled
 func (td *ToDoAPI) EventEnabler(c *gin.Context) {
 
@@ -305,8 +622,12 @@ func (td *ToDoAPI) EventEnabler(c *gin.Context) {
 		return
 	}
 
-	//Note that ParseInt always returns an int64, so we have to
-	//convert it to an int before we can use it.
+	if td.eventHandler == nil {
+		log.Println("Eventing is not set up")
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+
 	if eFlag {
 		//Enable Eventing
 		log.Println("Enabling Eventing")
@@ -319,3 +640,16 @@ func (td *ToDoAPI) EventEnabler(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"eventResetMode": eFlag})
 }
+
+// implementation for GET /event/stats
+// returns how many events were published, dropped and delivered
+func (td *ToDoAPI) EventStats(c *gin.Context) {
+	if td.eventHandler == nil {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"active": td.eventHandler.IsActive(),
+		"stats":  td.eventHandler.Stats(),
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"drexel.edu/todo-events/events"
+)
+
+// todo-events reads the todo event stream that the API writes when it
+// is started with -stream.  It can follow the stream as events are added,
+// print the events already in it, or read it as a member of a consumer
+// group, which is what a real notifier or audit logger would do.
+//
+//	todo-events tail                       print new events as they happen
+//	todo-events tail -from 0               print every event, then follow
+//	todo-events replay -from - -to +       print the events in the stream
+//	todo-events consume -group audit       read and acknowledge as part of a group
+
+// Global variables to hold the command line flags shared by every command
+var (
+	redisFlag  string
+	streamFlag string
+	jsonFlag   bool
+)
+
+const usage = `Usage: todo-events [flags] <command> [command flags]
+
+Commands:
+  tail      Print events as they are added to the stream
+  replay    Print the events that are already in the stream
+  consume   Read the stream as a member of a consumer group
+
+Flags:
+`
+
+// processCmdLineFlags parses the flags that come before the command, and
+// returns the command and its arguments
+func processCmdLineFlags() (string, []string) {
+	flag.StringVar(&redisFlag, "r", events.RedisLocation(), "Location of redis, REDIS_URL overrides the default")
+	flag.StringVar(&streamFlag, "s", events.DefaultStreamKey, "Key of the event stream")
+	flag.BoolVar(&jsonFlag, "json", false, "Print each event as a JSON object")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	return flag.Arg(0), flag.Args()[1:]
+}
+
+// printEvent prints one event, either as a line of text or as JSON
+func printEvent(msg events.StreamMessage) error {
+	if jsonFlag {
+		data, err := json.Marshal(struct {
+			StreamId string `json:"streamId"`
+			*events.ToDoEvent
+		}{msg.StreamId, msg.Event})
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	payload, _ := json.Marshal(msg.Event.Payload)
+	fmt.Printf("%s  %s  %-6s  %s\n", msg.StreamId, msg.Event.Timestamp.Local().Format(time.DateTime),
+		msg.Event.EventID, payload)
+	return nil
+}
+
+func main() {
+	command, args := processCmdLineFlags()
+
+	//Ctrl-C stops tail and consume cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stream, err := events.NewStreamWithKey(redisFlag, streamFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer stream.Close()
+
+	cmd := flag.NewFlagSet(command, flag.ExitOnError)
+	switch command {
+	case "tail":
+		from := cmd.String("from", "$", "Stream id to start after, $ for only new events, 0 for all of them")
+		cmd.Parse(args)
+		err = stream.Tail(ctx, *from, printEvent)
+
+	case "replay":
+		from := cmd.String("from", "-", "First stream id to print, - for the start of the stream")
+		to := cmd.String("to", "+", "Last stream id to print, + for the end of the stream")
+		cmd.Parse(args)
+		err = stream.Replay(ctx, *from, *to, printEvent)
+
+	case "consume":
+		host, _ := os.Hostname()
+		options := events.ConsumerOptions{}
+		cmd.StringVar(&options.Group, "group", "", "Name of the consumer group (required)")
+		cmd.StringVar(&options.Consumer, "consumer", host, "Name of this consumer in the group")
+		cmd.StringVar(&options.StartId, "start", "$", "Where a new group starts, $ for new events, 0 for all of them")
+		cmd.DurationVar(&options.ClaimIdle, "claim", 0, "Take over events pending on other consumers for this long, for example 1m")
+		cmd.Parse(args)
+		err = stream.Consume(ctx, options, printEvent)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
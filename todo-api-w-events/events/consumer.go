@@ -0,0 +1,201 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A consumer group lets several copies of a service share the stream.
+// Redis hands each entry to only one consumer in the group, and keeps it
+// on that consumer's pending list until the consumer acknowledges it
+// with XACK.  So if a consumer crashes part way through, the entries it
+// did not finish are still pending:
+//
+//   - when it comes back under the same name it reads its own pending
+//     entries first, and
+//   - with ClaimIdle set, the other consumers take over entries that have
+//     been pending on someone else for longer than that.
+//
+// An entry whose handler returns an error is left pending and tried
+// again when the consumer is idle.  After MaxRetries failures it is
+// logged and acknowledged, so one bad entry cannot block the group.
+
+// DefaultMaxRetries is how many times a failing entry is tried
+const DefaultMaxRetries = 5
+
+// ConsumerOptions say which group a consumer is in and how it behaves
+type ConsumerOptions struct {
+	// Group and Consumer name the group and this consumer in it.  Use a
+	// name that is the same when the consumer restarts, like a host name.
+	Group    string
+	Consumer string
+	// StartId is where a new group starts reading, "$" (the default) for
+	// only new entries or "0" for everything in the stream.  It is
+	// ignored if the group already exists.
+	StartId string
+	// ClaimIdle, if set, claims entries that have been pending on another
+	// consumer for longer than this
+	ClaimIdle time.Duration
+	// MaxRetries is how many times a failing entry is tried, zero means
+	// DefaultMaxRetries
+	MaxRetries int
+}
+
+// CreateGroup creates the consumer group, and the stream if it does not
+// exist yet.  A group that already exists is left alone.
+func (s *Stream) CreateGroup(ctx context.Context, group, startId string) error {
+	if startId == "" {
+		startId = "$"
+	}
+	err := s.client.XGroupCreateMkStream(ctx, s.key, group, startId).Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// Consume reads the stream as a member of a consumer group and passes
+// each entry to the handler, until the context is cancelled.  An entry is
+// acknowledged when the handler returns nil.
+// Preconditions:   (1) Group and Consumer must be set
+//
+// Postconditions:
+//
+//	 (1) The group is created if it does not exist
+//		(2) Entries left pending by an earlier run of this consumer are
+//			handled before new ones
+//		(3) Returns nil when the context is cancelled, or the redis error
+//			that stopped it
+func (s *Stream) Consume(ctx context.Context, options ConsumerOptions, handler StreamHandler) error {
+	if options.Group == "" || options.Consumer == "" {
+		return errors.New("a consumer needs a group and a consumer name")
+	}
+	if options.MaxRetries <= 0 {
+		options.MaxRetries = DefaultMaxRetries
+	}
+	if err := s.CreateGroup(ctx, options.Group, options.StartId); err != nil {
+		return err
+	}
+
+	c := &groupConsumer{stream: s, options: options, handler: handler, failures: make(map[string]int)}
+
+	//"0" reads this consumer's own pending entries, ">" reads new ones.
+	//Start with the pending ones, and go back to them whenever there is
+	//nothing new, that is when failed entries are tried again.
+	readPending := true
+	for ctx.Err() == nil {
+		if options.ClaimIdle > 0 {
+			if err := c.claim(ctx); err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+
+		from := ">"
+		block := streamBlock
+		if readPending {
+			from = "0"
+			//A negative Block leaves out BLOCK, pending entries are
+			//returned right away
+			block = -1
+		}
+		streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    options.Group,
+			Consumer: options.Consumer,
+			Streams:  []string{s.key, from},
+			Count:    streamBatchSize,
+			Block:    block,
+		}).Result()
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, redis.Nil):
+			readPending = true
+			continue
+		case err != nil:
+			return err
+		}
+
+		readPending = false
+		for _, stream := range streams {
+			if err := c.handle(ctx, stream.Messages); err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// groupConsumer holds the state of one Consume call
+type groupConsumer struct {
+	stream   *Stream
+	options  ConsumerOptions
+	handler  StreamHandler
+	failures map[string]int
+}
+
+// handle passes the entries to the handler and acknowledges the ones it
+// is done with
+func (c *groupConsumer) handle(ctx context.Context, msgs []redis.XMessage) error {
+	for _, msg := range msgs {
+		//An entry that was trimmed from the stream while it was pending
+		//comes back with no fields, there is nothing left to handle
+		decoded, err := DecodeStreamMessage(msg)
+		if err != nil {
+			log.Println("Skipping stream entry: ", err)
+		} else if err := c.handler(decoded); err != nil {
+			c.failures[msg.ID]++
+			if c.failures[msg.ID] < c.options.MaxRetries {
+				log.Printf("Stream entry %s failed, it will be tried again: %v", msg.ID, err)
+				continue
+			}
+			log.Printf("Stream entry %s failed %d times, giving up: %v", msg.ID, c.failures[msg.ID], err)
+		}
+
+		delete(c.failures, msg.ID)
+		if err := c.stream.client.XAck(ctx, c.stream.key, c.options.Group, msg.ID).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim takes over entries that have been pending on other consumers
+// for longer than ClaimIdle, and handles them.  XAUTOCLAIM would do this
+// in one command, but go-redis v8 cannot read its reply from redis 7, so
+// the entries are found with XPENDING and taken with XCLAIM.
+func (c *groupConsumer) claim(ctx context.Context) error {
+	pending, err := c.stream.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: c.stream.key,
+		Group:  c.options.Group,
+		Idle:   c.options.ClaimIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  streamBatchSize,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	ids := make([]string, 0, len(pending))
+	for _, entry := range pending {
+		ids = append(ids, entry.ID)
+	}
+	//XCLAIM checks the idle time again, so if another consumer claimed
+	//an entry first it is not claimed twice
+	msgs, err := c.stream.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   c.stream.key,
+		Group:    c.options.Group,
+		Consumer: c.options.Consumer,
+		MinIdle:  c.options.ClaimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	return c.handle(ctx, msgs)
+}
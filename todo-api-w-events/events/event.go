@@ -1,5 +1,15 @@
 package events
 
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"drexel.edu/todo/db"
+)
+
+// EventIDType says what kind of thing happened, subscribers register
+// for one of these
 type EventIDType int
 
 const (
@@ -8,18 +18,114 @@ const (
 	ToDoUpdateEvent
 	ToDoDeleteEvent
 	ToDoErrorEvent
+	ToDoReminderEvent
 )
 
+// String returns the name of the event type, it is used in the logs
+func (id EventIDType) String() string {
+	switch id {
+	case ToDoQueryEvent:
+		return "query"
+	case ToDoAddEvent:
+		return "add"
+	case ToDoUpdateEvent:
+		return "update"
+	case ToDoDeleteEvent:
+		return "delete"
+	case ToDoErrorEvent:
+		return "error"
+	case ToDoReminderEvent:
+		return "reminder"
+	}
+	return fmt.Sprintf("EventIDType(%d)", int(id))
+}
+
+// Payload is the data an event carries.  Every kind of event has its
+// own payload type, so a subscriber gets the fields it needs instead of
+// digging through a map.  The payload decides the type of its event.
+type Payload interface {
+	EventID() EventIDType
+}
+
+// QueryPayload is sent when todos are read, Items has the todos that
+// were returned
+type QueryPayload struct {
+	Items []db.ToDoItem `json:"items"`
+}
+
+// AddPayload is sent when a todo is added
+type AddPayload struct {
+	Item db.ToDoItem `json:"item"`
+}
+
+// UpdatePayload is sent when a todo is updated
+type UpdatePayload struct {
+	Item db.ToDoItem `json:"item"`
+}
+
+// DeletePayload is sent when a todo is deleted, or with All set when
+// all of them are
+type DeletePayload struct {
+	Id  int  `json:"id,omitempty"`
+	All bool `json:"all,omitempty"`
+}
+
+// ErrorPayload is sent when a request fails.  Operation is what the
+// request was trying to do, for example "add".
+type ErrorPayload struct {
+	Operation string `json:"operation"`
+	Error     string `json:"error"`
+}
+
+// ReminderPayload is sent once when an item that is not done goes past
+// its due date.  OverdueBy is how long ago that was when the scheduler
+// noticed, like "1m30s".
+type ReminderPayload struct {
+	Item      db.ToDoItem `json:"item"`
+	DueDate   time.Time   `json:"dueDate"`
+	OverdueBy string      `json:"overdueBy"`
+}
+
+func (QueryPayload) EventID() EventIDType    { return ToDoQueryEvent }
+func (AddPayload) EventID() EventIDType      { return ToDoAddEvent }
+func (UpdatePayload) EventID() EventIDType   { return ToDoUpdateEvent }
+func (DeletePayload) EventID() EventIDType   { return ToDoDeleteEvent }
+func (ErrorPayload) EventID() EventIDType    { return ToDoErrorEvent }
+func (ReminderPayload) EventID() EventIDType { return ToDoReminderEvent }
+
+// ToDoEvent is a single event.  Id is unique and increases with every
+// event made by this process, it is the time the event was made in
+// milliseconds and a sequence number, like <millis>-<seq>.
 type ToDoEvent struct {
-	EventID   EventIDType
-	EventData map[string]any
+	Id        string      `json:"id"`
+	EventID   EventIDType `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Payload   Payload     `json:"payload"`
 }
 
-func NewEvent(id EventIDType, key string, value any) *ToDoEvent {
+// eventSeq numbers the events so two made in the same millisecond still
+// get different ids
+var eventSeq atomic.Uint64
+
+// NewEvent returns an event for the payload, stamped with a new id and
+// the current time
+func NewEvent(payload Payload) *ToDoEvent {
+	now := time.Now().UTC()
 	return &ToDoEvent{
-		EventID: id,
-		EventData: map[string]any{
-			key: value,
-		},
+		Id:        fmt.Sprintf("%d-%d", now.UnixMilli(), eventSeq.Add(1)),
+		EventID:   payload.EventID(),
+		Timestamp: now,
+		Payload:   payload,
 	}
 }
+
+// PayloadAs returns the payload of the event as type T.  The second
+// result is false if the payload is some other type.
+//
+//	if add, ok := events.PayloadAs[events.AddPayload](event); ok {
+//		log.Println("added", add.Item.Title)
+//	}
+func PayloadAs[T Payload](event *ToDoEvent) (T, bool) {
+	payload, ok := event.Payload.(T)
+	return payload, ok
+}
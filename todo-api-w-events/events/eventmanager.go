@@ -2,92 +2,326 @@ package events
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
+// The event manager is an in-process event bus.  The API handlers call
+// Notify, which puts the event on a buffered queue and returns right
+// away, a goroutine takes the events off the queue and hands each one
+// to the subscribers registered for its type.  The handlers never wait
+// for the subscribers.
+//
+// When the subscribers fall behind and the queue fills up, the
+// OverflowPolicy decides what Notify does: wait for room, drop the new
+// event or drop the oldest queued one.  Stop stops taking new events and
+// waits until the ones already queued have been delivered, so stopping
+// does not lose events.
+
+// OverflowPolicy is what Notify does when the queue is full
+type OverflowPolicy int
+
+const (
+	// Block waits for room in the queue, for up to BlockTimeout.  This
+	// slows the API down to the speed of the subscribers.
+	Block OverflowPolicy = iota
+	// DropNewest drops the event being sent and keeps the queue as it is
+	DropNewest
+	// DropOldest drops the oldest event in the queue to make room
+	DropOldest
+)
+
+const (
+	// DefaultQueueSize is how many events can wait to be delivered
+	DefaultQueueSize = 256
+	// DefaultBlockTimeout is how long Notify waits for room with Block
+	DefaultBlockTimeout = time.Second
+)
+
+var (
+	// ErrNotActive is returned by Notify when the manager is not started
+	ErrNotActive = errors.New("event manager is not active")
+	// ErrQueueFull is returned by Notify when the event was dropped
+	// because the queue was full
+	ErrQueueFull = errors.New("event queue is full, event dropped")
+)
+
+// Handler is a subscriber.  It is called on the event goroutine, once
+// per event, an error it returns is logged and counted.
+type Handler func(event *ToDoEvent) error
+
+// Options configure a ToDoEventManager.  Zero values use the defaults.
+type Options struct {
+	QueueSize    int
+	Overflow     OverflowPolicy
+	BlockTimeout time.Duration
+}
+
+// Stats counts what happened to the events since the manager was made.
+// Published counts the events put on the queue and Dropped the ones
+// lost to a full queue, with DropOldest that includes events that were
+// published first.  Delivered and Failed count calls to subscribers.
+type Stats struct {
+	Published int `json:"published"`
+	Dropped   int `json:"dropped"`
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+	Queued    int `json:"queued"`
+}
+
 type ToDoEventManager struct {
-	ctx      context.Context
-	cancel   context.CancelFunc
-	queue    chan *ToDoEvent
+	options Options
+
+	//mu guards isActive.  Notify holds it for reading while it sends, so
+	//once Stop holds it for writing no event can be added to the queue.
+	mu       sync.RWMutex
 	isActive bool
+
+	//subMu guards the subscribers.  It is not mu, the event loop must
+	//keep delivering while Stop waits for a blocked Notify.
+	subMu       sync.RWMutex
+	subscribers map[EventIDType][]Handler
+	everything  []Handler
+
+	queue chan *ToDoEvent
+	stop  chan struct{}
+	done  chan struct{}
+
+	statsMu sync.Mutex
+	stats   Stats
 }
 
+// NewToDoEventManager returns an event manager with the default options,
+// it does not deliver events until it is started
 func NewToDoEventManager() *ToDoEventManager {
+	return NewToDoEventManagerWithOptions(Options{})
+}
+
+// NewToDoEventManagerWithOptions returns an event manager with its own
+// queue size and overflow policy
+func NewToDoEventManagerWithOptions(options Options) *ToDoEventManager {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.BlockTimeout <= 0 {
+		options.BlockTimeout = DefaultBlockTimeout
+	}
 	return &ToDoEventManager{
-		ctx:      nil,
-		cancel:   nil,
-		queue:    make(chan *ToDoEvent),
-		isActive: false,
+		options:     options,
+		subscribers: make(map[EventIDType][]Handler),
+		queue:       make(chan *ToDoEvent, options.QueueSize),
 	}
 }
 
-func (em *ToDoEventManager) Start() {
-	if !em.isActive {
-		em.ctx, em.cancel = context.WithCancel(context.Background())
-		em.isActive = true
-		go em.eventLoop()
-	}
+// Subscribe registers a handler for one type of event.  A type can have
+// any number of handlers, they are called in the order they were added.
+func (em *ToDoEventManager) Subscribe(eventID EventIDType, handler Handler) {
+	em.subMu.Lock()
+	defer em.subMu.Unlock()
+	em.subscribers[eventID] = append(em.subscribers[eventID], handler)
 }
 
-func (em *ToDoEventManager) eventLoop() {
-	log.Println("Starting Event Loop...")
-	for {
-		select {
-		case <-em.ctx.Done():
-			log.Println("Stopping Event Manager...")
-			return
-		case event := <-em.queue:
-			log.Printf("\n--> Received Event: %+v\n", event.EventData)
-			em.processEvent(event)
-		}
-	}
+// SubscribeAll registers a handler for every type of event
+func (em *ToDoEventManager) SubscribeAll(handler Handler) {
+	em.subMu.Lock()
+	defer em.subMu.Unlock()
+	em.everything = append(em.everything, handler)
 }
 
-func (em *ToDoEventManager) Stop() {
+// Start starts delivering events, it does nothing if the manager is
+// already active
+func (em *ToDoEventManager) Start() {
+	em.mu.Lock()
+	defer em.mu.Unlock()
 	if em.isActive {
-		em.cancel()
-		em.isActive = false
+		return
 	}
+	em.isActive = true
+	em.stop = make(chan struct{})
+	em.done = make(chan struct{})
+	go em.eventLoop(em.stop, em.done)
 }
 
-func (em *ToDoEventManager) Notify(event *ToDoEvent) {
-	if em.isActive {
-		em.queue <- event
+// Stop stops taking new events, delivers the ones that are queued and
+// then returns.  It does nothing if the manager is not active.
+func (em *ToDoEventManager) Stop() {
+	em.Shutdown(context.Background())
+}
+
+// Shutdown is Stop with a deadline.  If the queued events are not all
+// delivered before the context is done, it returns the context's error
+// and the rest are delivered in the background.
+func (em *ToDoEventManager) Shutdown(ctx context.Context) error {
+	em.mu.Lock()
+	if !em.isActive {
+		em.mu.Unlock()
+		return nil
+	}
+	em.isActive = false
+	close(em.stop)
+	done := em.done
+	em.mu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (em *ToDoEventManager) processEvent(event *ToDoEvent) {
-	switch event.EventID {
-	case ToDoQueryEvent:
-		em.processQueryEvent(event)
-	case ToDoAddEvent:
-		em.processAddEvent(event)
-	case ToDoUpdateEvent:
-		em.processUpdateEvent(event)
-	case ToDoDeleteEvent:
-		em.processDeleteEvent(event)
-	case ToDoErrorEvent:
-		em.processErrorEvent(event)
+// IsActive reports whether the manager is taking events
+func (em *ToDoEventManager) IsActive() bool {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	return em.isActive
+}
+
+// Notify queues an event for the subscribers.  It returns ErrNotActive
+// when the manager is stopped, and ErrQueueFull when the queue is full
+// and the event, or with DropOldest an older one, was dropped.
+func (em *ToDoEventManager) Notify(event *ToDoEvent) error {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	if !em.isActive {
+		return ErrNotActive
+	}
+
+	//The quick path, there is room in the queue
+	select {
+	case em.queue <- event:
+		em.count(func(s *Stats) { s.Published++ })
+		return nil
+	default:
+	}
+
+	switch em.options.Overflow {
+	case DropNewest:
+		em.count(func(s *Stats) { s.Dropped++ })
+		return ErrQueueFull
+
+	case DropOldest:
+		//Another sender may fill the room we make, so keep trying until
+		//the event is in, every event taken out is one dropped
+		for {
+			select {
+			case em.queue <- event:
+				em.count(func(s *Stats) { s.Published++ })
+				return ErrQueueFull
+			case <-em.queue:
+				em.count(func(s *Stats) { s.Dropped++ })
+			}
+		}
+
+	default:
+		timer := time.NewTimer(em.options.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case em.queue <- event:
+			em.count(func(s *Stats) { s.Published++ })
+			return nil
+		case <-timer.C:
+			em.count(func(s *Stats) { s.Dropped++ })
+			return ErrQueueFull
+		}
 	}
 }
 
-func (em *ToDoEventManager) processQueryEvent(event *ToDoEvent) {
-	fmt.Println("Processing Query Event")
+// Stats returns the event counts
+func (em *ToDoEventManager) Stats() Stats {
+	em.statsMu.Lock()
+	defer em.statsMu.Unlock()
+	stats := em.stats
+	stats.Queued = len(em.queue)
+	return stats
 }
 
-func (em *ToDoEventManager) processAddEvent(event *ToDoEvent) {
-	fmt.Println("Processing Add Event")
+func (em *ToDoEventManager) count(update func(s *Stats)) {
+	em.statsMu.Lock()
+	update(&em.stats)
+	em.statsMu.Unlock()
 }
 
-func (em *ToDoEventManager) processUpdateEvent(event *ToDoEvent) {
-	fmt.Println("Processing Update Event")
+// eventLoop delivers events until stop is closed, then delivers what is
+// left in the queue and closes done
+func (em *ToDoEventManager) eventLoop(stop, done chan struct{}) {
+	defer close(done)
+	log.Println("Starting Event Loop...")
+	for {
+		select {
+		case event := <-em.queue:
+			em.processEvent(event)
+		case <-stop:
+			//Nothing can be added to the queue once stop is closed, so
+			//when it is empty every event has been delivered
+			log.Printf("Stopping Event Manager, delivering %d queued events...", len(em.queue))
+			for {
+				select {
+				case event := <-em.queue:
+					em.processEvent(event)
+				default:
+					return
+				}
+			}
+		}
+	}
 }
 
-func (em *ToDoEventManager) processDeleteEvent(event *ToDoEvent) {
-	fmt.Println("Processing Delete Event")
+// processEvent hands the event to the subscribers for its type and then
+// to the ones for every type
+func (em *ToDoEventManager) processEvent(event *ToDoEvent) {
+	em.subMu.RLock()
+	handlers := make([]Handler, 0, len(em.subscribers[event.EventID])+len(em.everything))
+	handlers = append(handlers, em.subscribers[event.EventID]...)
+	handlers = append(handlers, em.everything...)
+	em.subMu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := em.deliver(handler, event); err != nil {
+			log.Printf("Error delivering %s event %s: %v", event.EventID, event.Id, err)
+			em.count(func(s *Stats) { s.Failed++ })
+			continue
+		}
+		em.count(func(s *Stats) { s.Delivered++ })
+	}
+}
+
+// deliver calls one handler, a handler that panics does not stop the
+// event loop, the panic is returned as an error
+func (em *ToDoEventManager) deliver(handler Handler, event *ToDoEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("subscriber panicked: %v", r)
+		}
+	}()
+	return handler(event)
 }
 
-func (em *ToDoEventManager) processErrorEvent(event *ToDoEvent) {
-	fmt.Println("Processing Error Event")
+// LogEvent is a subscriber that logs each event with the fields of its
+// payload
+func LogEvent(event *ToDoEvent) error {
+	switch payload := event.Payload.(type) {
+	case QueryPayload:
+		log.Printf("--> Event %s: query returned %d items", event.Id, len(payload.Items))
+	case AddPayload:
+		log.Printf("--> Event %s: added item %d %q", event.Id, payload.Item.Id, payload.Item.Title)
+	case UpdatePayload:
+		log.Printf("--> Event %s: updated item %d %q", event.Id, payload.Item.Id, payload.Item.Title)
+	case DeletePayload:
+		if payload.All {
+			log.Printf("--> Event %s: deleted all items", event.Id)
+		} else {
+			log.Printf("--> Event %s: deleted item %d", event.Id, payload.Id)
+		}
+	case ErrorPayload:
+		log.Printf("--> Event %s: %s failed: %s", event.Id, payload.Operation, payload.Error)
+	case ReminderPayload:
+		log.Printf("--> Event %s: item %d %q is overdue by %s", event.Id, payload.Item.Id, payload.Item.Title, payload.OverdueBy)
+	default:
+		log.Printf("--> Event %s: %s %+v", event.Id, event.EventID, event.Payload)
+	}
+	return nil
 }
@@ -0,0 +1,293 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The event manager only delivers events inside this process.  A Stream
+// also writes them to a redis stream, an append only log that other
+// services can read at their own pace: a notifier that tails it, an
+// audit logger that replays it from the start, or several copies of a
+// worker that share it through a consumer group.
+//
+// Each event is one stream entry with these fields:
+//
+//	id         the event id, like 1700000000000-1
+//	type       add, update or delete
+//	timestamp  when the event was made, RFC 3339
+//	payload    the payload as JSON
+//
+// The entry gets its own stream id from redis.  Readers resume from the
+// stream id, not the event id.
+
+const (
+	RedisDefaultLocation = "0.0.0.0:6379"
+	// DefaultStreamKey is the redis key of the todo event stream
+	DefaultStreamKey = "todo:events"
+	// DefaultStreamMaxLen is roughly how many entries the stream keeps,
+	// older ones are trimmed as new ones are added
+	DefaultStreamMaxLen = 10000
+	// streamBatchSize is how many entries are read from redis at a time
+	streamBatchSize = 100
+	// streamBlock is how long a read waits for new entries before it
+	// checks if it has been cancelled
+	streamBlock = 2 * time.Second
+)
+
+var (
+	// ErrBadStreamEntry is returned for an entry that is not a todo event
+	ErrBadStreamEntry = errors.New("stream entry is not a todo event")
+)
+
+// StreamMessage is an event read back from the stream.  StreamId is the
+// id redis gave the entry, pass it to Tail or Replay to continue after it.
+type StreamMessage struct {
+	StreamId string
+	Event    *ToDoEvent
+}
+
+// StreamHandler processes an event read from the stream.  With a consumer
+// group, returning an error leaves the entry pending so it is tried again.
+type StreamHandler func(msg StreamMessage) error
+
+// Stream publishes events to a redis stream and reads them back
+type Stream struct {
+	client *redis.Client
+	key    string
+	maxLen int64
+}
+
+// RedisLocation returns the REDIS_URL environment variable, or the
+// default location if it is not set
+func RedisLocation() string {
+	if location := os.Getenv("REDIS_URL"); location != "" {
+		return location
+	}
+	return RedisDefaultLocation
+}
+
+// NewStream connects to the redis at location and uses the default
+// stream key
+func NewStream(location string) (*Stream, error) {
+	return NewStreamWithKey(location, DefaultStreamKey)
+}
+
+// NewStreamWithKey connects to the redis at location and uses the stream
+// at key, tests use this to keep their own stream
+func NewStreamWithKey(location string, key string) (*Stream, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: location,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to redis at %s: %w", location, err)
+	}
+	return &Stream{client: client, key: key, maxLen: DefaultStreamMaxLen}, nil
+}
+
+// Key returns the redis key of the stream
+func (s *Stream) Key() string {
+	return s.key
+}
+
+// Close closes the connection to redis
+func (s *Stream) Close() error {
+	return s.client.Close()
+}
+
+// Publish adds the event to the stream.  It is a Handler, so it can be
+// subscribed to the event manager.
+func (s *Stream) Publish(event *ToDoEvent) error {
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return err
+	}
+	return s.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: s.key,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"id":        event.Id,
+			"type":      event.EventID.String(),
+			"timestamp": event.Timestamp.Format(time.RFC3339Nano),
+			"payload":   string(payload),
+		},
+	}).Err()
+}
+
+// PublishTo subscribes the stream to the add, update and delete events
+// of the event manager.  Queries and errors are not published, they do
+// not change any todos.
+func (s *Stream) PublishTo(em *ToDoEventManager) {
+	em.Subscribe(ToDoAddEvent, s.Publish)
+	em.Subscribe(ToDoUpdateEvent, s.Publish)
+	em.Subscribe(ToDoDeleteEvent, s.Publish)
+}
+
+// ParseEventIDType returns the event type with the name, the reverse of
+// EventIDType.String
+func ParseEventIDType(name string) (EventIDType, error) {
+	for id := ToDoQueryEvent; id <= ToDoReminderEvent; id++ {
+		if id.String() == name {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown type %q", ErrBadStreamEntry, name)
+}
+
+// decodePayload turns the JSON of a payload back into the payload type
+// for the event type
+func decodePayload(id EventIDType, data string) (Payload, error) {
+	payload, err := func() (Payload, error) {
+		switch id {
+		case ToDoQueryEvent:
+			return unmarshalPayload[QueryPayload](data)
+		case ToDoAddEvent:
+			return unmarshalPayload[AddPayload](data)
+		case ToDoUpdateEvent:
+			return unmarshalPayload[UpdatePayload](data)
+		case ToDoDeleteEvent:
+			return unmarshalPayload[DeletePayload](data)
+		case ToDoReminderEvent:
+			return unmarshalPayload[ReminderPayload](data)
+		default:
+			return unmarshalPayload[ErrorPayload](data)
+		}
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadStreamEntry, err)
+	}
+	return payload, nil
+}
+
+// unmarshalPayload decodes the JSON into a payload of type T
+func unmarshalPayload[T Payload](data string) (Payload, error) {
+	var payload T
+	err := json.Unmarshal([]byte(data), &payload)
+	return payload, err
+}
+
+// DecodeStreamMessage turns a stream entry back into an event
+func DecodeStreamMessage(msg redis.XMessage) (StreamMessage, error) {
+	field := func(name string) string {
+		value, _ := msg.Values[name].(string)
+		return value
+	}
+
+	id, err := ParseEventIDType(field("type"))
+	if err != nil {
+		return StreamMessage{}, fmt.Errorf("entry %s: %w", msg.ID, err)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, field("timestamp"))
+	if err != nil {
+		return StreamMessage{}, fmt.Errorf("entry %s: %w: bad timestamp", msg.ID, ErrBadStreamEntry)
+	}
+	payload, err := decodePayload(id, field("payload"))
+	if err != nil {
+		return StreamMessage{}, fmt.Errorf("entry %s: %w", msg.ID, err)
+	}
+
+	return StreamMessage{
+		StreamId: msg.ID,
+		Event: &ToDoEvent{
+			Id:        field("id"),
+			EventID:   id,
+			Timestamp: timestamp,
+			Payload:   payload,
+		},
+	}, nil
+}
+
+// handleMessages decodes the entries and passes them to the handler in
+// order.  It stops at the first error.  An entry that cannot be decoded
+// is logged and skipped, retrying it would never work.
+func handleMessages(msgs []redis.XMessage, handler StreamHandler, done func(id string) error) error {
+	for _, msg := range msgs {
+		decoded, err := DecodeStreamMessage(msg)
+		if err != nil {
+			log.Println("Skipping stream entry: ", err)
+		} else if err := handler(decoded); err != nil {
+			return err
+		}
+		if done != nil {
+			if err := done(msg.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Replay reads the entries between the stream ids start and end, both
+// included, and passes them to the handler in order.  "-" is the first
+// entry and "+" the last, Replay(ctx, "-", "+", h) reads all of them.
+func (s *Stream) Replay(ctx context.Context, start, end string, handler StreamHandler) error {
+	for {
+		msgs, err := s.client.XRangeN(ctx, s.key, start, end, streamBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		if err := handleMessages(msgs, handler, nil); err != nil {
+			return err
+		}
+		if len(msgs) < streamBatchSize {
+			return nil
+		}
+		//The next page starts just after the last entry, "(" makes the
+		//start exclusive
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+// Tail passes the entries added after the stream id from to the handler,
+// and keeps waiting for new ones until the context is cancelled.  "$"
+// starts with the next new entry, "0" with the first one.
+func (s *Stream) Tail(ctx context.Context, from string, handler StreamHandler) error {
+	//"$" means whatever is last at the time of each read, so it is
+	//turned into a real id once, or entries added between two reads
+	//would be missed
+	if from == "$" {
+		last, err := s.client.XRevRangeN(ctx, s.key, "+", "-", 1).Result()
+		if err != nil {
+			return err
+		}
+		from = "0"
+		if len(last) > 0 {
+			from = last[0].ID
+		}
+	}
+
+	for {
+		streams, err := s.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{s.key, from},
+			Count:   streamBatchSize,
+			Block:   streamBlock,
+		}).Result()
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, redis.Nil):
+			continue
+		case err != nil:
+			return err
+		}
+
+		for _, stream := range streams {
+			err := handleMessages(stream.Messages, handler, func(id string) error {
+				from = id
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
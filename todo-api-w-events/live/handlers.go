@@ -0,0 +1,232 @@
+package live
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// The handlers below are GET /todo/stream and GET /todo/ws.  They are
+// methods on the Hub so any API that has one can add the routes, see
+// main.go.  Both take the filter as query parameters, for example
+// /todo/stream?done=false&type=add,update
+
+// AllowOrigins returns a CheckOrigin for the origins the CORS config of
+// the API allows, "*" allows every origin.  The browser does not apply
+// CORS to a WebSocket, so the hub has to.  Requests without an Origin
+// header do not come from a browser and are let through.
+func AllowOrigins(origins ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range origins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ping is the heartbeat message, it has no id so it does not move the
+// client's Last-Event-ID
+type ping struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+}
+
+// connect reads the filter and the last event id and connects a client,
+// it aborts the request if it cannot
+func (h *Hub) connect(c *gin.Context) (*Client, bool) {
+	filter, err := ParseFilter(c.Request.URL.Query())
+	if err != nil {
+		log.Println("Error parsing filter: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	//EventSource sends the header when it reconnects, a browser cannot
+	//set headers on a WebSocket so it uses the query parameter
+	lastEventId := c.GetHeader("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = c.Query("lastEventId")
+	}
+
+	client, err := h.Connect(filter, lastEventId)
+	if err != nil {
+		log.Println("Error connecting live client: ", err)
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return client, true
+}
+
+// implementation for GET /todo/stream
+// sends the todo changes as Server-Sent Events until the client goes
+// away.  Each change is an event named add, update or delete, with the
+// event id as its id, and a ping event is sent every heartbeat.
+func (h *Hub) StreamEvents(c *gin.Context) {
+	client, ok := h.connect(c)
+	if !ok {
+		return
+	}
+	defer client.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	//Stops nginx and the ingress from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	//Every write gets a deadline, so a client that stops reading cannot
+	//hold the handler forever.  It is lifted when the stream ends so the
+	//server can still finish the response.
+	controller := http.NewResponseController(c.Writer)
+	defer controller.SetWriteDeadline(time.Time{})
+	if err := h.writeDeadline(controller); err != nil {
+		log.Println("Error writing to live client: ", err)
+		return
+	}
+
+	//retry tells EventSource how long to wait before it reconnects
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", time.Second.Milliseconds())
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(h.options.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-client.Done():
+			log.Println("Live client disconnected: ", client.Err())
+			return
+		case msg := <-client.Messages():
+			if err = h.writeDeadline(controller); err == nil {
+				err = writeSSE(c.Writer, msg.Id, msg.Type, msg)
+			}
+		case now := <-heartbeat.C:
+			if err = h.writeDeadline(controller); err == nil {
+				err = writeSSE(c.Writer, "", "ping", ping{Type: "ping", Time: now.UTC()})
+			}
+		}
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			log.Println("Error writing to live client: ", err)
+			return
+		}
+	}
+}
+
+// writeDeadline gives the next write WriteTimeout.  Writers that have no
+// deadlines, like httptest.ResponseRecorder, are written without one.
+func (h *Hub) writeDeadline(controller *http.ResponseController) error {
+	err := controller.SetWriteDeadline(time.Now().Add(h.options.WriteTimeout))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// writeSSE writes one event, the JSON is on a single line so it fits in
+// one data field
+func writeSSE(w gin.ResponseWriter, id string, event string, data any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+	return err
+}
+
+// implementation for GET /todo/ws
+// sends the todo changes as JSON text messages on a WebSocket until the
+// client goes away.  The heartbeat is a WebSocket ping, a client that
+// does not answer with a pong within two heartbeats is disconnected.
+// Anything the client sends is ignored.
+func (h *Hub) StreamWebSocket(c *gin.Context) {
+	client, ok := h.connect(c)
+	if !ok {
+		return
+	}
+	defer client.Close()
+
+	//Upgrade answers the request itself when it fails
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("Error upgrading to a WebSocket: ", err)
+		return
+	}
+	defer conn.Close()
+
+	//The reader handles the pongs and notices when the client closes,
+	//gorilla/websocket only processes control frames while reading
+	wait := 2 * h.options.HeartbeatInterval
+	conn.SetReadLimit(1024)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wait))
+	})
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(h.options.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-gone:
+			return
+		case <-client.Done():
+			reason := client.Err()
+			log.Println("Live client disconnected: ", reason)
+			code := websocket.CloseGoingAway
+			if errors.Is(reason, ErrTooSlow) {
+				code = websocket.CloseTryAgainLater
+			}
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason.Error()),
+				time.Now().Add(h.options.WriteTimeout))
+			return
+		case msg := <-client.Messages():
+			conn.SetWriteDeadline(time.Now().Add(h.options.WriteTimeout))
+			err = conn.WriteJSON(msg)
+		case <-heartbeat.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.options.WriteTimeout))
+		}
+		if err != nil {
+			log.Println("Error writing to live client: ", err)
+			return
+		}
+	}
+}
+
+// implementation for GET /todo/stream/stats
+// returns how many live clients are connected and how many were dropped
+func (h *Hub) LiveStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.Stats())
+}
@@ -0,0 +1,438 @@
+package live
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"drexel.edu/todo-events/events"
+	"drexel.edu/todo/db"
+	"github.com/gorilla/websocket"
+)
+
+// The hub pushes todo changes to the front-ends that are connected to
+// GET /todo/stream (Server-Sent Events) or GET /todo/ws (WebSocket), so
+// they do not have to keep polling GET /todo.
+//
+// The hub is a subscriber of the event manager.  Each connected client
+// has its own buffered queue, and the event loop only ever puts events
+// on those queues without waiting.  A client that does not keep up and
+// lets its queue fill is disconnected, it can reconnect and resume from
+// the last event it got.  Writing to the network happens on the client's
+// own goroutine, so a slow client never holds up the event loop.
+//
+// The last events are kept in memory so a client that reconnects with
+// the Last-Event-ID header, or the lastEventId query parameter, is sent
+// the events it missed.  An id older than the kept events gets all of
+// them.
+
+// The defaults for Options
+const (
+	DefaultClientBuffer      = 64
+	DefaultHistorySize       = 256
+	DefaultHeartbeatInterval = 15 * time.Second
+	DefaultWriteTimeout      = 10 * time.Second
+)
+
+var (
+	// ErrBadFilter is returned for query parameters that are not a
+	// valid filter
+	ErrBadFilter = errors.New("invalid filter")
+	// ErrClosed is returned by Connect when the hub has been closed
+	ErrClosed = errors.New("live update hub is closed")
+	// ErrTooSlow is why a client that fell behind was disconnected
+	ErrTooSlow = errors.New("client fell behind and was disconnected")
+	// ErrGone is why a client that closed its connection was disconnected
+	ErrGone = errors.New("client went away")
+)
+
+// Message is what a client is sent for every change.  Type is add,
+// update or delete, Data is the payload of the event.
+type Message struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      any       `json:"data"`
+
+	event *events.ToDoEvent
+}
+
+// Options configure a Hub.  Zero values use the defaults.
+type Options struct {
+	// ClientBuffer is how many messages can wait for one client before
+	// it is disconnected
+	ClientBuffer int
+	// HistorySize is how many messages are kept for resuming
+	HistorySize int
+	// HeartbeatInterval is how often an idle connection is pinged
+	HeartbeatInterval time.Duration
+	// WriteTimeout is how long a write to a client can take
+	WriteTimeout time.Duration
+	// CheckOrigin says whether a browser on the Origin of the request
+	// may open a WebSocket.  Nil only allows the API's own host, see
+	// AllowOrigins.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Stats counts the clients of the hub.  Dropped is how many were
+// disconnected because they fell behind.
+type Stats struct {
+	Clients   int `json:"clients"`
+	Connected int `json:"connected"`
+	Dropped   int `json:"dropped"`
+	Sent      int `json:"sent"`
+}
+
+// Hub keeps the connected clients and the recent messages
+type Hub struct {
+	options  Options
+	upgrader websocket.Upgrader
+
+	mu      sync.Mutex
+	closed  bool
+	clients map[*Client]struct{}
+	history []Message
+	stats   Stats
+}
+
+// New returns a hub with the default options
+func New() *Hub {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions returns a hub with its own buffer sizes and heartbeat
+func NewWithOptions(options Options) *Hub {
+	if options.ClientBuffer <= 0 {
+		options.ClientBuffer = DefaultClientBuffer
+	}
+	if options.HistorySize <= 0 {
+		options.HistorySize = DefaultHistorySize
+	}
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = DefaultWriteTimeout
+	}
+	return &Hub{
+		options: options,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     options.CheckOrigin,
+		},
+		clients: make(map[*Client]struct{}),
+	}
+}
+
+//------------------------------------------------------------
+// FILTERS
+//------------------------------------------------------------
+
+// Filter picks the messages a client wants.  Nil fields match
+// everything.  Done looks at the item of adds and updates, a delete
+// carries no item so it is sent whatever Done is, the client can ignore
+// ids it does not have.
+type Filter struct {
+	Types []string
+	Done  *bool
+	Id    *int
+}
+
+// ParseFilter reads a filter from the query parameters, for example
+// ?done=false&type=add,update&id=3
+func ParseFilter(query url.Values) (Filter, error) {
+	var filter Filter
+	for _, types := range query["type"] {
+		for _, name := range strings.Split(types, ",") {
+			switch name {
+			case "add", "update", "delete", "reminder":
+				filter.Types = append(filter.Types, name)
+			default:
+				return Filter{}, fmt.Errorf("%w: unknown type %q", ErrBadFilter, name)
+			}
+		}
+	}
+	if doneS := query.Get("done"); doneS != "" {
+		done, err := strconv.ParseBool(doneS)
+		if err != nil {
+			return Filter{}, fmt.Errorf("%w: done must be true or false", ErrBadFilter)
+		}
+		filter.Done = &done
+	}
+	if idS := query.Get("id"); idS != "" {
+		id, err := strconv.Atoi(idS)
+		if err != nil {
+			return Filter{}, fmt.Errorf("%w: id must be a number", ErrBadFilter)
+		}
+		filter.Id = &id
+	}
+	return filter, nil
+}
+
+// Matches reports whether the message passes the filter
+func (f Filter) Matches(msg Message) bool {
+	if len(f.Types) > 0 {
+		wanted := false
+		for _, name := range f.Types {
+			if name == msg.Type {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			return false
+		}
+	}
+
+	switch payload := msg.event.Payload.(type) {
+	case events.AddPayload:
+		return f.matchesItem(payload.Item)
+	case events.UpdatePayload:
+		return f.matchesItem(payload.Item)
+	case events.ReminderPayload:
+		return f.matchesItem(payload.Item)
+	case events.DeletePayload:
+		return f.Id == nil || payload.All || payload.Id == *f.Id
+	}
+	return true
+}
+
+func (f Filter) matchesItem(item db.ToDoItem) bool {
+	if f.Done != nil && item.IsDone != *f.Done {
+		return false
+	}
+	if f.Id != nil && item.Id != *f.Id {
+		return false
+	}
+	return true
+}
+
+//------------------------------------------------------------
+// CLIENTS
+//------------------------------------------------------------
+
+// Client is one connection.  The transport reads Messages until Done is
+// closed, which happens when the client falls behind or the hub closes.
+type Client struct {
+	hub      *Hub
+	filter   Filter
+	messages chan Message
+	done     chan struct{}
+	err      error
+}
+
+// Messages returns the queue of messages for the client
+func (cl *Client) Messages() <-chan Message {
+	return cl.messages
+}
+
+// Done is closed when the client has been disconnected by the hub
+func (cl *Client) Done() <-chan struct{} {
+	return cl.done
+}
+
+// Err says why the client was disconnected: ErrTooSlow, ErrClosed or
+// ErrGone.  It is nil until Done is closed.
+func (cl *Client) Err() error {
+	cl.hub.mu.Lock()
+	defer cl.hub.mu.Unlock()
+	return cl.err
+}
+
+// Close disconnects the client, the transport calls it when the
+// connection goes away
+func (cl *Client) Close() {
+	cl.hub.mu.Lock()
+	defer cl.hub.mu.Unlock()
+	cl.hub.disconnect(cl, ErrGone)
+}
+
+// Connect adds a client with the filter.  If lastEventId is not empty
+// the kept messages after it that pass the filter are queued first, so
+// the client picks up where it left off.
+func (h *Hub) Connect(filter Filter, lastEventId string) (*Client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	var missed []Message
+	if lastEventId != "" {
+		for _, msg := range h.history[h.resumeFrom(lastEventId):] {
+			if filter.Matches(msg) {
+				missed = append(missed, msg)
+			}
+		}
+	}
+
+	//The queue must hold what was missed, or the client would be
+	//dropped before it sees a single new message
+	size := h.options.ClientBuffer
+	if len(missed) > size {
+		size = len(missed) + h.options.ClientBuffer
+	}
+	client := &Client{
+		hub:      h,
+		filter:   filter,
+		messages: make(chan Message, size),
+		done:     make(chan struct{}),
+	}
+	for _, msg := range missed {
+		client.messages <- msg
+	}
+	h.clients[client] = struct{}{}
+	h.stats.Connected++
+	return client, nil
+}
+
+// resumeFrom returns the index in the history of the first message
+// after lastEventId.  The hub lock must be held.
+func (h *Hub) resumeFrom(lastEventId string) int {
+	for i, msg := range h.history {
+		if msg.Id == lastEventId {
+			return i + 1
+		}
+	}
+	//The id is not kept, any message that is newer is sent, and an id
+	//that cannot be read gets everything
+	for i, msg := range h.history {
+		if compareIds(msg.Id, lastEventId) > 0 {
+			return i
+		}
+	}
+	return len(h.history)
+}
+
+// compareIds orders two event ids, which look like <millis>-<seq>.  An
+// id that cannot be read sorts before every other.
+func compareIds(a, b string) int {
+	aMillis, aSeq, aOk := splitId(a)
+	bMillis, bSeq, bOk := splitId(b)
+	switch {
+	case !aOk && !bOk:
+		return 0
+	case !aOk:
+		return -1
+	case !bOk:
+		return 1
+	case aMillis != bMillis:
+		if aMillis < bMillis {
+			return -1
+		}
+		return 1
+	case aSeq != bSeq:
+		if aSeq < bSeq {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func splitId(id string) (uint64, uint64, bool) {
+	millisS, seqS, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	millis, err := strconv.ParseUint(millisS, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseUint(seqS, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return millis, seq, true
+}
+
+// disconnect removes the client and closes its done channel, the first
+// reason given is kept.  The hub lock must be held.
+func (h *Hub) disconnect(client *Client, reason error) {
+	if client.err != nil {
+		return
+	}
+	delete(h.clients, client)
+	client.err = reason
+	close(client.done)
+}
+
+//------------------------------------------------------------
+// PUBLISHING
+//------------------------------------------------------------
+
+// Publish sends the event to every client whose filter it passes.  It
+// is a Handler, so it can be subscribed to the event manager.  It never
+// waits, a client whose queue is full is disconnected.
+func (h *Hub) Publish(event *events.ToDoEvent) error {
+	msg := Message{
+		Id:        event.Id,
+		Type:      event.EventID.String(),
+		Timestamp: event.Timestamp,
+		Data:      event.Payload,
+		event:     event,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	//The queued events are still delivered after the server shuts down,
+	//there is no one left to send them to
+	if h.closed {
+		return nil
+	}
+
+	h.history = append(h.history, msg)
+	if len(h.history) > h.options.HistorySize {
+		h.history = h.history[len(h.history)-h.options.HistorySize:]
+	}
+
+	for client := range h.clients {
+		if !client.filter.Matches(msg) {
+			continue
+		}
+		select {
+		case client.messages <- msg:
+			h.stats.Sent++
+		default:
+			h.stats.Dropped++
+			h.disconnect(client, ErrTooSlow)
+		}
+	}
+	return nil
+}
+
+// PublishTo subscribes the hub to the add, update, delete and reminder
+// events of the event manager
+func (h *Hub) PublishTo(em *events.ToDoEventManager) {
+	em.Subscribe(events.ToDoAddEvent, h.Publish)
+	em.Subscribe(events.ToDoUpdateEvent, h.Publish)
+	em.Subscribe(events.ToDoDeleteEvent, h.Publish)
+	em.Subscribe(events.ToDoReminderEvent, h.Publish)
+}
+
+// Stats returns the client counts
+func (h *Hub) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.stats
+	stats.Clients = len(h.clients)
+	return stats
+}
+
+// Close disconnects every client and stops taking new ones.  The SSE
+// requests never end on their own, so it must be called before the
+// server is shut down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for client := range h.clients {
+		h.disconnect(client, ErrClosed)
+	}
+}
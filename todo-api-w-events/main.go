@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"drexel.edu/middleware/admin"
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
+	"drexel.edu/middleware/webhooks"
 	"drexel.edu/todo-events/api"
+	"drexel.edu/todo-events/events"
+	"drexel.edu/todo-events/live"
+	"drexel.edu/todo/db"
+	"drexel.edu/todo/schedule"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -13,8 +29,26 @@ import (
 // Global variables to hold the command line flags to drive the todo CLI
 // application
 var (
-	hostFlag string
-	portFlag uint
+	hostFlag      string
+	portFlag      uint
+	streamFlag    bool
+	backendFlag   string
+	dbFileFlag    string
+	redisFlag     string
+	scheduleEvery time.Duration
+
+	jwksFlag        string
+	apiKeyFlag      string
+	noAuthFlag      bool
+	adminHostFlag   string
+	adminPortFlag   uint
+	adminPolicyFlag string
+	enableChaosFlag bool
+	rateLimitsFlag  string
+	rateRedisFlag   string
+
+	webhooksPrivateFlag bool
+	corsOriginsFlag     string
 )
 
 // processCmdLineFlags parses the command line flags for our CLI
@@ -47,6 +81,44 @@ func processCmdLineFlags() {
 	//needed
 	flag.StringVar(&hostFlag, "h", "0.0.0.0", "Listen on all interfaces")
 	flag.UintVar(&portFlag, "p", 1080, "Default Port")
+	flag.BoolVar(&streamFlag, "stream", false, "Publish add, update and delete events to a redis stream, REDIS_URL sets the location")
+
+	//The storage backend can also be picked with the TODO_BACKEND,
+	//TODO_DB_FILE and REDIS_URL environment variables.  This API has
+	//always kept its data in memory, so that is still the default
+	flag.StringVar(&backendFlag, "backend", "", "Storage backend: memory, file or redis (default \"memory\")")
+	flag.StringVar(&dbFileFlag, "db", "", "Name of the database file for the file backend")
+	flag.StringVar(&redisFlag, "redis", "", "Location of the redis cache for the redis backend")
+	flag.DurationVar(&scheduleEvery, "schedule-every", schedule.DefaultInterval, "How often to look for recurring items and overdue reminders")
+
+	//The admin routes have their own listener, by default only on the
+	//loopback interface, and callers are authenticated with a token or an
+	//API key when -jwks or -auth-redis is given, and so are the callers
+	//of the public routes.  The API does not start without either unless
+	//--insecure-no-auth is given.  The chaos routes that crash the server
+	//are off unless --enable-chaos is given
+	flag.StringVar(&adminHostFlag, "admin-h", "127.0.0.1", "Interface the admin routes listen on")
+	flag.UintVar(&adminPortFlag, "admin-p", 1081, "Port of the admin routes")
+	flag.StringVar(&adminPolicyFlag, "admin-policy", "", "YAML file with the RBAC policy of the admin routes")
+	flag.BoolVar(&enableChaosFlag, "enable-chaos", false, "Turn on the chaos routes, like /admin/crash")
+	flag.StringVar(&jwksFlag, "jwks", "", "JWKS file with the keys tokens are signed with")
+	flag.StringVar(&apiKeyFlag, "auth-redis", "", "Location of the redis the API keys are kept in")
+	flag.BoolVar(&noAuthFlag, "insecure-no-auth", false, "Run without authentication, every route is open")
+
+	//Webhooks can not point at this machine or a private network, or
+	//whoever registers one could make the API call internal services
+	flag.BoolVar(&webhooksPrivateFlag, "webhooks-allow-private", false, "Let webhooks point at loopback and private addresses")
+
+	//The origins browsers may call the API from, CORS and the WebSocket
+	//at /todo/ws both use them.  Every origin is allowed by default
+	flag.StringVar(&corsOriginsFlag, "cors-origins", "*", "Comma separated origins browsers may call the API from, * for any")
+
+	//Requests are rate limited per caller, with the limits of
+	//defaultRateLimits unless a YAML file is given.  The counts are kept
+	//in redis so they hold across replicas, RATELIMIT_FILE and
+	//RATELIMIT_REDIS_URL work too
+	flag.StringVar(&rateLimitsFlag, "rate-limits", "", "YAML file with the rate limits of the routes")
+	flag.StringVar(&rateRedisFlag, "ratelimit-redis", "", "Location of the redis the rate limit counts are kept in")
 
 	flag.Parse()
 }
@@ -57,9 +129,45 @@ func processCmdLineFlags() {
 func main() {
 	processCmdLineFlags()
 	r := gin.Default()
-	r.Use(cors.Default())
+	origins := strings.Split(corsOriginsFlag, ",")
+	for i := range origins {
+		origins[i] = strings.TrimSpace(origins[i])
+	}
+	r.Use(cors.New(corsConfig(origins)))
+
+	//Like on the base API every route but /health needs a caller that
+	//authenticates with a token or an API key, with todo:read to read
+	//and stream the items, todo:write to change them and admin for the
+	//webhooks
+	authn, err := auth.New(auth.OptionsFromEnv(auth.Options{
+		JWKSFile:      jwksFlag,
+		RedisLocation: apiKeyFlag,
+		Insecure:      noAuthFlag,
+	}))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	//Every route is rate limited, per caller when the request has
+	//credentials that check out and per client address otherwise
+	limiter, err := newRateLimiter()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	r.Use(authn.Identify(), limiter.Middleware())
 
-	apiHandler, err := api.New()
+	if backendFlag == "" && os.Getenv("TODO_BACKEND") == "" {
+		backendFlag = db.MemoryBackend
+	}
+	cfg := db.ConfigFromEnv(db.Config{
+		Backend:       backendFlag,
+		FileName:      dbFileFlag,
+		RedisLocation: redisFlag,
+	})
+
+	apiHandler, err := api.New(cfg)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -67,25 +175,213 @@ func main() {
 
 	apiHandler.AddEventListener()
 
-	r.GET("/todo", apiHandler.ListAllTodos)
-	r.POST("/todo", apiHandler.AddToDo)
-	r.PUT("/todo", apiHandler.UpdateToDo)
-	r.DELETE("/todo", apiHandler.DeleteAllToDo)
-	r.DELETE("/todo/:id", apiHandler.DeleteToDo)
-	r.GET("/todo/:id", apiHandler.GetToDo)
+	//With -stream the events also go to redis, where the todo-events CLI
+	//and other services can read them
+	if streamFlag {
+		stream, err := events.NewStream(events.RedisLocation())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer stream.Close()
+		if err := apiHandler.PublishToStream(stream); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		log.Println("Publishing events to the redis stream", stream.Key())
+	}
+
+	//Webhooks are sent the add, update and delete events
+	hooks := webhooks.NewWithOptions(api.WebhookEventTypes, webhooks.Options{AllowPrivateTargets: webhooksPrivateFlag})
+	if err := apiHandler.AddWebhooks(hooks); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	//Front-ends are pushed the changes instead of polling GET /todo
+	hub := live.NewWithOptions(live.Options{CheckOrigin: live.AllowOrigins(origins...)})
+	if err := apiHandler.AddLiveUpdates(hub); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	//Recurring items come back and overdue items send a reminder event.
+	//What the scheduler has done is kept with the todos, so a restart
+	//does not repeat it
+	states, err := db.NewStateStore(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	scheduler, err := apiHandler.AddScheduler(states, schedule.Options{Interval: scheduleEvery})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	scheduler.Start()
+
+	read := authn.Require(auth.TodoRead)
+	write := authn.Require(auth.TodoWrite)
 
-	//These are some extra endpoints that will be used to demonstrate
-	//a few resiliency features of GoLang Gin, and healthchecks
-	r.GET("/crash", apiHandler.CrashSim)
+	r.GET("/todo", read, apiHandler.ListAllTodos)
+	r.POST("/todo", write, apiHandler.AddToDo)
+	r.PUT("/todo", write, apiHandler.UpdateToDo)
+	r.DELETE("/todo/:id", write, apiHandler.DeleteToDo)
+	r.GET("/todo/:id", read, apiHandler.GetToDo)
+	r.GET("/todo/stream", read, hub.StreamEvents)
+	r.GET("/todo/stream/stats", read, hub.LiveStats)
+	r.GET("/todo/ws", read, hub.StreamWebSocket)
+
+	//Healthchecks and the event counts, deleting every item, turning
+	//eventing on and off and the crash demo are on the admin listener
 	r.GET("/health", apiHandler.HealthCheck)
-	r.GET("/event/:enableFlag", apiHandler.EventEnabler)
+	r.GET("/event/stats", read, apiHandler.EventStats)
+
+	//Teams register a URL here to be sent todo changes instead of
+	//polling.  Webhooks make the API send requests, so like on the voter
+	//API only admins can manage them
+	webhookRoutes := r.Group("/webhooks", authn.Require(auth.Admin))
+	webhookRoutes.POST("", hooks.RegisterWebhook)
+	webhookRoutes.GET("", hooks.ListWebhooks)
+	webhookRoutes.GET("/dead-letters", hooks.ListDeadLetters)
+	webhookRoutes.POST("/dead-letters/:deliveryId/retry", hooks.RetryDelivery)
+	webhookRoutes.GET("/:id", hooks.GetWebhook)
+	webhookRoutes.DELETE("/:id", hooks.DeleteWebhook)
+	webhookRoutes.GET("/:id/deliveries", hooks.ListDeliveries)
 
 	//We will now show a common way to version an API and add a new
 	//version of an API handler under /v2.  This new API will support
 	//a path parameter to search for todos based on a status
 	v2 := r.Group("/v2")
-	v2.GET("/todo", apiHandler.ListSelectTodos)
+	v2.GET("/todo", read, apiHandler.ListSelectTodos)
 
+	//r.Run() would serve until the process is killed, and any events
+	//still queued would be lost.  Instead we run the server ourselves,
+	//and on Ctrl-C or a SIGTERM from docker we stop taking requests, let
+	//the ones in flight finish and then deliver the queued events
 	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
-	r.Run(serverPath)
+	server := &http.Server{Addr: serverPath, Handler: r}
+	//The live streams never finish on their own, Shutdown would wait for
+	//them forever, so they are closed as soon as it starts
+	server.RegisterOnShutdown(hub.Close)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	adminRouter, err := adminRoutes(apiHandler, authn)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	adminServer := &http.Server{Addr: fmt.Sprintf("%s:%d", adminHostFlag, adminPortFlag), Handler: adminRouter}
+	go func() {
+		if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	log.Println("Shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the server: ", err)
+	}
+	if err := adminServer.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the admin server: ", err)
+	}
+	scheduler.Stop()
+	if err := apiHandler.StopEventListener(ctx); err != nil {
+		log.Println("Error delivering the queued events: ", err)
+	}
+	//The queued events may have started webhook deliveries, they get
+	//what is left of the timeout, the ones still going after that are
+	//cancelled and put on the dead-letter list
+	if err := hooks.Shutdown(ctx); err != nil {
+		log.Println("Error delivering the webhooks: ", err)
+	}
+}
+
+// corsConfig is cors.Default with the origins given by -cors-origins
+func corsConfig(origins []string) cors.Config {
+	config := cors.DefaultConfig()
+	for _, origin := range origins {
+		if origin == "*" {
+			config.AllowAllOrigins = true
+			return config
+		}
+	}
+	config.AllowOrigins = origins
+	return config
+}
+
+// defaultRateLimits are the limits when there is no -rate-limits file.
+// GET /todo reads every item, so it has a lower limit than the rest.
+func defaultRateLimits() ratelimit.Config {
+	return ratelimit.Config{
+		Default: ratelimit.MustParseLimit("600/m"),
+		Routes: map[string]ratelimit.Rule{
+			"GET /todo": ratelimit.MustParseLimit("60/m"),
+			"/health":   {},
+		},
+	}
+}
+
+// newRateLimiter returns the rate limiter of the public routes
+func newRateLimiter() (*ratelimit.Limiter, error) {
+	options, err := ratelimit.OptionsFromEnv(ratelimit.Options{
+		Config:        defaultRateLimits(),
+		RedisLocation: rateRedisFlag,
+		Identify:      auth.Subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitsFlag != "" {
+		if options.Config, err = ratelimit.LoadConfig(rateLimitsFlag); err != nil {
+			return nil, err
+		}
+	}
+	return ratelimit.New(options)
+}
+
+// adminRoutes returns the router of the admin listener.  Every route
+// needs a caller the RBAC policy allows and an X-Audit-Reason header,
+// and is logged, see the admin package.
+func adminRoutes(apiHandler *api.ToDoAPI, authn *auth.Authenticator) (*gin.Engine, error) {
+	policy := admin.DefaultPolicy(authn.Enabled())
+	if adminPolicyFlag != "" {
+		var err error
+		if policy, err = admin.LoadPolicy(adminPolicyFlag); err != nil {
+			return nil, err
+		}
+	}
+	adm := admin.New(admin.Options{Policy: policy, EnableChaos: enableChaosFlag, Identify: identify})
+
+	r := gin.Default()
+	group := r.Group("/admin", authn.Require())
+	group.GET("/whoami", adm.WhoAmI)
+	group.DELETE("/todo", adm.Allow(admin.ActionDeleteAll), apiHandler.DeleteAllToDo)
+	group.GET("/event/:enableFlag", adm.Allow(admin.ActionToggleEvents), apiHandler.EventEnabler)
+	group.GET("/crash", adm.Chaos(admin.ActionCrash), apiHandler.CrashSim)
+	return r, nil
+}
+
+// identify returns the caller of an admin route from the principal the
+// auth middleware found, Anonymous when authentication is off
+func identify(c *gin.Context) admin.Identity {
+	principal, ok := auth.PrincipalFrom(c)
+	if !ok {
+		return admin.Anonymous
+	}
+	identity := admin.Identity{Subject: principal.Subject}
+	for _, scope := range principal.Scopes {
+		identity.Scopes = append(identity.Scopes, string(scope))
+	}
+	return identity
 }
@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"drexel.edu/todo-events/api"
+	"drexel.edu/todo/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests check that the todo routes of this API behave like the
+// ones of the base API, since both can run on the same store.
+
+func todoRouter(store db.Store) *gin.Engine {
+	return auditedRouter(store, db.NewMemoryAuditLog())
+}
+
+func auditedRouter(store db.Store, auditLog db.AuditLog) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	todoApi := api.NewWithAuditLog(store, auditLog)
+	r := gin.New()
+	r.GET("/todo", todoApi.ListAllTodos)
+	r.POST("/todo", todoApi.AddToDo)
+	r.PUT("/todo", todoApi.UpdateToDo)
+	r.DELETE("/todo/:id", todoApi.DeleteToDo)
+	r.GET("/todo/:id", todoApi.GetToDo)
+	r.GET("/v2/todo", todoApi.ListSelectTodos)
+	return r
+}
+
+func sendJSON(r http.Handler, method string, path string, body any, headers map[string]string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAddToDoAssignsId(t *testing.T) {
+	store := db.NewMemoryStore()
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	r := todoRouter(store)
+
+	w := sendJSON(r, http.MethodPost, "/todo", db.ToDoItem{Title: "Learn Kubernetes"}, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created db.ToDoItem
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, 2, created.Id, "An item without an id gets the next one")
+	assert.Equal(t, "/todo/2", w.Header().Get("Location"))
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusCreated, sendJSON(r, http.MethodPost, "/todo", db.ToDoItem{Id: 5, Title: "Learn Redis"}, nil).Code)
+	assert.Equal(t, http.StatusConflict, sendJSON(r, http.MethodPost, "/todo", db.ToDoItem{Id: 5, Title: "Again"}, nil).Code)
+}
+
+func TestUpdateToDoVersions(t *testing.T) {
+	store := db.NewMemoryStore()
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	r := todoRouter(store)
+
+	w := sendJSON(r, http.MethodGet, "/todo/1", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	w = sendJSON(r, http.MethodPut, "/todo", db.ToDoItem{Id: 1, Title: "Learn Go well"}, map[string]string{"If-Match": etag})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusPreconditionFailed,
+		sendJSON(r, http.MethodPut, "/todo", db.ToDoItem{Id: 1, Title: "Stale"}, map[string]string{"If-Match": etag}).Code,
+		"A stale ETag is a 412, like on the base API")
+	assert.Equal(t, http.StatusPreconditionFailed,
+		sendJSON(r, http.MethodPut, "/todo", db.ToDoItem{Id: 1, Title: "Stale", Version: 1}, nil).Code,
+		"So is a stale version in the body")
+	assert.Equal(t, http.StatusPreconditionFailed,
+		sendJSON(r, http.MethodPut, "/todo", db.ToDoItem{Id: 1, Title: "Bad"}, map[string]string{"If-Match": "nonsense"}).Code)
+
+	item, err := store.GetItem(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Learn Go well", item.Title)
+}
+
+func TestDeleteToDo(t *testing.T) {
+	store := db.NewMemoryStore()
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	r := todoRouter(store)
+
+	assert.Equal(t, http.StatusBadRequest, sendJSON(r, http.MethodDelete, "/todo/abc", nil, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, sendJSON(r, http.MethodDelete, "/todo/1.5", nil, nil).Code)
+	assert.Equal(t, http.StatusNotFound, sendJSON(r, http.MethodDelete, "/todo/2", nil, nil).Code)
+	assert.Equal(t, http.StatusOK, sendJSON(r, http.MethodDelete, "/todo/1", nil, nil).Code)
+	assert.Equal(t, http.StatusNotFound, sendJSON(r, http.MethodDelete, "/todo/1", nil, nil).Code)
+}
+
+func TestListSelectTodos(t *testing.T) {
+	store := db.NewMemoryStore()
+	for i, title := range []string{"Learn Go", "Learn Kubernetes", "Water the plants", "Learn Redis"} {
+		require.NoError(t, store.AddItem(db.ToDoItem{Id: i + 1, Title: title, IsDone: i%2 == 1}))
+	}
+	r := todoRouter(store)
+	titles := func(w *httptest.ResponseRecorder) []string {
+		var items []db.ToDoItem
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+		var titles []string
+		for _, item := range items {
+			titles = append(titles, item.Title)
+		}
+		return titles
+	}
+
+	w := sendJSON(r, http.MethodGet, "/v2/todo?title_prefix=learn&sort=-id&limit=2", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"Learn Redis", "Learn Kubernetes"}, titles(w))
+	assert.Equal(t, "3", w.Header().Get("X-Total-Count"))
+	assert.Contains(t, w.Header().Get("Link"), `rel="next"`)
+
+	w = sendJSON(r, http.MethodGet, "/todo?done=false", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"Learn Go", "Water the plants"}, titles(w), "GET /todo takes the same query")
+	assert.Len(t, titles(sendJSON(r, http.MethodGet, "/todo", nil, nil)), 4)
+
+	assert.Equal(t, http.StatusBadRequest, sendJSON(r, http.MethodGet, "/v2/todo?done=maybe", nil, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, sendJSON(r, http.MethodGet, "/v2/todo?sort=color", nil, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, sendJSON(r, http.MethodGet, "/todo?limit=-1", nil, nil).Code)
+}
+
+func TestChangesAreAudited(t *testing.T) {
+	store := db.NewMemoryStore()
+	auditLog := db.NewMemoryAuditLog()
+	r := auditedRouter(store, auditLog)
+	actor := map[string]string{api.ActorHeader: "alice"}
+
+	require.Equal(t, http.StatusCreated, sendJSON(r, http.MethodPost, "/todo", db.ToDoItem{Title: "Learn Go"}, actor).Code)
+	require.Equal(t, http.StatusOK, sendJSON(r, http.MethodPut, "/todo", db.ToDoItem{Id: 1, Title: "Learn Go well"}, actor).Code)
+	require.Equal(t, http.StatusOK, sendJSON(r, http.MethodDelete, "/todo/1", nil, nil).Code)
+
+	records, err := auditLog.ItemRecords(1)
+	require.NoError(t, err)
+	require.Len(t, records, 3, "Every change made through this API is in the item's history")
+	assert.Equal(t, []db.AuditOp{db.AuditOpAdd, db.AuditOpUpdate, db.AuditOpDelete},
+		[]db.AuditOp{records[0].Op, records[1].Op, records[2].Op})
+	assert.Equal(t, "alice", records[0].Actor)
+	assert.Equal(t, "Learn Go well", records[1].After.Title)
+	assert.NotEmpty(t, records[2].Actor, "Without an actor the client address is recorded")
+	assert.Nil(t, records[2].After)
+}
@@ -0,0 +1,292 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"drexel.edu/todo-events/api"
+	"drexel.edu/todo-events/events"
+	"drexel.edu/todo-events/live"
+	"drexel.edu/todo/db"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sseEvent is one event read from GET /todo/stream
+type sseEvent struct {
+	Id   string
+	Name string
+	Data string
+}
+
+// newLiveServer returns an event manager that pushes to a hub, and a
+// server with the live routes
+func newLiveServer(t *testing.T, options live.Options) (*api.ToDoAPI, *live.Hub, *httptest.Server) {
+	gin.SetMode(gin.TestMode)
+	em := events.NewToDoEventManager()
+	todoApi := &api.ToDoAPI{}
+	todoApi.ConnectEventListener(em)
+	hub := live.NewWithOptions(options)
+	require.NoError(t, todoApi.AddLiveUpdates(hub))
+	em.Start()
+
+	r := gin.New()
+	r.GET("/todo/stream", hub.StreamEvents)
+	r.GET("/todo/ws", hub.StreamWebSocket)
+	server := httptest.NewServer(r)
+	t.Cleanup(func() {
+		hub.Close()
+		server.Close()
+		em.Stop()
+	})
+	return todoApi, hub, server
+}
+
+// readSSE sends the events of the response on a channel until the body
+// is closed
+func readSSE(body *bufio.Reader) <-chan sseEvent {
+	out := make(chan sseEvent, 16)
+	go func() {
+		defer close(out)
+		var event sseEvent
+		for {
+			line, err := body.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "":
+				if event.Name != "" {
+					out <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				event.Id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.Name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return out
+}
+
+// openSSE connects to the stream, lastEventId is sent if it is not empty
+func openSSE(t *testing.T, ctx context.Context, url string, lastEventId string) <-chan sseEvent {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return readSSE(bufio.NewReader(resp.Body))
+}
+
+// nextChange skips the pings and returns the next change
+func nextChange(t *testing.T, stream <-chan sseEvent) sseEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-stream:
+			require.True(t, ok, "The stream ended")
+			if event.Name != "ping" {
+				return event
+			}
+		case <-timeout:
+			require.FailNow(t, "No change was sent")
+		}
+	}
+}
+
+func TestLiveServerSentEvents(t *testing.T) {
+	todoApi, hub, server := newLiveServer(t, live.Options{HeartbeatInterval: 50 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notDone := openSSE(t, ctx, server.URL+"/todo/stream?done=false", "")
+	assert.Eventually(t, func() bool { return hub.Stats().Clients == 1 }, time.Second, 10*time.Millisecond)
+
+	added := events.NewEvent(events.AddPayload{Item: db.ToDoItem{Id: 1, Title: "Learn SSE"}})
+	todoApi.Notify(added)
+	todoApi.Notify(events.NewEvent(events.AddPayload{Item: db.ToDoItem{Id: 2, Title: "Done already", IsDone: true}}))
+	todoApi.Notify(events.NewEvent(events.QueryPayload{}))
+	todoApi.Notify(events.NewEvent(events.UpdatePayload{Item: db.ToDoItem{Id: 1, Title: "Learn Server-Sent Events"}}))
+	todoApi.Notify(events.NewEvent(events.DeletePayload{Id: 1}))
+
+	event := nextChange(t, notDone)
+	assert.Equal(t, added.Id, event.Id)
+	assert.Equal(t, "add", event.Name)
+	var msg struct {
+		Type string `json:"type"`
+		Data struct {
+			Item db.ToDoItem `json:"item"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(event.Data), &msg))
+	assert.Equal(t, "Learn SSE", msg.Data.Item.Title)
+	assert.Equal(t, "update", nextChange(t, notDone).Name, "The done item and the query should be skipped")
+	assert.Equal(t, "delete", nextChange(t, notDone).Name)
+
+	//The heartbeat keeps coming while nothing changes
+	select {
+	case event := <-notDone:
+		assert.Equal(t, "ping", event.Name)
+		assert.Empty(t, event.Id, "A ping should not move the Last-Event-ID")
+	case <-time.After(time.Second):
+		assert.Fail(t, "No heartbeat was sent")
+	}
+
+	//A client that reconnects gets what it missed after its last event
+	resumed := openSSE(t, ctx, server.URL+"/todo/stream?type=update,delete", added.Id)
+	assert.Equal(t, "update", nextChange(t, resumed).Name)
+	assert.Equal(t, "delete", nextChange(t, resumed).Name)
+
+	resp, err := http.Get(server.URL + "/todo/stream?done=maybe")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestLiveWebSocket(t *testing.T) {
+	todoApi, _, server := newLiveServer(t, live.Options{HeartbeatInterval: 50 * time.Millisecond})
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/todo/ws?type=add"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(data string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	todoApi.Notify(events.NewEvent(events.DeletePayload{All: true}))
+	todoApi.Notify(events.NewEvent(events.AddPayload{Item: db.ToDoItem{Id: 3, Title: "Learn WebSockets"}}))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		Type string `json:"type"`
+		Data struct {
+			Item db.ToDoItem `json:"item"`
+		} `json:"data"`
+	}
+	require.NoError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, "add", msg.Type, "The delete should be filtered out")
+	assert.Equal(t, 3, msg.Data.Item.Id)
+
+	//Pings are handled while reading
+	go conn.ReadMessage()
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		assert.Fail(t, "No ping was sent")
+	}
+}
+
+func TestLiveSlowClientIsDisconnected(t *testing.T) {
+	hub := live.NewWithOptions(live.Options{ClientBuffer: 2})
+	defer hub.Close()
+	slow, err := hub.Connect(live.Filter{}, "")
+	require.NoError(t, err)
+	reading, err := hub.Connect(live.Filter{}, "")
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, hub.Publish(events.NewEvent(events.AddPayload{Item: db.ToDoItem{Id: i}})))
+		<-reading.Messages()
+	}
+
+	select {
+	case <-slow.Done():
+	default:
+		require.FailNow(t, "The slow client should be disconnected")
+	}
+	assert.ErrorIs(t, slow.Err(), live.ErrTooSlow)
+	assert.NoError(t, reading.Err())
+	assert.Equal(t, 1, hub.Stats().Dropped)
+	assert.Equal(t, 1, hub.Stats().Clients)
+
+	//Closing the hub disconnects everyone else
+	hub.Close()
+	<-reading.Done()
+	assert.ErrorIs(t, reading.Err(), live.ErrClosed)
+	_, err = hub.Connect(live.Filter{}, "")
+	assert.ErrorIs(t, err, live.ErrClosed)
+}
+
+func TestLiveWebSocketOrigin(t *testing.T) {
+	url := func(server *httptest.Server) string {
+		return "ws" + strings.TrimPrefix(server.URL, "http") + "/todo/ws"
+	}
+	origin := func(value string) http.Header {
+		return http.Header{"Origin": []string{value}}
+	}
+
+	//Without a CheckOrigin only the API's own host may connect
+	_, _, server := newLiveServer(t, live.Options{})
+	_, resp, err := websocket.DefaultDialer.Dial(url(server), origin("https://evil.example.com"))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	conn, _, err := websocket.DefaultDialer.Dial(url(server), origin(server.URL))
+	require.NoError(t, err)
+	conn.Close()
+
+	_, _, server = newLiveServer(t, live.Options{CheckOrigin: live.AllowOrigins("https://app.example.com")})
+	conn, _, err = websocket.DefaultDialer.Dial(url(server), origin("https://app.example.com"))
+	require.NoError(t, err)
+	conn.Close()
+	_, resp, err = websocket.DefaultDialer.Dial(url(server), origin("https://evil.example.com"))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	conn, _, err = websocket.DefaultDialer.Dial(url(server), nil)
+	require.NoError(t, err, "Clients that are not browsers send no Origin")
+	conn.Close()
+
+	_, _, server = newLiveServer(t, live.Options{CheckOrigin: live.AllowOrigins("*")})
+	conn, _, err = websocket.DefaultDialer.Dial(url(server), origin("https://evil.example.com"))
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestLiveStreamWriteDeadline(t *testing.T) {
+	//The deadline is moved forward for every write, so a stream that
+	//lasts longer than WriteTimeout keeps going
+	_, _, server := newLiveServer(t, live.Options{
+		HeartbeatInterval: 20 * time.Millisecond,
+		WriteTimeout:      50 * time.Millisecond,
+	})
+	resp, err := http.Get(server.URL + "/todo/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	received := readSSE(bufio.NewReader(resp.Body))
+
+	pings := 0
+	timeout := time.After(5 * time.Second)
+	for pings < 10 {
+		select {
+		case event, ok := <-received:
+			require.True(t, ok, "The stream ended after %d pings", pings)
+			if event.Name == "ping" {
+				pings++
+			}
+		case <-timeout:
+			require.Fail(t, "Not enough pings", "got %d", pings)
+		}
+	}
+}
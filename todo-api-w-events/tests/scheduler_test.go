@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"drexel.edu/todo-events/api"
+	"drexel.edu/todo-events/events"
+	"drexel.edu/todo/db"
+	"drexel.edu/todo/schedule"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nextEvent waits for an event on the channel
+func nextEvent(t *testing.T, received <-chan *events.ToDoEvent) *events.ToDoEvent {
+	t.Helper()
+	select {
+	case event := <-received:
+		return event
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "No event was sent")
+		return nil
+	}
+}
+
+func TestSchedulerSendsRemindersAndRecurs(t *testing.T) {
+	store := db.NewMemoryStore()
+	due, _ := time.Parse(time.RFC3339, "2024-03-01T09:00:00Z")
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Pay rent", DueDate: &due, Recurrence: "@monthly"}))
+
+	em := events.NewToDoEventManager()
+	received := make(chan *events.ToDoEvent, 8)
+	collect := func(event *events.ToDoEvent) error {
+		received <- event
+		return nil
+	}
+	em.Subscribe(events.ToDoReminderEvent, collect)
+	em.Subscribe(events.ToDoAddEvent, collect)
+	todoApi := api.NewWithStore(store)
+	todoApi.ConnectEventListener(em)
+
+	clock := schedule.NewManualClock(due.Add(90 * time.Second))
+	scheduler, err := todoApi.AddScheduler(db.NewMemoryStateStore(), schedule.Options{Clock: clock})
+	require.NoError(t, err)
+
+	//While eventing is off the reminder cannot be sent, it is kept for
+	//the next run.  The next item is added either way.
+	result, err := scheduler.RunOnce()
+	assert.ErrorIs(t, err, events.ErrNotActive)
+	assert.Empty(t, result.Reminders)
+	require.Len(t, result.Recurred, 1)
+
+	em.Start()
+	defer em.Stop()
+	result, err = scheduler.RunOnce()
+	require.NoError(t, err)
+	require.Len(t, result.Reminders, 1)
+
+	reminder, ok := events.PayloadAs[events.ReminderPayload](nextEvent(t, received))
+	require.True(t, ok)
+	assert.Equal(t, 1, reminder.Item.Id)
+	assert.Equal(t, due, reminder.DueDate)
+	assert.Equal(t, "1m30s", reminder.OverdueBy)
+
+	//The next month is added once, and is not reminded until it is due
+	next, err := store.GetItem(2)
+	require.NoError(t, err)
+	assert.Equal(t, "Pay rent", next.Title)
+	assert.Equal(t, "2024-04-01T00:00:00Z", next.DueDate.Format(time.RFC3339))
+	clock.Advance(24 * time.Hour)
+	result, err = scheduler.RunOnce()
+	require.NoError(t, err)
+	assert.Empty(t, result.Reminders)
+	assert.Empty(t, result.Recurred)
+	select {
+	case event := <-received:
+		assert.Fail(t, "No more events should be sent", "got %s", event.EventID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
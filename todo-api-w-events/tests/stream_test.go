@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"drexel.edu/todo-events/events"
+	"drexel.edu/todo/db"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These run against a local redis, for example the container started by
+// make redis-up, and are skipped when it is not running.  Each test uses
+// its own stream key and deletes it when it is done.
+
+// newStream returns a stream on a fresh key
+func newStream(t *testing.T) *events.Stream {
+	t.Helper()
+	key := fmt.Sprintf("test:events:%s:%d", t.Name(), time.Now().UnixNano())
+	stream, err := events.NewStreamWithKey(events.RedisLocation(), key)
+	if err != nil {
+		t.Skip("Redis is not available, skipping: ", err)
+	}
+	t.Cleanup(func() {
+		client := redis.NewClient(&redis.Options{Addr: events.RedisLocation()})
+		client.Del(context.Background(), key)
+		client.Close()
+		stream.Close()
+	})
+	return stream
+}
+
+// publishChanges sends an add, an update and a delete through an event
+// manager that publishes to the stream
+func publishChanges(t *testing.T, stream *events.Stream) {
+	t.Helper()
+	em := events.NewToDoEventManager()
+	stream.PublishTo(em)
+	em.Start()
+	item := db.ToDoItem{Id: 1, Title: "Learn Redis Streams"}
+	require.NoError(t, em.Notify(events.NewEvent(events.AddPayload{Item: item})))
+	require.NoError(t, em.Notify(events.NewEvent(events.QueryPayload{Items: []db.ToDoItem{item}})))
+	item.IsDone = true
+	require.NoError(t, em.Notify(events.NewEvent(events.UpdatePayload{Item: item})))
+	require.NoError(t, em.Notify(events.NewEvent(events.DeletePayload{Id: 1})))
+	em.Stop()
+}
+
+func TestStreamReplay(t *testing.T) {
+	stream := newStream(t)
+	publishChanges(t, stream)
+
+	var got []events.StreamMessage
+	err := stream.Replay(context.Background(), "-", "+", func(msg events.StreamMessage) error {
+		got = append(got, msg)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, got, 3, "Queries should not be published")
+
+	add, ok := events.PayloadAs[events.AddPayload](got[0].Event)
+	assert.True(t, ok)
+	assert.Equal(t, "Learn Redis Streams", add.Item.Title)
+	update, ok := events.PayloadAs[events.UpdatePayload](got[1].Event)
+	assert.True(t, ok)
+	assert.True(t, update.Item.IsDone)
+	assert.Equal(t, events.DeletePayload{Id: 1}, got[2].Event.Payload)
+	assert.NotEmpty(t, got[0].Event.Id)
+	assert.False(t, got[0].Event.Timestamp.IsZero())
+
+	//Replaying from just after the first entry skips it
+	first := got[0].StreamId
+	got = nil
+	err = stream.Replay(context.Background(), "("+first, "+", func(msg events.StreamMessage) error {
+		got = append(got, msg)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+}
+
+func TestStreamConsumerGroup(t *testing.T) {
+	stream := newStream(t)
+	publishChanges(t, stream)
+
+	//The handler fails the update once.  It is left pending and handled
+	//again when the consumer is idle, after the delete.
+	var mu sync.Mutex
+	var seen []events.EventIDType
+	failed := false
+	handler := func(msg events.StreamMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, msg.Event.EventID)
+		if msg.Event.EventID == events.ToDoUpdateEvent && !failed {
+			failed = true
+			return errors.New("try again")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- stream.Consume(ctx, events.ConsumerOptions{Group: "audit", Consumer: "one", StartId: "0"}, handler)
+	}()
+
+	//Wait until every entry has been handled and acknowledged
+	client := redis.NewClient(&redis.Options{Addr: events.RedisLocation()})
+	defer client.Close()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		pending, err := client.XPending(context.Background(), stream.Key(), "audit").Result()
+		return err == nil && pending.Count == 0 && len(seen) == 4
+	}, 10*time.Second, 100*time.Millisecond)
+	cancel()
+	require.NoError(t, <-result)
+	assert.Equal(t, []events.EventIDType{events.ToDoAddEvent, events.ToDoUpdateEvent, events.ToDoDeleteEvent, events.ToDoUpdateEvent}, seen)
+
+	//Everything was acknowledged, so a second run of the same consumer
+	//has nothing to do
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := stream.Consume(ctx, events.ConsumerOptions{Group: "audit", Consumer: "one"}, func(msg events.StreamMessage) error {
+		t.Errorf("Unexpected event %s", msg.StreamId)
+		return nil
+	})
+	assert.NoError(t, err)
+}
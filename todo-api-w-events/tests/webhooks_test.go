@@ -0,0 +1,287 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"drexel.edu/middleware/webhooks"
+	"drexel.edu/todo-events/api"
+	"drexel.edu/todo-events/events"
+	"drexel.edu/todo/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver is an httptest server that records the deliveries it gets.
+// The first failures requests are answered with status.
+type receiver struct {
+	*httptest.Server
+	secret string
+
+	mu         sync.Mutex
+	failures   int
+	status     int
+	deliveries []*http.Request
+	bodies     [][]byte
+	verified   []bool
+}
+
+func newReceiver(t *testing.T, secret string, failures int, status int) *receiver {
+	rc := &receiver{secret: secret, failures: failures, status: status}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		rc.deliveries = append(rc.deliveries, r)
+		rc.bodies = append(rc.bodies, body)
+		rc.verified = append(rc.verified, webhooks.Verify(rc.secret, r.Header.Get(webhooks.HeaderTimestamp), body,
+			r.Header.Get(webhooks.HeaderSignature), time.Minute))
+		if len(rc.deliveries) <= rc.failures {
+			w.WriteHeader(rc.status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.deliveries)
+}
+
+// newManager returns a webhook manager with short backoffs, the
+// receivers of the tests are on the loopback interface
+func newManager(t *testing.T) *webhooks.Manager {
+	hooks := webhooks.NewWithOptions(api.WebhookEventTypes, webhooks.Options{
+		MaxAttempts:         3,
+		BaseBackoff:         10 * time.Millisecond,
+		Timeout:             time.Second,
+		AllowPrivateTargets: true,
+	})
+	t.Cleanup(hooks.Close)
+	return hooks
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	hooks := newManager(t)
+	all := newReceiver(t, "all-secret", 0, 0)
+	deletes := newReceiver(t, "delete-secret", 0, 0)
+	_, err := hooks.Register(all.URL, nil, "all-secret")
+	require.NoError(t, err)
+	_, err = hooks.Register(deletes.URL, []string{"todo.delete"}, "delete-secret")
+	require.NoError(t, err)
+
+	//The todo events reach the webhooks through the event manager
+	em := events.NewToDoEventManager()
+	todoApi := &api.ToDoAPI{}
+	todoApi.ConnectEventListener(em)
+	require.NoError(t, todoApi.AddWebhooks(hooks))
+	em.Start()
+	todoApi.Notify(events.NewEvent(events.AddPayload{Item: db.ToDoItem{Id: 1, Title: "Learn webhooks"}}))
+	todoApi.Notify(events.NewEvent(events.QueryPayload{}))
+	todoApi.Notify(events.NewEvent(events.DeletePayload{Id: 1}))
+	em.Stop()
+
+	assert.Eventually(t, func() bool { return all.count() == 2 && deletes.count() == 1 }, 5*time.Second, 10*time.Millisecond,
+		"Queries are not sent, and the second webhook only asked for deletes")
+
+	all.mu.Lock()
+	defer all.mu.Unlock()
+	assert.Equal(t, []bool{true, true}, all.verified, "Every delivery should be signed with the secret")
+	//Each delivery is sent on its own, so they can arrive in any order
+	add := 0
+	if all.deliveries[0].Header.Get(webhooks.HeaderEvent) != "todo.add" {
+		add = 1
+	}
+	assert.Equal(t, "todo.add", all.deliveries[add].Header.Get(webhooks.HeaderEvent))
+	var event struct {
+		Type string `json:"type"`
+		Data struct {
+			Item db.ToDoItem `json:"item"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(all.bodies[add], &event))
+	assert.Equal(t, "todo.add", event.Type)
+	assert.Equal(t, "Learn webhooks", event.Data.Item.Title)
+
+	assert.False(t, webhooks.Verify("wrong-secret", all.deliveries[add].Header.Get(webhooks.HeaderTimestamp), all.bodies[add],
+		all.deliveries[add].Header.Get(webhooks.HeaderSignature), time.Minute), "Another secret should not verify")
+}
+
+func TestWebhookRetryAndDeadLetter(t *testing.T) {
+	hooks := newManager(t)
+	flaky := newReceiver(t, "s", 2, http.StatusServiceUnavailable)
+	down := newReceiver(t, "s", 100, http.StatusInternalServerError)
+	rejecting := newReceiver(t, "s", 100, http.StatusBadRequest)
+	flakyHook, _ := hooks.Register(flaky.URL, nil, "s")
+	downHook, _ := hooks.Register(down.URL, nil, "s")
+	hooks.Register(rejecting.URL, nil, "s")
+
+	require.NoError(t, hooks.Dispatch(webhooks.Event{Id: "1-1", Type: "todo.update", Timestamp: time.Now()}))
+	assert.Eventually(t, func() bool { return len(hooks.DeadLetters()) == 2 && flaky.count() == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	//The flaky receiver worked on the third attempt
+	history, err := hooks.History(flakyHook.Id)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Equal(t, http.StatusServiceUnavailable, history[0].StatusCode)
+	assert.True(t, history[2].Delivered)
+
+	//The receiver that is down used up its attempts, the one that
+	//rejects the delivery with a 400 was not retried
+	assert.Equal(t, 3, down.count())
+	assert.Equal(t, 1, rejecting.count())
+	letters := hooks.DeadLetters()
+	byWebhook := map[int]webhooks.DeadLetter{}
+	for _, letter := range letters {
+		byWebhook[letter.WebhookId] = letter
+	}
+	assert.Equal(t, 3, byWebhook[downHook.Id].Attempts)
+	assert.Equal(t, "1-1", byWebhook[downHook.Id].Event.Id)
+
+	//Once the receiver is back the dead letter can be sent again
+	down.mu.Lock()
+	down.failures = 0
+	down.mu.Unlock()
+	require.NoError(t, hooks.RetryDeadLetter(byWebhook[downHook.Id].DeliveryId))
+	assert.Eventually(t, func() bool { return down.count() == 4 }, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, hooks.DeadLetters(), 1)
+	assert.ErrorIs(t, hooks.RetryDeadLetter("missing"), webhooks.ErrDeadLetterNotFound)
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hooks := newManager(t)
+	r := gin.New()
+	r.POST("/webhooks", hooks.RegisterWebhook)
+	r.GET("/webhooks", hooks.ListWebhooks)
+	r.GET("/webhooks/:id/deliveries", hooks.ListDeliveries)
+	r.DELETE("/webhooks/:id", hooks.DeleteWebhook)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := send(http.MethodPost, "/webhooks", `{"url": "http://localhost:9/hook", "events": ["todo.add"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var created map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.NotEmpty(t, created["secret"], "A secret should be made and returned once")
+
+	w = send(http.MethodGet, "/webhooks", "")
+	assert.NotContains(t, w.Body.String(), "secret", "The secret should not be listed")
+
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/webhooks", `{"url": "http://localhost:9", "events": ["todo.query"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/webhooks", `{"url": "ftp://localhost:9"}`).Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/webhooks/1/deliveries", "").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/webhooks/1", "").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/webhooks/1/deliveries", "").Code)
+}
+
+func TestWebhookPrivateTargets(t *testing.T) {
+	hooks := webhooks.New(api.WebhookEventTypes)
+	t.Cleanup(hooks.Close)
+
+	for _, target := range []string{
+		"http://127.0.0.1:1081/admin/todo",
+		"http://localhost/hook",
+		"http://api.localhost/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.10/hook",
+		"http://0.0.0.0/hook",
+	} {
+		_, err := hooks.Register(target, nil, "")
+		assert.ErrorIs(t, err, webhooks.ErrInvalidWebhook, target)
+	}
+	_, err := hooks.Register("https://hooks.example.com/todo", nil, "")
+	assert.NoError(t, err)
+}
+
+// slowReceiver answers every delivery once release is closed
+func slowReceiver(t *testing.T) (*httptest.Server, chan struct{}) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, release
+}
+
+func TestWebhookShutdownWaits(t *testing.T) {
+	hooks := newManager(t)
+	server, release := slowReceiver(t)
+	hook, err := hooks.Register(server.URL, nil, "")
+	require.NoError(t, err)
+	require.NoError(t, hooks.Dispatch(webhooks.Event{Id: "1-1", Type: "todo.add", Timestamp: time.Now()}))
+
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, hooks.Shutdown(ctx))
+
+	history, err := hooks.History(hook.Id)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.True(t, history[0].Delivered, "Shutdown should wait for the attempt in flight")
+	assert.Empty(t, hooks.DeadLetters())
+	assert.ErrorIs(t, hooks.Dispatch(webhooks.Event{Id: "1-2", Type: "todo.add", Timestamp: time.Now()}), webhooks.ErrClosed)
+}
+
+func TestWebhookShutdownDeadline(t *testing.T) {
+	hooks := newManager(t)
+	server, release := slowReceiver(t)
+	defer close(release)
+	_, err := hooks.Register(server.URL, nil, "")
+	require.NoError(t, err)
+	require.NoError(t, hooks.Dispatch(webhooks.Event{Id: "1-1", Type: "todo.add", Timestamp: time.Now()}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, hooks.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Len(t, hooks.DeadLetters(), 1, "The delivery that was cancelled should be a dead letter")
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	hooks := webhooks.NewWithOptions(api.WebhookEventTypes, webhooks.Options{
+		Workers:             1,
+		QueueSize:           1,
+		AllowPrivateTargets: true,
+	})
+	t.Cleanup(hooks.Close)
+	server, release := slowReceiver(t)
+	defer close(release)
+	_, err := hooks.Register(server.URL, nil, "")
+	require.NoError(t, err)
+
+	//The first delivery keeps the worker busy, the second waits in the
+	//queue and the third does not fit
+	require.NoError(t, hooks.Dispatch(webhooks.Event{Id: "1-1", Type: "todo.add", Timestamp: time.Now()}))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, hooks.Dispatch(webhooks.Event{Id: "1-2", Type: "todo.add", Timestamp: time.Now()}))
+	require.NoError(t, hooks.Dispatch(webhooks.Event{Id: "1-3", Type: "todo.add", Timestamp: time.Now()}))
+
+	letters := hooks.DeadLetters()
+	require.Len(t, letters, 1)
+	assert.Equal(t, "1-3", letters[0].Event.Id)
+	assert.Contains(t, letters[0].LastError, "queue is full")
+	assert.ErrorIs(t, hooks.RetryDeadLetter(letters[0].DeliveryId), webhooks.ErrQueueFull)
+}
@@ -1,9 +1,16 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
 
 	"drexel.edu/todo/db"
 	"github.com/gin-gonic/gin"
@@ -11,17 +18,94 @@ import (
 
 // The api package creates and maintains a reference to the data handler
 // this is a good design practice
+//
+// Every change goes through an AuditedStore, so it is recorded in the
+// audit history with who made it and the item before and after.
+//
+// db is the default list, the one behind /todo.  The named lists under
+// /lists/:listId/todo each have their own store, opened by openList the
+// first time the list is used and kept in stores, see lists.go.
 type ToDoAPI struct {
-	db *db.ToDo
+	db    *db.AuditedStore
+	lists *db.ListRegistry
+
+	openList func(list string) (*db.AuditedStore, error)
+	mu       sync.Mutex
+	stores   map[string]*db.AuditedStore
 }
 
-func New() (*ToDoAPI, error) {
-	dbHandler, err := db.New()
+// ActorHeader names who is making a request, it is recorded with each
+// change in the audit history
+const ActorHeader = "X-Actor"
+
+// New creates the storage backend described by the config and returns
+// an API handler that uses it.  The audit history and the lists are kept
+// by the same backend.
+func New(cfg db.Config) (*ToDoAPI, error) {
+	dbHandler, err := db.NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := db.NewAuditLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := db.NewListRegistry(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ToDoAPI{db: dbHandler}, nil
+	td := NewWithAuditLog(dbHandler, auditLog)
+	td.lists = registry
+	td.openList = func(list string) (*db.AuditedStore, error) {
+		listCfg := cfg.ForList(list)
+		store, err := db.NewStore(listCfg)
+		if err != nil {
+			return nil, err
+		}
+		auditLog, err := db.NewAuditLog(listCfg)
+		if err != nil {
+			return nil, err
+		}
+		return db.NewAuditedStore(store, auditLog), nil
+	}
+	return td, nil
+}
+
+// NewWithStore returns an API handler that uses an existing storage
+// backend.  This is handy for tests that want to provide their own store.
+// The audit history is kept in memory.
+func NewWithStore(store db.Store) *ToDoAPI {
+	return NewWithAuditLog(store, db.NewMemoryAuditLog())
+}
+
+// NewWithAuditLog returns an API handler that uses an existing storage
+// backend and audit log.  The lists, and the items of the named lists,
+// are kept in memory.
+func NewWithAuditLog(store db.Store, auditLog db.AuditLog) *ToDoAPI {
+	return &ToDoAPI{
+		db:    db.NewAuditedStore(store, auditLog),
+		lists: db.NewMemoryListRegistry(),
+		openList: func(list string) (*db.AuditedStore, error) {
+			return db.NewAuditedStore(db.NewMemoryStore(), db.NewMemoryAuditLog()), nil
+		},
+		stores: make(map[string]*db.AuditedStore),
+	}
+}
+
+// storeFor returns the store to make the changes of a request with, so
+// they are recorded as made by whoever sent it.  That is the user, see
+// userOf, then the X-Actor header, or the client address when there is
+// neither.
+func (td *ToDoAPI) storeFor(c *gin.Context) *db.AuditedStore {
+	actor := userOf(c)
+	if actor == "" {
+		actor = c.GetHeader(ActorHeader)
+	}
+	if actor == "" {
+		actor = c.ClientIP()
+	}
+	return td.listStore(c).As(actor)
 }
 
 //Below we implement the API functions.  Some of the framework
@@ -39,7 +123,7 @@ func New() (*ToDoAPI, error) {
 // returns all todos
 func (td *ToDoAPI) ListAllTodos(c *gin.Context) {
 
-	todoList, err := td.db.GetAllItems()
+	todoList, err := td.listStore(c).GetAllItems()
 	if err != nil {
 		log.Println("Error Getting All Items: ", err)
 		c.AbortWithStatus(http.StatusNotFound)
@@ -57,64 +141,127 @@ func (td *ToDoAPI) ListAllTodos(c *gin.Context) {
 }
 
 // implementation for GET /v2/todo
-// returns todos that are either done or not done
-// depending on the value of the done query parameter
-// for example, /v2/todo?done=true will return all
-// todos that are done.  Note you can have multiple
-// query parameters, for example /v2/todo?done=true&foo=bar
+// returns the todos that match a query.  All of the query parameters
+// are optional and can be combined, for example
+// /v2/todo?done=false&title=go&sort=-priority,dueDate&limit=10
+//
+//	done=true|false        only done or not done items
+//	title=<text>           title contains the text, ignoring case
+//	title_prefix=<text>    title starts with the text, ignoring case
+//	priority=<priority>    only items with this priority
+//	tag=<tag>              only items with this tag
+//	sort=<field>,-<field>  sort order, - for descending, default id
+//	limit=<n>              at most n items
+//	offset=<n>             skip the first n items
+//	cursor=<cursor>        the page after the cursor from a Link header
+//
+// The body is still a plain JSON array of items.  The number of items
+// that matched across all pages is in the X-Total-Count header and the
+// next, previous and first pages are in the Link header.
 func (td *ToDoAPI) ListSelectTodos(c *gin.Context) {
-	//lets first load the data
-	todoList, err := td.db.GetAllItems()
+	query, err := queryFromRequest(c)
 	if err != nil {
-		log.Println("Error Getting Database Items: ", err)
-		c.AbortWithStatus(http.StatusNotFound)
+		log.Println("Error in query: ", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	//If the database is empty, make an empty slice so that the
-	//JSON marshalling works correctly
-	if todoList == nil {
-		todoList = make([]db.ToDoItem, 0)
+
+	//The db package pushes the filters down to the backend when it
+	//can, for example to RediSearch, instead of loading every item
+	result, err := db.QueryItems(td.listStore(c), query)
+	if err != nil {
+		log.Println("Error querying items: ", err)
+		c.AbortWithStatus(statusFor(err))
+		return
 	}
 
-	//Note that the query parameter is a string, so we
-	//need to convert it to a bool
-	doneS := c.Query("done")
+	c.Header("X-Total-Count", strconv.Itoa(result.Total))
+	if links := pageLinks(c.Request.URL, query, result); links != "" {
+		c.Header("Link", links)
+	}
 
-	//if the doneS is empty, then we will return all items
-	if doneS == "" {
-		c.JSON(http.StatusOK, todoList)
-		return
+	//If nothing matched, make an empty slice so that the JSON
+	//marshalling returns [] instead of null
+	if result.Items == nil {
+		result.Items = make([]db.ToDoItem, 0)
 	}
+	c.JSON(http.StatusOK, result.Items)
+}
 
-	//Now we can handle the case where doneS is not empty
-	//and we need to filter the list based on the doneS value
+// queryFromRequest reads the query parameters of GET /v2/todo
+func queryFromRequest(c *gin.Context) (db.Query, error) {
+	query := db.Query{
+		TitleSearch: c.Query("title"),
+		TitlePrefix: c.Query("title_prefix"),
+		Priority:    db.Priority(c.Query("priority")),
+		Tag:         c.Query("tag"),
+		Cursor:      c.Query("cursor"),
+	}
 
-	done, err := strconv.ParseBool(doneS)
+	//Note that the query parameters are strings, so we
+	//need to convert them to the right types
+	if doneS := c.Query("done"); doneS != "" {
+		done, err := strconv.ParseBool(doneS)
+		if err != nil {
+			return query, fmt.Errorf("done must be true or false, got %q", doneS)
+		}
+		query.Done = &done
+	}
+	for name, value := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		if s := c.Query(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return query, fmt.Errorf("%s must be a number that is 0 or more, got %q", name, s)
+			}
+			*value = n
+		}
+	}
+	sortKeys, err := db.ParseSort(c.Query("sort"))
 	if err != nil {
-		log.Println("Error converting done to bool: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+		return query, err
 	}
+	query.Sort = sortKeys
+	return query, query.Validate()
+}
 
-	//Now we need to filter the list based on the done value
-	//that was passed in.  We will create a new slice and
-	//only add items that match the done value
-	var filteredList []db.ToDoItem
-	for _, item := range todoList {
-		if item.IsDone == done {
-			filteredList = append(filteredList, item)
+// pageLinks builds an RFC 8288 Link header for the pages around this
+// one.  Clients that sent an offset get offset links, everyone else gets
+// a cursor link to the next page, which does not skip or repeat items
+// when the list changes between requests.
+func pageLinks(u *url.URL, query db.Query, result db.QueryResult) string {
+	if query.Limit == 0 {
+		return ""
+	}
+	link := func(rel string, set map[string]string) string {
+		params := u.Query()
+		for _, name := range []string{"offset", "cursor"} {
+			params.Del(name)
+		}
+		for name, value := range set {
+			params.Set(name, value)
 		}
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, params.Encode(), rel)
 	}
 
-	//Note that the database returns a nil slice if there are no items
-	//in the database.  We need to convert this to an empty slice
-	//so that the JSON marshalling works correctly.  We want to return
-	//an empty slice, not a nil slice. This will result in the json being []
-	if filteredList == nil {
-		filteredList = make([]db.ToDoItem, 0)
+	var links []string
+	usesOffset := u.Query().Has("offset")
+	if !usesOffset && result.NextCursor != "" {
+		links = append(links, link("next", map[string]string{"cursor": result.NextCursor}))
 	}
-
-	c.JSON(http.StatusOK, filteredList)
+	if next := query.Offset + query.Limit; usesOffset && next < result.Total {
+		links = append(links, link("next", map[string]string{"offset": strconv.Itoa(next)}))
+	}
+	if query.Offset > 0 {
+		prev := query.Offset - query.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link("prev", map[string]string{"offset": strconv.Itoa(prev)}))
+	}
+	if query.Offset > 0 || query.Cursor != "" {
+		links = append(links, link("first", nil))
+	}
+	return strings.Join(links, ", ")
 }
 
 // implementation for GET /todo/:id
@@ -134,13 +281,17 @@ func (td *ToDoAPI) GetToDo(c *gin.Context) {
 
 	//Note that ParseInt always returns an int64, so we have to
 	//convert it to an int before we can use it.
-	todoItem, err := td.db.GetItem(int(id64))
+	todoItem, err := td.listStore(c).GetItem(int(id64))
 	if err != nil {
 		log.Println("Item not found: ", err)
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
+	//The ETag lets a client send the item back with If-Match, so a
+	//PUT fails instead of overwriting a change made by someone else
+	c.Header("ETag", etagFor(todoItem))
+
 	//Git will automatically convert the struct to JSON
 	//and set the content-type header to application/json
 	c.JSON(http.StatusOK, todoItem)
@@ -168,17 +319,36 @@ func (td *ToDoAPI) AddToDo(c *gin.Context) {
 		return
 	}
 
-	if err := td.db.AddItem(todoItem); err != nil {
+	//Clients do not have to invent ids, an item posted without one
+	//gets the next id from the database.  Picking the id is atomic in
+	//every backend, so two clients posting at once get different ids.
+	store := td.storeFor(c)
+	if todoItem.Id == 0 {
+		created, err := store.CreateItem(todoItem)
+		if err != nil {
+			log.Println("Error creating item: ", err)
+			c.AbortWithStatus(statusFor(err))
+			return
+		}
+		todoItem = created
+	} else if err := store.AddItem(todoItem); err != nil {
 		log.Println("Error adding item: ", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		c.AbortWithStatus(statusFor(err))
 		return
 	}
 
-	c.JSON(http.StatusOK, todoItem)
+	//The database sets the created and updated times, so send back
+	//the item as it was stored rather than the one that was posted
+	c.Header("Location", path.Join(c.Request.URL.Path, strconv.Itoa(todoItem.Id)))
+	td.respondWithItem(c, http.StatusCreated, todoItem.Id)
 }
 
 // implementation for PUT /todo
-// Web api standards use PUT for Updates
+// Web api standards use PUT for Updates.  Updates use optimistic
+// concurrency, the item is only replaced if the client saw the latest
+// version of it.  The version can be sent in the body, or as the ETag
+// from GET /todo/:id in an If-Match header.  A stale version returns
+// 412 Precondition Failed.
 func (td *ToDoAPI) UpdateToDo(c *gin.Context) {
 	var todoItem db.ToDoItem
 	if err := c.ShouldBindJSON(&todoItem); err != nil {
@@ -187,24 +357,211 @@ func (td *ToDoAPI) UpdateToDo(c *gin.Context) {
 		return
 	}
 
-	if err := td.db.UpdateItem(todoItem); err != nil {
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" && ifMatch != "*" {
+		version, ok := versionFromETag(ifMatch)
+		if !ok || (todoItem.Version != 0 && todoItem.Version != version) {
+			log.Println("If-Match does not match the item version: ", ifMatch)
+			c.AbortWithStatus(http.StatusPreconditionFailed)
+			return
+		}
+		//The database checks the version in the same step as the
+		//write, so nothing can change in between
+		todoItem.Version = version
+	}
+
+	if err := td.storeFor(c).UpdateItem(todoItem); err != nil {
 		log.Println("Error updating item: ", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		c.AbortWithStatus(statusFor(err))
 		return
 	}
 
-	c.JSON(http.StatusOK, todoItem)
+	td.respondWithItem(c, http.StatusOK, todoItem.Id)
+}
+
+// respondWithItem reads an item back from the database and returns it,
+// so the response has the timestamps and version the database manages
+func (td *ToDoAPI) respondWithItem(c *gin.Context, status int, id int) {
+	todoItem, err := td.listStore(c).GetItem(id)
+	if err != nil {
+		log.Println("Error reading item back: ", err)
+		c.AbortWithStatus(statusFor(err))
+		return
+	}
+	c.Header("ETag", etagFor(todoItem))
+	c.JSON(status, todoItem)
+}
+
+// etagFor returns the ETag of an item, its version in quotes
+func etagFor(item db.ToDoItem) string {
+	return fmt.Sprintf("%q", strconv.Itoa(item.Version))
+}
+
+// versionFromETag reads the version back out of an If-Match header.  A
+// weak ETag (W/"3") is accepted the same as a strong one.
+func versionFromETag(etag string) (int, bool) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil {
+		return 0, false
+	}
+	version, err := strconv.Atoi(unquoted)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// statusFor maps a database error to the HTTP status code to return.
+// Errors that are not recognized are server errors.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidItem) || errors.Is(err, db.ErrInvalidQuery) || errors.Is(err, db.ErrInvalidList):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrItemNotFound) || errors.Is(err, db.ErrVersionNotFound),
+		errors.Is(err, db.ErrListNotFound) || errors.Is(err, db.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrItemExists) || errors.Is(err, db.ErrListExists) || errors.Is(err, db.ErrUserExists):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrVersionConflict):
+		return http.StatusPreconditionFailed
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// implementation for POST /todo:bulk
+// adds a JSON array of items.  Like POST /todo, items without an id get
+// the next free one.  Each item is added on its own, so some can fail
+// while the rest are added.  The response is a summary with a result
+// per item.  With ?dry_run=true nothing is added, the summary says what
+// would happen.
+func (td *ToDoAPI) BulkCreateToDo(c *gin.Context) {
+	dryRun, err := dryRunFromRequest(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var items []db.ToDoItem
+	if err := c.ShouldBindJSON(&items); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	summary, err := db.BulkCreate(td.storeFor(c), items, dryRun)
+	if err != nil {
+		log.Println("Error creating items: ", err)
+		c.AbortWithStatus(statusFor(err))
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// implementation for PATCH /todo
+// changes some fields of every item that matches a filter.  The filter
+// is given with the same query parameters as GET /v2/todo, and the body
+// has the fields to set, for example
+//
+//	PATCH /todo?title_prefix=learn   {"done": true}
+//
+// marks every item whose title starts with learn as done.  Items that
+// are changed by someone else while the patch runs are reported as
+// failed rather than overwritten.  ?dry_run=true reports what would
+// change without changing it.
+func (td *ToDoAPI) PatchToDos(c *gin.Context) {
+	query, dryRun, err := bulkQueryFromRequest(c)
+	if err != nil {
+		log.Println("Error in query: ", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Unknown fields are rejected, a typo like "dne" should not turn
+	//into a patch that quietly does nothing
+	var patch db.ItemPatch
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	summary, err := db.PatchItems(td.storeFor(c), query, patch, dryRun)
+	if err != nil {
+		log.Println("Error patching items: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// dryRunFromRequest reads the dry_run query parameter
+func dryRunFromRequest(c *gin.Context) (bool, error) {
+	s := c.Query("dry_run")
+	if s == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("dry_run must be true or false, got %q", s)
+	}
+	return dryRun, nil
+}
+
+// bulkQueryFromRequest reads the filter and dry_run parameters of the
+// bulk endpoints
+func bulkQueryFromRequest(c *gin.Context) (db.Query, bool, error) {
+	dryRun, err := dryRunFromRequest(c)
+	if err != nil {
+		return db.Query{}, false, err
+	}
+	query, err := queryFromRequest(c)
+	return query, dryRun, err
+}
+
+// CustomMethods returns the handler for the requests gin has no route
+// for.  Gin cannot register a path like /todo:bulk next to /todo, it
+// reads the colon as the start of a path parameter, so these custom
+// methods are matched here instead.  write is the scope check of the
+// bulk routes, it only runs once a path matched, so unknown paths are
+// still a 404 for anyone.  POST /lists/:listId/todo:bulk is checked for
+// access the same way as the routes of the list.
+func (td *ToDoAPI) CustomMethods(write gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if c.Request.URL.Path == "/todo:bulk" {
+			if write(c); !c.IsAborted() {
+				td.BulkCreateToDo(c)
+			}
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(c.Request.URL.Path, "/"), "/")
+		if len(parts) == 3 && parts[0] == "lists" && parts[2] == "todo:bulk" {
+			c.Params = append(c.Params, gin.Param{Key: "listId", Value: parts[1]})
+			if write(c); !c.IsAborted() && td.openListFor(c, db.RoleWrite) {
+				td.BulkCreateToDo(c)
+			}
+			return
+		}
+		c.AbortWithStatus(http.StatusNotFound)
+	}
 }
 
 // implementation for DELETE /todo/:id
 // deletes a todo
 func (td *ToDoAPI) DeleteToDo(c *gin.Context) {
-	idS := c.Param("id")
-	id64, _ := strconv.ParseInt(idS, 10, 32)
+	id, ok := idFromRequest(c)
+	if !ok {
+		return
+	}
 
-	if err := td.db.DeleteItem(int(id64)); err != nil {
+	if err := td.storeFor(c).DeleteItem(id); err != nil {
 		log.Println("Error deleting item: ", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		c.AbortWithStatus(statusFor(err))
 		return
 	}
 
@@ -212,21 +569,190 @@ func (td *ToDoAPI) DeleteToDo(c *gin.Context) {
 }
 
 // implementation for DELETE /todo
-// deletes all todos
+// deletes the todos that match a filter, given with the same query
+// parameters as GET /v2/todo, for example /todo?done=true deletes the
+// items that are done.  A filter is needed, deleting every item is done
+// on the admin listener with DELETE /admin/todo.
+func (td *ToDoAPI) DeleteMatchingToDos(c *gin.Context) {
+	query, _, err := bulkQueryFromRequest(c)
+	if err == nil && !query.Filtered() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "a filter is needed, deleting every item is an admin operation"})
+		return
+	}
+	td.DeleteAllToDo(c)
+}
+
+// implementation for DELETE /admin/todo
+// deletes the todos that match a filter like DELETE /todo, without a
+// filter every item is deleted.  The response is a summary of the
+// deleted items, with ?dry_run=true it lists what would be deleted
+// without deleting anything.
 func (td *ToDoAPI) DeleteAllToDo(c *gin.Context) {
+	query, dryRun, err := bulkQueryFromRequest(c)
+	if err != nil {
+		log.Println("Error in query: ", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	summary, err := db.DeleteItems(td.storeFor(c), query, dryRun)
+	if err != nil {
+		log.Println("Error deleting items: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+/*   AUDIT HISTORY */
+
+// idFromRequest reads the :id parameter, it aborts the request with a
+// 400 if it is not a number
+func idFromRequest(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println("Error converting id to int: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// seqFromRequest reads a sequence number query parameter, 0 when it is
+// not there
+func seqFromRequest(c *gin.Context, name string) (int64, error) {
+	s := c.Query(name)
+	if s == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("%s must be a sequence number, got %q", name, s)
+	}
+	return seq, nil
+}
 
-	if err := td.db.DeleteAll(); err != nil {
-		log.Println("Error deleting all items: ", err)
+// implementation for GET /todo/:id/history
+// returns the audit records of an item, oldest first.  Each record has
+// the item before and after the change, who made it and when.
+func (td *ToDoAPI) GetToDoHistory(c *gin.Context) {
+	id, ok := idFromRequest(c)
+	if !ok {
+		return
+	}
+	history, err := td.listStore(c).History(id)
+	if err != nil {
+		log.Println("Error reading history: ", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	if len(history) == 0 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
 
-	c.Status(http.StatusOK)
+// implementation for POST /todo/:id/revert?to=<version>
+// puts an item back the way it was at a version from its history.  The
+// revert is a change like any other, the item gets a new version and
+// the revert is recorded in the history.
+func (td *ToDoAPI) RevertToDo(c *gin.Context) {
+	id, ok := idFromRequest(c)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(c.Query("to"))
+	if err != nil || version <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "to must be the version to revert to"})
+		return
+	}
+
+	item, err := td.storeFor(c).Revert(id, version)
+	if err != nil {
+		log.Println("Error reverting item: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("ETag", etagFor(item))
+	c.JSON(http.StatusOK, item)
+}
+
+// implementation for GET /todo/history?after=<seq>
+// returns every audit record after a sequence number, all of them
+// without one
+func (td *ToDoAPI) ListHistory(c *gin.Context) {
+	after, err := seqFromRequest(c, "after")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	records, err := td.listStore(c).Log().Records(after)
+	if err != nil {
+		log.Println("Error reading history: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = make([]db.AuditRecord, 0)
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// implementation for GET /todo/history/replay?until=<seq>
+// returns the items the database had right after a record, rebuilt by
+// replaying the audit history.  Without until it replays everything,
+// which should match GET /todo.  Nothing is changed.
+func (td *ToDoAPI) ReplayHistory(c *gin.Context) {
+	until, err := seqFromRequest(c, "until")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	records, err := td.listStore(c).Log().Records(0)
+	if err != nil {
+		log.Println("Error reading history: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, db.ReplayAudit(records, until))
+}
+
+// implementation for POST /todo/history/replay?until=<seq>
+// rebuilds the database from the audit history, as it was right after
+// a record.  Only the items that differ are written, and the writes are
+// recorded in the history like any other.  The response is a bulk
+// summary, with ?dry_run=true nothing is changed.
+func (td *ToDoAPI) RebuildFromHistory(c *gin.Context) {
+	until, err := seqFromRequest(c, "until")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dryRun, err := dryRunFromRequest(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	records, err := td.listStore(c).Log().Records(0)
+	if err != nil {
+		log.Println("Error reading history: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	summary, err := db.RebuildFromAudit(td.storeFor(c), records, until, dryRun)
+	if err != nil {
+		log.Println("Error rebuilding from history: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
 }
 
 /*   SPECIAL HANDLERS FOR DEMONSTRATION - CRASH SIMULATION AND HEALTH CHECK */
 
-// implementation for GET /crash
+// implementation for GET /admin/crash
 // This simulates a crash to show some of the benefits of the
 // gin framework
 func (td *ToDoAPI) CrashSim(c *gin.Context) {
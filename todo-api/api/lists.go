@@ -0,0 +1,289 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"drexel.edu/middleware/auth"
+	"drexel.edu/todo/db"
+	"github.com/gin-gonic/gin"
+)
+
+// Users and named lists.  Every item belongs to a list.  The /todo routes
+// are the default list, which anyone can read and change, and the same
+// routes under /lists/:listId/todo work on a named list.  A named list is
+// owned by the user that made it, who can share it with other users to
+// read or to write.
+//
+// The user making a request is the subject of its token or API key when
+// authentication is on, see the auth package, and the X-User header when
+// it is off.  A list the user has no role on returns 404 so it does
+// not give away that the list exists, and a role that is not enough, for
+// example a PUT with read access, returns 403.
+
+// UserHeader names the user making a request when authentication is off
+const UserHeader = "X-User"
+
+// userOf returns the user making a request.  A request that was
+// authenticated cannot claim to be someone else with X-User.
+func userOf(c *gin.Context) string {
+	if principal, ok := auth.PrincipalFrom(c); ok {
+		return principal.Subject
+	}
+	return c.GetHeader(UserHeader)
+}
+
+// Keys of the values ListAccess sets on the gin context
+const (
+	listKey      = "todo.list"
+	listStoreKey = "todo.listStore"
+)
+
+// listStore returns the store of the list the request is for, the
+// default list unless ListAccess picked another one
+func (td *ToDoAPI) listStore(c *gin.Context) *db.AuditedStore {
+	if store, ok := c.Get(listStoreKey); ok {
+		return store.(*db.AuditedStore)
+	}
+	return td.db
+}
+
+// storeForList returns the store of a list, opening it the first time
+func (td *ToDoAPI) storeForList(list string) (*db.AuditedStore, error) {
+	if list == db.DefaultList {
+		return td.db, nil
+	}
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	if store, ok := td.stores[list]; ok {
+		return store, nil
+	}
+	store, err := td.openList(list)
+	if err != nil {
+		return nil, err
+	}
+	td.stores[list] = store
+	return store, nil
+}
+
+// openListFor looks up the :listId of the request and checks the user has
+// at least the role needed.  It puts the list and its store on the
+// context, or aborts the request and returns false.
+func (td *ToDoAPI) openListFor(c *gin.Context, need db.Role) bool {
+	list, err := td.lists.GetList(c.Param("listId"))
+	if err != nil {
+		log.Println("Error getting list: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return false
+	}
+
+	user := userOf(c)
+	role := list.RoleOf(user)
+	switch {
+	case role == db.RoleNone && user == "":
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "a user is needed for this list"})
+		return false
+	case role == db.RoleNone:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v: %s", db.ErrListNotFound, list.Id)})
+		return false
+	case !role.Allows(need):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s has %q access to %s, %q is needed", user, role, list.Id, need)})
+		return false
+	}
+
+	store, err := td.storeForList(list.Id)
+	if err != nil {
+		log.Println("Error opening list: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	c.Set(listKey, list)
+	c.Set(listStoreKey, store)
+	return true
+}
+
+// ListAccess is the middleware of the /lists/:listId/todo routes.  Reading
+// needs read access and everything else write access.
+func (td *ToDoAPI) ListAccess(c *gin.Context) {
+	need := db.RoleWrite
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		need = db.RoleRead
+	}
+	if td.openListFor(c, need) {
+		c.Next()
+	}
+}
+
+// RequireRole returns a middleware that lets a request through only if
+// the user has at least role on the :listId list
+func (td *ToDoAPI) RequireRole(role db.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if td.openListFor(c, role) {
+			c.Next()
+		}
+	}
+}
+
+// listView is a list as it is returned, with the role of the user that
+// asked for it
+type listView struct {
+	db.TodoList
+	Role db.Role `json:"role"`
+}
+
+func viewOf(list db.TodoList, user string) listView {
+	return listView{TodoList: list, Role: list.RoleOf(user)}
+}
+
+/*   USERS */
+
+// implementation for POST /users
+// adds a user, the body has the id and optionally a name
+func (td *ToDoAPI) AddUser(c *gin.Context) {
+	var user db.User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	user, err := td.lists.AddUser(user)
+	if err != nil {
+		log.Println("Error adding user: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/users/"+user.Id)
+	c.JSON(http.StatusCreated, user)
+}
+
+// implementation for GET /users/:userId
+func (td *ToDoAPI) GetUser(c *gin.Context) {
+	user, err := td.lists.GetUser(c.Param("userId"))
+	if err != nil {
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+/*   LISTS */
+
+// implementation for GET /lists
+// returns the default list and the lists the user owns or has been
+// shared, each with the role the user has on it
+func (td *ToDoAPI) ListLists(c *gin.Context) {
+	user := userOf(c)
+	lists, err := td.lists.ListsFor(user)
+	if err != nil {
+		log.Println("Error getting lists: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	views := make([]listView, 0, len(lists))
+	for _, list := range lists {
+		views = append(views, viewOf(list, user))
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// implementation for POST /lists
+// adds a list owned by the user, the body has the id and optionally a
+// name
+func (td *ToDoAPI) CreateList(c *gin.Context) {
+	user := userOf(c)
+	if user == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "a user is needed to make a list"})
+		return
+	}
+	var list db.TodoList
+	if err := c.ShouldBindJSON(&list); err != nil {
+		log.Println("Error binding JSON: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	list, err := td.lists.CreateList(user, list)
+	if err != nil {
+		log.Println("Error creating list: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/lists/"+list.Id)
+	c.JSON(http.StatusCreated, viewOf(list, user))
+}
+
+// implementation for GET /lists/:listId
+func (td *ToDoAPI) GetList(c *gin.Context) {
+	list := c.MustGet(listKey).(db.TodoList)
+	c.JSON(http.StatusOK, viewOf(list, userOf(c)))
+}
+
+// implementation for PATCH /lists/:listId
+// renames a list, only the owner can
+func (td *ToDoAPI) RenameList(c *gin.Context) {
+	var body struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	list, err := td.lists.RenameList(c.Param("listId"), body.Name)
+	if err != nil {
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, viewOf(list, userOf(c)))
+}
+
+// implementation for DELETE /lists/:listId
+// deletes a list and its items, only the owner can.  The deletes are
+// recorded in the audit history of the list like any other.
+func (td *ToDoAPI) DeleteList(c *gin.Context) {
+	id := c.Param("listId")
+	summary, err := db.DeleteItems(td.storeFor(c), db.Query{}, false)
+	if err != nil {
+		log.Println("Error deleting the items of the list: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	if err := td.lists.DeleteList(id); err != nil {
+		log.Println("Error deleting list: ", err)
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	td.mu.Lock()
+	delete(td.stores, id)
+	td.mu.Unlock()
+	c.JSON(http.StatusOK, summary)
+}
+
+// implementation for PUT /lists/:listId/shares/:userId
+// shares a list with a user, the body is {"role": "read"} or
+// {"role": "write"}.  Only the owner can.
+func (td *ToDoAPI) ShareList(c *gin.Context) {
+	var body struct {
+		Role db.Role `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	list, err := td.lists.Share(c.Param("listId"), c.Param("userId"), body.Role)
+	if err != nil {
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, viewOf(list, userOf(c)))
+}
+
+// implementation for DELETE /lists/:listId/shares/:userId
+// stops sharing a list with a user, only the owner can
+func (td *ToDoAPI) UnshareList(c *gin.Context) {
+	list, err := td.lists.Unshare(c.Param("listId"), c.Param("userId"))
+	if err != nil {
+		c.AbortWithStatusJSON(statusFor(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, viewOf(list, userOf(c)))
+}
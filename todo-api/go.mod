@@ -1,6 +1,6 @@
-module drexel.edu/todo
+module drexel.edu/todo-api
 
-go 1.20
+go 1.21
 
 require github.com/gin-gonic/gin v1.9.1
 
@@ -31,3 +31,25 @@ require (
 	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+require (
+	drexel.edu/middleware v0.0.0
+	drexel.edu/todo v0.0.0
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/go-redis/redis/v8 v8.11.5 // indirect
+	github.com/nitishm/go-rejson/v4 v4.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+)
+
+// The storage backends are shared with the todo CLI, and the gin
+// middleware with the other services
+replace (
+	drexel.edu/middleware => ../middleware
+	drexel.edu/todo => ../todo
+)
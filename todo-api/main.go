@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"os"
 
-	"drexel.edu/todo/api"
+	"drexel.edu/middleware/admin"
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
+	"drexel.edu/todo-api/api"
+	"drexel.edu/todo/db"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -13,8 +17,22 @@ import (
 // Global variables to hold the command line flags to drive the todo CLI
 // application
 var (
-	hostFlag string
-	portFlag uint
+	hostFlag    string
+	portFlag    uint
+	backendFlag string
+	dbFileFlag  string
+	redisFlag   string
+	jwksFlag    string
+	apiKeyFlag  string
+	noAuthFlag  bool
+
+	adminHostFlag   string
+	adminPortFlag   uint
+	adminPolicyFlag string
+	enableChaosFlag bool
+
+	rateLimitsFlag string
+	rateRedisFlag  string
 )
 
 // processCmdLineFlags parses the command line flags for our CLI
@@ -48,6 +66,36 @@ func processCmdLineFlags() {
 	flag.StringVar(&hostFlag, "h", "0.0.0.0", "Listen on all interfaces")
 	flag.UintVar(&portFlag, "p", 1080, "Default Port")
 
+	//The storage backend can also be picked with the TODO_BACKEND,
+	//TODO_DB_FILE and REDIS_URL environment variables.  This API has
+	//always kept its data in memory, so that is still the default
+	flag.StringVar(&backendFlag, "backend", "", "Storage backend: memory, file or redis (default \"memory\")")
+	flag.StringVar(&dbFileFlag, "db", "", "Name of the database file for the file backend")
+	flag.StringVar(&redisFlag, "redis", "", "Location of the redis cache for the redis backend")
+
+	//Authentication is on when there is a JWKS to check tokens against or
+	//a redis to look API keys up in, AUTH_JWKS_FILE and AUTH_REDIS_URL
+	//work too.  Without either the API does not start, unless it is told
+	//to run with every route open
+	flag.StringVar(&jwksFlag, "jwks", "", "JWKS file with the keys tokens are signed with")
+	flag.StringVar(&apiKeyFlag, "auth-redis", "", "Location of the redis the API keys are kept in")
+	flag.BoolVar(&noAuthFlag, "insecure-no-auth", false, "Run without authentication, every route is open")
+
+	//The admin routes have their own listener, by default only on the
+	//loopback interface.  The chaos routes that crash the server are off
+	//unless --enable-chaos is given
+	flag.StringVar(&adminHostFlag, "admin-h", "127.0.0.1", "Interface the admin routes listen on")
+	flag.UintVar(&adminPortFlag, "admin-p", 1081, "Port of the admin routes")
+	flag.StringVar(&adminPolicyFlag, "admin-policy", "", "YAML file with the RBAC policy of the admin routes")
+	flag.BoolVar(&enableChaosFlag, "enable-chaos", false, "Turn on the chaos routes, like /admin/crash")
+
+	//Requests are rate limited per client, with the limits of
+	//defaultRateLimits unless a YAML file is given.  The counts are kept
+	//in redis so they hold across replicas, RATELIMIT_FILE and
+	//RATELIMIT_REDIS_URL work too
+	flag.StringVar(&rateLimitsFlag, "rate-limits", "", "YAML file with the rate limits of the routes")
+	flag.StringVar(&rateRedisFlag, "ratelimit-redis", "", "Location of the redis the rate limit counts are kept in")
+
 	flag.Parse()
 }
 
@@ -59,28 +107,191 @@ func main() {
 	r := gin.Default()
 	r.Use(cors.Default())
 
-	apiHandler, err := api.New()
+	if backendFlag == "" && os.Getenv("TODO_BACKEND") == "" {
+		backendFlag = db.MemoryBackend
+	}
+	cfg := db.ConfigFromEnv(db.Config{
+		Backend:       backendFlag,
+		FileName:      dbFileFlag,
+		RedisLocation: redisFlag,
+	})
+
+	apiHandler, err := api.New(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	authn, err := auth.New(auth.OptionsFromEnv(auth.Options{
+		JWKSFile:      jwksFlag,
+		RedisLocation: apiKeyFlag,
+		Insecure:      noAuthFlag,
+	}))
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	read := authn.Require(auth.TodoRead)
+	write := authn.Require(auth.TodoWrite)
+	adminOnly := authn.Require(auth.Admin)
 
-	r.GET("/todo", apiHandler.ListAllTodos)
-	r.POST("/todo", apiHandler.AddToDo)
-	r.PUT("/todo", apiHandler.UpdateToDo)
-	r.DELETE("/todo", apiHandler.DeleteAllToDo)
-	r.DELETE("/todo/:id", apiHandler.DeleteToDo)
-	r.GET("/todo/:id", apiHandler.GetToDo)
+	//Every route is rate limited, per caller when the request has
+	//credentials that check out and per client address otherwise
+	limiter, err := newRateLimiter()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	r.Use(authn.Identify(), limiter.Middleware())
+
+	//The default list keeps its routes under /todo
+	todoRoutes(r.Group("/todo"), apiHandler, authn)
+
+	//Users and named lists, the items of a list are under
+	///lists/:listId/todo with the same routes as /todo
+	r.POST("/users", write, apiHandler.AddUser)
+	r.GET("/users/:userId", read, apiHandler.GetUser)
+	r.GET("/lists", read, apiHandler.ListLists)
+	r.POST("/lists", write, apiHandler.CreateList)
+	owner := apiHandler.RequireRole(db.RoleOwner)
+	r.GET("/lists/:listId", read, apiHandler.ListAccess, apiHandler.GetList)
+	r.PATCH("/lists/:listId", write, owner, apiHandler.RenameList)
+	r.DELETE("/lists/:listId", write, owner, apiHandler.DeleteList)
+	r.PUT("/lists/:listId/shares/:userId", write, owner, apiHandler.ShareList)
+	r.DELETE("/lists/:listId/shares/:userId", write, owner, apiHandler.UnshareList)
+	//The request is authenticated before the list is looked up, so the
+	//user is known, the routes check the scopes
+	todoRoutes(r.Group("/lists/:listId/todo", authn.Require(), apiHandler.ListAccess), apiHandler, authn)
+
+	//POST /todo:bulk and /lists/:listId/todo:bulk are matched by
+	//CustomMethods, gin cannot route them.  It checks the write scope
+	//itself, other unknown paths are a 404 without authentication
+	r.NoRoute(apiHandler.CustomMethods(write))
+
+	//API keys are made and deleted by admins, GET /whoami shows what a
+	//token or key is allowed
+	r.POST("/apikeys", adminOnly, authn.CreateAPIKey)
+	r.GET("/apikeys", adminOnly, authn.ListAPIKeys)
+	r.DELETE("/apikeys/:id", adminOnly, authn.DeleteAPIKey)
+	r.GET("/whoami", authn.Require(), authn.WhoAmI)
 
-	r.GET("/crash", apiHandler.CrashSim)
 	r.GET("/health", apiHandler.HealthCheck)
 
 	//We will now show a common way to version an API and add a new
 	//version of an API handler under /v2.  This new API will support
 	//a path parameter to search for todos based on a status
 	v2 := r.Group("/v2")
-	v2.GET("/todo", apiHandler.ListSelectTodos)
+	v2.GET("/todo", read, apiHandler.ListSelectTodos)
+	v2.GET("/lists/:listId/todo", read, apiHandler.ListAccess, apiHandler.ListSelectTodos)
+
+	//Deleting every item and crashing the server are on the admin
+	//listener, not next to the normal routes
+	adminRouter, err := adminRoutes(apiHandler, authn)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go func() {
+		adminPath := fmt.Sprintf("%s:%d", adminHostFlag, adminPortFlag)
+		if err := adminRouter.Run(adminPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
 
 	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
 	r.Run(serverPath)
 }
+
+// defaultRateLimits are the limits when there is no -rate-limits file.
+// GET /todo reads every item, so it has a lower limit than the rest.
+func defaultRateLimits() ratelimit.Config {
+	return ratelimit.Config{
+		Default: ratelimit.MustParseLimit("600/m"),
+		Routes: map[string]ratelimit.Rule{
+			"GET /todo":                 ratelimit.MustParseLimit("60/m"),
+			"GET /lists/:listId/todo":   ratelimit.MustParseLimit("60/m"),
+			"GET /todo/history/replay":  ratelimit.MustParseLimit("30/m"),
+			"POST /todo/history/replay": ratelimit.MustParseLimit("5/m"),
+			"/health":                   {},
+		},
+	}
+}
+
+// newRateLimiter returns the rate limiter of the public routes
+func newRateLimiter() (*ratelimit.Limiter, error) {
+	options, err := ratelimit.OptionsFromEnv(ratelimit.Options{
+		Config:        defaultRateLimits(),
+		RedisLocation: rateRedisFlag,
+		Identify:      auth.Subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitsFlag != "" {
+		if options.Config, err = ratelimit.LoadConfig(rateLimitsFlag); err != nil {
+			return nil, err
+		}
+	}
+	return ratelimit.New(options)
+}
+
+// adminRoutes returns the router of the admin listener.  Every route
+// needs a caller the RBAC policy allows and an X-Audit-Reason header,
+// and is logged, see the admin package.
+func adminRoutes(apiHandler *api.ToDoAPI, authn *auth.Authenticator) (*gin.Engine, error) {
+	policy := admin.DefaultPolicy(authn.Enabled())
+	if adminPolicyFlag != "" {
+		var err error
+		if policy, err = admin.LoadPolicy(adminPolicyFlag); err != nil {
+			return nil, err
+		}
+	}
+	adm := admin.New(admin.Options{Policy: policy, EnableChaos: enableChaosFlag, Identify: identify})
+
+	r := gin.Default()
+	group := r.Group("/admin", authn.Require())
+	group.GET("/whoami", adm.WhoAmI)
+	group.DELETE("/todo", adm.Allow(admin.ActionDeleteAll), apiHandler.DeleteAllToDo)
+	group.GET("/crash", adm.Chaos(admin.ActionCrash), apiHandler.CrashSim)
+	return r, nil
+}
+
+// identify returns the caller of an admin route from the principal the
+// auth middleware found, Anonymous when authentication is off
+func identify(c *gin.Context) admin.Identity {
+	principal, ok := auth.PrincipalFrom(c)
+	if !ok {
+		return admin.Anonymous
+	}
+	identity := admin.Identity{Subject: principal.Subject}
+	for _, scope := range principal.Scopes {
+		identity.Scopes = append(identity.Scopes, string(scope))
+	}
+	return identity
+}
+
+// todoRoutes adds the routes of a list of items to a group, /todo for
+// the default list and /lists/:listId/todo for the named lists.  Each
+// route says the scope it needs, deleting by a filter and rebuilding from
+// the history are for admins.  Deleting every item is on the admin
+// listener.
+func todoRoutes(todo *gin.RouterGroup, apiHandler *api.ToDoAPI, authn *auth.Authenticator) {
+	read := authn.Require(auth.TodoRead)
+	write := authn.Require(auth.TodoWrite)
+	adminOnly := authn.Require(auth.Admin)
+
+	todo.GET("", read, apiHandler.ListAllTodos)
+	todo.POST("", write, apiHandler.AddToDo)
+	todo.PUT("", write, apiHandler.UpdateToDo)
+	todo.PATCH("", write, apiHandler.PatchToDos)
+	todo.DELETE("", adminOnly, apiHandler.DeleteMatchingToDos)
+	todo.DELETE("/:id", write, apiHandler.DeleteToDo)
+	todo.GET("/:id", read, apiHandler.GetToDo)
+
+	//The audit history of every change made through the API
+	todo.GET("/history", read, apiHandler.ListHistory)
+	todo.GET("/history/replay", read, apiHandler.ReplayHistory)
+	todo.POST("/history/replay", adminOnly, apiHandler.RebuildFromHistory)
+	todo.GET("/:id/history", read, apiHandler.GetToDoHistory)
+	todo.POST("/:id/revert", write, apiHandler.RevertToDo)
+}
@@ -0,0 +1,42 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"drexel.edu/todo-api/api"
+	"drexel.edu/todo/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// denyWrite stands in for the todo:write scope check of a caller that
+// does not have it
+func denyWrite(c *gin.Context) {
+	c.AbortWithStatus(http.StatusForbidden)
+}
+
+func TestCustomMethodsScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.NoRoute(api.NewWithStore(db.NewMemoryStore()).CustomMethods(denyWrite))
+
+	send := func(method, path string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(`[{"title": "Learn Helm"}]`)))
+		return w.Code
+	}
+
+	//Only the bulk routes need the scope, other unknown paths are a 404
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/nothing"))
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/nothing"))
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/todo:bulk"))
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "/todo:bulk"))
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "/lists/work/todo:bulk"))
+
+	r = gin.New()
+	r.NoRoute(api.NewWithStore(db.NewMemoryStore()).CustomMethods(func(c *gin.Context) {}))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/todo:bulk"))
+}
@@ -0,0 +1,33 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"drexel.edu/todo-api/api"
+	"drexel.edu/todo/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteToDo(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := db.NewMemoryStore()
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	r := gin.New()
+	r.DELETE("/todo/:id", api.NewWithStore(store).DeleteToDo)
+
+	send := func(path string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, path, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, send("/todo/abc"))
+	assert.Equal(t, http.StatusBadRequest, send("/todo/1.5"))
+	assert.Equal(t, http.StatusNotFound, send("/todo/2"))
+	assert.Equal(t, http.StatusOK, send("/todo/1"))
+	assert.Equal(t, http.StatusNotFound, send("/todo/1"))
+}
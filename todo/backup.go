@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+
+	"drexel.edu/todo/db"
+	"github.com/spf13/cobra"
+)
+
+// backupCmd builds the "todo backup" command.  Backups are a feature of
+// the JSON file backend, see db/backup.go.
+func (c *cli) backupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Create, list, restore and prune versioned backups",
+		Long: `Backups are timestamped, checksummed copies of the database kept in
+the <db>.backups directory.  A backup is verified before it is restored.`,
+	}
+	cmd.AddCommand(
+		c.backupCreateCmd(),
+		c.backupListCmd(),
+		c.backupRestoreCmd(),
+		c.backupPruneCmd(),
+	)
+	return cmd
+}
+
+func (c *cli) backupCreateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "create",
+		Short: "Save a timestamped, checksummed copy of the database",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fileDb, err := c.openFileStore("backup")
+			if err != nil {
+				return err
+			}
+			backup, err := fileDb.CreateBackup()
+			if err != nil {
+				return err
+			}
+			cmd.PrintErrf("Created backup %s with %d items\n", backup.Id, backup.Items)
+			return nil
+		},
+	}
+}
+
+func (c *cli) backupListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the backups, oldest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fileDb, err := c.openFileStore("backup")
+			if err != nil {
+				return err
+			}
+			backups, damaged, err := fileDb.ListBackups()
+			if err != nil {
+				return err
+			}
+			cmd.Printf("%-27s  %-20s  %6s  %8s  %s\n", "ID", "CREATED", "ITEMS", "BYTES", "SHA256")
+			for _, backup := range backups {
+				cmd.Printf("%-27s  %-20s  %6d  %8d  %s\n", backup.Id,
+					backup.Created.Format("2006-01-02 15:04:05"), backup.Items, backup.Size, shortChecksum(backup.Checksum))
+			}
+			cmd.PrintErrln("THERE ARE", len(backups), "BACKUPS")
+			printDamaged(cmd, damaged)
+			return nil
+		},
+	}
+}
+
+func (c *cli) backupRestoreCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <id>",
+		Short: "Verify a backup and restore the database from it",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return usageErrorf("restore requires the id of a backup, see 'todo backup list'")
+			}
+			return nil
+		},
+		ValidArgsFunction: c.completeBackupIds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fileDb, err := c.openFileStore("backup")
+			if err != nil {
+				return err
+			}
+			if err := fileDb.RestoreBackup(args[0]); err != nil {
+				return err
+			}
+			cmd.PrintErrln("Database restored from backup", args[0])
+			return nil
+		},
+	}
+}
+
+func (c *cli) backupPruneCmd() *cobra.Command {
+	var keep int
+	cmd := &cobra.Command{
+		Use:   "prune --keep N",
+		Short: "Delete all but the newest N backups",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !cmd.Flags().Changed("keep") || keep < 0 {
+				return usageErrorf("prune requires --keep N, with N zero or more")
+			}
+			fileDb, err := c.openFileStore("backup")
+			if err != nil {
+				return err
+			}
+			pruned, damaged, err := fileDb.PruneBackups(keep)
+			if err != nil {
+				return err
+			}
+			ids := make([]string, 0, len(pruned))
+			for _, backup := range pruned {
+				ids = append(ids, backup.Id)
+			}
+			cmd.PrintErrf("Deleted %d backups %s\n", len(pruned), strings.Join(ids, " "))
+			printDamaged(cmd, damaged)
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&keep, "keep", 0, "Number of backups to keep")
+	return cmd
+}
+
+// completeBackupIds offers the ids of the backups for shell completion
+func (c *cli) completeBackupIds(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	fileDb, err := c.openFileStore("backup")
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	backups, _, err := fileDb.ListBackups()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	ids := make([]string, 0, len(backups))
+	for _, backup := range backups {
+		ids = append(ids, backup.Id)
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// shortChecksum is the start of a checksum, enough to tell backups apart
+func shortChecksum(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
+
+// printDamaged reports the backups with a damaged manifest, they are
+// skipped by list and prune and left for the user to look at
+func printDamaged(cmd *cobra.Command, damaged []db.DamagedBackup) {
+	for _, backup := range damaged {
+		cmd.PrintErrln("Skipped damaged backup", backup.Id+":", backup.Err)
+	}
+}
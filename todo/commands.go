@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"drexel.edu/todo/db"
+	"drexel.edu/todo/output"
+	"github.com/spf13/cobra"
+)
+
+// This file holds the commands that work with todo items.  Each command
+// validates its own flags and arguments and returns a usageError when
+// they are wrong, so that main can exit with ExitUsage.
+
+// itemFlags are the flags used by add and update to describe an item,
+// either field by field or as a JSON string
+type itemFlags struct {
+	id       int
+	title    string
+	done     bool
+	due      string
+	priority string
+	tags     []string
+	notes    string
+	repeat   string
+	jsonItem string
+}
+
+// fieldFlags are the flags that set one field of an item
+var fieldFlags = []string{"title", "done", "due", "priority", "tags", "notes", "repeat"}
+
+func (f *itemFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.title, "title", "", "Title of the item")
+	cmd.Flags().BoolVar(&f.done, "done", false, "Mark the item as done")
+	cmd.Flags().StringVar(&f.due, "due", "", "Due date, 2024-03-01 or 2024-03-01T17:00:00Z, empty to clear it")
+	cmd.Flags().StringVar(&f.priority, "priority", "", "Priority: low, medium or high, empty to clear it")
+	cmd.Flags().StringSliceVar(&f.tags, "tags", nil, "Comma separated tags, replaces the item's tags")
+	cmd.Flags().StringVar(&f.notes, "notes", "", "Free form notes")
+	cmd.Flags().StringVar(&f.repeat, "repeat", "", "Recurrence, a cron expression like \"0 9 * * 1-5\" or an RRULE like FREQ=WEEKLY;BYDAY=MO, empty to stop repeating")
+	cmd.Flags().StringVar(&f.jsonItem, "json", "", "The whole item as a JSON string, instead of the other flags")
+	cmd.RegisterFlagCompletionFunc("priority", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"low", "medium", "high"}, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+// changed reports whether any of the field flags were set
+func (f *itemFlags) changed(cmd *cobra.Command) bool {
+	for _, name := range fieldFlags {
+		if cmd.Flags().Changed(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply copies the field flags that were set onto item, the other
+// fields are left alone
+func (f *itemFlags) apply(cmd *cobra.Command, item db.ToDoItem) (db.ToDoItem, error) {
+	flags := cmd.Flags()
+	if flags.Changed("title") {
+		item.Title = f.title
+	}
+	if flags.Changed("done") {
+		item.IsDone = f.done
+	}
+	if flags.Changed("due") {
+		due, err := db.ParseDueDate(f.due)
+		if err != nil {
+			return item, usageError{err}
+		}
+		item.DueDate = due
+	}
+	if flags.Changed("priority") {
+		item.Priority = db.Priority(f.priority)
+	}
+	if flags.Changed("tags") {
+		item.Tags = db.NormalizeTags(f.tags)
+	}
+	if flags.Changed("notes") {
+		item.Notes = f.notes
+	}
+	if flags.Changed("repeat") {
+		item.Recurrence = f.repeat
+	}
+	return item, nil
+}
+
+// fromJson returns the item in the --json flag
+func (f *itemFlags) fromJson(cmd *cobra.Command) (db.ToDoItem, error) {
+	for _, name := range append([]string{"id"}, fieldFlags...) {
+		if cmd.Flags().Changed(name) {
+			return db.ToDoItem{}, usageErrorf("--json cannot be combined with --%s", name)
+		}
+	}
+	item, err := db.JsonToItem(f.jsonItem)
+	if err != nil {
+		return db.ToDoItem{}, usageErrorf("--json requires a valid JSON todo item: %v", err)
+	}
+	return item, nil
+}
+
+// validateItem checks the fields every stored item must have.  An id of
+// 0 asks the database to pick the next id.
+func validateItem(item db.ToDoItem) error {
+	if item.Id < 0 {
+		return usageErrorf("the item id must be a positive number, got %d", item.Id)
+	}
+	if item.Title == "" {
+		return usageErrorf("the item must have a title")
+	}
+	if err := item.Validate(); err != nil {
+		return usageError{err}
+	}
+	return nil
+}
+
+// parseIds converts the id arguments of a command to ints
+func parseIds(args []string) ([]int, error) {
+	ids := make([]int, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil || id <= 0 {
+			return nil, usageErrorf("%q is not a valid item id", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// idArgs accepts between min and max id arguments, max < 0 means no
+// limit
+func idArgs(min, max int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) < min || (max >= 0 && len(args) > max) {
+			return usageErrorf("%s: wrong number of item ids, see 'todo %s -h'", cmd.Name(), cmd.Name())
+		}
+		_, err := parseIds(args)
+		return err
+	}
+}
+
+// completeItemIds offers the ids of the items in the database for shell
+// completion, with the title as the description
+func (c *cli) completeItemIds(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	store, err := c.openStore()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	items, err := store.GetAllItems()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, fmt.Sprintf("%d\t%s", item.Id, item.Title))
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+func (c *cli) addCmd() *cobra.Command {
+	var f itemFlags
+	cmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add an item to the database",
+		Long: `Add an item to the database.  Without --id the database picks the
+next id, which is printed.`,
+		Example: `  todo add --title "Learn Cloud Native Architecture"
+  todo add --id 3 --title "Learn Cloud Native Architecture"
+  todo add --id 4 --title "Learn Helm" --due 2024-03-01 --priority high --tags k8s,cloud
+  todo add --title "Water the plants" --due 2024-03-04T09:00:00Z --repeat "FREQ=WEEKLY;BYDAY=MO,TH"
+  todo add --json '{"id": 3, "title": "Learn Cloud Native Architecture"}'`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			item, err := f.apply(cmd, db.ToDoItem{Id: f.id})
+			if err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("json") {
+				if item, err = f.fromJson(cmd); err != nil {
+					return err
+				}
+			}
+			if err := validateItem(item); err != nil {
+				return err
+			}
+
+			store, err := c.openStore()
+			if err != nil {
+				return err
+			}
+			if item.Id == 0 {
+				if item, err = store.CreateItem(item); err != nil {
+					return err
+				}
+			} else if err := store.AddItem(item); err != nil {
+				return err
+			}
+			cmd.PrintErrln("Added item", item.Id)
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&f.id, "id", 0, "Id of the new item (default the next id)")
+	f.register(cmd)
+	return cmd
+}
+
+func (c *cli) listCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List all the items in the database",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := c.openStore()
+			if err != nil {
+				return err
+			}
+			items, err := store.GetAllItems()
+			if err != nil {
+				return err
+			}
+			if err := output.WriteItems(cmd.OutOrStdout(), items, c.out); err != nil {
+				return err
+			}
+			cmd.PrintErrln("THERE ARE", len(items), "ITEMS IN THE DB")
+			return nil
+		},
+	}
+}
+
+func (c *cli) getCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "get <id>",
+		Short:             "Show an item in the database",
+		Args:              idArgs(1, 1),
+		ValidArgsFunction: c.completeItemIds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ids, _ := parseIds(args)
+			store, err := c.openStore()
+			if err != nil {
+				return err
+			}
+			item, err := store.GetItem(ids[0])
+			if err != nil {
+				return err
+			}
+			return output.WriteItem(cmd.OutOrStdout(), item, c.out)
+		},
+	}
+}
+
+func (c *cli) updateCmd() *cobra.Command {
+	var f itemFlags
+	cmd := &cobra.Command{
+		Use:   "update <id>",
+		Short: "Update an item in the database",
+		Long: `Update an item in the database.  Only the fields that are set with
+--title, --done, --due, --priority, --tags, --notes and --repeat are changed, or use
+--json to replace the whole item.  The created, updated and completed
+times are kept by the database and cannot be set.`,
+		Example: `  todo update 3 --title "Learn Cloud Native Architecture"
+  todo update 3 --priority high --due 2024-03-01T17:00:00Z
+  todo update 3 --due "" --tags ""
+  todo update 3 --json '{"id": 3, "title": "Learn Cloud Native Architecture", "done": true}'`,
+		Args:              idArgs(1, 1),
+		ValidArgsFunction: c.completeItemIds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ids, _ := parseIds(args)
+			if !cmd.Flags().Changed("json") && !f.changed(cmd) {
+				return usageErrorf("update requires --json or at least one of --%s", strings.Join(fieldFlags, ", --"))
+			}
+
+			store, err := c.openStore()
+			if err != nil {
+				return err
+			}
+
+			var item db.ToDoItem
+			if cmd.Flags().Changed("json") {
+				if item, err = f.fromJson(cmd); err != nil {
+					return err
+				}
+				if item.Id != ids[0] {
+					return usageErrorf("the id in --json (%d) does not match the item id %d", item.Id, ids[0])
+				}
+			} else {
+				if item, err = store.GetItem(ids[0]); err != nil {
+					return err
+				}
+				if item, err = f.apply(cmd, item); err != nil {
+					return err
+				}
+			}
+			if err := validateItem(item); err != nil {
+				return err
+			}
+
+			if err := store.UpdateItem(item); err != nil {
+				return err
+			}
+			cmd.PrintErrln("Updated item", item.Id)
+			return nil
+		},
+	}
+	f.register(cmd)
+	return cmd
+}
+
+// doneCmd builds "todo done" when done is true and "todo undone" when it
+// is false
+func (c *cli) doneCmd(done bool) *cobra.Command {
+	use, short := "done", "Mark items as done"
+	if !done {
+		use, short = "undone", "Mark items as not done"
+	}
+	return &cobra.Command{
+		Use:               use + " <id>...",
+		Short:             short,
+		Args:              idArgs(1, -1),
+		ValidArgsFunction: c.completeItemIds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ids, _ := parseIds(args)
+			store, err := c.openStore()
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if err := store.ChangeItemDoneStatus(id, done); err != nil {
+					return fmt.Errorf("item %d: %w", id, err)
+				}
+				cmd.PrintErrf("Marked item %d as %s\n", id, use)
+			}
+			return nil
+		},
+	}
+}
+
+func (c *cli) deleteCmd() *cobra.Command {
+	var all bool
+	cmd := &cobra.Command{
+		Use:               "delete <id>...",
+		Short:             "Delete items from the database",
+		Example:           "  todo delete 3 4\n  todo delete --all",
+		Args:              idArgs(0, -1),
+		ValidArgsFunction: c.completeItemIds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all == (len(args) > 0) {
+				return usageErrorf("delete requires either item ids or --all")
+			}
+			ids, _ := parseIds(args)
+			store, err := c.openStore()
+			if err != nil {
+				return err
+			}
+
+			if all {
+				if err := store.DeleteAll(); err != nil {
+					return err
+				}
+				cmd.PrintErrln("Deleted all items")
+				return nil
+			}
+			for _, id := range ids {
+				if err := store.DeleteItem(id); err != nil {
+					return fmt.Errorf("item %d: %w", id, err)
+				}
+				cmd.PrintErrln("Deleted item", id)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&all, "all", false, "Delete every item in the database")
+	return cmd
+}
+
+func (c *cli) restoreCmd() *cobra.Command {
+	var lsn int64
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore the database from the backup file",
+		Long: `Restore the database from the todo.json.bak backup file, or with --lsn
+to the state it had right after that change in the operation log.
+See 'todo history' for the LSN of each change.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Flags().Changed("lsn") && lsn < 0 {
+				return usageErrorf("--lsn cannot be negative")
+			}
+			fileDb, err := c.openFileStore("restore")
+			if err != nil {
+				return err
+			}
+
+			if cmd.Flags().Changed("lsn") {
+				if err := fileDb.RestoreToLSN(lsn); err != nil {
+					return err
+				}
+				cmd.PrintErrln("Database restored to LSN", lsn)
+				return nil
+			}
+			if err := fileDb.RestoreDB(); err != nil {
+				return err
+			}
+			cmd.PrintErrln("Database restored from backup file")
+			return nil
+		},
+	}
+	cmd.Flags().Int64Var(&lsn, "lsn", 0, "Restore the database to this log sequence number")
+	return cmd
+}
+
+func (c *cli) historyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "List the changes in the operation log of the database",
+		Long: `List the changes in the operation log of the database.  Compacting the
+log keeps the newest 10 snapshots in the <db>.history directory, and the
+log segments after the oldest of them, 'todo history prune' keeps fewer.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fileDb, err := c.openFileStore("history")
+			if err != nil {
+				return err
+			}
+			history, err := fileDb.History()
+			if err != nil {
+				return err
+			}
+			for _, rec := range history {
+				cmd.Printf("%6d  %s  %-9s  id=%d\n", rec.LSN, rec.Time.Format(time.RFC3339), rec.Op, rec.Id)
+			}
+			return nil
+		},
+	}
+	cmd.AddCommand(c.historyPruneCmd())
+	return cmd
+}
+
+func (c *cli) historyPruneCmd() *cobra.Command {
+	var keep int
+	cmd := &cobra.Command{
+		Use:   "prune --keep N",
+		Short: "Delete all but the newest N snapshots and the log segments before them",
+		Long: `Delete all but the newest N snapshots from the <db>.history directory,
+and the log segments that end before the oldest of them.  The database
+can no longer be restored to an LSN before that snapshot.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !cmd.Flags().Changed("keep") || keep < 1 {
+				return usageErrorf("prune requires --keep N, with N one or more")
+			}
+			fileDb, err := c.openFileStore("history")
+			if err != nil {
+				return err
+			}
+			removed, err := fileDb.PruneHistory(keep)
+			if err != nil {
+				return err
+			}
+			cmd.PrintErrf("Deleted %d history files %s\n", len(removed), strings.Join(removed, " "))
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&keep, "keep", 0, "Number of snapshots to keep")
+	return cmd
+}
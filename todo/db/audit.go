@@ -0,0 +1,350 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The audit history records who changed what.  An AuditedStore wraps
+// any Store, and every change made through it is appended to an
+// AuditLog as a record with the item before and after the change.  The
+// records are never changed or removed, so the history of an item can
+// be listed, an item can be put back the way it was at an earlier
+// version, and the whole database can be rebuilt by replaying the log
+// from the start.
+//
+// The wrapper reads the item before the change and again after it, and
+// the two reads and the write are done under one lock, so within a
+// process the before and after are the states on either side of the
+// change.  Changes made by other processes, or straight to the store,
+// are not recorded.
+
+// AuditOp is the kind of change an audit record is for
+type AuditOp string
+
+const (
+	AuditOpAdd    AuditOp = "add"
+	AuditOpUpdate AuditOp = "update"
+	AuditOpDelete AuditOp = "delete"
+	AuditOpRevert AuditOp = "revert"
+)
+
+// ErrVersionNotFound is returned when a revert asks for a version the
+// history of the item does not have
+var ErrVersionNotFound = errors.New("version is not in the history of the item")
+
+// AuditRecord is one change to one item.  Before is nil for an add and
+// After is nil for a delete.  Version is the version of the item after
+// the change, or the version that was deleted.  Actor is who made the
+// change, as told by the caller.
+type AuditRecord struct {
+	Seq     int64     `json:"seq"`
+	Op      AuditOp   `json:"op"`
+	ItemId  int       `json:"itemId"`
+	Version int       `json:"version"`
+	Actor   string    `json:"actor,omitempty"`
+	Time    time.Time `json:"time"`
+	Before  *ToDoItem `json:"before,omitempty"`
+	After   *ToDoItem `json:"after,omitempty"`
+}
+
+// sortAuditRecords orders records by sequence number
+func sortAuditRecords(records []AuditRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+}
+
+// AuditedStore is a Store that records every change in an AuditLog.
+// Reads go straight to the wrapped store.
+type AuditedStore struct {
+	store Store
+	log   AuditLog
+	actor string
+
+	//mu is shared by the copies made with As, so the changes of every
+	//actor are serialized
+	mu *sync.Mutex
+}
+
+// Compile time checks that the wrapper is a Store and keeps the query
+// push down of the store it wraps
+var (
+	_ Store   = (*AuditedStore)(nil)
+	_ Querier = (*AuditedStore)(nil)
+)
+
+// NewAuditedStore wraps a store so its changes are recorded in log
+func NewAuditedStore(store Store, log AuditLog) *AuditedStore {
+	return &AuditedStore{store: store, log: log, mu: &sync.Mutex{}}
+}
+
+// As returns a copy of the store whose changes are recorded as made by
+// actor.  The copy shares the store, the log and the lock.
+func (a *AuditedStore) As(actor string) *AuditedStore {
+	scoped := *a
+	scoped.actor = actor
+	return &scoped
+}
+
+// Store returns the wrapped store
+func (a *AuditedStore) Store() Store {
+	return a.store
+}
+
+// Log returns the audit log
+func (a *AuditedStore) Log() AuditLog {
+	return a.log
+}
+
+// record appends a record for a change that has been made.  The change
+// cannot be taken back, so the error says the history is missing it.
+func (a *AuditedStore) record(op AuditOp, id int, before, after *ToDoItem) error {
+	rec := AuditRecord{Op: op, ItemId: id, Actor: a.actor, Time: now(), Before: before, After: after}
+	if after != nil {
+		rec.Version = after.Version
+	} else if before != nil {
+		rec.Version = before.Version
+	}
+	if _, err := a.log.Append(rec); err != nil {
+		return fmt.Errorf("item %d was changed but the audit record was not written: %w", id, err)
+	}
+	return nil
+}
+
+// current returns the stored item, or nil if there is none
+func (a *AuditedStore) current(id int) (*ToDoItem, error) {
+	item, err := a.store.GetItem(id)
+	if errors.Is(err, ErrItemNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// change runs write and records the item before and after it
+func (a *AuditedStore) change(op AuditOp, id int, write func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	before, err := a.current(id)
+	if err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	after, err := a.current(id)
+	if err != nil {
+		return err
+	}
+	return a.record(op, id, before, after)
+}
+
+// AddItem adds the item and records it
+func (a *AuditedStore) AddItem(item ToDoItem) error {
+	return a.change(AuditOpAdd, item.Id, func() error { return a.store.AddItem(item) })
+}
+
+// CreateItem creates the item and records it
+func (a *AuditedStore) CreateItem(item ToDoItem) (ToDoItem, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	created, err := a.store.CreateItem(item)
+	if err != nil {
+		return ToDoItem{}, err
+	}
+	return created, a.record(AuditOpAdd, created.Id, nil, &created)
+}
+
+// UpdateItem updates the item and records the change
+func (a *AuditedStore) UpdateItem(item ToDoItem) error {
+	return a.change(AuditOpUpdate, item.Id, func() error { return a.store.UpdateItem(item) })
+}
+
+// ChangeItemDoneStatus changes the done flag and records the change
+func (a *AuditedStore) ChangeItemDoneStatus(id int, value bool) error {
+	return a.change(AuditOpUpdate, id, func() error { return a.store.ChangeItemDoneStatus(id, value) })
+}
+
+// DeleteItem deletes the item and records what it was
+func (a *AuditedStore) DeleteItem(id int) error {
+	return a.change(AuditOpDelete, id, func() error { return a.store.DeleteItem(id) })
+}
+
+// DeleteAll deletes every item and records a delete for each one, so
+// the history of every item ends with its delete
+func (a *AuditedStore) DeleteAll() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	items, err := a.store.GetAllItems()
+	if err != nil {
+		return err
+	}
+	if err := a.store.DeleteAll(); err != nil {
+		return err
+	}
+	for i := range items {
+		if err := a.record(AuditOpDelete, items[i].Id, &items[i], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetItem reads from the wrapped store
+func (a *AuditedStore) GetItem(id int) (ToDoItem, error) {
+	return a.store.GetItem(id)
+}
+
+// GetAllItems reads from the wrapped store
+func (a *AuditedStore) GetAllItems() ([]ToDoItem, error) {
+	return a.store.GetAllItems()
+}
+
+// QueryItems runs the query on the wrapped store, so a store that
+// pushes queries down still does
+func (a *AuditedStore) QueryItems(q Query) (QueryResult, error) {
+	return QueryItems(a.store, q)
+}
+
+// History returns the audit records of an item, oldest first
+func (a *AuditedStore) History(id int) ([]AuditRecord, error) {
+	return a.log.ItemRecords(id)
+}
+
+// Revert puts the item back the way it was at version.  If the history
+// has the version more than once, because the item was deleted and
+// added again, the latest one is used.  The revert is itself a change,
+// it gets a new version and is recorded, so it can be reverted too.  An
+// item that has been deleted is added back.
+func (a *AuditedStore) Revert(id int, version int) (ToDoItem, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	history, err := a.log.ItemRecords(id)
+	if err != nil {
+		return ToDoItem{}, err
+	}
+	var target *ToDoItem
+	for _, rec := range history {
+		if rec.After != nil && rec.After.Version == version {
+			target = rec.After
+		}
+	}
+	if target == nil {
+		return ToDoItem{}, fmt.Errorf("%w: item %d has no version %d", ErrVersionNotFound, id, version)
+	}
+
+	before, err := a.current(id)
+	if err != nil {
+		return ToDoItem{}, err
+	}
+	restored := *target
+	if before == nil {
+		err = a.store.AddItem(restored)
+	} else {
+		//Version 0 skips the check, the caller asked for this state
+		//whatever happened since
+		restored.Version = 0
+		err = a.store.UpdateItem(restored)
+	}
+	if err != nil {
+		return ToDoItem{}, err
+	}
+	after, err := a.current(id)
+	if err != nil {
+		return ToDoItem{}, err
+	}
+	if after == nil {
+		return ToDoItem{}, ErrItemNotFound
+	}
+	return *after, a.record(AuditOpRevert, id, before, after)
+}
+
+//------------------------------------------------------------
+// REPLAYING THE HISTORY
+//------------------------------------------------------------
+
+// ReplayAudit rebuilds the items from audit records, as they were right
+// after the record with sequence number untilSeq.  An untilSeq of 0
+// replays every record.  The records must start from an empty database,
+// which is the case for a whole audit log.
+func ReplayAudit(records []AuditRecord, untilSeq int64) []ToDoItem {
+	records = append([]AuditRecord(nil), records...)
+	sortAuditRecords(records)
+
+	items := make(map[int]ToDoItem)
+	for _, rec := range records {
+		if untilSeq > 0 && rec.Seq > untilSeq {
+			break
+		}
+		if rec.After == nil {
+			delete(items, rec.ItemId)
+			continue
+		}
+		items[rec.ItemId] = *rec.After
+	}
+
+	replayed := make([]ToDoItem, 0, len(items))
+	for _, item := range items {
+		replayed = append(replayed, item)
+	}
+	sortItemsById(replayed)
+	return replayed
+}
+
+// RebuildFromAudit makes the store hold the items ReplayAudit returns
+// for the records.  Only the differences are written: items that should
+// not be there are deleted, missing ones are added and changed ones are
+// updated.  The store gives the items new versions and timestamps, the
+// content is what the history says.  Given the AuditedStore the rebuild
+// is recorded like any other change.  With dryRun set nothing is
+// written, the summary says what would change.
+func RebuildFromAudit(store Store, records []AuditRecord, untilSeq int64, dryRun bool) (BulkSummary, error) {
+	wanted := ReplayAudit(records, untilSeq)
+	existing, err := store.GetAllItems()
+	if err != nil {
+		return BulkSummary{}, err
+	}
+	stored := make(map[int]ToDoItem, len(existing))
+	for _, item := range existing {
+		stored[item.Id] = item
+	}
+
+	summary := BulkSummary{DryRun: dryRun, Results: []BulkResult{}}
+	keep := make(map[int]bool, len(wanted))
+	for _, item := range wanted {
+		keep[item.Id] = true
+		current, ok := stored[item.Id]
+		switch {
+		case ok && current.SameContent(item):
+			summary.add(item.Id, BulkUnchanged, nil)
+		case dryRun && ok:
+			summary.add(item.Id, BulkUpdated, nil)
+		case dryRun:
+			summary.add(item.Id, BulkCreated, nil)
+		case ok:
+			item.Version = 0
+			summary.add(item.Id, BulkUpdated, store.UpdateItem(item))
+		default:
+			summary.add(item.Id, BulkCreated, store.AddItem(item))
+		}
+	}
+	for _, item := range existing {
+		if keep[item.Id] {
+			continue
+		}
+		if dryRun {
+			summary.add(item.Id, BulkDeleted, nil)
+			continue
+		}
+		summary.add(item.Id, BulkDeleted, store.DeleteItem(item.Id))
+	}
+	summary.Total = len(summary.Results)
+	return summary, nil
+}
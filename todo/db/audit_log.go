@@ -0,0 +1,359 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The audit log is kept by the same kind of backend as the items, so an
+// API that is configured for redis keeps its history in redis too.
+// Records are only ever appended, nothing in this file changes or
+// removes a record once it is written.
+
+// AuditLog stores audit records.  Append gives the record the next
+// sequence number and returns it as stored.  Records returns the records
+// after a sequence number and ItemRecords the ones for one item, both
+// ordered by sequence number.
+type AuditLog interface {
+	Append(rec AuditRecord) (AuditRecord, error)
+	Records(afterSeq int64) ([]AuditRecord, error)
+	ItemRecords(id int) ([]AuditRecord, error)
+}
+
+// Compile time checks that each audit log satisfies the AuditLog interface
+var (
+	_ AuditLog = (*MemoryAuditLog)(nil)
+	_ AuditLog = (*FileAuditLog)(nil)
+	_ AuditLog = (*RedisAuditLog)(nil)
+)
+
+// The redis keys of the audit log of the default list.  They are outside
+// of the todo: prefix so they are not mistaken for items.  A named list
+// adds its name, audit:todo:<list> and seq:audit:todo:<list>.
+const (
+	RedisAuditKey    = "audit:todo"
+	RedisAuditSeqKey = "seq:audit:todo"
+)
+
+// NewAuditLog creates the audit log for the backend named in the config.
+// The file backend keeps its history in <db>.audit next to the database,
+// so each list has its own.
+func NewAuditLog(cfg Config) (AuditLog, error) {
+	switch cfg.Backend {
+	case FileBackend:
+		return NewFileAuditLog(cfg.FileName + ".audit")
+	case MemoryBackend:
+		return NewMemoryAuditLog(), nil
+	case RedisBackend:
+		return NewRedisListAuditLog(cfg.RedisLocation, cfg.List)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+//------------------------------------------------------------
+// IN MEMORY
+//------------------------------------------------------------
+
+// MemoryAuditLog keeps the records in a slice, it is lost when the
+// process exits
+type MemoryAuditLog struct {
+	mu      sync.RWMutex
+	records []AuditRecord
+}
+
+// NewMemoryAuditLog returns an empty in memory audit log
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{}
+}
+
+// Append adds the record with the next sequence number
+func (m *MemoryAuditLog) Append(rec AuditRecord) (AuditRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec.Seq = int64(len(m.records)) + 1
+	m.records = append(m.records, rec)
+	return rec, nil
+}
+
+// Records returns the records after afterSeq
+func (m *MemoryAuditLog) Records(afterSeq int64) ([]AuditRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if afterSeq < 0 {
+		afterSeq = 0
+	}
+	if afterSeq >= int64(len(m.records)) {
+		return nil, nil
+	}
+	return append([]AuditRecord(nil), m.records[afterSeq:]...), nil
+}
+
+// ItemRecords returns the records of one item
+func (m *MemoryAuditLog) ItemRecords(id int) ([]AuditRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var records []AuditRecord
+	for _, rec := range m.records {
+		if rec.ItemId == id {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+//------------------------------------------------------------
+// FILE
+//------------------------------------------------------------
+
+// FileAuditLog appends the records to a file, one json record per line.
+// The file is only ever appended to, so it is locked directly rather
+// than through a .lock file, and every append is flushed to disk before
+// it returns.  Other processes can append to the same file.
+type FileAuditLog struct {
+	fileName string
+
+	mu sync.Mutex
+	//offset is how much of the file has been read and lastSeq the
+	//highest sequence number in that part
+	offset  int64
+	lastSeq int64
+}
+
+// NewFileAuditLog opens the audit log in fileName, creating it if it
+// does not exist
+func NewFileAuditLog(fileName string) (*FileAuditLog, error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &FileAuditLog{fileName: fileName}, nil
+}
+
+// FileName returns the name of the file the records are kept in
+func (l *FileAuditLog) FileName() string {
+	return l.fileName
+}
+
+// Append adds the record with the next sequence number
+func (l *FileAuditLog) Append(rec AuditRecord) (AuditRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.fileName, os.O_RDWR, 0644)
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	defer f.Close()
+	if err := lockFile(f, true); err != nil {
+		return AuditRecord{}, err
+	}
+	defer unlockFile(f)
+
+	//Another process may have appended since the last time, read what
+	//it wrote to find the last sequence number
+	if _, err := f.Seek(l.offset, io.SeekStart); err != nil {
+		return AuditRecord{}, err
+	}
+	records, read, err := readAuditRecords(f)
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	l.offset += read
+	if len(records) > 0 {
+		l.lastSeq = records[len(records)-1].Seq
+	}
+
+	rec.Seq = l.lastSeq + 1
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	line = append(line, '\n')
+	//A crash in the middle of an append can leave a partial line, the
+	//next record is written over it
+	if _, err := f.WriteAt(line, l.offset); err != nil {
+		return AuditRecord{}, err
+	}
+	if err := f.Truncate(l.offset + int64(len(line))); err != nil {
+		return AuditRecord{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return AuditRecord{}, err
+	}
+	l.offset += int64(len(line))
+	l.lastSeq = rec.Seq
+	return rec, nil
+}
+
+// Records returns the records after afterSeq
+func (l *FileAuditLog) Records(afterSeq int64) ([]AuditRecord, error) {
+	return l.filter(func(rec AuditRecord) bool { return rec.Seq > afterSeq })
+}
+
+// ItemRecords returns the records of one item
+func (l *FileAuditLog) ItemRecords(id int) ([]AuditRecord, error) {
+	return l.filter(func(rec AuditRecord) bool { return rec.ItemId == id })
+}
+
+func (l *FileAuditLog) filter(keep func(rec AuditRecord) bool) ([]AuditRecord, error) {
+	f, err := os.Open(l.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := lockFile(f, false); err != nil {
+		return nil, err
+	}
+	defer unlockFile(f)
+
+	all, _, err := readAuditRecords(f)
+	if err != nil {
+		return nil, err
+	}
+	var records []AuditRecord
+	for _, rec := range all {
+		if keep(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// readAuditRecords reads the complete lines from r.  It returns the
+// records and how many bytes they took up, a partial last line is left
+// out.
+func readAuditRecords(r io.Reader) ([]AuditRecord, int64, error) {
+	var records []AuditRecord
+	var read int64
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return records, read, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		read += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, 0, fmt.Errorf("corrupt audit record at byte %d: %w", read-int64(len(line)), err)
+		}
+		records = append(records, rec)
+	}
+}
+
+//------------------------------------------------------------
+// REDIS
+//------------------------------------------------------------
+
+// RedisAuditLog keeps every record as json in the list audit:todo and
+// again in a list per item, audit:todo:<id>, so the history of an item
+// is read without going through every record.  The sequence numbers
+// come from INCR on seq:audit:todo.
+type RedisAuditLog struct {
+	client  *redis.Client
+	context context.Context
+	key     string
+	seqKey  string
+}
+
+// NewRedisAuditLog connects to the redis at location
+func NewRedisAuditLog(location string) (*RedisAuditLog, error) {
+	return NewRedisListAuditLog(location, DefaultList)
+}
+
+// NewRedisListAuditLog connects to the redis at location, for the audit
+// log of one list
+func NewRedisListAuditLog(location string, list string) (*RedisAuditLog, error) {
+	client := redis.NewClient(&redis.Options{Addr: location})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	auditLog := &RedisAuditLog{client: client, context: ctx, key: RedisAuditKey, seqKey: RedisAuditSeqKey}
+	if list != "" && list != DefaultList {
+		auditLog.key += ":" + list
+		auditLog.seqKey += ":" + list
+	}
+	return auditLog, nil
+}
+
+func (r *RedisAuditLog) itemKey(id int) string {
+	return fmt.Sprintf("%s:%d", r.key, id)
+}
+
+// Append adds the record with the next sequence number.  The record
+// goes into both lists in one transaction.
+func (r *RedisAuditLog) Append(rec AuditRecord) (AuditRecord, error) {
+	seq, err := r.client.Incr(r.context, r.seqKey).Result()
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	rec.Seq = seq
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	_, err = r.client.TxPipelined(r.context, func(pipe redis.Pipeliner) error {
+		pipe.RPush(r.context, r.key, data)
+		return pipe.RPush(r.context, r.itemKey(rec.ItemId), data).Err()
+	})
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	return rec, nil
+}
+
+// Records returns the records after afterSeq.  Two clients can take a
+// sequence number and push in the opposite order, so the records are
+// sorted after they are read.
+func (r *RedisAuditLog) Records(afterSeq int64) ([]AuditRecord, error) {
+	records, err := r.readList(r.key)
+	if err != nil {
+		return nil, err
+	}
+	var after []AuditRecord
+	for _, rec := range records {
+		if rec.Seq > afterSeq {
+			after = append(after, rec)
+		}
+	}
+	return after, nil
+}
+
+// ItemRecords returns the records of one item
+func (r *RedisAuditLog) ItemRecords(id int) ([]AuditRecord, error) {
+	return r.readList(r.itemKey(id))
+}
+
+func (r *RedisAuditLog) readList(key string) ([]AuditRecord, error) {
+	values, err := r.client.LRange(r.context, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]AuditRecord, 0, len(values))
+	for _, value := range values {
+		var rec AuditRecord
+		if err := json.Unmarshal([]byte(value), &rec); err != nil {
+			return nil, fmt.Errorf("corrupt audit record in %s: %w", key, err)
+		}
+		records = append(records, rec)
+	}
+	sortAuditRecords(records)
+	return records, nil
+}
@@ -0,0 +1,316 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups of the file backend live in the <db>.backups directory.  Each
+// backup is made of two files:
+//
+//	<id>.json          the items, in the same format as todo.json
+//	<id>.manifest.json when the backup was made, its size and sha256
+//
+// The id is the UTC time the backup was created, so sorting the ids sorts
+// the backups from oldest to newest.  The manifest is written last, so a
+// backup without a manifest was interrupted and is ignored.  A backup
+// whose manifest cannot be read is listed as damaged and left alone, so
+// one bad file does not stop the others from being listed or pruned.  A
+// backup is always verified against its manifest before it is restored.
+
+// backupIdFormat is the time layout used for backup ids
+const backupIdFormat = "20060102T150405.000000000Z"
+
+const (
+	backupDataSuffix     = ".json"
+	backupManifestSuffix = ".manifest.json"
+)
+
+var (
+	ErrBackupNotFound = errors.New("backup does not exist")
+	ErrBackupCorrupt  = errors.New("backup failed verification")
+)
+
+// Backup describes one backup.  It is stored as the manifest of the
+// backup.
+type Backup struct {
+	Id       string    `json:"id"`
+	Created  time.Time `json:"created"`
+	Items    int       `json:"items"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"sha256"`
+}
+
+// DamagedBackup is a backup with a manifest that cannot be read, Err
+// says what is wrong with it
+type DamagedBackup struct {
+	Id  string
+	Err error
+}
+
+// CreateBackup saves a copy of the current items as a new backup
+//
+// Precondition:  The database has been opened with New()
+//
+// Postcondition: A backup with a new id and a manifest holding its
+// checksum is saved in the backups directory
+func (t *ToDo) CreateBackup() (Backup, error) {
+	unlock, err := t.lockDB(true)
+	if err != nil {
+		return Backup{}, err
+	}
+	defer unlock()
+
+	if err := t.refresh(); err != nil {
+		return Backup{}, err
+	}
+	items := t.items
+	if items == nil {
+		items = []ToDoItem{}
+	}
+	data, err := json.MarshalIndent(items, "", "\t")
+	if err != nil {
+		return Backup{}, err
+	}
+
+	if err := os.MkdirAll(t.backupDir(), 0755); err != nil {
+		return Backup{}, err
+	}
+
+	//Two backups in the same nanosecond are unlikely, but never
+	//overwrite an existing backup
+	created := time.Now().UTC()
+	backup := Backup{
+		Id:       created.Format(backupIdFormat),
+		Created:  created,
+		Items:    len(items),
+		Size:     int64(len(data)),
+		Checksum: checksum(data),
+	}
+	if _, err := os.Stat(t.backupDataFile(backup.Id)); err == nil {
+		return Backup{}, fmt.Errorf("backup %s already exists", backup.Id)
+	}
+
+	if err := WriteFileAtomic(t.backupDataFile(backup.Id), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return Backup{}, err
+	}
+
+	manifest, err := json.MarshalIndent(backup, "", "\t")
+	if err != nil {
+		return Backup{}, err
+	}
+	if err := WriteFileAtomic(t.backupManifestFile(backup.Id), func(w io.Writer) error {
+		_, err := w.Write(manifest)
+		return err
+	}); err != nil {
+		return Backup{}, err
+	}
+	return backup, nil
+}
+
+// ListBackups returns all complete backups, oldest first, and the
+// backups with a damaged manifest.  The backups are not verified, use
+// VerifyBackup for that.
+func (t *ToDo) ListBackups() ([]Backup, []DamagedBackup, error) {
+	entries, err := os.ReadDir(t.backupDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return []Backup{}, []DamagedBackup{}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backups := []Backup{}
+	damaged := []DamagedBackup{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), backupManifestSuffix)
+		if !ok {
+			continue
+		}
+		backup, err := t.readManifest(id)
+		if errors.Is(err, ErrBackupCorrupt) {
+			damaged = append(damaged, DamagedBackup{Id: id, Err: err})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Id < backups[j].Id
+	})
+	return backups, damaged, nil
+}
+
+// VerifyBackup checks the size and checksum of a backup against its
+// manifest, and that it holds a valid list of items.  It returns the
+// manifest of the backup.
+func (t *ToDo) VerifyBackup(id string) (Backup, error) {
+	backup, _, err := t.loadBackup(id)
+	return backup, err
+}
+
+// RestoreBackup replaces the database with the items in a backup
+//
+// Precondition:  The backup exists
+//
+// Postcondition: The backup is verified and, only if it is intact, the
+// database is replaced by its items.  Like RestoreDB the restore
+// is recorded in the operation log so it can be undone.
+func (t *ToDo) RestoreBackup(id string) error {
+	//Verify before taking the lock so a bad backup never blocks
+	//other todo processes
+	_, items, err := t.loadBackup(id)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := t.lockDB(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return t.resetItems(items)
+}
+
+// PruneBackups deletes all but the newest keep backups and returns the
+// backups that were deleted.  Backups with a damaged manifest are not
+// counted or deleted, they are returned so they can be looked at.
+func (t *ToDo) PruneBackups(keep int) ([]Backup, []DamagedBackup, error) {
+	if keep < 0 {
+		return nil, nil, errors.New("the number of backups to keep cannot be negative")
+	}
+
+	unlock, err := t.lockDB(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	backups, damaged, err := t.ListBackups()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(backups) <= keep {
+		return []Backup{}, damaged, nil
+	}
+
+	pruned := backups[:len(backups)-keep]
+	for _, backup := range pruned {
+		//Remove the manifest first, a data file without a manifest is
+		//never listed
+		if err := os.Remove(t.backupManifestFile(backup.Id)); err != nil {
+			return nil, nil, err
+		}
+		if err := os.Remove(t.backupDataFile(backup.Id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+	return pruned, damaged, nil
+}
+
+//------------------------------------------------------------
+// BACKUP HELPERS
+//------------------------------------------------------------
+
+func (t *ToDo) backupDir() string {
+	return t.dbFileName + ".backups"
+}
+
+func (t *ToDo) backupDataFile(id string) string {
+	return filepath.Join(t.backupDir(), id+backupDataSuffix)
+}
+
+func (t *ToDo) backupManifestFile(id string) string {
+	return filepath.Join(t.backupDir(), id+backupManifestSuffix)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readManifest loads the manifest of a backup.  The id is checked so a
+// command line argument can never point outside the backups directory.
+func (t *ToDo) readManifest(id string) (Backup, error) {
+	if id == "" || id != filepath.Base(id) {
+		return Backup{}, fmt.Errorf("%w: %q", ErrBackupNotFound, id)
+	}
+
+	data, err := os.ReadFile(t.backupManifestFile(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Backup{}, fmt.Errorf("%w: %s", ErrBackupNotFound, id)
+	}
+	if err != nil {
+		return Backup{}, err
+	}
+
+	var backup Backup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return Backup{}, fmt.Errorf("%w: %s has a damaged manifest: %v", ErrBackupCorrupt, id, err)
+	}
+	switch {
+	case backup.Id != id:
+		return Backup{}, fmt.Errorf("%w: the manifest of %s is for %q", ErrBackupCorrupt, id, backup.Id)
+	case !validChecksum(backup.Checksum):
+		return Backup{}, fmt.Errorf("%w: %s has a damaged manifest: %q is not a sha256", ErrBackupCorrupt, id, backup.Checksum)
+	case backup.Size < 0 || backup.Items < 0:
+		return Backup{}, fmt.Errorf("%w: %s has a damaged manifest: negative size or item count", ErrBackupCorrupt, id)
+	}
+	return backup, nil
+}
+
+// validChecksum reports whether sum is a hex encoded sha256
+func validChecksum(sum string) bool {
+	if len(sum) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+// loadBackup reads a backup and checks it against its manifest
+func (t *ToDo) loadBackup(id string) (Backup, []ToDoItem, error) {
+	backup, err := t.readManifest(id)
+	if err != nil {
+		return Backup{}, nil, err
+	}
+
+	data, err := os.ReadFile(t.backupDataFile(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Backup{}, nil, fmt.Errorf("%w: %s is missing its data file", ErrBackupCorrupt, id)
+	}
+	if err != nil {
+		return Backup{}, nil, err
+	}
+
+	if int64(len(data)) != backup.Size {
+		return Backup{}, nil, fmt.Errorf("%w: %s is %d bytes, expected %d", ErrBackupCorrupt, id, len(data), backup.Size)
+	}
+	if sum := checksum(data); sum != backup.Checksum {
+		return Backup{}, nil, fmt.Errorf("%w: %s has checksum %s, expected %s", ErrBackupCorrupt, id, sum, backup.Checksum)
+	}
+
+	var items []ToDoItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return Backup{}, nil, fmt.Errorf("%w: %s: %v", ErrBackupCorrupt, id, err)
+	}
+	if len(items) != backup.Items {
+		return Backup{}, nil, fmt.Errorf("%w: %s has %d items, expected %d", ErrBackupCorrupt, id, len(items), backup.Items)
+	}
+	return backup, items, nil
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The bulk functions work on many items at once, either a list of new
+// items or every item that matches a query.  They are written against
+// the Store interface, so they work with every backend.  They are not
+// transactions, each item is written on its own and one failing does
+// not stop or undo the others.  The summary says what happened to each
+// item.  With dryRun set nothing is written, the summary says what
+// would have happened.
+
+// The statuses of the items in a BulkSummary
+const (
+	BulkCreated   = "created"
+	BulkUpdated   = "updated"
+	BulkDeleted   = "deleted"
+	BulkUnchanged = "unchanged"
+	BulkFailed    = "failed"
+)
+
+// BulkResult is what happened to one item
+type BulkResult struct {
+	Id     int    `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkSummary reports the outcome of a bulk operation.  Total is the
+// number of items that were sent or matched, the counts add up to it.
+type BulkSummary struct {
+	DryRun    bool         `json:"dryRun"`
+	Total     int          `json:"total"`
+	Created   int          `json:"created,omitempty"`
+	Updated   int          `json:"updated,omitempty"`
+	Deleted   int          `json:"deleted,omitempty"`
+	Unchanged int          `json:"unchanged,omitempty"`
+	Failed    int          `json:"failed,omitempty"`
+	Results   []BulkResult `json:"results"`
+}
+
+// add records the result for one item and counts it
+func (s *BulkSummary) add(id int, status string, err error) {
+	result := BulkResult{Id: id, Status: status}
+	if err != nil {
+		result.Status = BulkFailed
+		result.Error = err.Error()
+	}
+	switch result.Status {
+	case BulkCreated:
+		s.Created++
+	case BulkUpdated:
+		s.Updated++
+	case BulkDeleted:
+		s.Deleted++
+	case BulkUnchanged:
+		s.Unchanged++
+	case BulkFailed:
+		s.Failed++
+	}
+	s.Results = append(s.Results, result)
+}
+
+// ItemPatch lists the fields to change on an item, the fields that are
+// nil are left alone.  Tags replaces all of the tags, an empty list
+// removes them.
+type ItemPatch struct {
+	Title      *string    `json:"title,omitempty"`
+	IsDone     *bool      `json:"done,omitempty"`
+	DueDate    *time.Time `json:"dueDate,omitempty"`
+	Priority   *Priority  `json:"priority,omitempty"`
+	Tags       *[]string  `json:"tags,omitempty"`
+	Notes      *string    `json:"notes,omitempty"`
+	Recurrence *string    `json:"recurrence,omitempty"`
+}
+
+// IsEmpty reports whether the patch does not change anything
+func (p ItemPatch) IsEmpty() bool {
+	return p == ItemPatch{}
+}
+
+// Validate checks the fields the patch sets
+func (p ItemPatch) Validate() error {
+	if p.IsEmpty() {
+		return fmt.Errorf("%w: the patch does not set any fields", ErrInvalidItem)
+	}
+	check := ToDoItem{}
+	if p.Priority != nil {
+		check.Priority = *p.Priority
+	}
+	if p.Recurrence != nil {
+		check.Recurrence = *p.Recurrence
+	}
+	return check.Validate()
+}
+
+// Apply returns a copy of the item with the patch applied
+func (p ItemPatch) Apply(item ToDoItem) ToDoItem {
+	if p.Title != nil {
+		item.Title = *p.Title
+	}
+	if p.IsDone != nil {
+		item.IsDone = *p.IsDone
+	}
+	if p.DueDate != nil {
+		due := p.DueDate.UTC()
+		item.DueDate = &due
+	}
+	if p.Priority != nil {
+		item.Priority = *p.Priority
+	}
+	if p.Tags != nil {
+		item.Tags = NormalizeTags(*p.Tags)
+	}
+	if p.Notes != nil {
+		item.Notes = *p.Notes
+	}
+	if p.Recurrence != nil {
+		item.Recurrence = *p.Recurrence
+	}
+	return item
+}
+
+// BulkCreate adds a list of items.  Items with an id are added under
+// that id, items without one get the next free id like CreateItem.
+func BulkCreate(store Store, items []ToDoItem, dryRun bool) (BulkSummary, error) {
+	summary := BulkSummary{DryRun: dryRun, Total: len(items), Results: []BulkResult{}}
+	seen := make(map[int]bool)
+	for _, item := range items {
+		err := item.Validate()
+		if err == nil && item.Id < 0 {
+			err = fmt.Errorf("%w: id cannot be negative", ErrInvalidItem)
+		}
+		//Two items with the same id in one request, the second one
+		//would fail, so report that in a dry run too
+		if err == nil && item.Id != 0 {
+			if seen[item.Id] {
+				err = fmt.Errorf("%w: id %d is used twice", ErrItemExists, item.Id)
+			}
+			seen[item.Id] = true
+		}
+
+		switch {
+		case err != nil:
+		case dryRun && item.Id != 0:
+			_, err = store.GetItem(item.Id)
+			if err == nil {
+				err = ErrItemExists
+			} else if errors.Is(err, ErrItemNotFound) {
+				err = nil
+			}
+		case dryRun:
+		case item.Id == 0:
+			item, err = store.CreateItem(item)
+		default:
+			err = store.AddItem(item)
+		}
+		summary.add(item.Id, BulkCreated, err)
+	}
+	return summary, nil
+}
+
+// PatchItems applies a patch to every item that matches the filters of
+// the query.  Items the patch would not change are left alone.  Each
+// item is written with the version it was read at, so an item that is
+// changed by someone else in the meantime fails instead of losing that
+// change.
+func PatchItems(store Store, q Query, patch ItemPatch, dryRun bool) (BulkSummary, error) {
+	if err := patch.Validate(); err != nil {
+		return BulkSummary{}, err
+	}
+	matched, err := matchingItems(store, q)
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	summary := BulkSummary{DryRun: dryRun, Total: len(matched), Results: []BulkResult{}}
+	for _, item := range matched {
+		patched := patch.Apply(item)
+		switch {
+		case patched.SameContent(item):
+			summary.add(item.Id, BulkUnchanged, nil)
+		case dryRun:
+			summary.add(item.Id, BulkUpdated, nil)
+		default:
+			summary.add(item.Id, BulkUpdated, store.UpdateItem(patched))
+		}
+	}
+	return summary, nil
+}
+
+// DeleteItems deletes every item that matches the filters of the query
+func DeleteItems(store Store, q Query, dryRun bool) (BulkSummary, error) {
+	matched, err := matchingItems(store, q)
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	summary := BulkSummary{DryRun: dryRun, Total: len(matched), Results: []BulkResult{}}
+	for _, item := range matched {
+		if dryRun {
+			summary.add(item.Id, BulkDeleted, nil)
+			continue
+		}
+		summary.add(item.Id, BulkDeleted, store.DeleteItem(item.Id))
+	}
+	return summary, nil
+}
+
+// matchingItems returns every item that passes the filters of the
+// query.  The bulk functions work on all of the matches, so sorting and
+// paging do not apply.
+func matchingItems(store Store, q Query) ([]ToDoItem, error) {
+	if q.Limit != 0 || q.Offset != 0 || q.Cursor != "" {
+		return nil, fmt.Errorf("%w: bulk operations apply to every match, limit, offset and cursor cannot be used", ErrInvalidQuery)
+	}
+	result, err := QueryItems(store, Query{
+		Done:        q.Done,
+		TitleSearch: q.TitleSearch,
+		TitlePrefix: q.TitlePrefix,
+		Priority:    q.Priority,
+		Tag:         q.Tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Items, nil
+}
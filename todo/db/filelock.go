@@ -0,0 +1,81 @@
+package db
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// lockDB takes an advisory lock on a <db>.lock file that sits next to the
+// database file.  We cannot lock the database file itself because
+// WriteFileAtomic replaces it with a new file on every save.  Readers take
+// a shared lock and writers take an exclusive lock, so concurrent todo
+// processes are serialized.  The mutex does the same for goroutines in
+// this process, since they share our in memory copy of the database.
+// The returned function releases both locks.
+func (t *ToDo) lockDB(exclusive bool) (func(), error) {
+	t.mu.Lock()
+
+	f, err := os.OpenFile(t.dbFileName+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		t.mu.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+		t.mu.Unlock()
+	}, nil
+}
+
+// WriteFileAtomic replaces fileName with the output of write.  The data
+// is written to a temp file in the same directory, flushed to disk with
+// fsync, and then renamed over fileName.  A rename within a directory is
+// atomic, so readers see either the old file or the new file, never a
+// partially written one, even if the process crashes half way through.
+// The CLI uses it for exports too.
+func WriteFileAtomic(fileName string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(fileName)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	//If anything goes wrong make sure we do not leave the temp file behind
+	tmpName := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	//CreateTemp makes the file 0600, use the usual permissions instead
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return err
+	}
+	committed = true
+
+	//Finally flush the directory so the rename itself survives a crash
+	return syncDir(dir)
+}
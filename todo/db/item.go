@@ -0,0 +1,175 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The fields of a ToDoItem beyond id, title and done are all optional, so
+// records written before they existed still load as they are.  The
+// timestamps are managed by the stores, whatever a client sends for
+// them is replaced by stampAdd and stampUpdate.
+
+// Priority is how important an item is, the empty priority means none
+type Priority string
+
+const (
+	PriorityNone   Priority = ""
+	PriorityLow    Priority = "low"
+	PriorityMedium Priority = "medium"
+	PriorityHigh   Priority = "high"
+)
+
+// Priorities lists the priorities from lowest to highest
+var Priorities = []Priority{PriorityNone, PriorityLow, PriorityMedium, PriorityHigh}
+
+// Rank orders priorities, higher is more important.  It returns -1 for
+// a priority that is not valid.
+func (p Priority) Rank() int {
+	for i, known := range Priorities {
+		if p == known {
+			return i
+		}
+	}
+	return -1
+}
+
+// ErrInvalidItem is returned when an item fails validation
+var ErrInvalidItem = errors.New("invalid item")
+
+// Validate checks the fields that have a fixed set of values and the
+// recurrence, see recurrence.go
+func (item ToDoItem) Validate() error {
+	if item.Priority.Rank() < 0 {
+		return fmt.Errorf("%w: priority must be low, medium or high, got %q", ErrInvalidItem, item.Priority)
+	}
+	if item.Recurrence != "" {
+		if _, err := ParseRecurrence(item.Recurrence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SameContent reports whether two items have the same user provided
+// fields, the timestamps and the version are ignored
+func (item ToDoItem) SameContent(other ToDoItem) bool {
+	if item.Id != other.Id || item.Title != other.Title || item.IsDone != other.IsDone ||
+		item.Priority != other.Priority || item.Notes != other.Notes ||
+		item.Recurrence != other.Recurrence || !sameTime(item.DueDate, other.DueDate) || len(item.Tags) != len(other.Tags) {
+		return false
+	}
+	for i := range item.Tags {
+		if item.Tags[i] != other.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// IsOverdue reports whether the item is not done and its due date has
+// passed
+func (item ToDoItem) IsOverdue(now time.Time) bool {
+	return !item.IsDone && item.DueDate != nil && item.DueDate.Before(now)
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// NormalizeTags trims the tags and drops empty and repeated ones,
+// keeping the order they were given in
+func NormalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// DueDateLayouts are the layouts accepted by ParseDueDate
+var DueDateLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// ParseDueDate parses a due date typed by a person, either a full
+// RFC 3339 time or a date, which is taken as midnight UTC.  An empty
+// string means no due date and returns nil.
+func ParseDueDate(s string) (*time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	for _, layout := range DueDateLayouts {
+		if due, err := time.Parse(layout, s); err == nil {
+			due = due.UTC()
+			return &due, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: due date %q should look like 2024-03-01 or 2024-03-01T17:00:00Z", ErrInvalidItem, s)
+}
+
+// now returns the time the stores use for the timestamps.  Times are
+// kept in UTC so every backend stores the same value.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// stampAdd prepares a new item to be stored.  The created and updated
+// times are set to now.  A created time that is already set is kept, so
+// that importing an exported database does not lose it.  Every new item
+// starts at version 1.
+func stampAdd(item ToDoItem, at time.Time) ToDoItem {
+	item.Tags = NormalizeTags(item.Tags)
+	item.Version = 1
+	if item.CreatedAt == nil {
+		item.CreatedAt = &at
+	}
+	item.UpdatedAt = &at
+	item.CompletedAt = nil
+	if item.IsDone {
+		item.CompletedAt = &at
+	}
+	return item
+}
+
+// checkVersion implements optimistic concurrency.  A caller that read
+// version 3 of an item sends it back with Version 3, if the stored item
+// has moved on since then the update is rejected.  A Version of 0 means
+// the caller does not care and always wins.
+func checkVersion(existing, item ToDoItem) error {
+	if item.Version != 0 && item.Version != existing.Version {
+		return fmt.Errorf("%w: item %d is at version %d, not %d", ErrVersionConflict, item.Id, existing.Version, item.Version)
+	}
+	return nil
+}
+
+// stampUpdate prepares an item that replaces existing.  The created time
+// is kept, the updated time is set to now and the completed time is set
+// when the item becomes done and cleared when it is no longer done.  The
+// version is one more than the stored version, items written before
+// versions existed are at version 0.
+func stampUpdate(existing, item ToDoItem, at time.Time) ToDoItem {
+	item.Tags = NormalizeTags(item.Tags)
+	item.Version = existing.Version + 1
+	item.CreatedAt = existing.CreatedAt
+	item.UpdatedAt = &at
+	switch {
+	case !item.IsDone:
+		item.CompletedAt = nil
+	case existing.IsDone && existing.CompletedAt != nil:
+		item.CompletedAt = existing.CompletedAt
+	default:
+		item.CompletedAt = &at
+	}
+	return item
+}
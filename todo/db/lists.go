@@ -0,0 +1,513 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Items belong to a todo list.  The default list is the one that was
+// there before lists existed, it has no owner and anyone can read and
+// change it.  Every other list is made by a user, who owns it and can
+// share it with other users, either to read it or to change its items
+// too.  Each list keeps its items in its own part of the backend, see
+// Config.ForList.
+//
+// The users and the lists are kept by a ListRegistry, in the same kind
+// of backend as the items.  The registry is small, so it is stored as
+// one document that is read, changed and written back in one step:
+// under a lock file for the file backend and with WATCH in redis.
+
+// DefaultList is the id of the default list
+const DefaultList = "default"
+
+// Role is what a user can do with a list.  Each role can do everything
+// the roles before it can.
+type Role string
+
+const (
+	RoleNone  Role = ""
+	RoleRead  Role = "read"
+	RoleWrite Role = "write"
+	RoleOwner Role = "owner"
+)
+
+// Roles lists the roles from least to most access
+var Roles = []Role{RoleNone, RoleRead, RoleWrite, RoleOwner}
+
+// Rank orders roles, it returns -1 for a role that is not valid
+func (r Role) Rank() int {
+	for i, known := range Roles {
+		if r == known {
+			return i
+		}
+	}
+	return -1
+}
+
+// Allows reports whether the role can do what needs the other role
+func (r Role) Allows(need Role) bool {
+	return r.Rank() >= need.Rank()
+}
+
+// The errors of the registry
+var (
+	ErrUserNotFound = errors.New("user does not exist")
+	ErrUserExists   = errors.New("user already exists")
+	ErrListNotFound = errors.New("list does not exist")
+	ErrListExists   = errors.New("list already exists")
+	ErrInvalidList  = errors.New("invalid list")
+)
+
+// User is someone who can own and share lists
+type User struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// TodoList is a named list of items.  Shares maps the users it is
+// shared with to their role, read or write.
+type TodoList struct {
+	Id        string          `json:"id"`
+	Name      string          `json:"name"`
+	Owner     string          `json:"owner,omitempty"`
+	Shares    map[string]Role `json:"shares,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// RoleOf returns the role a user has on the list.  Everyone can write
+// the default list.
+func (l TodoList) RoleOf(user string) Role {
+	switch {
+	case l.Id == DefaultList:
+		return RoleWrite
+	case user == "":
+		return RoleNone
+	case user == l.Owner:
+		return RoleOwner
+	}
+	return l.Shares[user]
+}
+
+// DefaultTodoList returns the default list, it is not stored in the
+// registry
+func DefaultTodoList() TodoList {
+	return TodoList{Id: DefaultList, Name: "Default"}
+}
+
+// validId is what user and list ids look like.  They are used in redis
+// keys and file names, and a list id must not start with a digit so
+// todo:<list>:<id> cannot be read as an item of the default list.
+var validId = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+// ValidateId checks a user or list id
+func ValidateId(id string) error {
+	if !validId.MatchString(id) {
+		return fmt.Errorf("%w: %q should start with a letter and have only lower case letters, digits, - and _", ErrInvalidList, id)
+	}
+	return nil
+}
+
+// registryDoc is everything the registry stores
+type registryDoc struct {
+	Users map[string]User     `json:"users"`
+	Lists map[string]TodoList `json:"lists"`
+}
+
+func (d *registryDoc) init() {
+	if d.Users == nil {
+		d.Users = make(map[string]User)
+	}
+	if d.Lists == nil {
+		d.Lists = make(map[string]TodoList)
+	}
+}
+
+// registryBackend reads the registry, or changes it in one step.  A
+// change whose fn returns an error is not written.
+type registryBackend interface {
+	read() (registryDoc, error)
+	update(fn func(doc *registryDoc) error) error
+}
+
+// ListRegistry keeps the users and the lists
+type ListRegistry struct {
+	backend registryBackend
+}
+
+// NewListRegistry creates the registry for the backend named in the
+// config.  The file backend keeps it in <db>.lists next to the database
+// and redis under lists:todo.
+func NewListRegistry(cfg Config) (*ListRegistry, error) {
+	switch cfg.Backend {
+	case FileBackend:
+		return &ListRegistry{backend: &fileRegistry{fileName: cfg.FileName + ".lists"}}, nil
+	case MemoryBackend:
+		return NewMemoryListRegistry(), nil
+	case RedisBackend:
+		client := redis.NewClient(&redis.Options{Addr: cfg.RedisLocation})
+		ctx := context.Background()
+		if err := client.Ping(ctx).Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return &ListRegistry{backend: &redisRegistry{client: client, context: ctx}}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// NewMemoryListRegistry returns an empty registry kept in memory
+func NewMemoryListRegistry() *ListRegistry {
+	return &ListRegistry{backend: &memoryRegistry{}}
+}
+
+// AddUser adds a user
+func (r *ListRegistry) AddUser(user User) (User, error) {
+	if err := ValidateId(user.Id); err != nil {
+		return User{}, err
+	}
+	user.CreatedAt = now()
+	err := r.backend.update(func(doc *registryDoc) error {
+		if _, ok := doc.Users[user.Id]; ok {
+			return fmt.Errorf("%w: %s", ErrUserExists, user.Id)
+		}
+		doc.Users[user.Id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// GetUser returns a user
+func (r *ListRegistry) GetUser(id string) (User, error) {
+	doc, err := r.backend.read()
+	if err != nil {
+		return User{}, err
+	}
+	user, ok := doc.Users[id]
+	if !ok {
+		return User{}, fmt.Errorf("%w: %s", ErrUserNotFound, id)
+	}
+	return user, nil
+}
+
+// CreateList adds a list owned by owner, who must be a user
+func (r *ListRegistry) CreateList(owner string, list TodoList) (TodoList, error) {
+	if err := ValidateId(list.Id); err != nil {
+		return TodoList{}, err
+	}
+	if list.Id == DefaultList {
+		return TodoList{}, fmt.Errorf("%w: %s", ErrListExists, list.Id)
+	}
+	if list.Name == "" {
+		list.Name = list.Id
+	}
+	at := now()
+	list.Owner, list.Shares, list.CreatedAt, list.UpdatedAt = owner, nil, at, at
+	err := r.backend.update(func(doc *registryDoc) error {
+		if _, ok := doc.Users[owner]; !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, owner)
+		}
+		if _, ok := doc.Lists[list.Id]; ok {
+			return fmt.Errorf("%w: %s", ErrListExists, list.Id)
+		}
+		doc.Lists[list.Id] = list
+		return nil
+	})
+	if err != nil {
+		return TodoList{}, err
+	}
+	return list, nil
+}
+
+// GetList returns a list, the default list is always there
+func (r *ListRegistry) GetList(id string) (TodoList, error) {
+	if id == DefaultList {
+		return DefaultTodoList(), nil
+	}
+	doc, err := r.backend.read()
+	if err != nil {
+		return TodoList{}, err
+	}
+	list, ok := doc.Lists[id]
+	if !ok {
+		return TodoList{}, fmt.Errorf("%w: %s", ErrListNotFound, id)
+	}
+	return list, nil
+}
+
+// ListsFor returns the default list and the lists the user owns or has
+// been shared, sorted by id
+func (r *ListRegistry) ListsFor(user string) ([]TodoList, error) {
+	doc, err := r.backend.read()
+	if err != nil {
+		return nil, err
+	}
+	lists := []TodoList{DefaultTodoList()}
+	for _, list := range doc.Lists {
+		if list.RoleOf(user) != RoleNone {
+			lists = append(lists, list)
+		}
+	}
+	sort.Slice(lists[1:], func(i, j int) bool {
+		return lists[1+i].Id < lists[1+j].Id
+	})
+	return lists, nil
+}
+
+// changeList runs fn on a stored list and writes it back
+func (r *ListRegistry) changeList(id string, fn func(doc *registryDoc, list *TodoList) error) (TodoList, error) {
+	if id == DefaultList {
+		return TodoList{}, fmt.Errorf("%w: the default list cannot be changed", ErrInvalidList)
+	}
+	var changed TodoList
+	err := r.backend.update(func(doc *registryDoc) error {
+		list, ok := doc.Lists[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrListNotFound, id)
+		}
+		if err := fn(doc, &list); err != nil {
+			return err
+		}
+		list.UpdatedAt = now()
+		doc.Lists[id] = list
+		changed = list
+		return nil
+	})
+	return changed, err
+}
+
+// RenameList changes the name of a list
+func (r *ListRegistry) RenameList(id string, name string) (TodoList, error) {
+	return r.changeList(id, func(doc *registryDoc, list *TodoList) error {
+		list.Name = name
+		return nil
+	})
+}
+
+// Share gives a user read or write access to a list, replacing the
+// role they had
+func (r *ListRegistry) Share(id string, user string, role Role) (TodoList, error) {
+	if role != RoleRead && role != RoleWrite {
+		return TodoList{}, fmt.Errorf("%w: a list is shared to read or write, not %q", ErrInvalidList, role)
+	}
+	return r.changeList(id, func(doc *registryDoc, list *TodoList) error {
+		if _, ok := doc.Users[user]; !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, user)
+		}
+		if user == list.Owner {
+			return fmt.Errorf("%w: %s owns the list", ErrInvalidList, user)
+		}
+		if list.Shares == nil {
+			list.Shares = make(map[string]Role)
+		}
+		list.Shares[user] = role
+		return nil
+	})
+}
+
+// Unshare takes a user's access to a list away
+func (r *ListRegistry) Unshare(id string, user string) (TodoList, error) {
+	return r.changeList(id, func(doc *registryDoc, list *TodoList) error {
+		delete(list.Shares, user)
+		return nil
+	})
+}
+
+// DeleteList removes a list from the registry, the caller deletes its
+// items
+func (r *ListRegistry) DeleteList(id string) error {
+	if id == DefaultList {
+		return fmt.Errorf("%w: the default list cannot be deleted", ErrInvalidList)
+	}
+	return r.backend.update(func(doc *registryDoc) error {
+		if _, ok := doc.Lists[id]; !ok {
+			return fmt.Errorf("%w: %s", ErrListNotFound, id)
+		}
+		delete(doc.Lists, id)
+		return nil
+	})
+}
+
+//------------------------------------------------------------
+// REGISTRY BACKENDS
+//------------------------------------------------------------
+
+// memoryRegistry keeps the document in memory
+type memoryRegistry struct {
+	mu  sync.Mutex
+	doc registryDoc
+}
+
+// read returns a copy, so the caller cannot change the registry by
+// changing the maps it got
+func (m *memoryRegistry) read() (registryDoc, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copyRegistryDoc(m.doc)
+}
+
+func (m *memoryRegistry) update(fn func(doc *registryDoc) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, err := copyRegistryDoc(m.doc)
+	if err != nil {
+		return err
+	}
+	if err := fn(&doc); err != nil {
+		return err
+	}
+	m.doc = doc
+	return nil
+}
+
+func copyRegistryDoc(doc registryDoc) (registryDoc, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return registryDoc{}, err
+	}
+	var copied registryDoc
+	err = json.Unmarshal(data, &copied)
+	copied.init()
+	return copied, err
+}
+
+// fileRegistry keeps the document in a json file.  Changes hold an
+// exclusive lock on <file>.lock, the file itself is replaced atomically
+// so it cannot be locked.
+type fileRegistry struct {
+	fileName string
+}
+
+func (f *fileRegistry) load() (registryDoc, error) {
+	var doc registryDoc
+	data, err := os.ReadFile(f.fileName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return registryDoc{}, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return registryDoc{}, fmt.Errorf("corrupt list registry %s: %w", f.fileName, err)
+		}
+	}
+	doc.init()
+	return doc, nil
+}
+
+func (f *fileRegistry) lock(exclusive bool) (func(), error) {
+	lock, err := os.OpenFile(f.fileName+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock, exclusive); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(lock)
+		lock.Close()
+	}, nil
+}
+
+func (f *fileRegistry) read() (registryDoc, error) {
+	unlock, err := f.lock(false)
+	if err != nil {
+		return registryDoc{}, err
+	}
+	defer unlock()
+	return f.load()
+}
+
+func (f *fileRegistry) update(fn func(doc *registryDoc) error) error {
+	unlock, err := f.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	doc, err := f.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(&doc); err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.fileName, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(doc)
+	})
+}
+
+// RedisListsKey holds the registry in redis, it is outside of the todo:
+// prefix so it is not mistaken for an item
+const RedisListsKey = "lists:todo"
+
+// redisRegistry keeps the document under RedisListsKey.  A change is
+// retried when another client changes the registry at the same time.
+type redisRegistry struct {
+	client  *redis.Client
+	context context.Context
+}
+
+func (r *redisRegistry) get(getter interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+}) (registryDoc, error) {
+	var doc registryDoc
+	data, err := getter.Get(r.context, RedisListsKey).Bytes()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return registryDoc{}, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return registryDoc{}, fmt.Errorf("corrupt list registry in %s: %w", RedisListsKey, err)
+		}
+	}
+	doc.init()
+	return doc, nil
+}
+
+func (r *redisRegistry) read() (registryDoc, error) {
+	return r.get(r.client)
+}
+
+func (r *redisRegistry) update(fn func(doc *registryDoc) error) error {
+	txf := func(tx *redis.Tx) error {
+		doc, err := r.get(tx)
+		if err != nil {
+			return err
+		}
+		if err := fn(&doc); err != nil {
+			return err
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(r.context, func(pipe redis.Pipeliner) error {
+			return pipe.Set(r.context, RedisListsKey, data, 0).Err()
+		})
+		return err
+	}
+	for attempt := 0; attempt < redisWatchRetries; attempt++ {
+		err := r.client.Watch(r.context, txf, RedisListsKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("the list registry kept changing while it was being updated")
+}
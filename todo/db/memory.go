@@ -0,0 +1,147 @@
+package db
+
+import (
+	"sync"
+)
+
+// MemoryStore is a Store that keeps all of the items in an in memory
+// map.  Nothing is persisted, so it is handy for demos and testing.
+// The gin framework serves requests on multiple goroutines, so access
+// to the map is guarded with a lock.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	toDoMap DbMap
+	seq     int //highest id handed out or added so far
+}
+
+// NewMemoryStore is a constructor function that returns a pointer to a
+// new, empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		toDoMap: make(DbMap),
+	}
+}
+
+// AddItem accepts a ToDoItem and adds it to the map.  It returns
+// ErrItemExists if an item with the same id is already stored.
+func (m *MemoryStore) AddItem(item ToDoItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := item.Validate(); err != nil {
+		return err
+	}
+	if _, ok := m.toDoMap[item.Id]; ok {
+		return ErrItemExists
+	}
+	m.toDoMap[item.Id] = stampAdd(item, now())
+	if item.Id > m.seq {
+		m.seq = item.Id
+	}
+	return nil
+}
+
+// CreateItem gives the item the next id and adds it to the map.  Ids
+// are never reused, even after the item that had one is deleted.
+func (m *MemoryStore) CreateItem(item ToDoItem) (ToDoItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := item.Validate(); err != nil {
+		return ToDoItem{}, err
+	}
+	m.seq++
+	item.Id = m.seq
+	item = stampAdd(item, now())
+	m.toDoMap[item.Id] = item
+	return item, nil
+}
+
+// UpdateItem accepts a ToDoItem and replaces the stored item with the
+// same id.  It returns ErrItemNotFound if there is no such item and
+// ErrVersionConflict if the item has a stale version.
+func (m *MemoryStore) UpdateItem(item ToDoItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := item.Validate(); err != nil {
+		return err
+	}
+	existing, ok := m.toDoMap[item.Id]
+	if !ok {
+		return ErrItemNotFound
+	}
+	if err := checkVersion(existing, item); err != nil {
+		return err
+	}
+	m.toDoMap[item.Id] = stampUpdate(existing, item, now())
+	return nil
+}
+
+// DeleteItem removes the item with the provided id.  It returns
+// ErrItemNotFound if there is no such item.
+func (m *MemoryStore) DeleteItem(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.toDoMap[id]; !ok {
+		return ErrItemNotFound
+	}
+	delete(m.toDoMap, id)
+	return nil
+}
+
+// DeleteAll removes all items from the map
+func (m *MemoryStore) DeleteAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	//To delete everything, we can just create a new map
+	//and let the garbage collector clean up the old one
+	m.toDoMap = make(DbMap)
+	return nil
+}
+
+// GetItem returns the item with the provided id, or ErrItemNotFound
+// along with an empty ToDoItem
+func (m *MemoryStore) GetItem(id int) (ToDoItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	item, ok := m.toDoMap[id]
+	if !ok {
+		return ToDoItem{}, ErrItemNotFound
+	}
+	return item, nil
+}
+
+// GetAllItems returns all of the items sorted by id.  Maps in go do
+// not have a stable order, so we sort to keep the output predictable.
+func (m *MemoryStore) GetAllItems() ([]ToDoItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var toDoList []ToDoItem
+	for _, item := range m.toDoMap {
+		toDoList = append(toDoList, item)
+	}
+	sortItemsById(toDoList)
+	return toDoList, nil
+}
+
+// ChangeItemDoneStatus sets the done flag of the item with the provided
+// id and stamps the completion time.  It returns ErrItemNotFound if there
+// is no such item.
+func (m *MemoryStore) ChangeItemDoneStatus(id int, value bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.toDoMap[id]
+	if !ok {
+		return ErrItemNotFound
+	}
+	updated := item
+	updated.IsDone = value
+	m.toDoMap[id] = stampUpdate(item, updated, now())
+	return nil
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Query selects, orders and pages items.  Every backend can answer a
+// query by loading all of the items and running RunQuery over them.
+// Backends that can do better, like redis with RediSearch, implement
+// Querier and push the filters down so fewer items are loaded.  Either
+// way the results are the same, QueryItems picks the right path.
+
+// ErrInvalidQuery is returned for a query that cannot be run, for example
+// one that sorts by a field that does not exist
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Query describes which items to return and in what order.  The zero
+// Query returns every item sorted by id.
+type Query struct {
+	//Filters, the empty value means no filter
+	Done        *bool
+	TitleSearch string //case insensitive substring of the title
+	TitlePrefix string //case insensitive prefix of the title
+	Priority    Priority
+	Tag         string
+
+	//Sort is applied in order, the item id always breaks ties so the
+	//order is stable between pages
+	Sort []SortKey
+
+	//Paging.  Limit 0 means no limit.  Cursor is the NextCursor of the
+	//previous page and cannot be combined with Offset.
+	Limit  int
+	Offset int
+	Cursor string
+}
+
+// SortKey is a field to sort by
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// QueryResult is one page of a query
+type QueryResult struct {
+	Items []ToDoItem
+	//Total is the number of items that match the filters, on all pages
+	Total int
+	//NextCursor fetches the page after this one, it is empty on the
+	//last page
+	NextCursor string
+}
+
+// Querier is implemented by stores that can run queries themselves
+type Querier interface {
+	QueryItems(q Query) (QueryResult, error)
+}
+
+// QueryItems runs a query against any store
+func QueryItems(store Store, q Query) (QueryResult, error) {
+	if err := q.Validate(); err != nil {
+		return QueryResult{}, err
+	}
+	if querier, ok := store.(Querier); ok {
+		return querier.QueryItems(q)
+	}
+	items, err := store.GetAllItems()
+	if err != nil {
+		return QueryResult{}, err
+	}
+	return RunQuery(items, q)
+}
+
+// sortFields maps the names used in sort keys, the JSON field names, to
+// a comparison.  Missing times sort after the ones that are set.
+var sortFields = map[string]func(a, b ToDoItem) int{
+	"id":    func(a, b ToDoItem) int { return a.Id - b.Id },
+	"title": func(a, b ToDoItem) int { return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title)) },
+	"done": func(a, b ToDoItem) int {
+		return boolToInt(a.IsDone) - boolToInt(b.IsDone)
+	},
+	"priority":    func(a, b ToDoItem) int { return a.Priority.Rank() - b.Priority.Rank() },
+	"dueDate":     func(a, b ToDoItem) int { return compareTimes(a.DueDate, b.DueDate) },
+	"createdAt":   func(a, b ToDoItem) int { return compareTimes(a.CreatedAt, b.CreatedAt) },
+	"updatedAt":   func(a, b ToDoItem) int { return compareTimes(a.UpdatedAt, b.UpdatedAt) },
+	"completedAt": func(a, b ToDoItem) int { return compareTimes(a.CompletedAt, b.CompletedAt) },
+	"version":     func(a, b ToDoItem) int { return a.Version - b.Version },
+}
+
+// SortFields lists the fields that can be sorted by
+func SortFields() []string {
+	names := make([]string, 0, len(sortFields))
+	for name := range sortFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseSort reads a sort parameter like "priority,-dueDate", a leading -
+// sorts that field in descending order
+func ParseSort(s string) ([]SortKey, error) {
+	var keys []SortKey
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key := SortKey{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+		if _, ok := sortFields[key.Field]; !ok {
+			return nil, fmt.Errorf("%w: cannot sort by %q, the fields are %s", ErrInvalidQuery, key.Field, strings.Join(SortFields(), ", "))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Validate checks the query before it is run
+func (q Query) Validate() error {
+	for _, key := range q.Sort {
+		if _, ok := sortFields[key.Field]; !ok {
+			return fmt.Errorf("%w: cannot sort by %q", ErrInvalidQuery, key.Field)
+		}
+	}
+	if q.Priority.Rank() < 0 {
+		return fmt.Errorf("%w: unknown priority %q", ErrInvalidQuery, q.Priority)
+	}
+	if q.Limit < 0 || q.Offset < 0 {
+		return fmt.Errorf("%w: limit and offset cannot be negative", ErrInvalidQuery)
+	}
+	if q.Cursor != "" && q.Offset > 0 {
+		return fmt.Errorf("%w: use either a cursor or an offset, not both", ErrInvalidQuery)
+	}
+	if q.Cursor != "" {
+		if _, err := decodeCursor(q.Cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches reports whether an item passes the filters of the query
+func (q Query) Matches(item ToDoItem) bool {
+	title := strings.ToLower(item.Title)
+	switch {
+	case q.Done != nil && item.IsDone != *q.Done:
+		return false
+	case q.TitleSearch != "" && !strings.Contains(title, strings.ToLower(q.TitleSearch)):
+		return false
+	case q.TitlePrefix != "" && !strings.HasPrefix(title, strings.ToLower(q.TitlePrefix)):
+		return false
+	case q.Priority != PriorityNone && item.Priority != q.Priority:
+		return false
+	case q.Tag != "" && !hasTag(item, q.Tag):
+		return false
+	}
+	return true
+}
+
+// Filtered reports whether the query has a filter, a query without one
+// matches every item
+func (q Query) Filtered() bool {
+	return q.Done != nil || q.TitleSearch != "" || q.TitlePrefix != "" ||
+		q.Priority != PriorityNone || q.Tag != ""
+}
+
+// compare orders two items by the sort keys, then by id
+func (q Query) compare(a, b ToDoItem) int {
+	for _, key := range q.Sort {
+		c := sortFields[key.Field](a, b)
+		if key.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return a.Id - b.Id
+}
+
+// RunQuery filters, sorts and pages a slice of items in memory.  The
+// slice is not changed.
+func RunQuery(items []ToDoItem, q Query) (QueryResult, error) {
+	if err := q.Validate(); err != nil {
+		return QueryResult{}, err
+	}
+
+	var matched []ToDoItem
+	for _, item := range items {
+		if q.Matches(item) {
+			matched = append(matched, item)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return q.compare(matched[i], matched[j]) < 0
+	})
+	result := QueryResult{Total: len(matched)}
+
+	//A cursor is the last item of the previous page.  The page starts
+	//with the first item that sorts after it, so items added or deleted
+	//in between do not shift the pages like they do with an offset.
+	start := q.Offset
+	if q.Cursor != "" {
+		after, _ := decodeCursor(q.Cursor)
+		start = sort.Search(len(matched), func(i int) bool {
+			return q.compare(matched[i], after) > 0
+		})
+	}
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := len(matched)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+
+	result.Items = append([]ToDoItem{}, matched[start:end]...)
+	if end < len(matched) && end > start {
+		result.NextCursor = encodeCursor(matched[end-1])
+	}
+	return result, nil
+}
+
+// encodeCursor turns the last item of a page into an opaque string.  The
+// sortable fields are kept so the cursor works with any sort order.
+func encodeCursor(item ToDoItem) string {
+	item.Tags, item.Notes = nil, ""
+	data, _ := json.Marshal(item)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (ToDoItem, error) {
+	var item ToDoItem
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &item)
+	}
+	if err != nil {
+		return ToDoItem{}, fmt.Errorf("%w: the cursor is not valid", ErrInvalidQuery)
+	}
+	return item, nil
+}
+
+func hasTag(item ToDoItem, tag string) bool {
+	for _, t := range item.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return a.Compare(*b)
+}
@@ -0,0 +1,360 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An item with a recurrence comes back on a schedule.  When it is done,
+// or its due date passes, the scheduler adds the next item of the series
+// with the same fields and the next due date, see the schedule package.
+//
+// The recurrence is either a cron expression or an iCalendar RRULE:
+//
+//	0 9 * * 1-5                      9:00 every weekday
+//	@weekly                          midnight every Sunday
+//	FREQ=WEEKLY;BYDAY=MO,WE;COUNT=6  every Monday and Wednesday, 6 times
+//	RRULE:FREQ=MONTHLY;INTERVAL=3    every 3 months
+//
+// Cron expressions have the usual five fields, minute, hour, day of the
+// month, month and day of the week, each a *, a number, a range, a list
+// or a step like */15.  An RRULE can use FREQ (HOURLY, DAILY, WEEKLY,
+// MONTHLY or YEARLY), INTERVAL, BYDAY, COUNT and UNTIL.  The next due
+// date of an RRULE counts from the due date of the item before it.
+// Every time is in UTC.
+
+// Recurrence is a parsed recurrence rule
+type Recurrence interface {
+	// Next returns the first occurrence after the time, false when the
+	// series has ended
+	Next(after time.Time) (time.Time, bool)
+	// Following returns the recurrence the next item of the series
+	// carries, false when this item is the last one
+	Following() (string, bool)
+}
+
+// ParseRecurrence parses a cron expression or an RRULE
+func ParseRecurrence(s string) (Recurrence, error) {
+	s = strings.TrimSpace(s)
+	upper := strings.ToUpper(s)
+	if strings.HasPrefix(upper, "RRULE:") || strings.HasPrefix(upper, "FREQ=") {
+		return parseRRule(s)
+	}
+	return parseCron(s)
+}
+
+// maxRecurrenceSearch bounds the search for the next occurrence, a cron
+// expression like 0 0 31 2 * never matches
+const maxRecurrenceSearch = 5 * 366 * 24 * time.Hour
+
+//------------------------------------------------------------
+// CRON
+//------------------------------------------------------------
+
+// cronRule is a parsed cron expression, each field is the set of values
+// it matches
+type cronRule struct {
+	source                       string
+	minute, hour, dom, month     map[int]bool
+	dow                          map[int]bool
+	domRestricted, dowRestricted bool
+}
+
+// cronMacros are the @ shorthands
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCron(s string) (*cronRule, error) {
+	expr := s
+	if macro, ok := cronMacros[strings.ToLower(s)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: recurrence %q should be a cron expression with 5 fields or an RRULE", ErrInvalidItem, s)
+	}
+
+	rule := &cronRule{source: s}
+	var err error
+	ranges := []struct {
+		set      *map[int]bool
+		min, max int
+	}{
+		{&rule.minute, 0, 59},
+		{&rule.hour, 0, 23},
+		{&rule.dom, 1, 31},
+		{&rule.month, 1, 12},
+		{&rule.dow, 0, 7},
+	}
+	for i, r := range ranges {
+		if *r.set, err = parseCronField(fields[i], r.min, r.max); err != nil {
+			return nil, fmt.Errorf("%w: recurrence %q: %v", ErrInvalidItem, s, err)
+		}
+	}
+	//Sunday is 0 or 7
+	if rule.dow[7] {
+		rule.dow[0] = true
+	}
+	rule.domRestricted = fields[2] != "*"
+	rule.dowRestricted = fields[4] != "*"
+	return rule, nil
+}
+
+// parseCronField returns the values a field matches
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, stepS, found := strings.Cut(part, "/"); found {
+			n, err := strconv.Atoi(stepS)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			part, step = base, n
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			loS, hiS, isRange := strings.Cut(part, "-")
+			var err error
+			if lo, err = strconv.Atoi(loS); err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiS); err != nil {
+					return nil, fmt.Errorf("bad range %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matchesDay follows cron: when both the day of the month and the day
+// of the week are restricted, a day matching either one runs
+func (c *cronRule) matchesDay(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next finds the next minute that matches, skipping whole months, days
+// and hours that cannot
+func (c *cronRule) Next(after time.Time) (time.Time, bool) {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxRecurrenceSearch)
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !c.hour[t.Hour()]:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Following is the same expression, a cron series never ends
+func (c *cronRule) Following() (string, bool) {
+	return c.source, true
+}
+
+//------------------------------------------------------------
+// RRULE
+//------------------------------------------------------------
+
+// rrule is a parsed RRULE
+type rrule struct {
+	source   string
+	freq     string
+	interval int
+	byDay    map[time.Weekday]bool
+	count    int
+	until    *time.Time
+}
+
+var rruleDays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+func parseRRule(s string) (*rrule, error) {
+	bad := func(format string, args ...any) error {
+		return fmt.Errorf("%w: recurrence %q: %s", ErrInvalidItem, s, fmt.Sprintf(format, args...))
+	}
+
+	rule := &rrule{source: s, interval: 1}
+	body := s
+	if strings.HasPrefix(strings.ToUpper(body), "RRULE:") {
+		body = body[len("RRULE:"):]
+	}
+	for _, part := range strings.Split(body, ";") {
+		name, value, found := strings.Cut(part, "=")
+		if !found {
+			return nil, bad("%q should be NAME=VALUE", part)
+		}
+		value = strings.ToUpper(strings.TrimSpace(value))
+		switch strings.ToUpper(strings.TrimSpace(name)) {
+		case "FREQ":
+			switch value {
+			case "HOURLY", "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				rule.freq = value
+			default:
+				return nil, bad("FREQ must be HOURLY, DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, bad("INTERVAL must be a positive number")
+			}
+			rule.interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, bad("COUNT must be a positive number")
+			}
+			rule.count = n
+		case "UNTIL":
+			until, err := parseRRuleTime(value)
+			if err != nil {
+				return nil, bad("UNTIL should look like 20240301 or 20240301T170000Z")
+			}
+			rule.until = &until
+		case "BYDAY":
+			rule.byDay = make(map[time.Weekday]bool)
+			for _, day := range strings.Split(value, ",") {
+				weekday, ok := rruleDays[day]
+				if !ok {
+					return nil, bad("BYDAY has an unknown day %q", day)
+				}
+				rule.byDay[weekday] = true
+			}
+		default:
+			return nil, bad("%s is not supported", name)
+		}
+	}
+	if rule.freq == "" {
+		return nil, bad("FREQ is required")
+	}
+	if rule.byDay != nil && rule.freq != "DAILY" && rule.freq != "WEEKLY" {
+		return nil, bad("BYDAY can only be used with a DAILY or WEEKLY FREQ")
+	}
+	return rule, nil
+}
+
+func parseRRuleTime(s string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", s)
+}
+
+// Next steps on from after by the interval.  With BYDAY the days that
+// are not listed are skipped, for WEEKLY the listed days of a week come
+// before moving on by the interval.
+func (r *rrule) Next(after time.Time) (time.Time, bool) {
+	after = after.UTC()
+	var next time.Time
+	switch r.freq {
+	case "HOURLY":
+		next = after.Add(time.Duration(r.interval) * time.Hour)
+	case "DAILY":
+		next = after.AddDate(0, 0, r.interval)
+		//Within 7 steps every weekday the interval can reach has come up
+		for i := 0; r.byDay != nil && !r.byDay[next.Weekday()]; i++ {
+			if i == 7 {
+				return time.Time{}, false
+			}
+			next = next.AddDate(0, 0, r.interval)
+		}
+	case "WEEKLY":
+		next = after.AddDate(0, 0, 7*r.interval)
+		if r.byDay != nil {
+			next = r.nextWeekday(after)
+		}
+	case "MONTHLY":
+		next = after.AddDate(0, r.interval, 0)
+	case "YEARLY":
+		next = after.AddDate(r.interval, 0, 0)
+	}
+	if r.until != nil && next.After(*r.until) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// nextWeekday returns the next listed day later in the week of after,
+// weeks start on Monday, or the first listed day interval weeks on
+func (r *rrule) nextWeekday(after time.Time) time.Time {
+	fromMonday := func(t time.Time) int { return (int(t.Weekday()) + 6) % 7 }
+	for day := after.AddDate(0, 0, 1); fromMonday(day) > fromMonday(after); day = day.AddDate(0, 0, 1) {
+		if r.byDay[day.Weekday()] {
+			return day
+		}
+	}
+	monday := after.AddDate(0, 0, -fromMonday(after)+7*r.interval)
+	for day := monday; ; day = day.AddDate(0, 0, 1) {
+		if r.byDay[day.Weekday()] {
+			return day
+		}
+	}
+}
+
+// Following counts COUNT down by one, the item with COUNT=1 is the last.
+// Without a COUNT the rule is passed on as it was written.
+func (r *rrule) Following() (string, bool) {
+	switch r.count {
+	case 0:
+		return r.source, true
+	case 1:
+		return "", false
+	}
+	parts := []string{"FREQ=" + r.freq}
+	if r.interval != 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.interval))
+	}
+	if r.byDay != nil {
+		var days []string
+		for _, name := range []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"} {
+			if r.byDay[rruleDays[name]] {
+				days = append(days, name)
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.count > 1 {
+		parts = append(parts, fmt.Sprintf("COUNT=%d", r.count-1))
+	}
+	if r.until != nil {
+		parts = append(parts, "UNTIL="+r.until.Format("20060102T150405Z"))
+	}
+	return "RRULE:" + strings.Join(parts, ";"), true
+}
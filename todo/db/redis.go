@@ -0,0 +1,398 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nitishm/go-rejson/v4"
+)
+
+const (
+	RedisNilError        = "redis: nil"
+	RedisDefaultLocation = "0.0.0.0:6379"
+	RedisKeyPrefix       = "todo:"
+
+	//RedisIdSequenceKey holds the last id handed out by CreateItem.  It
+	//is outside of the todo: prefix so it is not mistaken for an item.
+	RedisIdSequenceKey = "seq:todo"
+
+	//redisWatchRetries is how many times an update is retried when the
+	//item changes between reading and writing it
+	redisWatchRetries = 5
+)
+
+type cache struct {
+	cacheClient *redis.Client
+	jsonHelper  *rejson.Handler
+	context     context.Context
+}
+
+// RedisStore is a Store that keeps each item as a JSON document in redis
+// under the key todo:<id>, or todo:<list>:<id> for the items of a named
+// list.  It requires the RedisJSON module, for example the
+// redis/redis-stack container used throughout this class.
+type RedisStore struct {
+	//Redis cache connections
+	cache
+
+	//The names of the keys of the list the store holds
+	keys redisKeys
+
+	//Whether the RediSearch index can be used, see redis_search.go
+	searchState searchState
+}
+
+// NewRedisStore is a constructor function that returns a pointer to a new
+// RedisStore for the default list.  It accepts a string that represents
+// the location of the redis cache, for example 0.0.0.0:6379
+func NewRedisStore(location string) (*RedisStore, error) {
+	return NewRedisListStore(location, DefaultList)
+}
+
+// NewRedisListStore returns a RedisStore for the items of one list
+func NewRedisListStore(location string, list string) (*RedisStore, error) {
+
+	//Connect to redis.  Other options can be provided, but the
+	//defaults are OK
+	client := redis.NewClient(&redis.Options{
+		Addr: location,
+	})
+
+	//We use this context to coordinate betwen our go code and
+	//the redis operaitons
+	ctx := context.Background()
+
+	//This is the reccomended way to ensure that our redis connection
+	//is working
+	err := client.Ping(ctx).Err()
+	if err != nil {
+		log.Println("Error connecting to redis" + err.Error())
+		return nil, err
+	}
+
+	//Associate the ReJSON helper with our redis connection so we
+	//can store and query JSON documents
+	jsonHelper := rejson.NewReJSONHandler()
+	jsonHelper.SetGoRedisClientWithContext(ctx, client)
+
+	store := &RedisStore{
+		cache: cache{
+			cacheClient: client,
+			jsonHelper:  jsonHelper,
+			context:     ctx,
+		},
+		keys: redisKeysFor(list),
+	}
+
+	//Items loaded straight into redis, for example from a redis-cli
+	//script, are not in the index set yet
+	if n, err := client.Exists(ctx, store.keys.ids).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if err := store.RebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+//------------------------------------------------------------
+// REDIS HELPERS
+//------------------------------------------------------------
+
+func isRedisNilError(err error) bool {
+	return errors.Is(err, redis.Nil) || err.Error() == RedisNilError
+}
+
+// redisKeys are the names of the keys a RedisStore uses.  The default
+// list keeps the names used before there were lists, so existing data
+// is its items: todo:<id>, the index set todo:ids, the id sequence
+// seq:todo and the search index idx:todo.  A named list puts its name
+// after the todo: prefix, todo:<list>:<id>, todo:<list>:ids and so on.
+type redisKeys struct {
+	prefix string
+	ids    string
+	seq    string
+	index  string
+}
+
+func redisKeysFor(list string) redisKeys {
+	if list == "" || list == DefaultList {
+		return redisKeys{prefix: RedisKeyPrefix, ids: RedisIdsKey, seq: RedisIdSequenceKey, index: RedisSearchIndex}
+	}
+	prefix := RedisKeyPrefix + list + ":"
+	return redisKeys{
+		prefix: prefix,
+		ids:    prefix + "ids",
+		seq:    RedisIdSequenceKey + ":" + list,
+		index:  RedisSearchIndex + ":" + list,
+	}
+}
+
+// In redis, our keys will be strings, they will look like
+// todo:<number>.  This function will take an integer and
+// return a string that can be used as a key in redis
+func (k redisKeys) item(id int) string {
+	return fmt.Sprintf("%s%d", k.prefix, id)
+}
+
+// isItem reports whether a key under the prefix is an item, and not the
+// index set or a key of another list.  List names never start with a
+// digit, so todo:<list>:<id> is not mistaken for an item of the default
+// list.
+func (k redisKeys) isItem(key string) bool {
+	if !strings.HasPrefix(key, k.prefix) {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(key, k.prefix))
+	return err == nil
+}
+
+// Helper to return a ToDoItem from redis provided a key.  A missing
+// key is reported as ErrItemNotFound
+func (r *RedisStore) getItemFromRedis(key string, item *ToDoItem) error {
+	itemObject, err := r.jsonHelper.JSONGet(key, ".")
+	if err != nil {
+		if isRedisNilError(err) {
+			return ErrItemNotFound
+		}
+		return err
+	}
+
+	//JSONGet returns an "any" object that is really a byte array
+	return json.Unmarshal(itemObject.([]byte), item)
+}
+
+// Helper to store a new document only if the key is not taken yet.  The
+// NX option makes the check and the write a single redis command, so two
+// clients adding the same id cannot both succeed.  The id is added to the
+// index set in the same transaction, see redis_index.go.
+func (r *RedisStore) setItemIfAbsent(id int, item ToDoItem) (bool, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return false, err
+	}
+	var set *redis.Cmd
+	_, err = r.cacheClient.TxPipelined(r.context, func(pipe redis.Pipeliner) error {
+		set = pipe.Do(r.context, "JSON.SET", r.keys.item(id), ".", string(data), "NX")
+		//Adding an id that is already in the set does nothing, so this
+		//is safe even when the item exists
+		return pipe.SAdd(r.context, r.keys.ids, id).Err()
+	})
+	if err != nil && !isRedisNilError(err) {
+		return false, err
+	}
+	if err := set.Err(); err != nil {
+		if isRedisNilError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Helper for read-modify-write updates.  The key is WATCHed while the
+// item is read, and the commands queued by fn run in a MULTI/EXEC
+// transaction that redis aborts if the key changed in the meantime.  In
+// that case the update is retried with a fresh copy of the item.
+func (r *RedisStore) updateWatched(id int, fn func(pipe redis.Pipeliner, key string, existing ToDoItem) error) error {
+	key := r.keys.item(id)
+	txf := func(tx *redis.Tx) error {
+		cmd := redis.NewCmd(r.context, "JSON.GET", key, ".")
+		_ = tx.Process(r.context, cmd)
+		data, err := cmd.Text()
+		if err != nil {
+			if isRedisNilError(err) {
+				return ErrItemNotFound
+			}
+			return err
+		}
+		var existing ToDoItem
+		if err := json.Unmarshal([]byte(data), &existing); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(r.context, func(pipe redis.Pipeliner) error {
+			return fn(pipe, key, existing)
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < redisWatchRetries; attempt++ {
+		err := r.cacheClient.Watch(r.context, txf, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: item %d kept changing while it was being updated", ErrVersionConflict, id)
+}
+
+// Helper to queue a JSON.SET of one path in a transaction
+func jsonSet(pipe redis.Pipeliner, ctx context.Context, key string, path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return pipe.Do(ctx, "JSON.SET", key, path, string(data)).Err()
+}
+
+//------------------------------------------------------------
+// THESE ARE THE PUBLIC FUNCTIONS THAT SUPPORT OUR TODO APP
+//------------------------------------------------------------
+
+// AddItem accepts a ToDoItem and stores it in redis.  It returns
+// ErrItemExists if an item with the same id is already stored.
+func (r *RedisStore) AddItem(item ToDoItem) error {
+	if err := item.Validate(); err != nil {
+		return err
+	}
+	added, err := r.setItemIfAbsent(item.Id, stampAdd(item, now()))
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrItemExists
+	}
+	return nil
+}
+
+// CreateItem gives the item the next id from the RedisIdSequenceKey
+// counter and stores it.  INCR is atomic, so every client gets its own
+// id.  Items added with AddItem can already hold an id the counter hands
+// out, those ids are skipped.
+func (r *RedisStore) CreateItem(item ToDoItem) (ToDoItem, error) {
+	if err := item.Validate(); err != nil {
+		return ToDoItem{}, err
+	}
+	for {
+		id, err := r.cacheClient.Incr(r.context, r.keys.seq).Result()
+		if err != nil {
+			return ToDoItem{}, err
+		}
+		item.Id = int(id)
+		stamped := stampAdd(item, now())
+		added, err := r.setItemIfAbsent(item.Id, stamped)
+		if err != nil {
+			return ToDoItem{}, err
+		}
+		if added {
+			return stamped, nil
+		}
+	}
+}
+
+// UpdateItem accepts a ToDoItem and overwrites the stored document.
+// It returns ErrItemNotFound if there is no such item and
+// ErrVersionConflict if the item has a stale version.
+func (r *RedisStore) UpdateItem(item ToDoItem) error {
+	if err := item.Validate(); err != nil {
+		return err
+	}
+
+	//The stored item is needed to check the version and keep the
+	//timestamps, so read and write it in one watched transaction
+	return r.updateWatched(item.Id, func(pipe redis.Pipeliner, key string, existing ToDoItem) error {
+		if err := checkVersion(existing, item); err != nil {
+			return err
+		}
+		if err := jsonSet(pipe, r.context, key, ".", stampUpdate(existing, item, now())); err != nil {
+			return err
+		}
+		return pipe.SAdd(r.context, r.keys.ids, item.Id).Err()
+	})
+}
+
+// DeleteItem removes the item with the provided id.  It returns
+// ErrItemNotFound if there is no such item.
+func (r *RedisStore) DeleteItem(id int) error {
+	//The document and its id in the index set go together
+	var del *redis.IntCmd
+	_, err := r.cacheClient.TxPipelined(r.context, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(r.context, r.keys.item(id))
+		return pipe.SRem(r.context, r.keys.ids, id).Err()
+	})
+	if err != nil {
+		return err
+	}
+	if del.Val() == 0 {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+// DeleteAll removes every todo:<id> key and the index set from redis.
+// The keys are found with SCAN rather than the index, so items that
+// were never indexed are removed too, and deleted a batch at a time.
+func (r *RedisStore) DeleteAll() error {
+	err := r.scanItemKeys(func(keys []string) error {
+		return r.cacheClient.Del(r.context, keys...).Err()
+	})
+	if err != nil {
+		return err
+	}
+	return r.cacheClient.Del(r.context, r.keys.ids).Err()
+}
+
+// GetItem returns the item with the provided id, or ErrItemNotFound
+// along with an empty ToDoItem
+func (r *RedisStore) GetItem(id int) (ToDoItem, error) {
+	var item ToDoItem
+	if err := r.getItemFromRedis(r.keys.item(id), &item); err != nil {
+		return ToDoItem{}, err
+	}
+	return item, nil
+}
+
+// GetAllItems returns all of the items stored in redis sorted by id.
+// The ids come from the index set and the items are fetched in batches.
+func (r *RedisStore) GetAllItems() ([]ToDoItem, error) {
+	var toDoList []ToDoItem
+
+	//SSCAN can return an id twice if the set grows while we walk it
+	seen := make(map[int]bool)
+	err := r.scanIndexedItems(func(items []ToDoItem) error {
+		for _, item := range items {
+			if !seen[item.Id] {
+				seen[item.Id] = true
+				toDoList = append(toDoList, item)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortItemsById(toDoList)
+	return toDoList, nil
+}
+
+// ChangeItemDoneStatus sets the done flag of the item with the provided
+// id and stamps the completion time.  RedisJSON lets us update just the
+// changed fields in place instead of rewriting the whole document.
+func (r *RedisStore) ChangeItemDoneStatus(id int, value bool) error {
+	return r.updateWatched(id, func(pipe redis.Pipeliner, key string, existing ToDoItem) error {
+		updated := existing
+		updated.IsDone = value
+		updated = stampUpdate(existing, updated, now())
+
+		for path, value := range map[string]any{
+			".done":      value,
+			".updatedAt": updated.UpdatedAt,
+			".version":   updated.Version,
+		} {
+			if err := jsonSet(pipe, r.context, key, path, value); err != nil {
+				return err
+			}
+		}
+		//completedAt is left out of the document when the item is not done
+		if updated.CompletedAt == nil {
+			return pipe.Do(r.context, "JSON.DEL", key, ".completedAt").Err()
+		}
+		return jsonSet(pipe, r.context, key, ".completedAt", updated.CompletedAt)
+	})
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"strings"
+)
+
+// KEYS walks the whole keyspace in one command and blocks redis while it
+// does, and fetching every document with its own JSON.GET costs a round
+// trip per item.  Instead the RedisStore keeps the ids of its items in a
+// set, RedisIdsKey, which is updated in the same transaction as the
+// items.  Listing walks the set with SSCAN and fetches the documents a
+// batch at a time with JSON.MGET, counting is a single SCARD.  The few
+// operations that must see every todo:* key, like DeleteAll, use SCAN,
+// which works through the keyspace in small steps.
+
+// RedisIdsKey is the set of the ids of every item of the default list
+const RedisIdsKey = RedisKeyPrefix + "ids"
+
+// redisBatchSize is the COUNT hint passed to SCAN and SSCAN, and the
+// most documents fetched by one JSON.MGET
+const redisBatchSize = 100
+
+// CountItems returns the number of stored items without touching the
+// items themselves
+func (r *RedisStore) CountItems() (int, error) {
+	n, err := r.cacheClient.SCard(r.context, r.keys.ids).Result()
+	return int(n), err
+}
+
+// RebuildIndex adds the id of every todo:<id> document to the index set.
+// Documents written without going through the store, for example by
+// loading cache/cache-data/redis-load.redis with redis-cli, are not in
+// the set until the index is rebuilt.  NewRedisStore rebuilds the index
+// when the set does not exist yet.
+func (r *RedisStore) RebuildIndex() error {
+	return r.scanItemKeys(func(keys []string) error {
+		ids := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, r.keys.prefix))
+		}
+		return r.cacheClient.SAdd(r.context, r.keys.ids, ids...).Err()
+	})
+}
+
+// scanItemKeys calls fn with batches of the todo:<id> keys found with
+// SCAN.  Other keys under the prefix, like the index set or the items of
+// the named lists, are skipped.
+// SCAN can return a key more than once, so fn must not mind repeats.
+func (r *RedisStore) scanItemKeys(fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.cacheClient.Scan(r.context, cursor, r.keys.prefix+"*", redisBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		itemKeys := keys[:0]
+		for _, key := range keys {
+			if r.keys.isItem(key) {
+				itemKeys = append(itemKeys, key)
+			}
+		}
+		if len(itemKeys) > 0 {
+			if err := fn(itemKeys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// scanIndexedItems calls fn with batches of the items in the index set.
+// Ids whose document has gone, for example because it expired or was
+// deleted with redis-cli, are dropped from the set along the way.
+func (r *RedisStore) scanIndexedItems(fn func(items []ToDoItem) error) error {
+	var cursor uint64
+	for {
+		ids, next, err := r.cacheClient.SScan(r.context, r.keys.ids, cursor, "", redisBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			items, err := r.getItemsFromRedis(ids)
+			if err != nil {
+				return err
+			}
+			if err := fn(items); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// getItemsFromRedis fetches the documents for a batch of ids with one
+// JSON.MGET
+func (r *RedisStore) getItemsFromRedis(ids []string) ([]ToDoItem, error) {
+	args := make([]interface{}, 0, len(ids)+2)
+	args = append(args, "JSON.MGET")
+	for _, id := range ids {
+		args = append(args, r.keys.prefix+id)
+	}
+	args = append(args, ".")
+	docs, err := r.cacheClient.Do(r.context, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]ToDoItem, 0, len(docs))
+	var missing []interface{}
+	for i, doc := range docs {
+		data, ok := doc.(string)
+		if !ok {
+			missing = append(missing, ids[i])
+			continue
+		}
+		item, err := JsonToItem(data)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(missing) > 0 {
+		if err := r.cacheClient.SRem(r.context, r.keys.ids, missing...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// RediSearch, part of redis-stack, can index the JSON documents the
+// RedisStore writes.  With an index the filters of a query run inside
+// redis and only the matching documents are sent back, instead of
+// fetching every todo:* key.  Plain redis without the module still
+// works, the store falls back to loading everything and filtering in Go.
+
+// RedisSearchIndex is the name of the RediSearch index over the todo:*
+// documents, a named list has its own index over todo:<list>:*
+const RedisSearchIndex = "idx:todo"
+
+// redisSearchMaxResults caps how many documents one FT.SEARCH returns
+const redisSearchMaxResults = 10000
+
+// searchState remembers whether the index exists, so FT.CREATE is only
+// tried once per store
+type searchState struct {
+	once      sync.Once
+	available bool
+}
+
+// Compile time check that the redis store runs its own queries
+var _ Querier = (*RedisStore)(nil)
+
+// QueryItems runs a query with the filters pushed down to RediSearch.
+// RediSearch matches whole words, so the results it returns are checked
+// again with RunQuery, which also does the sorting and paging.  That keeps
+// the answers the same as the other backends.
+func (r *RedisStore) QueryItems(q Query) (QueryResult, error) {
+	if !r.searchAvailable() {
+		items, err := r.GetAllItems()
+		if err != nil {
+			return QueryResult{}, err
+		}
+		return RunQuery(items, q)
+	}
+
+	items, err := r.search(redisSearchQuery(q))
+	if err != nil {
+		//A query RediSearch does not understand should not fail the
+		//request, scanning gives the same answer, just slower
+		log.Println("RediSearch query failed, scanning instead: ", err)
+		if items, err = r.GetAllItems(); err != nil {
+			return QueryResult{}, err
+		}
+	}
+	return RunQuery(items, q)
+}
+
+// searchAvailable creates the index the first time it is needed.  It
+// reports false if the RediSearch module is not loaded.
+func (r *RedisStore) searchAvailable() bool {
+	r.searchState.once.Do(func() {
+		err := r.cacheClient.Do(r.context, "FT.CREATE", r.keys.index,
+			"ON", "JSON", "PREFIX", "1", r.keys.prefix, "SCHEMA",
+			"$.title", "AS", "title", "TEXT",
+			"$.done", "AS", "done", "TAG",
+			"$.priority", "AS", "priority", "TAG",
+			"$.tags[*]", "AS", "tags", "TAG").Err()
+		if err != nil && !strings.Contains(err.Error(), "Index already exists") {
+			log.Println("RediSearch is not available, queries will scan: ", err)
+			return
+		}
+		r.searchState.available = true
+	})
+	return r.searchState.available
+}
+
+// search runs FT.SEARCH and decodes the documents it returns
+func (r *RedisStore) search(query string) ([]ToDoItem, error) {
+	reply, err := r.cacheClient.Do(r.context, "FT.SEARCH", r.keys.index, query,
+		"RETURN", "1", "$", "LIMIT", "0", fmt.Sprint(redisSearchMaxResults)).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 {
+		return nil, fmt.Errorf("unexpected FT.SEARCH reply")
+	}
+	if total, ok := reply[0].(int64); ok && total > redisSearchMaxResults {
+		return nil, fmt.Errorf("%d matches is more than FT.SEARCH returns at once", total)
+	}
+
+	//The reply is the count followed by key, [field, value] pairs.  The
+	//index of the default list covers todo:*, which takes in the items
+	//of the named lists too, those are skipped.
+	var items []ToDoItem
+	for i := 2; i < len(reply); i += 2 {
+		if key, _ := reply[i-1].(string); !r.keys.isItem(key) {
+			continue
+		}
+		fields, ok := reply[i].([]interface{})
+		if !ok || len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected FT.SEARCH document")
+		}
+		doc, _ := fields[1].(string)
+		var item ToDoItem
+		if err := json.Unmarshal([]byte(doc), &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// redisSearchQuery turns the filters of a query into RediSearch query
+// syntax.  Filters it cannot express exactly are made looser, never
+// stricter, since RunQuery checks every item again.
+func redisSearchQuery(q Query) string {
+	var clauses []string
+	if q.Done != nil {
+		//done is left out of the document when it is false
+		if *q.Done {
+			clauses = append(clauses, "@done:{true}")
+		} else {
+			clauses = append(clauses, "-@done:{true}")
+		}
+	}
+	if q.Priority != PriorityNone {
+		clauses = append(clauses, fmt.Sprintf("@priority:{%s}", q.Priority))
+	}
+	if q.Tag != "" {
+		clauses = append(clauses, fmt.Sprintf("@tags:{%s}", escapeSearchTerm(q.Tag)))
+	}
+	//Only a single word can be pushed down, RediSearch matches words
+	//and not substrings, so a prefix of the first word is used
+	if word := firstSearchWord(q.TitlePrefix); word != "" {
+		clauses = append(clauses, fmt.Sprintf("@title:%s*", word))
+	}
+	if len(clauses) == 0 {
+		return "*"
+	}
+	return strings.Join(clauses, " ")
+}
+
+// firstSearchWord returns the first word of s if it is long enough for a
+// RediSearch prefix query, which needs at least two characters
+func firstSearchWord(s string) string {
+	word := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(word) == 0 || len(word[0]) < 2 {
+		return ""
+	}
+	//The prefix must not end part way through a word separator
+	if !strings.HasPrefix(strings.ToLower(s), word[0]) {
+		return ""
+	}
+	return word[0]
+}
+
+// escapeSearchTerm escapes the punctuation RediSearch treats as syntax
+func escapeSearchTerm(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
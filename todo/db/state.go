@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A StateStore keeps small named values for the code that runs next to
+// the items, like the scheduler remembering which reminders it has sent.
+// It uses the same backend as the items so the state survives a restart
+// whenever the items do.  Values are stored as json.
+
+// StateStore saves and loads named values.  Load fills v and returns
+// false, leaving v alone, when nothing has been saved under the name.
+type StateStore interface {
+	Load(name string, v any) (bool, error)
+	Save(name string, v any) error
+}
+
+// Compile time checks that each state store satisfies the interface
+var (
+	_ StateStore = (*MemoryStateStore)(nil)
+	_ StateStore = (*FileStateStore)(nil)
+	_ StateStore = (*RedisStateStore)(nil)
+)
+
+// RedisStatePrefix is put in front of the names in redis, outside of the
+// todo: prefix so a value is not mistaken for an item
+const RedisStatePrefix = "state:todo:"
+
+// NewStateStore creates the state store for the backend named in the
+// config.  The file backend keeps each value in <db>.<name>.state next
+// to the database.
+func NewStateStore(cfg Config) (StateStore, error) {
+	switch cfg.Backend {
+	case FileBackend:
+		return NewFileStateStore(cfg.FileName), nil
+	case MemoryBackend:
+		return NewMemoryStateStore(), nil
+	case RedisBackend:
+		return NewRedisStateStore(cfg.RedisLocation)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+//------------------------------------------------------------
+// IN MEMORY
+//------------------------------------------------------------
+
+// MemoryStateStore keeps the values in a map, they are lost when the
+// process exits
+type MemoryStateStore struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+// NewMemoryStateStore returns an empty in memory state store
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{values: make(map[string][]byte)}
+}
+
+// Load reads the value saved under name
+func (m *MemoryStateStore) Load(name string, v any) (bool, error) {
+	m.mu.RLock()
+	data, ok := m.values[name]
+	m.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// Save replaces the value saved under name
+func (m *MemoryStateStore) Save(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[name] = data
+	return nil
+}
+
+//------------------------------------------------------------
+// FILE
+//------------------------------------------------------------
+
+// FileStateStore keeps each value in its own file next to the database.
+// The files are replaced atomically, a crash leaves the old value.
+type FileStateStore struct {
+	dbFileName string
+}
+
+// NewFileStateStore returns a state store for the database in dbFileName
+func NewFileStateStore(dbFileName string) *FileStateStore {
+	return &FileStateStore{dbFileName: dbFileName}
+}
+
+// FileName returns the file the value saved under name is kept in
+func (f *FileStateStore) FileName(name string) string {
+	return f.dbFileName + "." + name + ".state"
+}
+
+// Load reads the value saved under name
+func (f *FileStateStore) Load(name string, v any) (bool, error) {
+	data, err := os.ReadFile(f.FileName(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("corrupt state in %s: %w", f.FileName(name), err)
+	}
+	return true, nil
+}
+
+// Save replaces the value saved under name
+func (f *FileStateStore) Save(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.FileName(name), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+//------------------------------------------------------------
+// REDIS
+//------------------------------------------------------------
+
+// RedisStateStore keeps each value as a string under state:todo:<name>
+type RedisStateStore struct {
+	client  *redis.Client
+	context context.Context
+}
+
+// NewRedisStateStore connects to the redis at location
+func NewRedisStateStore(location string) (*RedisStateStore, error) {
+	client := redis.NewClient(&redis.Options{Addr: location})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisStateStore{client: client, context: ctx}, nil
+}
+
+// Load reads the value saved under name
+func (r *RedisStateStore) Load(name string, v any) (bool, error) {
+	data, err := r.client.Get(r.context, RedisStatePrefix+name).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("corrupt state in %s%s: %w", RedisStatePrefix, name, err)
+	}
+	return true, nil
+}
+
+// Save replaces the value saved under name
+func (r *RedisStateStore) Save(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.context, RedisStatePrefix+name, data, 0).Err()
+}
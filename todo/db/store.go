@@ -0,0 +1,181 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Store is the interface that every todo storage backend implements.  The
+// CLI and the gin API only talk to a Store, so the same code can run on top
+// of a JSON file, an in memory map or a Redis cache depending on how it is
+// configured.
+//
+// AddItem stores an item under the id the caller picked, CreateItem lets
+// the store allocate the next free id and returns the stored item.
+// UpdateItem rejects an item whose Version does not match the stored one
+// with ErrVersionConflict, a Version of 0 skips the check.
+type Store interface {
+	AddItem(item ToDoItem) error
+	CreateItem(item ToDoItem) (ToDoItem, error)
+	UpdateItem(item ToDoItem) error
+	DeleteItem(id int) error
+	DeleteAll() error
+	GetItem(id int) (ToDoItem, error)
+	GetAllItems() ([]ToDoItem, error)
+	ChangeItemDoneStatus(id int, value bool) error
+}
+
+// Compile time checks that each backend satisfies the Store interface
+var (
+	_ Store = (*ToDo)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*RedisStore)(nil)
+)
+
+// These errors are shared by all of the backends so callers can tell the
+// difference between a missing item, a duplicate item and an IO failure
+// using errors.Is()
+var (
+	ErrItemNotFound    = errors.New("item does not exist")
+	ErrItemExists      = errors.New("item already exists")
+	ErrVersionConflict = errors.New("item was changed by someone else")
+)
+
+// The names of the backends that can be selected from configuration
+const (
+	FileBackend   = "file"
+	MemoryBackend = "memory"
+	RedisBackend  = "redis"
+
+	DefaultDbFileName = "./data/todo.json"
+)
+
+// Config describes which backend to use and where it keeps its data.
+// FileName is only used by the file backend and RedisLocation is only
+// used by the redis backend.  List picks one of the named todo lists,
+// empty is the default list, see lists.go.
+type Config struct {
+	Backend       string
+	FileName      string
+	RedisLocation string
+	List          string
+}
+
+// ForList returns the config for the items of a named list.  The file
+// backend keeps them in their own file next to the database,
+// data/todo.json becomes data/todo.<list>.json, and the redis backend
+// under todo:<list>:<id>.
+func (cfg Config) ForList(list string) Config {
+	if list == DefaultList {
+		list = ""
+	}
+	ext := filepath.Ext(cfg.FileName)
+	base := strings.TrimSuffix(cfg.FileName, ext)
+	if cfg.List != "" {
+		base = strings.TrimSuffix(base, "."+cfg.List)
+	}
+	if list != "" {
+		base += "." + list
+	}
+	cfg.FileName = base + ext
+	cfg.List = list
+	return cfg
+}
+
+// ConfigFromEnv returns a Config where any empty field is filled in from
+// the TODO_BACKEND, TODO_DB_FILE and REDIS_URL environment variables, and
+// then from the package defaults.  Values that are already set, for example
+// from a command line flag, win over the environment.
+func ConfigFromEnv(cfg Config) Config {
+	if cfg.Backend == "" {
+		cfg.Backend = os.Getenv("TODO_BACKEND")
+	}
+	if cfg.FileName == "" {
+		cfg.FileName = os.Getenv("TODO_DB_FILE")
+	}
+	if cfg.RedisLocation == "" {
+		cfg.RedisLocation = os.Getenv("REDIS_URL")
+	}
+
+	if cfg.Backend == "" {
+		cfg.Backend = FileBackend
+	}
+	if cfg.FileName == "" {
+		cfg.FileName = DefaultDbFileName
+	}
+	if cfg.RedisLocation == "" {
+		cfg.RedisLocation = RedisDefaultLocation
+	}
+	return cfg
+}
+
+// NewStore creates the backend named in the config.  It returns an
+// error if the backend is unknown or if it could not be initialized,
+// for example if redis is not running.
+func NewStore(cfg Config) (Store, error) {
+	//Note we check each error before returning so that a failed
+	//constructor never hands back a non-nil Store holding a nil pointer
+	switch cfg.Backend {
+	case FileBackend:
+		store, err := New(cfg.FileName)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case MemoryBackend:
+		return NewMemoryStore(), nil
+	case RedisBackend:
+		store, err := NewRedisListStore(cfg.RedisLocation, cfg.List)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+//------------------------------------------------------------
+// HELPERS SHARED BY ALL OF THE BACKENDS
+//------------------------------------------------------------
+
+// PrintItem accepts a ToDoItem and prints it to the console
+// in a JSON pretty format
+func PrintItem(item ToDoItem) {
+	jsonBytes, _ := json.MarshalIndent(item, "", "  ")
+	fmt.Println(string(jsonBytes))
+}
+
+// PrintAllItems accepts a slice of ToDoItems and prints them to the
+// console in a JSON pretty format by calling PrintItem() for each one
+func PrintAllItems(itemList []ToDoItem) {
+	for _, item := range itemList {
+		PrintItem(item)
+	}
+}
+
+// JsonToItem accepts a json string and returns a ToDoItem.  The CLI
+// accepts todo items for insertion and updates in JSON format.
+func JsonToItem(jsonString string) (ToDoItem, error) {
+	var item ToDoItem
+	err := json.Unmarshal([]byte(jsonString), &item)
+	if err != nil {
+		return ToDoItem{}, err
+	}
+
+	return item, nil
+}
+
+// sortItemsById orders a slice of items by id.  Backends that keep
+// their items in a map or a keyspace use it to give callers a stable
+// order.
+func sortItemsById(items []ToDoItem) {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Id < items[j].Id
+	})
+}
@@ -3,16 +3,30 @@ package db
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"os"
+	"sync"
+	"time"
 )
 
-// ToDoItem is the struct that represents a single ToDo item
+// ToDoItem is the struct that represents a single ToDo item.  Everything
+// after IsDone is optional, see item.go.  The timestamps and the version
+// are set by the stores.
 type ToDoItem struct {
-	Id     int    `json:"id"`
-	Title  string `json:"title"`
-	IsDone bool   `json:"done,omitempty"`
+	Id          int        `json:"id"`
+	Title       string     `json:"title"`
+	IsDone      bool       `json:"done,omitempty"`
+	DueDate     *time.Time `json:"dueDate,omitempty"`
+	Priority    Priority   `json:"priority,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Notes       string     `json:"notes,omitempty"`
+	Recurrence  string     `json:"recurrence,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt   *time.Time `json:"updatedAt,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Version     int        `json:"version,omitempty"`
 }
 
 // DbMap is a type alias for a map of ToDoItems.  The key
@@ -20,8 +34,11 @@ type ToDoItem struct {
 type DbMap map[int]ToDoItem
 
 // ToDo is the struct that represents the main object of our
-// todo app.  It contains a map of ToDoItems and the name of
-// the file that is used to store the items.
+// todo app.  It contains an in memory copy of the ToDoItems and
+// the name of the file that is used to store the items.  ToDo is
+// the JSON file backend of the Store interface.  The file is a
+// snapshot, changes are appended to an operation log next to it,
+// see wal.go for the details.
 //
 // TODO: Notice how the fields in the struct are not exported
 //
@@ -37,34 +54,38 @@ type DbMap map[int]ToDoItem
 //   package as it becomes less protected.
 
 type ToDo struct {
-	toDoMap    DbMap
-	dbFileName string
+	mu           sync.Mutex
+	dbFileName   string
+	items        []ToDoItem
+	loaded       bool
+	lsn          int64
+	seq          int
+	snapshotLSN  int64
+	logOffset    int64
+	compactEvery int
+	historyKeep  int
 }
 
 // New is a constructor function that returns a pointer to a new
 // ToDo struct.  It takes a single string argument that is the
 // name of the file that will be used to store the ToDo items.
 // If the file doesn't exist, it will be created.  If the file
-// does exist, it will be loaded into the ToDo struct.
+// does exist, it is checked and recovered if it is damaged.
 func New(dbFile string) (*ToDo, error) {
 
-	//Check if the database file exists, if not use initDB to create it
-	//In go, you use the os.Stat function to get information about a file
-	//In this case, we are only checking the error, because if we get an
-	//error we can safely assume that this file does not exist.
-	if _, err := os.Stat(dbFile); err != nil {
-		//If the file doesn't exist, create it
-		err := initDB(dbFile)
-		if err != nil {
-			return nil, err
-		}
+	toDo := &ToDo{
+		dbFileName:   dbFile,
+		compactEvery: DefaultCompactEvery,
+		historyKeep:  DefaultHistoryKeep,
 	}
 
-	//Now that we know the file exists, at at the minimum we have
-	//a valid empty DB, lets create the ToDo struct
-	toDo := &ToDo{
-		toDoMap:    make(map[int]ToDoItem),
-		dbFileName: dbFile,
+	//Check if the database file exists and holds a valid json array.
+	//If it does not exist, checkDB uses initDB to create it, and if it
+	//is truncated or otherwise damaged it is recovered.  This is done
+	//while holding the lock so two todo processes starting at the same
+	//time do not both try to create the file.
+	if err := toDo.checkDB(); err != nil {
+		return nil, err
 	}
 
 	// We should be all set here, the ToDo struct is ready to go
@@ -90,7 +111,6 @@ func New(dbFile string) (*ToDo, error) {
 // does not exist.
 func (t *ToDo) RestoreDB() error {
 	//Copy the backup file to the db file
-	dbFileName := t.dbFileName
 	backupFileName := t.dbFileName + ".bak"
 
 	//Copy the backup file to the db file
@@ -111,6 +131,14 @@ func (t *ToDo) RestoreDB() error {
 
 	// TODO: Implement this function
 
+	// hold the write lock so no other todo process reads a half
+	// restored database
+	unlock, err := t.lockDB(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// open the file but check to see if the .bak file exists
 	backupFile, err := os.Open(backupFileName)
 
@@ -122,43 +150,13 @@ func (t *ToDo) RestoreDB() error {
 	// close the file after func has been completed
 	defer backupFile.Close()
 
-	// create a new filename or overwrite
-	restoredFile, err := os.Create(dbFileName)
-
-	// destination file fails to create throw an error
-	if err != nil {
+	// decode the backup first so we never restore a damaged file
+	var backupItems []ToDoItem
+	if err := json.NewDecoder(backupFile).Decode(&backupItems); err != nil {
 		return err
 	}
 
-	// close the destination file
-	defer restoredFile.Close()
-
-	// a buffer is needed to read from the file to memory
-	bufferReader := make([]byte, 8)
-
-	// for loop to allow iteration
-	for {
-
-		// read data backup file data
-		data, err := backupFile.Read(bufferReader)
-
-		// error out if error or EOF is found
-		if err != nil && err != io.EOF {
-			return err
-		}
-
-		// break out of the for loop once data is 0
-		if data == 0 {
-			break
-		}
-
-		// write back up to new file
-		if _, err := restoredFile.Write(bufferReader[:data]); err != nil {
-			return err
-		}
-	}
-
-	return err
+	return t.resetItems(backupItems)
 }
 
 //------------------------------------------------------------
@@ -191,41 +189,68 @@ func (t *ToDo) AddItem(item ToDoItem) error {
 	//at the end to indicate that the item was properly added to the
 	//database.
 
-	// set database file name
-	fileName := t.dbFileName
-
-	// read the file's content and return bytes
-	data, err := os.ReadFile(fileName)
+	// hold the write lock for the whole read-modify-write so another
+	// todo process cannot sneak in between the read and the save
+	unlock, err := t.lockDB(true)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	// setup a variable for the structure in memory
-	var todoContents []ToDoItem
+	// bring our copy of the database up to date, another todo
+	// process may have changed it since we last looked
+	if err := t.refresh(); err != nil {
+		return err
+	}
 
-	// unmarshal turns encoded data to be readable
-	err = json.Unmarshal(data, &todoContents)
-	if err != nil {
+	if err := item.Validate(); err != nil {
 		return err
 	}
 
 	// check to see if
-	for _, i := range todoContents {
-		if i.Id == item.Id {
-			return errors.New("found matching item.Id in todo.json")
-		}
+	if t.indexOf(item.Id) >= 0 {
+		return ErrItemExists
 	}
+	item = stampAdd(item, now())
 
-	todoContents = append(todoContents, item)
-
-	jsonAdd, _ := json.MarshalIndent(todoContents, "", "\t")
+	// append the change to the operation log instead of rewriting
+	// the whole database file
+	return t.appendLog(LogRecord{Op: LogOpAdd, Id: item.Id, Item: &item})
+}
 
-	err = os.WriteFile(fileName, jsonAdd, os.ModeAppend)
+// CreateItem accepts a ToDoItem, gives it the next id from the database
+// sequence and adds it to the DB.  Any id set on the item is ignored.
+// Preconditions:   (1) The database file must exist and be a valid
+//
+// Postconditions:
+//
+//	 (1) The item will be added to the DB with an id that has never
+//	     been used before, even by an item that was later deleted
+//		(2) The stored item, with its id and timestamps, is returned
+//		(3) If there is an error, it will be returned
+func (t *ToDo) CreateItem(item ToDoItem) (ToDoItem, error) {
+	// the sequence is read and bumped under the write lock, so two
+	// todo processes can never hand out the same id
+	unlock, err := t.lockDB(true)
 	if err != nil {
-		return err
+		return ToDoItem{}, err
 	}
+	defer unlock()
 
-	return nil
+	if err := t.refresh(); err != nil {
+		return ToDoItem{}, err
+	}
+
+	if err := item.Validate(); err != nil {
+		return ToDoItem{}, err
+	}
+
+	item.Id = t.seq + 1
+	item = stampAdd(item, now())
+	if err := t.appendLog(LogRecord{Op: LogOpAdd, Id: item.Id, Item: &item}); err != nil {
+		return ToDoItem{}, err
+	}
+	return item, nil
 }
 
 // DeleteItem accepts an item id and removes it from the DB.
@@ -254,44 +279,36 @@ func (t *ToDo) DeleteItem(id int) error {
 	//return nil at the end to indicate that the item was properly deleted
 	//from the database.
 
-	fileName := t.dbFileName
-
-	data, err := os.ReadFile(fileName)
+	unlock, err := t.lockDB(true)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	var todoContents []ToDoItem
-
-	err = json.Unmarshal(data, &todoContents)
-	if err != nil {
+	if err := t.refresh(); err != nil {
 		return err
 	}
 
-	n := 0
-	itemDeleted := false
-
-	for _, i := range todoContents {
-		if i.Id == id {
-			itemDeleted = true
-			todoContents = append(todoContents[:n], todoContents[n+1:]...)
-			break
-		}
-		n++
+	if t.indexOf(id) < 0 {
+		return ErrItemNotFound
 	}
 
-	if itemDeleted == true {
-		jsonAdd, _ := json.MarshalIndent(todoContents, "", "\t")
-		err = os.WriteFile(fileName, jsonAdd, os.ModeAppend)
-		if err != nil {
-			return err
-		}
+	return t.appendLog(LogRecord{Op: LogOpDelete, Id: id})
+}
+
+// DeleteAll removes all items from the DB
+func (t *ToDo) DeleteAll() error {
+	unlock, err := t.lockDB(true)
+	if err != nil {
+		return err
 	}
-	if itemDeleted == false {
-		return errors.New("could not delete Id, it does not exist in database")
+	defer unlock()
+
+	if err := t.refresh(); err != nil {
+		return err
 	}
 
-	return nil
+	return t.appendLog(LogRecord{Op: LogOpDeleteAll})
 }
 
 // UpdateItem accepts a ToDoItem and updates it in the DB.
@@ -320,41 +337,30 @@ func (t *ToDo) UpdateItem(item ToDoItem) error {
 	//no errors, this function should return nil at the end to indicate
 	//that the item was properly updated in the database.
 
-	fileName := t.dbFileName
-	var fileContents []ToDoItem
-
-	data, err := os.ReadFile(fileName)
+	unlock, err := t.lockDB(true)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	err = json.Unmarshal(data, &fileContents)
-	if err != nil {
+	if err := t.refresh(); err != nil {
 		return err
 	}
 
-	var idx int
-
-	for i := 0; i <= len(fileContents); i++ {
-		if fileContents[i].Id == item.Id {
-			idx = i
-			break
-		}
-		if i == len(fileContents) {
-			return errors.New("did not find id in database")
-		}
+	if err := item.Validate(); err != nil {
+		return err
 	}
 
-	fileContents[idx] = item
-
-	jsonUpdate, err := json.MarshalIndent(fileContents, "", "\t")
-
-	err = os.WriteFile(fileName, jsonUpdate, os.ModeAppend)
-	if err != nil {
+	idx := t.indexOf(item.Id)
+	if idx < 0 {
+		return ErrItemNotFound
+	}
+	if err := checkVersion(t.items[idx], item); err != nil {
 		return err
 	}
+	item = stampUpdate(t.items[idx], item, now())
 
-	return err
+	return t.appendLog(LogRecord{Op: LogOpUpdate, Id: item.Id, Item: &item})
 }
 
 // GetItem accepts an item id and returns the item from the DB.
@@ -384,32 +390,22 @@ func (t *ToDo) GetItem(id int) (ToDoItem, error) {
 	//as the error value the end to indicate that the item was
 	//properly returned from the database.
 
-	fileName := t.dbFileName
-	var fileContents []ToDoItem
-
-	data, err := os.ReadFile(fileName)
+	unlock, err := t.lockDB(false)
 	if err != nil {
 		return ToDoItem{}, err
 	}
+	defer unlock()
 
-	err = json.Unmarshal(data, &fileContents)
-	if err != nil {
+	if err := t.refresh(); err != nil {
 		return ToDoItem{}, err
 	}
 
-	var idx int
-
-	for i := 0; i < len(fileContents); i++ {
-		if fileContents[i].Id == id {
-			idx = i
-			break
-		}
-		if i == len(fileContents)-1 {
-			return ToDoItem{}, errors.New("did not find id in database")
-		}
+	idx := t.indexOf(id)
+	if idx < 0 {
+		return ToDoItem{}, ErrItemNotFound
 	}
 
-	return fileContents[idx], nil
+	return t.items[idx], nil
 }
 
 // GetAllItems returns all items from the DB.  If successful it
@@ -434,37 +430,34 @@ func (t *ToDo) GetAllItems() ([]ToDoItem, error) {
 	//Finally, if there were no errors along the way, return the slice
 	//and nil as the error value.
 
-	fileName := t.dbFileName
-	var fileContents []ToDoItem
-
-	data, err := os.ReadFile(fileName)
+	unlock, err := t.lockDB(false)
 	if err != nil {
-		return fileContents, err
+		return nil, err
 	}
+	defer unlock()
 
-	err = json.Unmarshal(data, &fileContents)
-	if err != nil {
-		return fileContents, err
+	if err := t.refresh(); err != nil {
+		return nil, err
 	}
 
-	return fileContents, nil
+	//Hand back a copy so the caller cannot change our in memory state
+	toDoList := make([]ToDoItem, len(t.items))
+	copy(toDoList, t.items)
+	return toDoList, nil
 }
 
 // PrintItem accepts a ToDoItem and prints it to the console
 // in a JSON pretty format. As some help, look at the
 // json.MarshalIndent() function from our in class go tutorial.
 func (t *ToDo) PrintItem(item ToDoItem) {
-	jsonBytes, _ := json.MarshalIndent(item, "", "  ")
-	fmt.Println(string(jsonBytes))
+	PrintItem(item)
 }
 
 // PrintAllItems accepts a slice of ToDoItems and prints them to the console
 // in a JSON pretty format.  It should call PrintItem() to print each item
 // versus repeating the code.
 func (t *ToDo) PrintAllItems(itemList []ToDoItem) {
-	for _, item := range itemList {
-		t.PrintItem(item)
-	}
+	PrintAllItems(itemList)
 }
 
 // JsonToItem accepts a json string and returns a ToDoItem
@@ -472,13 +465,7 @@ func (t *ToDo) PrintAllItems(itemList []ToDoItem) {
 // and updates in JSON format.  We need to convert it to a ToDoItem
 // struct to perform any operations on it.
 func (t *ToDo) JsonToItem(jsonString string) (ToDoItem, error) {
-	var item ToDoItem
-	err := json.Unmarshal([]byte(jsonString), &item)
-	if err != nil {
-		return ToDoItem{}, err
-	}
-
-	return item, nil
+	return JsonToItem(jsonString)
 }
 
 // ChangeItemDoneStatus accepts an item id and a boolean status.
@@ -515,6 +502,7 @@ func (t *ToDo) ChangeItemDoneStatus(id int, value bool) error {
 		return err
 	}
 
+	item.IsDone = value
 	err = t.UpdateItem(item)
 	if err != nil {
 		return err
@@ -534,68 +522,108 @@ func (t *ToDo) ChangeItemDoneStatus(id int, value bool) error {
 // exist.  Notice this function does not have a receiver as its
 // used by New() to create the DB file
 func initDB(dbFileName string) error {
-	f, err := os.Create(dbFileName)
-	if err != nil {
-		return err
-	}
-
 	// Given we are working with a json array as our DB structure
 	// we should initialize the file with an empty array, which
 	// in json is represented as "[]
-	_, err = f.Write([]byte("[]"))
+	return WriteFileAtomic(dbFileName, func(w io.Writer) error {
+		_, err := w.Write([]byte("[]"))
+		return err
+	})
+}
+
+// saveDB marshals the slice of items into json and atomically replaces
+// the database file with it.  The caller must hold the write lock.
+func (t *ToDo) saveDB(toDoList []ToDoItem) error {
+	//Marshal the slice into json, lets pretty print it, but
+	//this is not required
+	data, err := json.MarshalIndent(toDoList, "", "\t")
 	if err != nil {
 		return err
 	}
 
-	f.Close()
-
-	return nil
+	//Write the json to a temp file and rename it over our file
+	return WriteFileAtomic(t.dbFileName, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
 }
 
-func (t *ToDo) saveDB() error {
-	//1. Convert our map into a slice
-	//2. Marshal the slice into json
-	//3. Write the json to our file
-
-	//1. Convert our map into a slice
-	var toDoList []ToDoItem
-	for _, item := range t.toDoMap {
-		toDoList = append(toDoList, item)
-	}
-
-	//2. Marshal the slice into json, lets pretty print it, but
-	//   this is not required
-	data, err := json.MarshalIndent(toDoList, "", "  ")
+// loadDB reads the database file and returns its items in the order
+// they are stored.  The caller must hold the read or write lock.
+func (t *ToDo) loadDB() ([]ToDoItem, error) {
+	data, err := os.ReadFile(t.dbFileName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	//3. Write the json to our file
-	err = os.WriteFile(t.dbFileName, data, 0644)
+	//Now let's unmarshal the data into our slice
+	var toDoList []ToDoItem
+	err = json.Unmarshal(data, &toDoList)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return toDoList, nil
 }
 
-func (t *ToDo) loadDB() error {
-	data, err := os.ReadFile(t.dbFileName)
+// checkDB makes sure the database file holds a valid json array.  If
+// it does not, for example because an older version of this program
+// crashed half way through a write and left it truncated, the damaged
+// file is moved to <db>.corrupt and the database is recovered from the
+// <db>.bak backup file, or reset to an empty array if there is no
+// usable backup.
+func (t *ToDo) checkDB() error {
+	unlock, err := t.lockDB(true)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	//Now let's unmarshal the data into our map
-	var toDoList []ToDoItem
-	err = json.Unmarshal(data, &toDoList)
-	if err != nil {
+	if _, err := t.loadDB(); err == nil {
+		return t.initLog()
+	} else if errors.Is(err, fs.ErrNotExist) {
+		if err := initDB(t.dbFileName); err != nil {
+			return err
+		}
+		return t.initLog()
+	} else {
+		log.Printf("Database %s is damaged: %v", t.dbFileName, err)
+	}
+
+	corruptFileName := t.dbFileName + ".corrupt"
+	if err := os.Rename(t.dbFileName, corruptFileName); err != nil {
 		return err
 	}
+	log.Printf("Moved damaged database to %s", corruptFileName)
+
+	backupFileName := t.dbFileName + ".bak"
+	var backupItems []ToDoItem
+	backup, err := os.ReadFile(backupFileName)
+	if err == nil && json.Unmarshal(backup, &backupItems) == nil {
+		log.Printf("Recovering database from %s", backupFileName)
+		if err := WriteFileAtomic(t.dbFileName, func(w io.Writer) error {
+			_, err := w.Write(backup)
+			return err
+		}); err != nil {
+			return err
+		}
+		return t.initLog()
+	}
 
-	//Now let's iterate over our slice and add each item to our map
-	for _, item := range toDoList {
-		t.toDoMap[item.Id] = item
+	log.Printf("No usable backup found, starting with an empty database")
+	if err := initDB(t.dbFileName); err != nil {
+		return err
 	}
+	return t.initLog()
+}
 
-	return nil
+// indexOf returns the position of the item with the provided id in our
+// in memory copy of the database, or -1 if there is no such item
+func (t *ToDo) indexOf(id int) int {
+	for i := range t.items {
+		if t.items[i].Id == id {
+			return i
+		}
+	}
+	return -1
 }
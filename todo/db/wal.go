@@ -0,0 +1,618 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The file backend does not rewrite todo.json on every change.  Instead
+// todo.json is a snapshot and every add, update and delete is appended to
+// an operation log, <db>.log, as one json record per line.  Each record
+// gets the next log sequence number (LSN).  When the database is opened
+// the log is replayed on top of the snapshot, and once enough records
+// pile up the log is compacted into a new snapshot.
+//
+// Compacted log segments and snapshots are kept in the <db>.history
+// directory so that the database can be restored to the state it had at
+// any LSN, not just to the single .bak file.  Only the newest snapshots
+// are kept, DefaultHistoryKeep of them unless SetHistoryKeep says
+// otherwise, along with the log segments after the oldest of them.  The
+// database can be restored to any LSN from that snapshot on.
+//
+// The first line of the log is a header record that holds the LSN of
+// the snapshot the log starts from and the id sequence, the highest id
+// that was ever handed out.  The sequence only moves forward, so an id is
+// not reused after its item is deleted.  Replaying a record is idempotent
+// (adds and updates store the whole item, deletes ignore missing items)
+// so a crash part way through a compaction never corrupts the database.
+
+// DefaultCompactEvery is how many log records are written before the
+// log is compacted into a new snapshot
+const DefaultCompactEvery = 100
+
+// DefaultHistoryKeep is how many snapshots compact keeps in the history
+// directory
+const DefaultHistoryKeep = 10
+
+// LogOp is the kind of change recorded in the operation log
+type LogOp string
+
+const (
+	LogOpSnapshot  LogOp = "snapshot"
+	LogOpAdd       LogOp = "add"
+	LogOpUpdate    LogOp = "update"
+	LogOpDelete    LogOp = "delete"
+	LogOpDeleteAll LogOp = "deleteAll"
+	LogOpReset     LogOp = "reset"
+)
+
+// ErrHistoryUnavailable is returned when a point in time restore asks
+// for an LSN that is not covered by the kept history
+var ErrHistoryUnavailable = errors.New("history is not available for the requested lsn")
+
+// LogRecord is a single entry in the operation log.  Item is set for adds
+// and updates, Id for deletes and Items for resets, which replace the
+// whole database (for example when restoring a backup).  Seq is only set
+// on the header.
+type LogRecord struct {
+	LSN   int64      `json:"lsn"`
+	Op    LogOp      `json:"op"`
+	Id    int        `json:"id"`
+	Item  *ToDoItem  `json:"item,omitempty"`
+	Items []ToDoItem `json:"items,omitempty"`
+	Seq   int        `json:"seq,omitempty"`
+	Time  time.Time  `json:"time"`
+}
+
+// SetCompactEvery changes how many log records are written before the
+// log is compacted into a new snapshot
+func (t *ToDo) SetCompactEvery(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	t.compactEvery = n
+}
+
+// SetHistoryKeep changes how many snapshots are kept in the history
+// directory when the log is compacted, 0 keeps all of them
+func (t *ToDo) SetHistoryKeep(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	t.historyKeep = n
+}
+
+// PruneHistory deletes all but the newest keep snapshots from the history
+// directory, and the log segments that are only needed by the deleted
+// ones.  It returns the names of the files that were deleted.
+func (t *ToDo) PruneHistory(keep int) ([]string, error) {
+	if keep < 1 {
+		return nil, errors.New("at least one snapshot has to be kept")
+	}
+
+	unlock, err := t.lockDB(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return t.pruneHistory(keep)
+}
+
+// Compact writes the current state of the database to todo.json and
+// starts a new, empty operation log.  The retired log segment is kept in
+// the history directory for point in time restores.
+func (t *ToDo) Compact() error {
+	unlock, err := t.lockDB(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	return t.compact()
+}
+
+// LSN returns the log sequence number of the last change applied to
+// the database
+func (t *ToDo) LSN() (int64, error) {
+	unlock, err := t.lockDB(false)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	if err := t.refresh(); err != nil {
+		return 0, err
+	}
+	return t.lsn, nil
+}
+
+// History returns every log record that is still available, from the
+// history directory and the current log, ordered by LSN
+func (t *ToDo) History() ([]LogRecord, error) {
+	unlock, err := t.lockDB(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := t.refresh(); err != nil {
+		return nil, err
+	}
+	records, err := t.readAllRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	var history []LogRecord
+	for _, rec := range records {
+		history = append(history, rec)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].LSN < history[j].LSN
+	})
+	return history, nil
+}
+
+// RestoreToLSN puts the database back into the state it had right after
+// the change with the provided LSN was applied.  The restore is itself
+// recorded in the log, so it can be undone by restoring to a later LSN.
+func (t *ToDo) RestoreToLSN(lsn int64) error {
+	unlock, err := t.lockDB(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	if lsn < 0 || lsn > t.lsn {
+		return fmt.Errorf("lsn %d is out of range, the database is at lsn %d", lsn, t.lsn)
+	}
+
+	items, err := t.itemsAtLSN(lsn)
+	if err != nil {
+		return err
+	}
+	return t.resetItems(items)
+}
+
+//------------------------------------------------------------
+// OPERATION LOG HELPERS, THE CALLER MUST HOLD THE LOCK
+//------------------------------------------------------------
+
+// resetItems replaces the whole database with items.  The reset is
+// recorded in the operation log, so it can be undone with RestoreToLSN,
+// and then compacted so that the db file holds the new items.
+func (t *ToDo) resetItems(items []ToDoItem) error {
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	if err := t.appendLog(LogRecord{Op: LogOpReset, Items: items}); err != nil {
+		return err
+	}
+	return t.compact()
+}
+
+func (t *ToDo) logFileName() string {
+	return t.dbFileName + ".log"
+}
+
+func (t *ToDo) historyDir() string {
+	return t.dbFileName + ".history"
+}
+
+// headerLine returns the first line of a log that starts at lsn with the
+// id sequence at seq
+func headerLine(lsn int64, seq int) []byte {
+	line, _ := json.Marshal(LogRecord{LSN: lsn, Op: LogOpSnapshot, Seq: seq, Time: time.Now()})
+	return append(line, '\n')
+}
+
+// advanceSeq moves the id sequence past the ids in a record.  Databases
+// written before the sequence existed start from their highest id.
+func (t *ToDo) advanceSeq(items []ToDoItem, rec LogRecord) {
+	if rec.Seq > t.seq {
+		t.seq = rec.Seq
+	}
+	if rec.Item != nil && rec.Item.Id > t.seq {
+		t.seq = rec.Item.Id
+	}
+	for _, item := range append(items, rec.Items...) {
+		if item.Id > t.seq {
+			t.seq = item.Id
+		}
+	}
+}
+
+// initLog creates an empty log that starts from the current snapshot, and
+// saves that snapshot as the first entry of the history.  It is used the
+// first time a database is opened.
+func (t *ToDo) initLog() error {
+	if _, err := os.Stat(t.logFileName()); err == nil {
+		return nil
+	}
+
+	items, err := t.loadDB()
+	if err != nil {
+		return err
+	}
+	if err := t.saveHistorySnapshot(0, items); err != nil {
+		return err
+	}
+	t.advanceSeq(items, LogRecord{})
+	return WriteFileAtomic(t.logFileName(), func(w io.Writer) error {
+		_, err := w.Write(headerLine(0, t.seq))
+		return err
+	})
+}
+
+// refresh brings the in memory copy of the database up to date.  If the
+// log was compacted by another process since we last looked, the new
+// snapshot is loaded.  Then any records we have not seen yet are applied.
+func (t *ToDo) refresh() error {
+	data, err := os.ReadFile(t.logFileName())
+	if err != nil {
+		return err
+	}
+
+	header, headerLen, err := parseHeader(data)
+	if err != nil {
+		return err
+	}
+
+	if !t.loaded || header.LSN != t.snapshotLSN || int64(len(data)) < t.logOffset {
+		//A missing snapshot, for example after someone deleted todo.json,
+		//is treated as an empty database
+		items, err := t.loadDB()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		t.items = items
+		t.lsn = header.LSN
+		t.snapshotLSN = header.LSN
+		t.logOffset = int64(headerLen)
+		t.loaded = true
+		t.advanceSeq(items, header)
+	}
+
+	records, goodLen := parseRecords(data[t.logOffset:])
+	for _, rec := range records {
+		if rec.LSN > t.lsn {
+			t.items = applyRecord(t.items, rec)
+			t.lsn = rec.LSN
+			t.advanceSeq(nil, rec)
+		}
+	}
+	t.logOffset += int64(goodLen)
+	return nil
+}
+
+// appendLog gives the record the next LSN, appends it to the log, flushes
+// it to disk and applies it to the in memory copy.  The log is compacted
+// once enough records have been written.
+func (t *ToDo) appendLog(rec LogRecord) error {
+	rec.LSN = t.lsn + 1
+	rec.Time = time.Now()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f, err := os.OpenFile(t.logFileName(), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	//Drop anything after the last good record, a crash in the middle of
+	//an append can leave a partial line at the end of the log
+	if err := f.Truncate(t.logOffset); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(line, t.logOffset); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	t.logOffset += int64(len(line))
+	t.items = applyRecord(t.items, rec)
+	t.lsn = rec.LSN
+	t.advanceSeq(nil, rec)
+
+	if t.lsn-t.snapshotLSN >= int64(t.compactEvery) {
+		return t.compact()
+	}
+	return nil
+}
+
+// compact archives the current log segment, writes a new snapshot and
+// starts a new log.  The steps are ordered so that a crash at any point
+// leaves a snapshot and a log that replay to the right state.
+func (t *ToDo) compact() error {
+	if t.lsn == t.snapshotLSN {
+		return nil
+	}
+
+	//1. Keep the log segment we are about to retire
+	segment, err := os.ReadFile(t.logFileName())
+	if err != nil {
+		return err
+	}
+	if int64(len(segment)) > t.logOffset {
+		segment = segment[:t.logOffset]
+	}
+	if err := os.MkdirAll(t.historyDir(), 0755); err != nil {
+		return err
+	}
+	segmentName := filepath.Join(t.historyDir(), fmt.Sprintf("log-%d-%d.ndjson", t.snapshotLSN, t.lsn))
+	if err := WriteFileAtomic(segmentName, func(w io.Writer) error {
+		_, err := w.Write(segment)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	//2. Write the new snapshot, both as todo.json and into the history
+	if err := t.saveDB(t.items); err != nil {
+		return err
+	}
+	if err := t.saveHistorySnapshot(t.lsn, t.items); err != nil {
+		return err
+	}
+
+	//3. Start a new log from the new snapshot
+	header := headerLine(t.lsn, t.seq)
+	if err := WriteFileAtomic(t.logFileName(), func(w io.Writer) error {
+		_, err := w.Write(header)
+		return err
+	}); err != nil {
+		return err
+	}
+	t.snapshotLSN = t.lsn
+	t.logOffset = int64(len(header))
+
+	//4. Drop the history that is older than the snapshots we keep
+	if t.historyKeep > 0 {
+		if _, err := t.pruneHistory(t.historyKeep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneHistory deletes all but the newest keep snapshots, and the log
+// segments that end at or before the oldest snapshot that is kept.  No
+// restore can use their records, there is no snapshot to replay them
+// onto.
+func (t *ToDo) pruneHistory(keep int) ([]string, error) {
+	snapshots, err := t.historySnapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) <= keep {
+		return []string{}, nil
+	}
+	oldest := snapshots[len(snapshots)-keep]
+
+	removed := []string{}
+	for _, lsn := range snapshots[:len(snapshots)-keep] {
+		name := filepath.Join(t.historyDir(), fmt.Sprintf("snapshot-%d.json", lsn))
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		removed = append(removed, filepath.Base(name))
+	}
+
+	segments, err := filepath.Glob(filepath.Join(t.historyDir(), "log-*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		var from, to int64
+		if _, err := fmt.Sscanf(filepath.Base(segment), "log-%d-%d.ndjson", &from, &to); err != nil {
+			continue
+		}
+		if to > oldest {
+			continue
+		}
+		if err := os.Remove(segment); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		removed = append(removed, filepath.Base(segment))
+	}
+	return removed, nil
+}
+
+// historySnapshots returns the LSNs of the snapshots in the history
+// directory, oldest first
+func (t *ToDo) historySnapshots() ([]int64, error) {
+	names, err := filepath.Glob(filepath.Join(t.historyDir(), "snapshot-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []int64{}
+	for _, name := range names {
+		var lsn int64
+		base := strings.TrimSuffix(filepath.Base(name), ".json")
+		if _, err := fmt.Sscanf(base, "snapshot-%d", &lsn); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, lsn)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i] < snapshots[j]
+	})
+	return snapshots, nil
+}
+
+func (t *ToDo) saveHistorySnapshot(lsn int64, items []ToDoItem) error {
+	if err := os.MkdirAll(t.historyDir(), 0755); err != nil {
+		return err
+	}
+	if items == nil {
+		items = []ToDoItem{}
+	}
+	data, err := json.MarshalIndent(items, "", "\t")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(t.historyDir(), fmt.Sprintf("snapshot-%d.json", lsn))
+	return WriteFileAtomic(name, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// readAllRecords collects the records from every archived log segment and
+// the current log, keyed by LSN.  Segments can overlap if a compaction was
+// interrupted, so the map takes care of duplicates.
+func (t *ToDo) readAllRecords() (map[int64]LogRecord, error) {
+	records := make(map[int64]LogRecord)
+
+	segments, err := filepath.Glob(filepath.Join(t.historyDir(), "log-*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, t.logFileName())
+
+	for _, segment := range segments {
+		data, err := os.ReadFile(segment)
+		if err != nil {
+			return nil, err
+		}
+		_, headerLen, err := parseHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		recs, _ := parseRecords(data[headerLen:])
+		for _, rec := range recs {
+			records[rec.LSN] = rec
+		}
+	}
+	return records, nil
+}
+
+// itemsAtLSN rebuilds the database as it was at the provided LSN by
+// replaying the history on top of the closest earlier snapshot
+func (t *ToDo) itemsAtLSN(lsn int64) ([]ToDoItem, error) {
+	snapshots, err := t.historySnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	base := int64(-1)
+	for _, snapLSN := range snapshots {
+		if snapLSN <= lsn && snapLSN > base {
+			base = snapLSN
+		}
+	}
+	if base < 0 {
+		return nil, ErrHistoryUnavailable
+	}
+
+	data, err := os.ReadFile(filepath.Join(t.historyDir(), fmt.Sprintf("snapshot-%d.json", base)))
+	if err != nil {
+		return nil, err
+	}
+	var items []ToDoItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+
+	records, err := t.readAllRecords()
+	if err != nil {
+		return nil, err
+	}
+	for next := base + 1; next <= lsn; next++ {
+		rec, ok := records[next]
+		if !ok {
+			return nil, ErrHistoryUnavailable
+		}
+		items = applyRecord(items, rec)
+	}
+	return items, nil
+}
+
+// parseHeader decodes the header record on the first line of a log and
+// returns it along with the length of the line
+func parseHeader(data []byte) (LogRecord, int, error) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return LogRecord{}, 0, errors.New("operation log is missing its header")
+	}
+	var header LogRecord
+	if err := json.Unmarshal(data[:end], &header); err != nil || header.Op != LogOpSnapshot {
+		return LogRecord{}, 0, errors.New("operation log has an invalid header")
+	}
+	return header, end + 1, nil
+}
+
+// parseRecords decodes complete log lines.  It stops at the first partial
+// or damaged line and returns how many bytes were good.
+func parseRecords(data []byte) ([]LogRecord, int) {
+	var records []LogRecord
+	good := 0
+	for {
+		end := bytes.IndexByte(data[good:], '\n')
+		if end < 0 {
+			return records, good
+		}
+		var rec LogRecord
+		if err := json.Unmarshal(data[good:good+end], &rec); err != nil {
+			return records, good
+		}
+		records = append(records, rec)
+		good += end + 1
+	}
+}
+
+// applyRecord applies a single log record to a slice of items.  The item
+// order is kept the same as the order the items were added in.
+func applyRecord(items []ToDoItem, rec LogRecord) []ToDoItem {
+	switch rec.Op {
+	case LogOpAdd, LogOpUpdate:
+		if rec.Item == nil {
+			return items
+		}
+		for i := range items {
+			if items[i].Id == rec.Item.Id {
+				items[i] = *rec.Item
+				return items
+			}
+		}
+		return append(items, *rec.Item)
+	case LogOpDelete:
+		for i := range items {
+			if items[i].Id == rec.Id {
+				return append(items[:i], items[i+1:]...)
+			}
+		}
+		return items
+	case LogOpDeleteAll:
+		return []ToDoItem{}
+	case LogOpReset:
+		return append([]ToDoItem{}, rec.Items...)
+	}
+	return items
+}
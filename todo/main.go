@@ -2,253 +2,202 @@ package main
 
 import (
 	"errors"
-	"flag"
 	"fmt"
+	"io/fs"
+	"net"
 	"os"
 
 	"drexel.edu/todo/db"
+	"drexel.edu/todo/output"
+	"github.com/spf13/cobra"
 )
 
-// Global variables to hold the command line flags to drive the todo CLI
-// application
-var (
-	dbFileNameFlag string
-	restoreDbFlag  bool
-	listFlag       bool
-	itemStatusFlag bool
-	queryFlag      int
-	addFlag        string
-	updateFlag     string
-	deleteFlag     int
-)
-
-type AppOptType int
-
-// To make the code a little more clean we will use the following
-// constants as basically enumerations for different options.  This
-// allows us to use a switch statement in main to process the command line
-// flags effectively
+// The todo CLI is built from subcommands, for example "todo add" or
+// "todo list".  Every subcommand has its own flags, validation and help
+// text, "todo help <command>" or "todo <command> -h" shows it.
+//
+// The CLI used to be driven by a single set of flags from the flag
+// package, which were mapped to an operation inside flag.Visit.  That
+// made the last flag visited win, and there was no way to say that a
+// flag like -s needs -q.  As the EXTRA CREDIT in the original scaffold
+// suggested the CLI now uses Cobra (github.com/spf13/cobra), which gives
+// us subcommands, per command flags and shell completion for free.
+
+// Exit codes of the todo CLI.  Scripts can use them to tell a missing
+// item apart from a broken database.
 const (
-	LIST_DB_ITEM AppOptType = iota
-	RESTORE_DB_ITEM
-	QUERY_DB_ITEM
-	ADD_DB_ITEM
-	UPDATE_DB_ITEM
-	DELETE_DB_ITEM
-	CHANGE_ITEM_STATUS
-	NOT_IMPLEMENTED
-	INVALID_APP_OPT
+	ExitOK       = 0
+	ExitError    = 1 //Any error that does not have its own code
+	ExitUsage    = 2 //Unknown command, bad flag or bad argument
+	ExitNotFound = 3 //The item or backup does not exist
+	ExitConflict = 4 //The item already exists
+	ExitIO       = 5 //The database could not be read or written
 )
 
-// processCmdLineFlags parses the command line flags for our CLI
-//
-// TODO: This function uses the flag package to parse the command line
-//		 flags.  The flag package is not very flexible and can lead to
-//		 some confusing code.
-
-//			 REQUIRED:     Study the code below, and make sure you understand
-//						   how it works.  Go online and readup on how the
-//						   flag package works.  Then, write a nice comment
-//				  		   block to document this function that highights that
-//						   you understand how it works.
-//
-//			 EXTRA CREDIT: The best CLI and command line processor for
-//						   go is called Cobra.  Refactor this function to
-//						   use it.  See github.com/spf13/cobra for information
-//						   on how to use it.
-//
-//	 YOUR ANSWER:
-// 								The function processCmdLineFlags's main responsibility
-// 								is to set this program's parameter or passed arguments
-// 								before running. It's the first thing to be called before
-//								anything else in the code as it is placed right at the
-//								very beginning of main(). If there are no flags set
-//								error it will print out what the error message is and exit.
-//
-//								The flag package allows the program ability to have parameters
-//								set at the command line. The flag package is used to set
-//								each parameter that was design in this program. Each
-//								parameter takes in a pointer value, a letter or name to
-//								represent it, a default value, and a description of its usage.
-//
-//								For example, the command `kubectl` by itself isn't useful
-//                				if called by itself. The behavior that it will return
-//								by not passing a parameter or arguement is a help message
-//                				that prints an explanation of how to properly use the
-//                				command with sub-commands their optional parameters.
-//								What triggers the explanation of usage is the flag.Usage()
-//                				function.
-//
-//                				However, if a parameter(s) was set to this program. The
-//    							processCmdLineFlags function will go through and set all
-//								of the global variables, run through a switch case finding
-//								which parameters were set and trigger the appropriate
-//								functions.
-
-func processCmdLineFlags() (AppOptType, error) {
-	flag.StringVar(&dbFileNameFlag, "db", "./data/todo.json", "Name of the database file")
-	flag.BoolVar(&restoreDbFlag, "restore", false, "Restore the database from the backup file")
-	flag.BoolVar(&listFlag, "l", false, "List all the items in the database")
-	flag.IntVar(&queryFlag, "q", 0, "Query an item in the database")
-	flag.StringVar(&addFlag, "a", "", "Add an item to the database")
-	flag.StringVar(&updateFlag, "u", "", "Update an item in the database")
-	flag.IntVar(&deleteFlag, "d", 0, "Delete an item from the database")
-	flag.BoolVar(&itemStatusFlag, "s", false, "Change item 'done' status to true or false")
-
-	flag.Parse()
-
-	var appOpt AppOptType = INVALID_APP_OPT
-
-	//show help if no flags are set
-	if len(os.Args) == 1 {
-		flag.Usage()
-		return appOpt, errors.New("no flags were set")
-	}
+// usageError marks an error caused by how the command was called, as
+// opposed to an error from the database
+type usageError struct {
+	err error
+}
 
-	// Loop over the flags and check which ones are set, set appOpt
-	// accordingly
-	flag.Visit(func(f *flag.Flag) {
-		switch f.Name {
-		case "l":
-			appOpt = LIST_DB_ITEM
-		case "restore":
-			appOpt = RESTORE_DB_ITEM
-		case "q":
-			appOpt = QUERY_DB_ITEM
-		case "a":
-			appOpt = ADD_DB_ITEM
-		case "u":
-			appOpt = UPDATE_DB_ITEM
-		case "d":
-			appOpt = DELETE_DB_ITEM
-
-		//TODO: EXTRA CREDIT - Implment the -s flag that changes the
-		//done status of an item in the database.  For example -s=true
-		//will set the done status for a particular item to true, and
-		//-s=false will set the done states for a particular item to
-		//false.
-		//
-		//HINT FOR EXTRA CREDIT
-		//Note the -s option also requires an id for the item to that
-		//you want to change.  I recommend you use the -q option to
-		//specify the item id.  Therefore, the -s option is only valid
-		//if the -q option is also set
-		case "s":
-			//For extra credit you will need to change some things here
-			//and also in main under the CHANGE_ITEM_STATUS case
-			appOpt = CHANGE_ITEM_STATUS
-		default:
-			appOpt = INVALID_APP_OPT
-		}
-	})
+func (e usageError) Error() string {
+	return e.err.Error()
+}
 
-	if appOpt == INVALID_APP_OPT || appOpt == NOT_IMPLEMENTED {
-		fmt.Println("Invalid option set or the desired option is not currently implemented")
-		flag.Usage()
-		return appOpt, errors.New("no flags or unimplemented were set")
-	}
+func (e usageError) Unwrap() error {
+	return e.err
+}
+
+// usageErrorf creates a usageError with a formatted message
+func usageErrorf(format string, args ...any) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
 
-	return appOpt, nil
+// cli holds the settings shared by every command and opens the storage
+// backend the first time a command needs it
+type cli struct {
+	cfg     db.Config
+	out     output.Options
+	store   db.Store
+	started bool
 }
 
-// main is the entry point for our todo CLI application.  It processes
-// the command line flags and then uses the db package to perform the
-// requested operation
+// main is the entry point for our todo CLI application.  It runs the
+// requested command and exits with one of the Exit* codes.
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-	//Process the command line flags
-	opts, err := processCmdLineFlags()
+// run executes the CLI with the provided arguments and returns the exit
+// code
+func run(args []string) int {
+	c := &cli{}
+	root := c.rootCmd()
+	root.SetArgs(args)
+	//Cobra prints to stderr unless an output is set, our results go to
+	//stdout and errors to stderr
+	root.SetOut(os.Stdout)
+
+	err := root.Execute()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "Error:", err)
 	}
+	return c.exitCode(err)
+}
 
-	//Create a new db object
-	todo, err := db.New(dbFileNameFlag)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// exitCode maps an error returned by a command to an exit code
+func (c *cli) exitCode(err error) int {
+	var usageErr usageError
+	var pathErr *fs.PathError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return ExitOK
+	//Cobra reports unknown commands, bad flags and bad arguments before
+	//our commands start running
+	case errors.As(err, &usageErr) || !c.started || errors.Is(err, db.ErrInvalidItem):
+		return ExitUsage
+	case errors.Is(err, db.ErrItemNotFound) || errors.Is(err, db.ErrBackupNotFound):
+		return ExitNotFound
+	case errors.Is(err, db.ErrItemExists) || errors.Is(err, db.ErrVersionConflict):
+		return ExitConflict
+	case errors.Is(err, db.ErrBackupCorrupt) || errors.As(err, &pathErr) || errors.As(err, &netErr):
+		return ExitIO
+	default:
+		return ExitError
 	}
+}
 
-	//Switch over the command line flags and call the appropriate
-	//function in the db package
-	switch opts {
-	case RESTORE_DB_ITEM:
-		fmt.Println("Running RESTORE_DB_ITEM...")
-		if err := todo.RestoreDB(); err != nil {
-			fmt.Println("Error: ", err)
-			break
-		}
-		fmt.Println("Database restored from backup file")
-	case LIST_DB_ITEM:
-		fmt.Println("Running QUERY_DB_ITEM...")
-		todoList, err := todo.GetAllItems()
-		if err != nil {
-			fmt.Println("Error: ", err)
-			break
-		}
-		for _, item := range todoList {
-			todo.PrintItem(item)
-		}
-		fmt.Println("THERE ARE", len(todoList), "ITEMS IN THE DB")
-		fmt.Println("Ok")
-
-	case QUERY_DB_ITEM:
-		fmt.Println("Running QUERY_DB_ITEM...")
-		item, err := todo.GetItem(queryFlag)
-		if err != nil {
-			fmt.Println("Error: ", err)
-			break
-		}
-		todo.PrintItem(item)
-		fmt.Println("Ok")
-	case ADD_DB_ITEM:
-		fmt.Println("Running ADD_DB_ITEM...")
-		item, err := todo.JsonToItem(addFlag)
-		if err != nil {
-			fmt.Println("Add option requires a valid JSON todo item string")
-			fmt.Println("Error: ", err)
-			break
-		}
-		if err := todo.AddItem(item); err != nil {
-			fmt.Println("Error: ", err)
-			break
-		}
-		fmt.Println("Ok")
-
-	case UPDATE_DB_ITEM:
-		fmt.Println("Running UPDATE_DB_ITEM...")
-		item, err := todo.JsonToItem(updateFlag)
-		if err != nil {
-			fmt.Println("Update option requires a valid JSON todo item string")
-			fmt.Println("Error: ", err)
-			break
-		}
-		if err := todo.UpdateItem(item); err != nil {
-			fmt.Println("Error: ", err)
-			break
-		}
-		fmt.Println("Ok")
-
-	case DELETE_DB_ITEM:
-		fmt.Println("Running DELETE_DB_ITEM...")
-		err := todo.DeleteItem(deleteFlag)
-		if err != nil {
-			fmt.Println("Error: ", err)
-			break
-		}
-		fmt.Println("Ok")
-
-	case CHANGE_ITEM_STATUS:
-		//For the CHANGE_ITEM_STATUS extra credit you will also
-		//need to add some code here
-		fmt.Println("Running CHANGE_ITEM_STATUS...")
-		err := todo.ChangeItemDoneStatus(queryFlag, itemStatusFlag)
-		if err != nil {
-			fmt.Println("Error: ", err)
-			break
+// rootCmd builds the "todo" command and all of its subcommands.  The
+// storage flags are persistent, so they can be used with every
+// subcommand.  Anything not set on the command line is taken from the
+// TODO_BACKEND, TODO_DB_FILE and REDIS_URL environment variables, or
+// the defaults.
+func (c *cli) rootCmd() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "todo",
+		Short: "Manage a list of todo items",
+		Long: `todo manages a list of todo items stored in a JSON file, in memory
+or in redis.
+
+Exit codes: 0 ok, 1 error, 2 usage error, 3 not found, 4 already exists,
+5 database could not be read or written.`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			c.started = true
+			if err := c.out.Validate(); err != nil {
+				return usageError{err}
+			}
+			return nil
+		},
+	}
+	root.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError{err}
+	})
+
+	flags := root.PersistentFlags()
+	flags.StringVar(&c.cfg.FileName, "db", "", "Name of the database file (default \"./data/todo.json\")")
+	flags.StringVar(&c.cfg.Backend, "backend", "", "Storage backend to use: file, memory or redis (default \"file\")")
+	flags.StringVar(&c.cfg.RedisLocation, "redis", "", "Location of the redis cache for the redis backend (default \"0.0.0.0:6379\")")
+
+	//Output flags.  Only the items go to stdout, status messages go to
+	//stderr so the output can be piped into other tools
+	flags.StringVarP((*string)(&c.out.Format), "output", "o", string(output.Table), "Output format: table, json, ndjson, yaml or csv")
+	flags.StringSliceVar(&c.out.Columns, "columns", nil, "Columns to show in table and csv output, for example id,title (default all)")
+	flags.StringVar(&c.out.Sort, "sort", "", "Column to sort items by, prefix with - for descending order, for example -id")
+	root.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		formats := make([]string, 0, len(output.Formats))
+		for _, f := range output.Formats {
+			formats = append(formats, string(f))
 		}
-	default:
-		fmt.Println("INVALID_APP_OPT")
+		return formats, cobra.ShellCompDirectiveNoFileComp
+	})
+	root.RegisterFlagCompletionFunc("columns", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return output.ColumnNames(), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	root.AddCommand(
+		c.addCmd(),
+		c.listCmd(),
+		c.getCmd(),
+		c.updateCmd(),
+		c.doneCmd(true),
+		c.doneCmd(false),
+		c.deleteCmd(),
+		c.restoreCmd(),
+		c.historyCmd(),
+		c.backupCmd(),
+		c.importCmd(),
+		c.exportCmd(),
+	)
+	return root
+}
+
+// openStore creates the storage backend from the flags and environment
+func (c *cli) openStore() (db.Store, error) {
+	if c.store != nil {
+		return c.store, nil
+	}
+	store, err := db.NewStore(db.ConfigFromEnv(c.cfg))
+	if err != nil {
+		return nil, err
+	}
+	c.store = store
+	return store, nil
+}
+
+// openFileStore opens the JSON file backend for the commands that only
+// it supports, restore, history and backup
+func (c *cli) openFileStore(command string) (*db.ToDo, error) {
+	cfg := db.ConfigFromEnv(c.cfg)
+	if cfg.Backend != db.FileBackend {
+		return nil, usageErrorf("%s is only supported by the file backend", command)
+	}
+	store, err := c.openStore()
+	if err != nil {
+		return nil, err
 	}
+	return store.(*db.ToDo), nil
 }
@@ -0,0 +1,359 @@
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"drexel.edu/todo/db"
+	"gopkg.in/yaml.v3"
+)
+
+// The output package renders todo items for the CLI.  People read the
+// aligned table, scripts use one of the machine readable formats.  Only
+// the items are written to the provided writer, status messages are the
+// job of the caller and belong on stderr so the output can be piped.
+
+// Format is the name of an output format
+type Format string
+
+const (
+	Table  Format = "table"
+	JSON   Format = "json"
+	NDJSON Format = "ndjson"
+	YAML   Format = "yaml"
+	CSV    Format = "csv"
+)
+
+// Formats lists every supported format, for help text and completion
+var Formats = []Format{Table, JSON, NDJSON, YAML, CSV}
+
+// column is a field of an item that can be shown in the table and CSV
+// formats.  less is used when sorting by the column.  Hidden columns are
+// only shown when they are asked for with Options.Columns.
+type column struct {
+	name   string
+	value  func(item db.ToDoItem) string
+	less   func(a, b db.ToDoItem) bool
+	hidden bool
+}
+
+// columns are all the columns in their default order
+var columns = []column{
+	{
+		name:  "id",
+		value: func(item db.ToDoItem) string { return strconv.Itoa(item.Id) },
+		less:  func(a, b db.ToDoItem) bool { return a.Id < b.Id },
+	},
+	{
+		name:  "title",
+		value: func(item db.ToDoItem) string { return item.Title },
+		less:  func(a, b db.ToDoItem) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) },
+	},
+	{
+		name:  "done",
+		value: func(item db.ToDoItem) string { return strconv.FormatBool(item.IsDone) },
+		less:  func(a, b db.ToDoItem) bool { return !a.IsDone && b.IsDone },
+	},
+	{
+		name:  "priority",
+		value: func(item db.ToDoItem) string { return string(item.Priority) },
+		less:  func(a, b db.ToDoItem) bool { return a.Priority.Rank() < b.Priority.Rank() },
+	},
+	{
+		name:  "due",
+		value: func(item db.ToDoItem) string { return formatTime(item.DueDate) },
+		less:  func(a, b db.ToDoItem) bool { return timeLess(a.DueDate, b.DueDate) },
+	},
+	{
+		name:  "tags",
+		value: func(item db.ToDoItem) string { return strings.Join(item.Tags, ",") },
+		less:  func(a, b db.ToDoItem) bool { return strings.Join(a.Tags, ",") < strings.Join(b.Tags, ",") },
+	},
+	{
+		name:   "notes",
+		value:  func(item db.ToDoItem) string { return item.Notes },
+		less:   func(a, b db.ToDoItem) bool { return a.Notes < b.Notes },
+		hidden: true,
+	},
+	{
+		name:   "created",
+		value:  func(item db.ToDoItem) string { return formatTime(item.CreatedAt) },
+		less:   func(a, b db.ToDoItem) bool { return timeLess(a.CreatedAt, b.CreatedAt) },
+		hidden: true,
+	},
+	{
+		name:   "updated",
+		value:  func(item db.ToDoItem) string { return formatTime(item.UpdatedAt) },
+		less:   func(a, b db.ToDoItem) bool { return timeLess(a.UpdatedAt, b.UpdatedAt) },
+		hidden: true,
+	},
+	{
+		name:   "completed",
+		value:  func(item db.ToDoItem) string { return formatTime(item.CompletedAt) },
+		less:   func(a, b db.ToDoItem) bool { return timeLess(a.CompletedAt, b.CompletedAt) },
+		hidden: true,
+	},
+	{
+		name:   "version",
+		value:  func(item db.ToDoItem) string { return strconv.Itoa(item.Version) },
+		less:   func(a, b db.ToDoItem) bool { return a.Version < b.Version },
+		hidden: true,
+	},
+}
+
+// formatTime shows a time in the table, dates at midnight UTC (how due
+// dates without a time are stored) are shown without the time
+func formatTime(t *time.Time) string {
+	switch {
+	case t == nil:
+		return ""
+	case t.Equal(t.Truncate(24 * time.Hour)):
+		return t.Format("2006-01-02")
+	default:
+		return t.Format(time.RFC3339)
+	}
+}
+
+// timeLess orders optional times, items without a time sort last
+func timeLess(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a != nil
+	}
+	return a.Before(*b)
+}
+
+// ColumnNames returns the names of all the columns in their default
+// order
+func ColumnNames() []string {
+	names := make([]string, 0, len(columns))
+	for _, col := range columns {
+		names = append(names, col.name)
+	}
+	return names
+}
+
+// defaultColumnNames returns the columns shown when none are asked for
+func defaultColumnNames() []string {
+	var names []string
+	for _, col := range columns {
+		if !col.hidden {
+			names = append(names, col.name)
+		}
+	}
+	return names
+}
+
+func findColumn(name string) (column, error) {
+	for _, col := range columns {
+		if col.name == strings.ToLower(strings.TrimSpace(name)) {
+			return col, nil
+		}
+	}
+	return column{}, fmt.Errorf("unknown column %q, the columns are %s", name, strings.Join(ColumnNames(), ", "))
+}
+
+// Options controls how items are rendered
+//
+//	Format  one of the Formats, the default is Table
+//	Columns the columns shown by Table and CSV, the default is all but
+//	        notes and the timestamps
+//	Sort    the column to sort by, prefix it with - to sort in
+//	        descending order.  The default keeps the order of the items.
+type Options struct {
+	Format  Format
+	Columns []string
+	Sort    string
+}
+
+// Validate checks the options before any output is written
+func (o Options) Validate() error {
+	_, err := o.resolve()
+	return err
+}
+
+// resolved holds the options after the names have been looked up
+type resolved struct {
+	format  Format
+	columns []column
+	sortBy  *column
+	desc    bool
+}
+
+func (o Options) resolve() (resolved, error) {
+	r := resolved{format: o.Format}
+	if r.format == "" {
+		r.format = Table
+	}
+	known := false
+	for _, f := range Formats {
+		known = known || f == r.format
+	}
+	if !known {
+		return resolved{}, fmt.Errorf("unknown output format %q, the formats are %s", o.Format, joinFormats())
+	}
+
+	names := o.Columns
+	if len(names) == 0 {
+		names = defaultColumnNames()
+	}
+	for _, name := range names {
+		col, err := findColumn(name)
+		if err != nil {
+			return resolved{}, err
+		}
+		r.columns = append(r.columns, col)
+	}
+
+	if o.Sort != "" {
+		name, desc := strings.CutPrefix(o.Sort, "-")
+		col, err := findColumn(name)
+		if err != nil {
+			return resolved{}, err
+		}
+		r.sortBy, r.desc = &col, desc
+	}
+	return r, nil
+}
+
+func joinFormats() string {
+	names := make([]string, 0, len(Formats))
+	for _, f := range Formats {
+		names = append(names, string(f))
+	}
+	return strings.Join(names, ", ")
+}
+
+// WriteItems renders a list of items.  The items are not changed, they
+// are copied before sorting.
+func WriteItems(w io.Writer, items []db.ToDoItem, opts Options) error {
+	r, err := opts.resolve()
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]db.ToDoItem, len(items))
+	copy(sorted, items)
+	if r.sortBy != nil {
+		less := r.sortBy.less
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if r.desc {
+				return less(sorted[j], sorted[i])
+			}
+			return less(sorted[i], sorted[j])
+		})
+	}
+
+	switch r.format {
+	case JSON:
+		return json.NewEncoder(w).Encode(sorted)
+	case NDJSON:
+		enc := json.NewEncoder(w)
+		for _, item := range sorted {
+			if err := enc.Encode(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case YAML:
+		return writeYAML(w, sorted)
+	case CSV:
+		return writeCSV(w, sorted, r.columns)
+	default:
+		return writeTable(w, sorted, r.columns)
+	}
+}
+
+// WriteItem renders a single item.  JSON and YAML write the item on its
+// own rather than a list with one item in it.
+func WriteItem(w io.Writer, item db.ToDoItem, opts Options) error {
+	r, err := opts.resolve()
+	if err != nil {
+		return err
+	}
+	switch r.format {
+	case JSON:
+		return json.NewEncoder(w).Encode(item)
+	case YAML:
+		return writeYAML(w, item)
+	default:
+		return WriteItems(w, []db.ToDoItem{item}, opts)
+	}
+}
+
+// writeYAML uses the json names of the fields, so the YAML output has the
+// same keys as the JSON output
+func writeYAML(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic any
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(generic); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func writeCSV(w io.Writer, items []db.ToDoItem, cols []column) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, 0, len(cols))
+	for _, col := range cols {
+		header = append(header, col.name)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := cw.Write(row(item, cols)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeTable(w io.Writer, items []db.ToDoItem, cols []column) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := make([]string, 0, len(cols))
+	for _, col := range cols {
+		header = append(header, strings.ToUpper(col.name))
+	}
+	if _, err := fmt.Fprintln(tw, strings.Join(header, "\t")); err != nil {
+		return err
+	}
+	for _, item := range items {
+		//A tab or newline in a title would break the alignment.  Empty
+		//cells, like an item with no due date, are shown as a dash
+		cells := row(item, cols)
+		for i, cell := range cells {
+			cells[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(cell)
+			if cells[i] == "" {
+				cells[i] = "-"
+			}
+		}
+		if _, err := fmt.Fprintln(tw, strings.Join(cells, "\t")); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+func row(item db.ToDoItem, cols []column) []string {
+	cells := make([]string, 0, len(cols))
+	for _, col := range cols {
+		cells = append(cells, col.value(item))
+	}
+	return cells
+}
@@ -0,0 +1,349 @@
+// Package schedule runs the recurring items and the reminders of a todo
+// database in the background.  A Scheduler looks over the items every
+// interval:
+//
+//   - an item with a recurrence that is done, or whose due date has
+//     passed, gets the next item of its series added, once
+//   - an item that is not done and whose due date has passed gets one
+//     reminder for that due date
+//
+// What has been done is saved in a db.StateStore, so a restart does not
+// add a second next item or send a reminder again.  The time comes from
+// a Clock that tests can replace.
+//
+// Only one scheduler should run on a database, two API processes sharing
+// a redis would both add the next items.
+package schedule
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"drexel.edu/todo/db"
+)
+
+// Clock tells the scheduler the time
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real time
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// ManualClock is a Clock that only moves when it is told to, for tests
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a clock stopped at now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now.UTC()}
+}
+
+// Now returns the time the clock is at
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now.UTC()
+}
+
+// Advance moves the clock on by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Reminder is sent once for an item that is overdue
+type Reminder struct {
+	Item      db.ToDoItem   `json:"item"`
+	DueDate   time.Time     `json:"dueDate"`
+	OverdueBy time.Duration `json:"overdueBy"`
+}
+
+// Default options
+const (
+	DefaultInterval  = time.Minute
+	DefaultStateName = "schedule"
+)
+
+// Options configures a Scheduler, the zero values are replaced by the
+// defaults.  OnReminder is called for each reminder and OnRecur for each
+// next item added, with the item it follows.  A reminder whose OnReminder
+// returns an error is tried again on the next run.
+type Options struct {
+	Interval   time.Duration
+	Clock      Clock
+	StateName  string
+	OnReminder func(reminder Reminder) error
+	OnRecur    func(previous, next db.ToDoItem)
+}
+
+// State is what the scheduler has done, saved after every run.  Recurred
+// maps an item to the item added after it, 0 when its series has ended.
+// Reminded maps an item to the due date it was reminded of, so moving the
+// due date gets a new reminder.  Items that are deleted are dropped.
+type State struct {
+	LastRun  time.Time         `json:"lastRun"`
+	Recurred map[int]int       `json:"recurred"`
+	Reminded map[int]time.Time `json:"reminded"`
+}
+
+// Result says what one run did
+type Result struct {
+	Recurred  []db.ToDoItem `json:"recurred"`
+	Reminders []Reminder    `json:"reminders"`
+}
+
+// Scheduler adds the next items of recurring items and sends reminders
+type Scheduler struct {
+	store   db.Store
+	states  db.StateStore
+	options Options
+
+	//mu serializes the runs and guards state
+	mu    sync.Mutex
+	state State
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// New returns a scheduler for the items in store, keeping its state in
+// states.  The saved state is loaded now, the scheduler does not run
+// until Start or RunOnce is called.
+func New(store db.Store, states db.StateStore, options Options) (*Scheduler, error) {
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.Clock == nil {
+		options.Clock = SystemClock
+	}
+	if options.StateName == "" {
+		options.StateName = DefaultStateName
+	}
+
+	s := &Scheduler{
+		store:   store,
+		states:  states,
+		options: options,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if _, err := states.Load(options.StateName, &s.state); err != nil {
+		return nil, err
+	}
+	if s.state.Recurred == nil {
+		s.state.Recurred = make(map[int]int)
+	}
+	if s.state.Reminded == nil {
+		s.state.Reminded = make(map[int]time.Time)
+	}
+	return s, nil
+}
+
+// Start runs the scheduler every interval until Stop is called.  The
+// first run is right away, to catch up on anything that came due while
+// the process was not running.
+func (s *Scheduler) Start() {
+	s.startOnce.Do(func() {
+		go s.loop()
+	})
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.options.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.RunOnce(); err != nil {
+			log.Println("Error running the scheduler: ", err)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops the scheduler and waits for a run in progress to finish.
+// A scheduler that is stopped cannot be started again.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	//If Start was never called there is no loop to wait for
+	s.startOnce.Do(func() {
+		close(s.done)
+	})
+	<-s.done
+}
+
+// State returns a copy of what the scheduler has done
+func (s *Scheduler) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := State{LastRun: s.state.LastRun, Recurred: make(map[int]int), Reminded: make(map[int]time.Time)}
+	for k, v := range s.state.Recurred {
+		state.Recurred[k] = v
+	}
+	for k, v := range s.state.Reminded {
+		state.Reminded[k] = v
+	}
+	return state
+}
+
+// RunOnce looks over the items once.  It is what Start calls every
+// interval, and tests call it directly after moving the clock.
+func (s *Scheduler) RunOnce() (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.options.Clock.Now()
+	items, err := s.store.GetAllItems()
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Recurred: []db.ToDoItem{}, Reminders: []Reminder{}}
+	exists := make(map[int]bool, len(items))
+	var runErr error
+	for _, item := range items {
+		exists[item.Id] = true
+
+		if item.IsOverdue(now) && !s.state.Reminded[item.Id].Equal(*item.DueDate) {
+			reminder := Reminder{Item: item, DueDate: *item.DueDate, OverdueBy: now.Sub(*item.DueDate)}
+			if err := s.remind(reminder); err != nil {
+				runErr = errors.Join(runErr, err)
+			} else {
+				s.state.Reminded[item.Id] = *item.DueDate
+				result.Reminders = append(result.Reminders, reminder)
+			}
+		}
+
+		if !comesBack(item, now) {
+			continue
+		}
+		if _, handled := s.state.Recurred[item.Id]; handled {
+			continue
+		}
+		next, ok, err := NextItem(item, now)
+		if err != nil {
+			//The recurrence was checked when the item was stored, an item
+			//stored before that is skipped for good
+			log.Printf("Error in the recurrence of item %d: %v", item.Id, err)
+			s.state.Recurred[item.Id] = 0
+			continue
+		}
+		if !ok {
+			s.state.Recurred[item.Id] = 0
+			continue
+		}
+		created, err := s.store.CreateItem(next)
+		if err != nil {
+			runErr = errors.Join(runErr, err)
+			continue
+		}
+		s.state.Recurred[item.Id] = created.Id
+		result.Recurred = append(result.Recurred, created)
+		if s.options.OnRecur != nil {
+			s.options.OnRecur(item, created)
+		}
+	}
+
+	//Forget the items that have been deleted
+	for id := range s.state.Recurred {
+		if !exists[id] {
+			delete(s.state.Recurred, id)
+		}
+	}
+	for id := range s.state.Reminded {
+		if !exists[id] {
+			delete(s.state.Reminded, id)
+		}
+	}
+	s.state.LastRun = now
+	if err := s.states.Save(s.options.StateName, s.state); err != nil {
+		runErr = errors.Join(runErr, err)
+	}
+	return result, runErr
+}
+
+func (s *Scheduler) remind(reminder Reminder) error {
+	if s.options.OnReminder == nil {
+		return nil
+	}
+	return s.options.OnReminder(reminder)
+}
+
+// comesBack reports whether the next item of a recurring item is due to
+// be added, because the item is done or its due date has passed
+func comesBack(item db.ToDoItem, now time.Time) bool {
+	if item.Recurrence == "" {
+		return false
+	}
+	return item.IsDone || (item.DueDate != nil && !item.DueDate.After(now))
+}
+
+// NextItem returns the item that follows item in its series, false when
+// the series has ended.  It has the same title, priority, tags and notes,
+// it is not done, and it is due at the first occurrence after the due
+// date of item that is still in the future, the occurrences that were
+// missed are skipped.  An item without a due date counts from now.  The
+// id is left for the store to pick.
+func NextItem(item db.ToDoItem, now time.Time) (db.ToDoItem, bool, error) {
+	rule, err := db.ParseRecurrence(item.Recurrence)
+	if err != nil {
+		return db.ToDoItem{}, false, err
+	}
+	from := now
+	if item.DueDate != nil {
+		from = *item.DueDate
+	}
+
+	recurrence := item.Recurrence
+	for {
+		due, ok := rule.Next(from)
+		if !ok {
+			return db.ToDoItem{}, false, nil
+		}
+		if recurrence, ok = rule.Following(); !ok {
+			return db.ToDoItem{}, false, nil
+		}
+		if due.After(now) {
+			next := db.ToDoItem{
+				Title:      item.Title,
+				DueDate:    &due,
+				Priority:   item.Priority,
+				Tags:       append([]string(nil), item.Tags...),
+				Notes:      item.Notes,
+				Recurrence: recurrence,
+			}
+			return next, true, nil
+		}
+		//The missed occurrence uses up a COUNT too
+		if rule, err = db.ParseRecurrence(recurrence); err != nil {
+			return db.ToDoItem{}, false, err
+		}
+		from = due
+	}
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"path/filepath"
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the audit history behind GET /todo/:id/history,
+// POST /todo/:id/revert and the history replay
+
+func TestAuditedStoreRecordsChanges(t *testing.T) {
+	store := db.NewAuditedStore(db.NewMemoryStore(), db.NewMemoryAuditLog())
+	alice := store.As("alice")
+	require.NoError(t, alice.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	created, err := store.As("bob").CreateItem(db.ToDoItem{Title: "Learn Redis"})
+	require.NoError(t, err)
+	require.NoError(t, alice.UpdateItem(db.ToDoItem{Id: 1, Title: "Learn Go / GoLang"}))
+	require.NoError(t, alice.ChangeItemDoneStatus(1, true))
+	require.NoError(t, alice.DeleteItem(1))
+	assert.ErrorIs(t, alice.UpdateItem(db.ToDoItem{Id: 1}), db.ErrItemNotFound)
+
+	history, err := store.History(1)
+	require.NoError(t, err)
+	require.Len(t, history, 4, "A failed change should not be recorded")
+	assert.Equal(t, []db.AuditOp{db.AuditOpAdd, db.AuditOpUpdate, db.AuditOpUpdate, db.AuditOpDelete},
+		[]db.AuditOp{history[0].Op, history[1].Op, history[2].Op, history[3].Op})
+	assert.Nil(t, history[0].Before)
+	assert.Equal(t, "Learn Go", history[1].Before.Title)
+	assert.Equal(t, "Learn Go / GoLang", history[1].After.Title)
+	assert.Equal(t, 2, history[1].Version)
+	assert.True(t, history[2].After.IsDone)
+	assert.Nil(t, history[3].After)
+	assert.Equal(t, 3, history[3].Version, "A delete records the version that was deleted")
+	assert.Equal(t, "alice", history[0].Actor)
+
+	other, err := store.History(created.Id)
+	require.NoError(t, err)
+	require.Len(t, other, 1)
+	assert.Equal(t, "bob", other[0].Actor)
+
+	//DeleteAll records a delete for each item
+	require.NoError(t, store.DeleteAll())
+	other, _ = store.History(created.Id)
+	assert.Equal(t, db.AuditOpDelete, other[len(other)-1].Op)
+}
+
+func TestAuditRevert(t *testing.T) {
+	store := db.NewAuditedStore(db.NewMemoryStore(), db.NewMemoryAuditLog())
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "First", Tags: []string{"a"}}))
+	require.NoError(t, store.UpdateItem(db.ToDoItem{Id: 1, Title: "Second"}))
+	require.NoError(t, store.UpdateItem(db.ToDoItem{Id: 1, Title: "Third", IsDone: true}))
+
+	reverted, err := store.Revert(1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "First", reverted.Title)
+	assert.Equal(t, []string{"a"}, reverted.Tags)
+	assert.False(t, reverted.IsDone)
+	assert.Equal(t, 4, reverted.Version, "A revert is a new version")
+
+	history, _ := store.History(1)
+	assert.Equal(t, db.AuditOpRevert, history[len(history)-1].Op)
+	assert.Equal(t, "Third", history[len(history)-1].Before.Title)
+
+	//A deleted item is added back
+	require.NoError(t, store.DeleteItem(1))
+	reverted, err = store.Revert(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "Second", reverted.Title)
+
+	_, err = store.Revert(1, 99)
+	assert.ErrorIs(t, err, db.ErrVersionNotFound)
+	_, err = store.Revert(42, 1)
+	assert.ErrorIs(t, err, db.ErrVersionNotFound)
+}
+
+func TestAuditReplayAndRebuild(t *testing.T) {
+	auditLog, err := db.NewFileAuditLog(filepath.Join(t.TempDir(), "todo.json.audit"))
+	require.NoError(t, err)
+	store := db.NewAuditedStore(db.NewMemoryStore(), auditLog)
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 2, Title: "Learn Kubernetes"}))
+	require.NoError(t, store.UpdateItem(db.ToDoItem{Id: 2, Title: "Learn Kubernetes", IsDone: true}))
+	require.NoError(t, store.DeleteItem(1))
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 3, Title: "Learn Helm"}))
+
+	//Replaying everything gives the items that are stored
+	records, err := auditLog.Records(0)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	stored, _ := store.GetAllItems()
+	assert.Equal(t, stored, db.ReplayAudit(records, 0))
+
+	//Replaying part of the log gives the items as they were then
+	atTwo := db.ReplayAudit(records, 2)
+	assert.Equal(t, []int{1, 2}, ids(atTwo))
+	assert.False(t, atTwo[1].IsDone)
+
+	//The log is kept in the file, a new log on it picks up the sequence
+	reopened, err := db.NewFileAuditLog(auditLog.FileName())
+	require.NoError(t, err)
+	rec, err := reopened.Append(db.AuditRecord{Op: db.AuditOpDelete, ItemId: 9})
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), rec.Seq)
+	later, err := auditLog.Records(5)
+	require.NoError(t, err)
+	assert.Len(t, later, 1, "Records appended by another log should be seen")
+
+	//Rebuilding writes only the differences, and through the audited
+	//store the rebuild is recorded too
+	dry, err := db.RebuildFromAudit(store, records, 2, true)
+	require.NoError(t, err)
+	assert.Equal(t, db.BulkSummary{DryRun: true, Total: 3, Created: 1, Updated: 1, Deleted: 1, Results: []db.BulkResult{
+		{Id: 1, Status: db.BulkCreated},
+		{Id: 2, Status: db.BulkUpdated},
+		{Id: 3, Status: db.BulkDeleted},
+	}}, dry)
+	summary, err := db.RebuildFromAudit(store, records, 2, false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, summary.Failed)
+	rebuilt, _ := store.GetAllItems()
+	assert.Equal(t, []int{1, 2}, ids(rebuilt))
+	assert.False(t, rebuilt[1].IsDone)
+	all, _ := auditLog.Records(0)
+	assert.Len(t, all, 9)
+}
@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the versioned backups of the JSON file backend
+
+func TestBackupCreateAndRestore(t *testing.T) {
+	store, _ := newTempFileStore(t)
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+
+	backup, err := store.CreateBackup()
+	require.NoError(t, err, "Error creating backup")
+	assert.Equal(t, 1, backup.Items)
+	assert.Len(t, backup.Checksum, 64, "Backup should have a sha256 checksum")
+
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 2, Title: "Learn Kubernetes"}))
+	assert.NoError(t, store.RestoreBackup(backup.Id), "Error restoring backup")
+
+	items, err := store.GetAllItems()
+	assert.NoError(t, err)
+	assert.Equal(t, []db.ToDoItem{{Id: 1, Title: "Learn Go"}}, withoutManaged(items...), "Database was not restored")
+
+	_, err = store.VerifyBackup("20000101T000000.000000000Z")
+	assert.ErrorIs(t, err, db.ErrBackupNotFound, "Missing backup should not be found")
+}
+
+func TestCorruptBackupIsNotRestored(t *testing.T) {
+	store, dbFile := newTempFileStore(t)
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	backup, err := store.CreateBackup()
+	require.NoError(t, err)
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 2, Title: "Learn Kubernetes"}))
+
+	//Flip the title without changing the size of the backup
+	backupFile := filepath.Join(dbFile+".backups", backup.Id+".json")
+	data, err := os.ReadFile(backupFile)
+	require.NoError(t, err)
+	data = bytes.Replace(data, []byte("Learn Go"), []byte("Learn Gx"), 1)
+	require.NoError(t, os.WriteFile(backupFile, data, 0644))
+
+	assert.ErrorIs(t, store.RestoreBackup(backup.Id), db.ErrBackupCorrupt, "Corrupt backup should fail verification")
+	items, err := store.GetAllItems()
+	assert.NoError(t, err)
+	assert.Len(t, items, 2, "Database should not change when a restore fails")
+}
+
+func TestPruneBackups(t *testing.T) {
+	store, _ := newTempFileStore(t)
+	var created []db.Backup
+	for i := 1; i <= 4; i++ {
+		assert.NoError(t, store.AddItem(db.ToDoItem{Id: i, Title: "item"}))
+		backup, err := store.CreateBackup()
+		require.NoError(t, err)
+		created = append(created, backup)
+	}
+
+	pruned, damaged, err := store.PruneBackups(2)
+	assert.NoError(t, err, "Error pruning backups")
+	assert.Equal(t, created[:2], pruned, "The oldest backups should be pruned")
+	assert.Empty(t, damaged)
+
+	backups, _, err := store.ListBackups()
+	assert.NoError(t, err)
+	assert.Equal(t, created[2:], backups, "The newest backups should be kept")
+}
+
+func TestDamagedManifestsAreSkipped(t *testing.T) {
+	store, dbFile := newTempFileStore(t)
+	var created []db.Backup
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, store.AddItem(db.ToDoItem{Id: i, Title: "item"}))
+		backup, err := store.CreateBackup()
+		require.NoError(t, err)
+		created = append(created, backup)
+	}
+
+	//A short checksum used to crash the list command, and a manifest
+	//that is not json used to fail the whole listing
+	dir := dbFile + ".backups"
+	short := created[0]
+	short.Checksum = "abc"
+	data, err := json.Marshal(short)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, short.Id+".manifest.json"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, created[1].Id+".manifest.json"), []byte(`{"id": `), 0644))
+
+	backups, damaged, err := store.ListBackups()
+	require.NoError(t, err)
+	assert.Equal(t, created[2:], backups, "The intact backup should still be listed")
+	require.Len(t, damaged, 2)
+	for _, backup := range damaged {
+		assert.ErrorIs(t, backup.Err, db.ErrBackupCorrupt)
+	}
+	_, err = store.VerifyBackup(short.Id)
+	assert.ErrorIs(t, err, db.ErrBackupCorrupt)
+
+	pruned, damaged, err := store.PruneBackups(0)
+	require.NoError(t, err, "A damaged manifest should not stop prune")
+	assert.Equal(t, created[2:], pruned)
+	assert.Len(t, damaged, 2, "Damaged backups are left for the user to look at")
+	assert.FileExists(t, filepath.Join(dir, short.Id+".manifest.json"))
+}
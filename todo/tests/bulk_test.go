@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the bulk operations behind POST /todo:bulk,
+// PATCH /todo and DELETE /todo with a filter
+
+func TestBulkCreate(t *testing.T) {
+	store := newMemoryStore(t, db.ToDoItem{Id: 1, Title: "Existing"})
+	items := []db.ToDoItem{
+		{Title: "No id"},
+		{Id: 5, Title: "With id"},
+		{Id: 1, Title: "Taken"},
+		{Id: 5, Title: "Twice"},
+		{Title: "Bad priority", Priority: "urgent"},
+	}
+
+	dry, err := db.BulkCreate(store, items, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, dry.Created)
+	assert.Equal(t, 3, dry.Failed)
+	all, _ := store.GetAllItems()
+	assert.Len(t, all, 1, "A dry run should not write anything")
+
+	summary, err := db.BulkCreate(store, items, false)
+	require.NoError(t, err)
+	assert.Equal(t, dry.Created, summary.Created, "The dry run should predict the real one")
+	assert.Equal(t, dry.Failed, summary.Failed)
+	assert.Equal(t, db.BulkResult{Id: 2, Status: db.BulkCreated}, summary.Results[0], "The new item should get the next id")
+	assert.Equal(t, db.BulkFailed, summary.Results[2].Status)
+	assert.NotEmpty(t, summary.Results[2].Error)
+	all, _ = store.GetAllItems()
+	assert.Equal(t, []int{1, 2, 5}, ids(all))
+}
+
+func TestPatchAndDeleteItems(t *testing.T) {
+	store := newMemoryStore(t, queryItems...)
+	done := true
+	learn := db.Query{TitlePrefix: "learn"}
+
+	dry, err := db.PatchItems(store, learn, db.ItemPatch{IsDone: &done}, true)
+	require.NoError(t, err)
+	assert.Equal(t, db.BulkSummary{DryRun: true, Total: 2, Updated: 1, Unchanged: 1, Results: []db.BulkResult{
+		{Id: 1, Status: db.BulkUpdated},
+		{Id: 2, Status: db.BulkUnchanged},
+	}}, dry)
+	item, _ := store.GetItem(1)
+	assert.False(t, item.IsDone, "A dry run should not write anything")
+
+	summary, err := db.PatchItems(store, learn, db.ItemPatch{IsDone: &done}, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Updated)
+	item, _ = store.GetItem(1)
+	assert.True(t, item.IsDone)
+	assert.NotNil(t, item.CompletedAt, "Marking an item done through a patch should set the completed time")
+
+	_, err = db.PatchItems(store, learn, db.ItemPatch{}, false)
+	assert.ErrorIs(t, err, db.ErrInvalidItem, "An empty patch should be rejected")
+
+	summary, err = db.DeleteItems(store, db.Query{Done: &done}, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, summary.Deleted)
+	all, _ := store.GetAllItems()
+	assert.Equal(t, []int{3, 4}, ids(all))
+
+	_, err = db.DeleteItems(store, db.Query{Limit: 1}, false)
+	assert.ErrorIs(t, err, db.ErrInvalidQuery, "Paging does not make sense for a bulk delete")
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the crash safety of the JSON file backend.  They use a
+// temp directory so they do not touch the sample database in ../data
+
+func TestRecoverTruncatedDBFromBackup(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "todo.json")
+	backup := `[{"id": 1, "title": "Learn Go / GoLang"}]`
+	require.NoError(t, os.WriteFile(dbFile+".bak", []byte(backup), 0644))
+	require.NoError(t, os.WriteFile(dbFile, []byte(`[{"id": 1, "tit`), 0644))
+
+	store, err := db.New(dbFile)
+	assert.NoError(t, err, "New should recover a truncated database")
+
+	items, err := store.GetAllItems()
+	assert.NoError(t, err, "Error reading recovered database")
+	assert.Equal(t, []db.ToDoItem{{Id: 1, Title: "Learn Go / GoLang"}}, items, "Database was not recovered from backup")
+	assert.FileExists(t, dbFile+".corrupt", "Damaged database should be kept for inspection")
+}
+
+func TestRecoverTruncatedDBWithoutBackup(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "todo.json")
+	require.NoError(t, os.WriteFile(dbFile, []byte{}, 0644))
+
+	store, err := db.New(dbFile)
+	assert.NoError(t, err, "New should recover an empty database file")
+
+	items, err := store.GetAllItems()
+	assert.NoError(t, err, "Error reading recovered database")
+	assert.Empty(t, items, "Database without a backup should be reset to empty")
+}
+
+func TestConcurrentWritersDoNotLoseItems(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "todo.json")
+
+	//Two handles on the same file behave like two todo processes
+	first, err := db.New(dbFile)
+	require.NoError(t, err)
+	second, err := db.New(dbFile)
+	require.NoError(t, err)
+
+	const numItems = 40
+	var wg sync.WaitGroup
+	for i := 1; i <= numItems; i++ {
+		store := first
+		if i%2 == 0 {
+			store = second
+		}
+		wg.Add(1)
+		go func(store *db.ToDo, id int) {
+			defer wg.Done()
+			assert.NoError(t, store.AddItem(db.ToDoItem{Id: id, Title: "item"}))
+		}(store, i)
+	}
+	wg.Wait()
+
+	items, err := first.GetAllItems()
+	assert.NoError(t, err, "Error reading database")
+	assert.Len(t, items, numItems, "Concurrent adds should not overwrite each other")
+
+	//No temp files should be left behind by the atomic writes
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.Contains(entry.Name(), ".tmp-"), "Found leftover temp file %s", entry.Name())
+	}
+}
+
+func TestWriteFileAtomicKeepsOldFileOnError(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "export.json")
+	require.NoError(t, os.WriteFile(target, []byte("old"), 0644))
+
+	err := db.WriteFileAtomic(target, func(w io.Writer) error {
+		w.Write([]byte("half"))
+		return errors.New("export failed")
+	})
+	assert.Error(t, err)
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data), "A failed write should leave the file alone")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "The temp file should be removed")
+
+	require.NoError(t, db.WriteFileAtomic(target, func(w io.Writer) error {
+		_, err := w.Write([]byte("new"))
+		return err
+	}))
+	data, err = os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+}
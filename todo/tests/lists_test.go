@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the users and named lists behind /lists/:listId/todo
+
+func TestRoles(t *testing.T) {
+	assert.True(t, db.RoleOwner.Allows(db.RoleWrite))
+	assert.True(t, db.RoleWrite.Allows(db.RoleRead))
+	assert.False(t, db.RoleRead.Allows(db.RoleWrite))
+	assert.False(t, db.RoleNone.Allows(db.RoleRead))
+	assert.False(t, db.Role("admin").Allows(db.RoleRead))
+
+	list := db.TodoList{Id: "work", Owner: "alice", Shares: map[string]db.Role{"bob": db.RoleRead}}
+	assert.Equal(t, db.RoleOwner, list.RoleOf("alice"))
+	assert.Equal(t, db.RoleRead, list.RoleOf("bob"))
+	assert.Equal(t, db.RoleNone, list.RoleOf("carol"))
+	assert.Equal(t, db.RoleNone, list.RoleOf(""))
+	assert.Equal(t, db.RoleWrite, db.DefaultTodoList().RoleOf(""), "Anyone can write the default list")
+}
+
+func TestListRegistry(t *testing.T) {
+	registries := map[string]func(t *testing.T) *db.ListRegistry{
+		db.MemoryBackend: func(t *testing.T) *db.ListRegistry {
+			return db.NewMemoryListRegistry()
+		},
+		db.FileBackend: func(t *testing.T) *db.ListRegistry {
+			cfg := db.Config{Backend: db.FileBackend, FileName: filepath.Join(t.TempDir(), "todo.json")}
+			registry, err := db.NewListRegistry(cfg)
+			require.NoError(t, err)
+			return registry
+		},
+	}
+	for name, newRegistry := range registries {
+		t.Run(name, func(t *testing.T) {
+			registry := newRegistry(t)
+			_, err := registry.AddUser(db.User{Id: "alice", Name: "Alice"})
+			require.NoError(t, err)
+			_, err = registry.AddUser(db.User{Id: "bob"})
+			require.NoError(t, err)
+			_, err = registry.AddUser(db.User{Id: "alice"})
+			assert.ErrorIs(t, err, db.ErrUserExists)
+			_, err = registry.AddUser(db.User{Id: "1st"})
+			assert.ErrorIs(t, err, db.ErrInvalidList, "An id cannot start with a digit")
+
+			list, err := registry.CreateList("alice", db.TodoList{Id: "work"})
+			require.NoError(t, err)
+			assert.Equal(t, "alice", list.Owner)
+			assert.Equal(t, "work", list.Name)
+			_, err = registry.CreateList("alice", db.TodoList{Id: "work"})
+			assert.ErrorIs(t, err, db.ErrListExists)
+			_, err = registry.CreateList("alice", db.TodoList{Id: db.DefaultList})
+			assert.ErrorIs(t, err, db.ErrListExists)
+			_, err = registry.CreateList("carol", db.TodoList{Id: "home"})
+			assert.ErrorIs(t, err, db.ErrUserNotFound)
+
+			//Bob only sees the work list once it is shared with him
+			lists, err := registry.ListsFor("bob")
+			require.NoError(t, err)
+			require.Len(t, lists, 1)
+			assert.Equal(t, db.DefaultList, lists[0].Id)
+
+			_, err = registry.Share("work", "bob", db.RoleOwner)
+			assert.ErrorIs(t, err, db.ErrInvalidList, "Ownership cannot be shared")
+			_, err = registry.Share("work", "carol", db.RoleRead)
+			assert.ErrorIs(t, err, db.ErrUserNotFound)
+			list, err = registry.Share("work", "bob", db.RoleWrite)
+			require.NoError(t, err)
+			assert.Equal(t, db.RoleWrite, list.RoleOf("bob"))
+			lists, _ = registry.ListsFor("bob")
+			require.Len(t, lists, 2)
+			assert.Equal(t, "work", lists[1].Id)
+
+			list, err = registry.Unshare("work", "bob")
+			require.NoError(t, err)
+			assert.Equal(t, db.RoleNone, list.RoleOf("bob"))
+
+			require.NoError(t, registry.DeleteList("work"))
+			_, err = registry.GetList("work")
+			assert.ErrorIs(t, err, db.ErrListNotFound)
+			assert.ErrorIs(t, registry.DeleteList(db.DefaultList), db.ErrInvalidList)
+			_, err = registry.GetList(db.DefaultList)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestConfigForList(t *testing.T) {
+	cfg := db.Config{Backend: db.FileBackend, FileName: filepath.Join("data", "todo.json")}
+	work := cfg.ForList("work")
+	assert.Equal(t, filepath.Join("data", "todo.work.json"), work.FileName)
+	assert.Equal(t, "work", work.List)
+	assert.Equal(t, filepath.Join("data", "todo.home.json"), work.ForList("home").FileName)
+	assert.Equal(t, cfg, work.ForList(db.DefaultList))
+}
+
+func TestListsKeepTheirOwnItems(t *testing.T) {
+	dir := t.TempDir()
+	cfg := db.Config{Backend: db.FileBackend, FileName: filepath.Join(dir, "todo.json")}
+	if location := os.Getenv("REDIS_URL"); location != "" {
+		cfg = db.Config{Backend: db.RedisBackend, RedisLocation: location}
+	}
+
+	stores := make(map[string]db.Store)
+	for _, list := range []string{db.DefaultList, "work"} {
+		store, err := db.NewStore(cfg.ForList(list))
+		require.NoError(t, err)
+		require.NoError(t, store.DeleteAll())
+		stores[list] = store
+	}
+	for _, list := range []string{db.DefaultList, "work"} {
+		_, err := stores[list].CreateItem(db.ToDoItem{Title: "In " + list})
+		require.NoError(t, err)
+	}
+
+	//Each list numbers its items on its own and only sees its own items
+	for _, list := range []string{db.DefaultList, "work"} {
+		items, err := stores[list].GetAllItems()
+		require.NoError(t, err)
+		require.Len(t, items, 1, list)
+		assert.Equal(t, 1, items[0].Id)
+		assert.Equal(t, "In "+list, items[0].Title)
+	}
+	require.NoError(t, stores["work"].DeleteAll())
+	items, err := stores[db.DefaultList].GetAllItems()
+	require.NoError(t, err)
+	assert.Len(t, items, 1, "Clearing a list leaves the others alone")
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"drexel.edu/todo/db"
+	"drexel.edu/todo/output"
+	"github.com/stretchr/testify/assert"
+)
+
+// These tests cover the renderers used by the CLI --output option
+
+var outputItems = []db.ToDoItem{
+	{Id: 2, Title: "Learn Kubernetes", Priority: db.PriorityHigh, DueDate: &outputDue, Tags: []string{"cloud", "k8s"}},
+	{Id: 1, Title: "Learn Go, GoLang", IsDone: true},
+}
+
+var outputDue = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func render(t *testing.T, opts output.Options) string {
+	var buf bytes.Buffer
+	assert.NoError(t, output.WriteItems(&buf, outputItems, opts), "Error rendering items")
+	return buf.String()
+}
+
+func TestOutputFormats(t *testing.T) {
+	assert.Equal(t,
+		"ID  TITLE             DONE   PRIORITY  DUE         TAGS\n"+
+			"2   Learn Kubernetes  false  high      2024-03-01  cloud,k8s\n"+
+			"1   Learn Go, GoLang  true   -         -           -\n",
+		render(t, output.Options{}), "Table should be the default format")
+
+	assert.JSONEq(t, `[{"id": 2, "title": "Learn Kubernetes", "priority": "high", "dueDate": "2024-03-01T00:00:00Z", "tags": ["cloud", "k8s"]}, {"id": 1, "title": "Learn Go, GoLang", "done": true}]`,
+		render(t, output.Options{Format: output.JSON}))
+
+	assert.Equal(t,
+		`{"id":2,"title":"Learn Kubernetes","dueDate":"2024-03-01T00:00:00Z","priority":"high","tags":["cloud","k8s"]}`+"\n"+`{"id":1,"title":"Learn Go, GoLang","done":true}`+"\n",
+		render(t, output.Options{Format: output.NDJSON}))
+
+	assert.Equal(t,
+		"- dueDate: \"2024-03-01T00:00:00Z\"\n  id: 2\n  priority: high\n  tags:\n    - cloud\n    - k8s\n  title: Learn Kubernetes\n- done: true\n  id: 1\n  title: Learn Go, GoLang\n",
+		render(t, output.Options{Format: output.YAML}))
+
+	assert.Equal(t,
+		"id,title,done,priority,due,tags\n2,Learn Kubernetes,false,high,2024-03-01,\"cloud,k8s\"\n1,\"Learn Go, GoLang\",true,,,\n",
+		render(t, output.Options{Format: output.CSV}), "CSV should quote titles with commas")
+}
+
+func TestOutputColumnsAndSort(t *testing.T) {
+	assert.Equal(t,
+		"TITLE             ID\n"+
+			"Learn Go, GoLang  1\n"+
+			"Learn Kubernetes  2\n",
+		render(t, output.Options{Columns: []string{"title", "id"}, Sort: "id"}))
+
+	assert.Equal(t,
+		"id\n2\n1\n",
+		render(t, output.Options{Format: output.CSV, Columns: []string{"id"}, Sort: "-id"}))
+
+	assert.Equal(t, 2, outputItems[0].Id, "Sorting should not change the caller's items")
+
+	assert.Error(t, output.Options{Format: "xml"}.Validate(), "Unknown format should be rejected")
+	assert.Error(t, output.Options{Columns: []string{"owner"}}.Validate(), "Unknown column should be rejected")
+	assert.Error(t, output.Options{Sort: "-owner"}.Validate(), "Unknown sort column should be rejected")
+}
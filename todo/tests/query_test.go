@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the query language used by GET /v2/todo
+
+var queryItems = []db.ToDoItem{
+	{Id: 1, Title: "Learn Go", Priority: db.PriorityLow},
+	{Id: 2, Title: "Learn Kubernetes", IsDone: true, Priority: db.PriorityHigh, Tags: []string{"cloud"}},
+	{Id: 3, Title: "Write Go tests", Priority: db.PriorityHigh},
+	{Id: 4, Title: "Ship it", Tags: []string{"Cloud"}},
+}
+
+func ids(items []db.ToDoItem) []int {
+	ids := make([]int, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.Id)
+	}
+	return ids
+}
+
+func TestQueryFiltersAndSort(t *testing.T) {
+	notDone := false
+	sortKeys, err := db.ParseSort("-priority,title")
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		query db.Query
+		want  []int
+	}{
+		"everything":    {db.Query{}, []int{1, 2, 3, 4}},
+		"not done":      {db.Query{Done: &notDone}, []int{1, 3, 4}},
+		"title search":  {db.Query{TitleSearch: "GO"}, []int{1, 3}},
+		"title prefix":  {db.Query{TitlePrefix: "learn "}, []int{1, 2}},
+		"priority":      {db.Query{Priority: db.PriorityHigh}, []int{2, 3}},
+		"tag":           {db.Query{Tag: "cloud"}, []int{2, 4}},
+		"sorted":        {db.Query{Sort: sortKeys}, []int{2, 3, 1, 4}},
+		"sorted filter": {db.Query{Sort: sortKeys, Done: &notDone}, []int{3, 1, 4}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			result, err := db.RunQuery(queryItems, tc.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, ids(result.Items))
+			assert.Equal(t, len(tc.want), result.Total)
+		})
+	}
+
+	_, err = db.ParseSort("title,-color")
+	assert.ErrorIs(t, err, db.ErrInvalidQuery, "Unknown sort fields should be rejected")
+}
+
+func TestQueryPaging(t *testing.T) {
+	result, err := db.RunQuery(queryItems, db.Query{Limit: 3, Offset: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 4}, ids(result.Items))
+	assert.Equal(t, 4, result.Total, "Total should count every page")
+	assert.Empty(t, result.NextCursor, "There is no page after the last one")
+
+	//Walk the pages with cursors, deleting an item that was already seen
+	//part way through should not shift the later pages
+	sortKeys, _ := db.ParseSort("-title")
+	first, err := db.RunQuery(queryItems, db.Query{Sort: sortKeys, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 4}, ids(first.Items))
+	require.NotEmpty(t, first.NextCursor)
+
+	withoutThree := []db.ToDoItem{queryItems[0], queryItems[1], queryItems[3]}
+	second, err := db.RunQuery(withoutThree, db.Query{Sort: sortKeys, Limit: 2, Cursor: first.NextCursor})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 1}, ids(second.Items), "An offset of 2 would have skipped item 2")
+
+	_, err = db.RunQuery(queryItems, db.Query{Cursor: "not a cursor"})
+	assert.ErrorIs(t, err, db.ErrInvalidQuery)
+}
+
+func TestQueryItemsUsesStore(t *testing.T) {
+	store := newMemoryStore(t, queryItems...)
+	result, err := db.QueryItems(store, db.Query{TitleSearch: "learn", Limit: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, ids(result.Items))
+	assert.Equal(t, 2, result.Total)
+}
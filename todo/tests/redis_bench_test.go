@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These run against a local redis, for example the one started by
+// cache/start-redis.sh, and are skipped when it is not running.  Compare
+// the two listing benchmarks with
+//
+//	go test ./tests -run '^$' -bench GetAllItems
+
+// benchItems is how many items the listing benchmarks load
+const benchItems = 1000
+
+func redisLocation() string {
+	if location := os.Getenv("REDIS_URL"); location != "" {
+		return location
+	}
+	return db.RedisDefaultLocation
+}
+
+// newRedisStore returns an empty redis store holding n items
+func newRedisStore(tb testing.TB, n int) *db.RedisStore {
+	tb.Helper()
+	store, err := db.NewRedisStore(redisLocation())
+	if err != nil {
+		tb.Skip("Redis is not available, skipping: ", err)
+	}
+	require.NoError(tb, store.DeleteAll())
+	for i := 1; i <= n; i++ {
+		require.NoError(tb, store.AddItem(db.ToDoItem{Id: i, Title: fmt.Sprint("Item ", i)}))
+	}
+	return store
+}
+
+func TestRedisIndex(t *testing.T) {
+	store := newRedisStore(t, 3)
+	count, err := store.CountItems()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	//An item written without the store is only listed once the index is
+	//rebuilt, and an indexed item deleted behind the store's back is
+	//dropped from the index the next time it is listed
+	client := redis.NewClient(&redis.Options{Addr: redisLocation()})
+	defer client.Close()
+	ctx := context.Background()
+	require.NoError(t, client.Do(ctx, "JSON.SET", "todo:4", ".", `{"id":4,"title":"Loaded by redis-cli"}`).Err())
+	require.NoError(t, client.Del(ctx, "todo:1").Err())
+
+	items, err := store.GetAllItems()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, ids(items))
+
+	require.NoError(t, store.RebuildIndex())
+	items, err = store.GetAllItems()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3, 4}, ids(items))
+
+	assert.NoError(t, store.DeleteAll())
+	count, err = store.CountItems()
+	assert.NoError(t, err)
+	assert.Zero(t, count, "DeleteAll should remove the index too")
+}
+
+// BenchmarkGetAllItems lists items with the index set, SSCAN and JSON.MGET
+func BenchmarkGetAllItems(b *testing.B) {
+	store := newRedisStore(b, benchItems)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		items, err := store.GetAllItems()
+		if err != nil || len(items) != benchItems {
+			b.Fatalf("got %d items, %v", len(items), err)
+		}
+	}
+}
+
+// BenchmarkGetAllItemsWithKeys lists items the way the store used to, KEYS
+// followed by one JSON.GET per item, for comparison
+func BenchmarkGetAllItemsWithKeys(b *testing.B) {
+	newRedisStore(b, benchItems)
+	client := redis.NewClient(&redis.Options{Addr: redisLocation()})
+	defer client.Close()
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		keys, err := client.Keys(ctx, db.RedisKeyPrefix+"[0-9]*").Result()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var items []db.ToDoItem
+		for _, key := range keys {
+			data, err := client.Do(ctx, "JSON.GET", key, ".").Text()
+			if err != nil {
+				b.Fatal(err)
+			}
+			item, err := db.JsonToItem(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			items = append(items, item)
+		}
+		if len(items) != benchItems {
+			b.Fatalf("got %d items", len(items))
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"drexel.edu/todo/db"
+	"drexel.edu/todo/schedule"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the recurring items and the reminders sent by the
+// scheduler
+
+func date(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	//2024-03-01 is a Friday
+	from := date("2024-03-01T09:00:00Z")
+	cases := []struct {
+		rule string
+		next string
+	}{
+		{"0 9 * * 1-5", "2024-03-04T09:00:00Z"},
+		{"*/15 * * * *", "2024-03-01T09:15:00Z"},
+		{"@monthly", "2024-04-01T00:00:00Z"},
+		{"0 0 29 2 *", "2028-02-29T00:00:00Z"},
+		{"30 8 1,15 * *", "2024-03-15T08:30:00Z"},
+		{"FREQ=DAILY", "2024-03-02T09:00:00Z"},
+		{"FREQ=DAILY;BYDAY=MO,TU", "2024-03-04T09:00:00Z"},
+		{"RRULE:FREQ=WEEKLY;INTERVAL=2", "2024-03-15T09:00:00Z"},
+		{"FREQ=WEEKLY;BYDAY=FR,SA", "2024-03-02T09:00:00Z"},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE", "2024-03-11T09:00:00Z"},
+		{"FREQ=MONTHLY;INTERVAL=3", "2024-06-01T09:00:00Z"},
+	}
+	for _, c := range cases {
+		rule, err := db.ParseRecurrence(c.rule)
+		require.NoError(t, err, c.rule)
+		next, ok := rule.Next(from)
+		assert.True(t, ok, c.rule)
+		assert.Equal(t, date(c.next), next, c.rule)
+	}
+
+	rule, _ := db.ParseRecurrence("FREQ=DAILY;UNTIL=20240302")
+	_, ok := rule.Next(date("2024-03-02T00:00:00Z"))
+	assert.False(t, ok, "UNTIL ends the series")
+
+	for _, bad := range []string{"0 9 * *", "61 * * * *", "FREQ=SECONDLY", "FREQ=MONTHLY;BYDAY=MO", "INTERVAL=2", "FREQ=DAILY;COUNT=0"} {
+		_, err := db.ParseRecurrence(bad)
+		assert.ErrorIs(t, err, db.ErrInvalidItem, bad)
+	}
+	assert.ErrorIs(t, db.NewMemoryStore().AddItem(db.ToDoItem{Id: 1, Recurrence: "every day"}), db.ErrInvalidItem)
+}
+
+func TestNextItem(t *testing.T) {
+	due := date("2024-03-01T09:00:00Z")
+	item := db.ToDoItem{Id: 1, Title: "Stand up", IsDone: true, DueDate: &due, Tags: []string{"work"},
+		Recurrence: "FREQ=DAILY;COUNT=3"}
+
+	next, ok, err := schedule.NextItem(item, due)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 0, next.Id)
+	assert.False(t, next.IsDone)
+	assert.Equal(t, []string{"work"}, next.Tags)
+	assert.Equal(t, date("2024-03-02T09:00:00Z"), *next.DueDate)
+	assert.Equal(t, "RRULE:FREQ=DAILY;COUNT=2", next.Recurrence)
+
+	//Missed occurrences are skipped and use up the count
+	next, ok, _ = schedule.NextItem(item, date("2024-03-02T12:00:00Z"))
+	require.True(t, ok)
+	assert.Equal(t, date("2024-03-03T09:00:00Z"), *next.DueDate)
+	assert.Equal(t, "RRULE:FREQ=DAILY;COUNT=1", next.Recurrence)
+
+	item.Recurrence = "FREQ=DAILY;COUNT=1"
+	_, ok, _ = schedule.NextItem(item, due)
+	assert.False(t, ok, "The last item of the series has no next item")
+}
+
+func TestSchedulerRecursAndReminds(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "todo.json")
+	store, err := db.New(dbFile)
+	require.NoError(t, err)
+	states := db.NewFileStateStore(dbFile)
+	clock := schedule.NewManualClock(date("2024-03-01T08:00:00Z"))
+
+	due := date("2024-03-01T09:00:00Z")
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Stand up", DueDate: &due, Recurrence: "0 9 * * 1-5"}))
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 2, Title: "Water the plants", Recurrence: "FREQ=WEEKLY"}))
+	require.NoError(t, store.AddItem(db.ToDoItem{Id: 3, Title: "Taxes", DueDate: &due}))
+
+	var reminded []int
+	var recurred [][2]int
+	options := schedule.Options{
+		Clock: clock,
+		OnReminder: func(r schedule.Reminder) error {
+			reminded = append(reminded, r.Item.Id)
+			return nil
+		},
+		OnRecur: func(previous, next db.ToDoItem) {
+			recurred = append(recurred, [2]int{previous.Id, next.Id})
+		},
+	}
+	scheduler, err := schedule.New(store, states, options)
+	require.NoError(t, err)
+
+	//Nothing is due yet
+	result, err := scheduler.RunOnce()
+	require.NoError(t, err)
+	assert.Empty(t, result.Recurred)
+	assert.Empty(t, result.Reminders)
+
+	//Item 1 comes due, it is reminded and comes back on Monday, item 3
+	//is reminded
+	clock.Set(date("2024-03-01T09:30:00Z"))
+	result, err = scheduler.RunOnce()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, reminded)
+	require.Len(t, result.Recurred, 1)
+	assert.Equal(t, [][2]int{{1, 4}}, recurred)
+	monday, _ := store.GetItem(4)
+	assert.Equal(t, "Stand up", monday.Title)
+	assert.Equal(t, date("2024-03-04T09:00:00Z"), *monday.DueDate)
+	assert.Equal(t, 30*time.Minute, result.Reminders[0].OverdueBy)
+
+	//Running again does nothing new
+	result, err = scheduler.RunOnce()
+	require.NoError(t, err)
+	assert.Empty(t, result.Recurred)
+	assert.Empty(t, result.Reminders)
+
+	//Completing item 2, which has no due date, counts from now.  A new
+	//scheduler on the same state does not repeat what was done.
+	require.NoError(t, store.ChangeItemDoneStatus(2, true))
+	restarted, err := schedule.New(store, states, options)
+	require.NoError(t, err)
+	result, err = restarted.RunOnce()
+	require.NoError(t, err)
+	require.Len(t, result.Recurred, 1)
+	assert.Equal(t, date("2024-03-08T09:30:00Z"), *result.Recurred[0].DueDate)
+	assert.Equal(t, []int{1, 3}, reminded, "Reminders should not be sent twice")
+	assert.Equal(t, map[int]int{1: 4, 2: 5}, restarted.State().Recurred)
+
+	//Moving a due date gets a new reminder, deleting an item forgets it
+	later := date("2024-03-01T10:00:00Z")
+	require.NoError(t, store.UpdateItem(db.ToDoItem{Id: 3, Title: "Taxes", DueDate: &later}))
+	require.NoError(t, store.DeleteItem(1))
+	clock.Advance(time.Hour)
+	_, err = restarted.RunOnce()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3, 3}, reminded)
+	_, tracked := restarted.State().Recurred[1]
+	assert.False(t, tracked)
+
+	//Start runs right away and Stop waits for it
+	clock.Advance(72 * time.Hour)
+	restarted.Start()
+	assert.Eventually(t, func() bool { return restarted.State().LastRun.Equal(clock.Now()) }, time.Second, 10*time.Millisecond)
+	restarted.Stop()
+	scheduler.Stop()
+}
@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests in this file are a conformance suite for the db.Store
+// interface.  Every backend is run through exactly the same checks so
+// that the CLI and the API behave the same no matter which one is
+// configured.  The redis backend is skipped if redis is not running.
+
+// storeFactories returns a function per backend that creates a fresh,
+// empty store for a test
+func storeFactories() map[string]func(t *testing.T) db.Store {
+	return map[string]func(t *testing.T) db.Store{
+		db.FileBackend: func(t *testing.T) db.Store {
+			fileName := filepath.Join(t.TempDir(), "todo.json")
+			store, err := db.NewStore(db.Config{Backend: db.FileBackend, FileName: fileName})
+			require.NoError(t, err, "Error creating file store")
+			return store
+		},
+		db.MemoryBackend: func(t *testing.T) db.Store {
+			store, err := db.NewStore(db.Config{Backend: db.MemoryBackend})
+			require.NoError(t, err, "Error creating memory store")
+			return store
+		},
+		db.RedisBackend: func(t *testing.T) db.Store {
+			location := os.Getenv("REDIS_URL")
+			if location == "" {
+				location = db.RedisDefaultLocation
+			}
+			store, err := db.NewStore(db.Config{Backend: db.RedisBackend, RedisLocation: location})
+			if err != nil {
+				t.Skip("Redis is not available, skipping: ", err)
+			}
+			require.NoError(t, store.DeleteAll(), "Error clearing redis store")
+			return store
+		},
+	}
+}
+
+// withoutManaged clears the timestamps and the version the stores
+// manage, so items can be compared with the items that were added
+func withoutManaged(items ...db.ToDoItem) []db.ToDoItem {
+	stripped := make([]db.ToDoItem, 0, len(items))
+	for _, item := range items {
+		item.CreatedAt, item.UpdatedAt, item.CompletedAt = nil, nil, nil
+		item.Version = 0
+		stripped = append(stripped, item)
+	}
+	return stripped
+}
+
+func TestStoreConformance(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			t.Run("AddAndGet", func(t *testing.T) {
+				store := newStore(t)
+				item := db.ToDoItem{Id: 1, Title: "Learn Go / GoLang"}
+
+				assert.NoError(t, store.AddItem(item), "Error adding item")
+				got, err := store.GetItem(1)
+				assert.NoError(t, err, "Error getting item")
+				assert.Equal(t, withoutManaged(item), withoutManaged(got), "Did not get back the item that was added")
+			})
+
+			t.Run("AddDuplicate", func(t *testing.T) {
+				store := newStore(t)
+				item := db.ToDoItem{Id: 1, Title: "Learn Go / GoLang"}
+
+				assert.NoError(t, store.AddItem(item), "Error adding item")
+				assert.ErrorIs(t, store.AddItem(item), db.ErrItemExists, "Duplicate add should fail")
+			})
+
+			t.Run("GetMissing", func(t *testing.T) {
+				store := newStore(t)
+				_, err := store.GetItem(42)
+				assert.ErrorIs(t, err, db.ErrItemNotFound, "Missing item should not be found")
+			})
+
+			t.Run("Update", func(t *testing.T) {
+				store := newStore(t)
+				assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+
+				updated := db.ToDoItem{Id: 1, Title: "Learn Go / GoLang", IsDone: true}
+				assert.NoError(t, store.UpdateItem(updated), "Error updating item")
+				got, err := store.GetItem(1)
+				assert.NoError(t, err, "Error getting item")
+				assert.Equal(t, withoutManaged(updated), withoutManaged(got), "Item was not updated")
+
+				err = store.UpdateItem(db.ToDoItem{Id: 2, Title: "Not here"})
+				assert.ErrorIs(t, err, db.ErrItemNotFound, "Updating a missing item should fail")
+			})
+
+			t.Run("Delete", func(t *testing.T) {
+				store := newStore(t)
+				assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+
+				assert.NoError(t, store.DeleteItem(1), "Error deleting item")
+				assert.ErrorIs(t, store.DeleteItem(1), db.ErrItemNotFound, "Deleting twice should fail")
+			})
+
+			t.Run("GetAllAndDeleteAll", func(t *testing.T) {
+				store := newStore(t)
+				items, err := store.GetAllItems()
+				assert.NoError(t, err, "Error getting items from empty store")
+				assert.Empty(t, items, "New store should be empty")
+
+				for _, id := range []int{3, 1, 2} {
+					assert.NoError(t, store.AddItem(db.ToDoItem{Id: id, Title: "item"}))
+				}
+				items, err = store.GetAllItems()
+				assert.NoError(t, err, "Error getting all items")
+				assert.Len(t, items, 3, "Expected all items to be returned")
+
+				assert.NoError(t, store.DeleteAll(), "Error deleting all items")
+				items, err = store.GetAllItems()
+				assert.NoError(t, err, "Error getting items after delete all")
+				assert.Empty(t, items, "Store should be empty after delete all")
+			})
+
+			t.Run("ChangeDoneStatus", func(t *testing.T) {
+				store := newStore(t)
+				assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+
+				assert.NoError(t, store.ChangeItemDoneStatus(1, true), "Error changing status")
+				got, err := store.GetItem(1)
+				assert.NoError(t, err, "Error getting item")
+				assert.True(t, got.IsDone, "Item should be done")
+
+				assert.NoError(t, store.ChangeItemDoneStatus(1, false), "Error changing status")
+				got, _ = store.GetItem(1)
+				assert.False(t, got.IsDone, "Item should not be done")
+
+				err = store.ChangeItemDoneStatus(2, true)
+				assert.ErrorIs(t, err, db.ErrItemNotFound, "Changing a missing item should fail")
+			})
+
+			t.Run("CreateAllocatesIds", func(t *testing.T) {
+				store := newStore(t)
+				assert.NoError(t, store.AddItem(db.ToDoItem{Id: 2, Title: "Picked by the caller"}))
+
+				first, err := store.CreateItem(db.ToDoItem{Id: 99, Title: "Learn Go"})
+				require.NoError(t, err, "Error creating item")
+				assert.Equal(t, 3, first.Id, "The id should follow the highest id, not the one sent")
+				assert.Equal(t, 1, first.Version, "A new item should be at version 1")
+
+				//Ids are not handed out again after the item is deleted
+				assert.NoError(t, store.DeleteItem(first.Id))
+				second, err := store.CreateItem(db.ToDoItem{Title: "Learn Kubernetes"})
+				require.NoError(t, err)
+				assert.Equal(t, 4, second.Id, "Deleted ids should not be reused")
+
+				got, err := store.GetItem(second.Id)
+				assert.NoError(t, err)
+				assert.Equal(t, second, got, "CreateItem should return the stored item")
+			})
+
+			t.Run("VersionConflict", func(t *testing.T) {
+				store := newStore(t)
+				assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+				read, _ := store.GetItem(1)
+
+				read.Title = "Learn Go / GoLang"
+				assert.NoError(t, store.UpdateItem(read), "Updating the current version should work")
+				got, _ := store.GetItem(1)
+				assert.Equal(t, 2, got.Version, "Every update should bump the version")
+
+				read.Title = "Lost update"
+				assert.ErrorIs(t, store.UpdateItem(read), db.ErrVersionConflict, "A stale version should be rejected")
+
+				assert.NoError(t, store.ChangeItemDoneStatus(1, true))
+				got, _ = store.GetItem(1)
+				assert.Equal(t, 3, got.Version, "Changing the done status is an update too")
+
+				assert.NoError(t, store.UpdateItem(db.ToDoItem{Id: 1, Title: "No version"}), "Version 0 skips the check")
+			})
+
+			t.Run("ManagedTimestamps", func(t *testing.T) {
+				store := newStore(t)
+				due := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+				assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go", DueDate: &due,
+					Priority: db.PriorityHigh, Tags: []string{"go", " go ", ""}, Notes: "Start with the tour"}))
+
+				added, err := store.GetItem(1)
+				require.NoError(t, err)
+				require.NotNil(t, added.CreatedAt, "Add should set the created time")
+				assert.Equal(t, added.CreatedAt, added.UpdatedAt, "A new item was updated when it was created")
+				assert.Nil(t, added.CompletedAt, "An item that is not done has no completed time")
+				assert.Equal(t, []string{"go"}, added.Tags, "Tags should be normalized")
+				assert.True(t, due.Equal(*added.DueDate), "Due date was not stored")
+
+				assert.NoError(t, store.ChangeItemDoneStatus(1, true))
+				done, _ := store.GetItem(1)
+				require.NotNil(t, done.CompletedAt, "Completing an item should set the completed time")
+				assert.Equal(t, added.CreatedAt, done.CreatedAt, "The created time should not change")
+				assert.False(t, done.UpdatedAt.Before(*added.UpdatedAt), "The updated time should move forward")
+
+				assert.NoError(t, store.ChangeItemDoneStatus(1, false))
+				undone, _ := store.GetItem(1)
+				assert.Nil(t, undone.CompletedAt, "Reopening an item should clear the completed time")
+
+				err = store.AddItem(db.ToDoItem{Id: 2, Title: "Bad", Priority: "urgent"})
+				assert.ErrorIs(t, err, db.ErrInvalidItem, "Unknown priorities should be rejected")
+			})
+		})
+	}
+}
+
+func TestFileSequenceSurvivesReopen(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "todo.json")
+	store, err := db.New(fileName)
+	require.NoError(t, err)
+	item, err := store.CreateItem(db.ToDoItem{Title: "Learn Go"})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteItem(item.Id))
+	require.NoError(t, store.Compact())
+
+	//A new process only sees the files
+	reopened, err := db.New(fileName)
+	require.NoError(t, err)
+	next, err := reopened.CreateItem(db.ToDoItem{Title: "Learn Kubernetes"})
+	require.NoError(t, err)
+	assert.Equal(t, item.Id+1, next.Id, "The sequence should be kept in the database files")
+}
+
+func TestNewStoreUnknownBackend(t *testing.T) {
+	store, err := db.NewStore(db.Config{Backend: "floppy"})
+	assert.Error(t, err, "Unknown backend should be rejected")
+	assert.Nil(t, store, "No store should be returned for an unknown backend")
+}
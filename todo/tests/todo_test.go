@@ -10,45 +10,40 @@ package tests
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"drexel.edu/todo/db"
 	fake "github.com/brianvoe/gofakeit/v6" //aliasing package name
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-// Note the default file path is relative to the test package location.  The
+// Note the fixture path is relative to the test package location.  The
 // project has a /tests path where you are at and a /data path where the
-// database file sits.  So to get there we need to back up a directory and
+// sample database sits.  So to get there we need to back up a directory and
 // then go into the /data directory.  Thus this is why we are setting the
-// default file name to "../data/todo.json"
-const (
-	DEFAULT_DB_FILE_NAME        = "../data/todo.json"
-	DEFAULT_DB_BACKUP_FILE_NAME = "../data/todo.json.bak"
-)
-
-var (
-	DB *db.ToDo
-)
-
-// note init() is a helpful function in golang.  If it exists in a package
-// such as we are doing here with the testing package, it will be called
-// exactly once.  This is a great place to do setup work for your tests.
-func init() {
-	//Below we are setting up the gloabal DB variable that we can use in
-	//all of our testing functions to make life easier
-	testdb, err := db.New(DEFAULT_DB_FILE_NAME)
-	if err != nil {
-		fmt.Print("ERROR CREATING DB:", err)
-		os.Exit(1)
+// fixture directory to "../data"
+const FIXTURE_DIR = "../data"
+
+// newFixtureDB copies the sample database and its backup out of ../data
+// into a temp directory and opens the copy, starting fresh from the sample
+// data in the backup.  The tests change the database, so they never work
+// on the files that are checked in.  It returns the db and its file name.
+func newFixtureDB(t *testing.T) (*db.ToDo, string) {
+	dir := t.TempDir()
+	for _, name := range []string{"todo.json", "todo.json.bak"} {
+		data, err := os.ReadFile(filepath.Join(FIXTURE_DIR, name))
+		require.NoError(t, err, "Error reading the sample database")
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
 	}
 
-	DB = testdb //setup the global DB variable to support test cases
-
-	//Now lets start with a fresh DB with the sample test data
-	testdb.RestoreDB()
+	dbFile := filepath.Join(dir, "todo.json")
+	testdb, err := db.New(dbFile)
+	require.NoError(t, err, "Error creating db")
+	require.NoError(t, testdb.RestoreDB(), "Error restoring the sample data")
+	return testdb, dbFile
 }
 
 // Sample Test, will always pass, comparing the second parameter to true, which
@@ -58,6 +53,7 @@ func TestTrue(t *testing.T) {
 }
 
 func TestAddHardCodedItem(t *testing.T) {
+	DB, _ := newFixtureDB(t)
 	item := db.ToDoItem{
 		Id:     999,
 		Title:  "This is a test case item",
@@ -82,7 +78,9 @@ func TestAddHardCodedItem(t *testing.T) {
 	//and making sure it matches the item that you put in the DB above
 
 	fileContents, _ := DB.GetItem(item.Id)
-	assert.Equal(t, item, fileContents, "found added item.id")
+	assert.Equal(t, item.Title, fileContents.Title, "found added item.id")
+	assert.Equal(t, item.IsDone, fileContents.IsDone, "found added item.id")
+	assert.NotNil(t, fileContents.CreatedAt, "The database should stamp the created time")
 }
 
 func TestAddRandomStructItem(t *testing.T) {
@@ -115,24 +113,26 @@ func TestAddRandomItem(t *testing.T) {
 
 // RestoreDB func test
 func TestRestoreDB(t *testing.T) {
+	DB, dbFile := newFixtureDB(t)
 
-	assert.FileExists(t, DEFAULT_DB_BACKUP_FILE_NAME, "todo.json.back file in ../data does not exist")
+	assert.FileExists(t, dbFile+".bak", "todo.json.back file in ../data does not exist")
 
 	// remove the current db
-	err := os.Remove(DEFAULT_DB_FILE_NAME)
+	err := os.Remove(dbFile)
 	assert.NoError(t, err, "Found error while removing file in TestRestoreDB")
-	assert.NoFileExists(t, DEFAULT_DB_FILE_NAME, "todo.json file in ../data exist")
+	assert.NoFileExists(t, dbFile, "todo.json file in ../data exist")
 
 	// use the restoreDB function and see if the file was created
 	err = DB.RestoreDB()
 	assert.NoError(t, err, "Found error while running RestoreDB in TestRestoreDB")
-	assert.FileExists(t, DEFAULT_DB_FILE_NAME, "todo.json file in ../data does not exist")
+	assert.FileExists(t, dbFile, "todo.json file in ../data does not exist")
 }
 
 func TestGetAllItems(t *testing.T) {
+	DB, dbFile := newFixtureDB(t)
 	items, err := DB.GetAllItems()
 	var fileContents []db.ToDoItem
-	data, _ := os.ReadFile(DEFAULT_DB_BACKUP_FILE_NAME)
+	data, _ := os.ReadFile(dbFile + ".bak")
 	err = json.Unmarshal(data, &fileContents)
 
 	assert.NoError(t, err, "Found error while running TestGetAllItems")
@@ -140,6 +140,7 @@ func TestGetAllItems(t *testing.T) {
 }
 
 func TestDeleteItem(t *testing.T) {
+	DB, _ := newFixtureDB(t)
 
 	// add a new item.id
 	item := db.ToDoItem{
@@ -160,6 +161,7 @@ func TestDeleteItem(t *testing.T) {
 }
 
 func TestGetItem(t *testing.T) {
+	DB, _ := newFixtureDB(t)
 
 	// test an actual existing id
 	id := 1
@@ -174,6 +176,7 @@ func TestGetItem(t *testing.T) {
 }
 
 func TestUpdateItem(t *testing.T) {
+	DB, dbFile := newFixtureDB(t)
 
 	item := db.ToDoItem{
 		Id:     4,
@@ -186,8 +189,13 @@ func TestUpdateItem(t *testing.T) {
 		return
 	}
 
+	// changes go to the operation log first, compact so that the
+	// update is written to the database file we read below
+	err = DB.Compact()
+	assert.NoError(t, err, "Ran into error while compacting the database")
+
 	var fileContents []db.ToDoItem
-	data, _ := os.ReadFile(DEFAULT_DB_FILE_NAME)
+	data, _ := os.ReadFile(dbFile)
 	err = json.Unmarshal(data, &fileContents)
 
 	assert.NoError(t, err, "Ran into error while running UpdateItem func")
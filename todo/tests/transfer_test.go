@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"drexel.edu/todo/db"
+	"drexel.edu/todo/transfer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the import and export of todo items
+
+func newMemoryStore(t *testing.T, items ...db.ToDoItem) db.Store {
+	store := db.NewMemoryStore()
+	for _, item := range items {
+		require.NoError(t, store.AddItem(item))
+	}
+	return store
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	items := []db.ToDoItem{
+		{Id: 1, Title: "Learn Go, GoLang", IsDone: true},
+		{Id: 2, Title: `It's "quoted"`},
+	}
+	for _, format := range transfer.Formats {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			count, err := transfer.Export(newMemoryStore(t, items...), &buf, format)
+			assert.NoError(t, err, "Error exporting")
+			assert.Equal(t, 2, count)
+
+			target := newMemoryStore(t)
+			report, err := transfer.Import(target, &buf, format, transfer.Upsert, false)
+			assert.NoError(t, err, "Error importing")
+			assert.Equal(t, 2, report.Counts.Added)
+
+			got, err := target.GetAllItems()
+			assert.NoError(t, err)
+			assert.Equal(t, withoutManaged(items...), withoutManaged(got...), "Items changed in the round trip")
+		})
+	}
+}
+
+func TestImportConflictPolicies(t *testing.T) {
+	input := `{"id": 1, "title": "Learn Go / GoLang"}
+{"id": 2, "title": "Learn Kubernetes"}
+`
+	existing := db.ToDoItem{Id: 1, Title: "Learn Go"}
+
+	store := newMemoryStore(t, existing)
+	report, err := transfer.Import(store, strings.NewReader(input), transfer.NDJSON, transfer.SkipExisting, false)
+	assert.NoError(t, err)
+	assert.Equal(t, transfer.Counts{Added: 1, Skipped: 1}, report.Counts)
+	item, _ := store.GetItem(1)
+	assert.Equal(t, existing.Title, item.Title, "Skip should keep the existing item")
+
+	store = newMemoryStore(t, existing)
+	report, err = transfer.Import(store, strings.NewReader(input), transfer.NDJSON, transfer.Upsert, false)
+	assert.NoError(t, err)
+	assert.Equal(t, transfer.Counts{Added: 1, Updated: 1}, report.Counts)
+	item, _ = store.GetItem(1)
+	assert.Equal(t, "Learn Go / GoLang", item.Title, "Upsert should replace the existing item")
+
+	store = newMemoryStore(t, existing)
+	_, err = transfer.Import(store, strings.NewReader(input), transfer.NDJSON, transfer.FailOnConflict, false)
+	assert.ErrorIs(t, err, db.ErrItemExists, "Fail should stop at the existing item")
+}
+
+func TestImportDryRun(t *testing.T) {
+	store := newMemoryStore(t, db.ToDoItem{Id: 1, Title: "Learn Go"})
+	input := `id,title,done
+1,Learn Go,false
+2,Learn Kubernetes,true
+2,Learn Kubernetes again,true
+`
+	report, err := transfer.Import(store, strings.NewReader(input), transfer.CSV, transfer.Upsert, true)
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, []transfer.Change{
+		{Id: 1, Action: transfer.Unchanged},
+		{Id: 2, Action: transfer.Added},
+		{Id: 2, Action: transfer.Updated},
+	}, report.Changes, "Dry run should report what would happen")
+
+	items, err := store.GetAllItems()
+	assert.NoError(t, err)
+	assert.Len(t, items, 1, "Dry run should not write anything")
+}
+
+func TestImportRedisSeedScript(t *testing.T) {
+	//The seed data used to load redis in the cache demo
+	file, err := os.Open("../../cache/cache-data/redis-load.redis")
+	require.NoError(t, err)
+	defer file.Close()
+
+	store := newMemoryStore(t)
+	report, err := transfer.Import(store, file, transfer.RedisCLI, transfer.Upsert, false)
+	assert.NoError(t, err, "Error importing the redis seed script")
+	assert.Equal(t, 4, report.Counts.Added)
+
+	item, err := store.GetItem(3)
+	assert.NoError(t, err)
+	assert.Equal(t, withoutManaged(db.ToDoItem{Id: 3, Title: "Learn GoLang"}), withoutManaged(item))
+}
@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"drexel.edu/todo/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests cover the operation log of the JSON file backend: replay,
+// compaction and point in time restore
+
+func newTempFileStore(t *testing.T) (*db.ToDo, string) {
+	dbFile := filepath.Join(t.TempDir(), "todo.json")
+	store, err := db.New(dbFile)
+	require.NoError(t, err, "Error creating file store")
+	return store, dbFile
+}
+
+func TestLogIsReplayedOnNew(t *testing.T) {
+	store, dbFile := newTempFileStore(t)
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 2, Title: "Learn Kubernetes"}))
+	assert.NoError(t, store.DeleteItem(1))
+
+	//The snapshot has not been rewritten, the changes are only in the log
+	data, err := os.ReadFile(dbFile)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[]`, string(data), "Snapshot should not change until compaction")
+
+	reopened, err := db.New(dbFile)
+	require.NoError(t, err)
+	items, err := reopened.GetAllItems()
+	assert.NoError(t, err)
+	assert.Equal(t, []db.ToDoItem{{Id: 2, Title: "Learn Kubernetes"}}, withoutManaged(items...), "Log was not replayed")
+}
+
+func TestLogIsCompacted(t *testing.T) {
+	store, dbFile := newTempFileStore(t)
+	store.SetCompactEvery(2)
+
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 2, Title: "Learn Kubernetes"}))
+
+	data, err := os.ReadFile(dbFile)
+	require.NoError(t, err)
+	var snapshot []db.ToDoItem
+	require.NoError(t, json.Unmarshal(data, &snapshot))
+	assert.Equal(t, []db.ToDoItem{{Id: 1, Title: "Learn Go"}, {Id: 2, Title: "Learn Kubernetes"}},
+		withoutManaged(snapshot...), "Snapshot should hold the compacted changes")
+
+	lsn, err := store.LSN()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), lsn, "Compaction should not change the lsn")
+}
+
+func TestPartialLogRecordIsIgnored(t *testing.T) {
+	store, dbFile := newTempFileStore(t)
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))
+
+	//Simulate a crash in the middle of appending a record
+	f, err := os.OpenFile(dbFile+".log", os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"lsn":2,"op":"add","id":2,"item":{"id":2,"ti`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reopened, err := db.New(dbFile)
+	require.NoError(t, err)
+	assert.NoError(t, reopened.AddItem(db.ToDoItem{Id: 3, Title: "Learn Cloud Native Architecture"}))
+
+	items, err := reopened.GetAllItems()
+	assert.NoError(t, err)
+	assert.Equal(t, []db.ToDoItem{
+		{Id: 1, Title: "Learn Go"},
+		{Id: 3, Title: "Learn Cloud Native Architecture"},
+	}, withoutManaged(items...), "Partial record should be dropped")
+}
+
+func TestRestoreToLSN(t *testing.T) {
+	store, _ := newTempFileStore(t)
+	//Compact often so the restore has to use archived log segments
+	store.SetCompactEvery(2)
+
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 1, Title: "Learn Go"}))           //lsn 1
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 2, Title: "Learn Kubernetes"}))   //lsn 2
+	assert.NoError(t, store.AddItem(db.ToDoItem{Id: 3, Title: "Learn Cloud Native"})) //lsn 3
+	assert.NoError(t, store.DeleteItem(2))                                            //lsn 4
+	assert.NoError(t, store.ChangeItemDoneStatus(1, true))                            //lsn 5
+
+	assert.NoError(t, store.RestoreToLSN(2), "Error restoring to lsn 2")
+	items, err := store.GetAllItems()
+	assert.NoError(t, err)
+	assert.Equal(t, []db.ToDoItem{
+		{Id: 1, Title: "Learn Go"},
+		{Id: 2, Title: "Learn Kubernetes"},
+	}, withoutManaged(items...), "Database should be back at lsn 2")
+
+	//The restore is logged, so we can move forward again
+	assert.NoError(t, store.RestoreToLSN(5), "Error restoring to lsn 5")
+	items, err = store.GetAllItems()
+	assert.NoError(t, err)
+	assert.Equal(t, []db.ToDoItem{
+		{Id: 1, Title: "Learn Go", IsDone: true},
+		{Id: 3, Title: "Learn Cloud Native"},
+	}, withoutManaged(items...), "Database should be back at lsn 5")
+
+	history, err := store.History()
+	assert.NoError(t, err)
+	assert.Len(t, history, 7, "History should hold every change including the restores")
+
+	assert.Error(t, store.RestoreToLSN(100), "Restoring to a future lsn should fail")
+}
+
+// historyFiles lists the snapshots and log segments in the history
+// directory of dbFile
+func historyFiles(t *testing.T, dbFile string) (snapshots []string, segments []string) {
+	snapshots, err := filepath.Glob(filepath.Join(dbFile+".history", "snapshot-*.json"))
+	require.NoError(t, err)
+	segments, err = filepath.Glob(filepath.Join(dbFile+".history", "log-*.ndjson"))
+	require.NoError(t, err)
+	return snapshots, segments
+}
+
+func TestCompactKeepsLimitedHistory(t *testing.T) {
+	store, dbFile := newTempFileStore(t)
+	store.SetCompactEvery(1)
+	store.SetHistoryKeep(3)
+	for i := 1; i <= 8; i++ {
+		require.NoError(t, store.AddItem(db.ToDoItem{Id: i, Title: "item"}))
+	}
+
+	snapshots, segments := historyFiles(t, dbFile)
+	assert.Len(t, snapshots, 3, "Compact should only keep the newest snapshots")
+	assert.Len(t, segments, 2, "Only the segments after the oldest snapshot are needed")
+
+	lsn, err := store.LSN()
+	require.NoError(t, err)
+	require.NoError(t, store.RestoreToLSN(lsn-2), "The kept history should still restore")
+	items, err := store.GetAllItems()
+	require.NoError(t, err)
+	assert.Len(t, items, 6)
+	assert.ErrorIs(t, store.RestoreToLSN(1), db.ErrHistoryUnavailable, "Pruned history cannot be restored")
+}
+
+func TestPruneHistory(t *testing.T) {
+	store, dbFile := newTempFileStore(t)
+	store.SetCompactEvery(1)
+	store.SetHistoryKeep(0)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, store.AddItem(db.ToDoItem{Id: i, Title: "item"}))
+	}
+	snapshots, _ := historyFiles(t, dbFile)
+	assert.Len(t, snapshots, 6, "0 should keep all of the history, with the snapshot the log started from")
+
+	_, err := store.PruneHistory(0)
+	assert.Error(t, err, "At least one snapshot has to be kept")
+	removed, err := store.PruneHistory(1)
+	require.NoError(t, err)
+	assert.Len(t, removed, 10, "Five snapshots and the five segments after them should go")
+	snapshots, segments := historyFiles(t, dbFile)
+	assert.Len(t, snapshots, 1)
+	assert.Empty(t, segments)
+
+	lsn, err := store.LSN()
+	require.NoError(t, err)
+	assert.NoError(t, store.RestoreToLSN(lsn))
+}
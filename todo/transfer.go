@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"drexel.edu/todo/db"
+	"drexel.edu/todo/output"
+	"drexel.edu/todo/transfer"
+	"github.com/spf13/cobra"
+)
+
+// The import and export commands move items between the configured
+// database and another location.  A location is one of
+//
+//	-                  stdin or stdout
+//	<path>             a data file in --format, by default taken from the
+//	                   file extension
+//	redis://host:port  a redis database, items are copied store to store
+//	file://<path>      a todo JSON file database, items are copied store
+//	                   to store
+
+const (
+	redisScheme = "redis://"
+	fileScheme  = "file://"
+)
+
+// transferFlags are the flags shared by import and export
+type transferFlags struct {
+	format string
+	policy string
+	dryRun bool
+}
+
+func (f *transferFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&f.format, "format", "f", "", "File format: json, ndjson, csv or redis-cli (default from the file extension, or json)")
+	cmd.Flags().StringVar(&f.policy, "on-conflict", string(transfer.Upsert), "What to do with items that already exist: upsert, skip or fail")
+	cmd.Flags().BoolVar(&f.dryRun, "dry-run", false, "Report what would be imported without writing anything")
+	cmd.RegisterFlagCompletionFunc("format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		names := make([]string, 0, len(transfer.Formats))
+		for _, f := range transfer.Formats {
+			names = append(names, string(f))
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.RegisterFlagCompletionFunc("on-conflict", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"upsert", "skip", "fail"}, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+// resolveFormat picks the format from the flag or the file name
+func (f *transferFlags) resolveFormat(location string) (transfer.Format, error) {
+	if f.format != "" {
+		format, err := transfer.ParseFormat(f.format)
+		if err != nil {
+			return "", usageError{err}
+		}
+		return format, nil
+	}
+	if location == "-" {
+		return transfer.JSON, nil
+	}
+	format, err := transfer.FormatFromFileName(location)
+	if err != nil {
+		return "", usageErrorf("%v, use --format", err)
+	}
+	return format, nil
+}
+
+func (f *transferFlags) resolvePolicy() (transfer.ConflictPolicy, error) {
+	policy, err := transfer.ParsePolicy(f.policy)
+	if err != nil {
+		return "", usageError{err}
+	}
+	return policy, nil
+}
+
+// openLocationStore opens the store for a redis:// or file:// location.
+// It returns nil if the location is a data file.
+func openLocationStore(location string) (db.Store, error) {
+	switch {
+	case strings.HasPrefix(location, redisScheme):
+		return db.NewStore(db.Config{Backend: db.RedisBackend, RedisLocation: strings.TrimPrefix(location, redisScheme)})
+	case strings.HasPrefix(location, fileScheme):
+		return db.NewStore(db.Config{Backend: db.FileBackend, FileName: strings.TrimPrefix(location, fileScheme)})
+	}
+	return nil, nil
+}
+
+// printReport writes the summary of an import to stderr.  The list of
+// changes goes to stdout, so a dry run can be reviewed or piped.
+func (c *cli) printReport(cmd *cobra.Command, report transfer.Report) error {
+	if report.DryRun {
+		switch c.out.Format {
+		case output.JSON, output.NDJSON:
+			if err := json.NewEncoder(cmd.OutOrStdout()).Encode(report); err != nil {
+				return err
+			}
+		default:
+			for _, change := range report.Changes {
+				cmd.Printf("%-9s %d\n", change.Action, change.Id)
+			}
+		}
+	}
+	cmd.PrintErrln(report)
+	return nil
+}
+
+func (c *cli) exportCmd() *cobra.Command {
+	var f transferFlags
+	var to string
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the items in the database to a file or another database",
+		Example: `  todo export --to todo.csv
+  todo export -f ndjson | gzip > todo.ndjson.gz
+  todo export -f redis-cli --to ../cache/cache-data/redis-load.redis
+  todo export --to redis://localhost:6379 --on-conflict skip`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policy, err := f.resolvePolicy()
+			if err != nil {
+				return err
+			}
+			store, err := c.openStore()
+			if err != nil {
+				return err
+			}
+
+			target, err := openLocationStore(to)
+			if err != nil {
+				return err
+			}
+			if target != nil {
+				report, err := transfer.Copy(store, target, policy, f.dryRun)
+				if perr := c.printReport(cmd, report); perr != nil {
+					return perr
+				}
+				return err
+			}
+
+			format, err := f.resolveFormat(to)
+			if err != nil {
+				return err
+			}
+			if f.dryRun {
+				return usageErrorf("--dry-run only applies when exporting to another database")
+			}
+			//A file is only replaced once the export worked, a failed
+			//export leaves the old one as it was
+			var count int
+			export := func(w io.Writer) error {
+				count, err = transfer.Export(store, w, format)
+				return err
+			}
+			if to == "-" {
+				err = export(cmd.OutOrStdout())
+			} else {
+				err = db.WriteFileAtomic(to, export)
+			}
+			if err != nil {
+				return err
+			}
+			cmd.PrintErrln("Exported", count, "items")
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&to, "to", "-", "Where to export to: a file, - for stdout, redis://host:port or file://<todo db>")
+	f.register(cmd)
+	return cmd
+}
+
+func (c *cli) importCmd() *cobra.Command {
+	var f transferFlags
+	var from string
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import items into the database from a file or another database",
+		Example: `  todo import --from todo.csv --dry-run
+  todo import --from ../cache/cache-data/redis-load.redis --on-conflict skip
+  todo --backend redis import --from file://data/todo.json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policy, err := f.resolvePolicy()
+			if err != nil {
+				return err
+			}
+			store, err := c.openStore()
+			if err != nil {
+				return err
+			}
+
+			source, err := openLocationStore(from)
+			if err != nil {
+				return err
+			}
+			if source != nil {
+				report, err := transfer.Copy(source, store, policy, f.dryRun)
+				if perr := c.printReport(cmd, report); perr != nil {
+					return perr
+				}
+				return err
+			}
+
+			format, err := f.resolveFormat(from)
+			if err != nil {
+				return err
+			}
+			var r io.Reader = cmd.InOrStdin()
+			if from != "-" {
+				file, err := os.Open(from)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				r = file
+			}
+			report, err := transfer.Import(store, r, format, policy, f.dryRun)
+			if perr := c.printReport(cmd, report); perr != nil {
+				return perr
+			}
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "-", "Where to import from: a file, - for stdin, redis://host:port or file://<todo db>")
+	f.register(cmd)
+	return cmd
+}
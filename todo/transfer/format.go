@@ -0,0 +1,402 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"drexel.edu/todo/db"
+)
+
+// The transfer package moves todo items between databases and files.
+// Items are read and written one at a time so that large databases can be
+// streamed, for example from a JSON file database into redis, without
+// holding a second copy in memory.
+
+// Format is the name of an import/export file format
+type Format string
+
+const (
+	// JSON is a JSON array of items, the format of todo.json
+	JSON Format = "json"
+	// NDJSON is one JSON item per line
+	NDJSON Format = "ndjson"
+	// CSV has a header row naming the columns, see csvColumns.  Tags are
+	// separated by semicolons.
+	CSV Format = "csv"
+	// RedisCLI is a script of "json.set todo:<id> $ '<item>'" commands,
+	// each followed by "sadd todo:ids <id>" to index the item, the
+	// format of cache/cache-data/redis-load.redis.  It can be loaded
+	// with "redis-cli < file".
+	RedisCLI Format = "redis-cli"
+)
+
+// Formats lists every supported format
+var Formats = []Format{JSON, NDJSON, CSV, RedisCLI}
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+// csvColumns are the columns written to CSV files.  When reading only id
+// and title are required, the columns can be in any order.
+var csvColumns = []string{"id", "title", "done", "dueDate", "priority", "tags", "notes", "recurrence", "createdAt", "updatedAt", "completedAt"}
+
+// csvTagSeparator separates the tags in the tags column
+const csvTagSeparator = ";"
+
+// ParseFormat checks a format name
+func ParseFormat(name string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == strings.ToLower(name) {
+			return f, nil
+		}
+	}
+	names := make([]string, 0, len(Formats))
+	for _, f := range Formats {
+		names = append(names, string(f))
+	}
+	return "", fmt.Errorf("%w %q, the formats are %s", ErrUnknownFormat, name, strings.Join(names, ", "))
+}
+
+// FormatFromFileName guesses the format from the extension of a file
+// name, .json, .ndjson/.jsonl, .csv or .redis
+func FormatFromFileName(fileName string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return JSON, nil
+	case ".ndjson", ".jsonl":
+		return NDJSON, nil
+	case ".csv":
+		return CSV, nil
+	case ".redis":
+		return RedisCLI, nil
+	}
+	return "", fmt.Errorf("%w, cannot tell the format of %q from its extension", ErrUnknownFormat, fileName)
+}
+
+//------------------------------------------------------------
+// DECODING
+//------------------------------------------------------------
+
+// Decode reads items in the provided format and calls fn for each one,
+// in the order they appear.  Decoding stops at the first error returned
+// by fn.
+func Decode(r io.Reader, format Format, fn func(item db.ToDoItem) error) error {
+	switch format {
+	case JSON:
+		return decodeJSON(r, fn)
+	case NDJSON:
+		return decodeNDJSON(r, fn)
+	case CSV:
+		return decodeCSV(r, fn)
+	case RedisCLI:
+		return decodeRedisCLI(r, fn)
+	}
+	return fmt.Errorf("%w %q", ErrUnknownFormat, format)
+}
+
+// decodeJSON walks the array token by token so only one item is in
+// memory at a time
+func decodeJSON(r io.Reader, fn func(item db.ToDoItem) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("reading json: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errors.New("reading json: expected an array of items")
+	}
+	for n := 1; dec.More(); n++ {
+		var item db.ToDoItem
+		if err := dec.Decode(&item); err != nil {
+			return fmt.Errorf("reading json item %d: %w", n, err)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("reading json: %w", err)
+	}
+	return nil
+}
+
+func decodeNDJSON(r io.Reader, fn func(item db.ToDoItem) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var item db.ToDoItem
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			return fmt.Errorf("reading ndjson line %d: %w", line, err)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func decodeCSV(r io.Reader, fn func(item db.ToDoItem) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading csv header: %w", err)
+	}
+
+	//The columns can be in any order, but id and title are required.
+	//Column names are matched without case, so dueDate and duedate are
+	//the same column
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"id", "title"} {
+		if _, ok := index[name]; !ok {
+			return fmt.Errorf("reading csv: the header has no %q column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		i, ok := index[strings.ToLower(name)]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading csv: %w", err)
+		}
+
+		var item db.ToDoItem
+		if item.Id, err = strconv.Atoi(field(record, "id")); err != nil {
+			return fmt.Errorf("reading csv line %d: bad id: %w", line, err)
+		}
+		item.Title = field(record, "title")
+		if done := field(record, "done"); done != "" {
+			if item.IsDone, err = strconv.ParseBool(done); err != nil {
+				return fmt.Errorf("reading csv line %d: bad done value: %w", line, err)
+			}
+		}
+		if item.DueDate, err = db.ParseDueDate(field(record, "dueDate")); err != nil {
+			return fmt.Errorf("reading csv line %d: %w", line, err)
+		}
+		item.Priority = db.Priority(field(record, "priority"))
+		if tags := field(record, "tags"); tags != "" {
+			item.Tags = db.NormalizeTags(strings.Split(tags, csvTagSeparator))
+		}
+		item.Notes = field(record, "notes")
+		item.Recurrence = field(record, "recurrence")
+		for name, stamp := range map[string]**time.Time{
+			"createdAt":   &item.CreatedAt,
+			"updatedAt":   &item.UpdatedAt,
+			"completedAt": &item.CompletedAt,
+		} {
+			if value := field(record, name); value != "" {
+				parsed, err := time.Parse(time.RFC3339Nano, value)
+				if err != nil {
+					return fmt.Errorf("reading csv line %d: bad %s: %w", line, name, err)
+				}
+				*stamp = &parsed
+			}
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeRedisCLI reads the json.set commands of a redis-cli script.
+// Other commands, like the flushdb at the top of redis-load.redis and the
+// sadd commands that index the items, blank lines and # comments are
+// skipped.
+func decodeRedisCLI(r io.Reader, fn func(item db.ToDoItem) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		args, err := splitRedisArgs(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("reading redis-cli line %d: %w", line, err)
+		}
+		if len(args) == 0 || !strings.EqualFold(args[0], "json.set") {
+			continue
+		}
+		if len(args) != 4 || !strings.HasPrefix(args[1], db.RedisKeyPrefix) || (args[2] != "$" && args[2] != ".") {
+			return fmt.Errorf("reading redis-cli line %d: expected json.set %s<id> $ '<item>'", line, db.RedisKeyPrefix)
+		}
+		var item db.ToDoItem
+		if err := json.Unmarshal([]byte(args[3]), &item); err != nil {
+			return fmt.Errorf("reading redis-cli line %d: %w", line, err)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// splitRedisArgs splits a redis-cli line into its arguments.  Like
+// redis-cli, arguments can be wrapped in single or double quotes and a
+// backslash escapes the next character.
+func splitRedisArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, ch := range line {
+		switch {
+		case escaped:
+			current.WriteRune(ch)
+			escaped = false
+		case ch == '\\' && quote != 0:
+			escaped = true
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(ch)
+		case ch == '\'' || ch == '"':
+			quote, inArg = ch, true
+		case ch == '#' && !inArg && len(args) == 0:
+			return args, nil
+		case ch == ' ' || ch == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(ch)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+//------------------------------------------------------------
+// ENCODING
+//------------------------------------------------------------
+
+// Encoder writes items one at a time in a format.  Close must be called
+// to finish the output, the JSON array is not closed until then.
+type Encoder struct {
+	w      io.Writer
+	format Format
+	csv    *csv.Writer
+	count  int
+}
+
+// NewEncoder creates an encoder that writes to w
+func NewEncoder(w io.Writer, format Format) (*Encoder, error) {
+	if _, err := ParseFormat(string(format)); err != nil {
+		return nil, err
+	}
+	e := &Encoder{w: w, format: format}
+	if format == CSV {
+		e.csv = csv.NewWriter(w)
+		if err := e.csv.Write(csvColumns); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Encode writes one item
+func (e *Encoder) Encode(item db.ToDoItem) error {
+	defer func() { e.count++ }()
+
+	switch e.format {
+	case CSV:
+		return e.csv.Write([]string{
+			strconv.Itoa(item.Id),
+			item.Title,
+			strconv.FormatBool(item.IsDone),
+			formatTime(item.DueDate),
+			string(item.Priority),
+			strings.Join(item.Tags, csvTagSeparator),
+			item.Notes,
+			item.Recurrence,
+			formatTime(item.CreatedAt),
+			formatTime(item.UpdatedAt),
+			formatTime(item.CompletedAt),
+		})
+	case RedisCLI:
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(string(data))
+		_, err = fmt.Fprintf(e.w, "json.set %s%d $ '%s'\nsadd %s %d\n", db.RedisKeyPrefix, item.Id, quoted, db.RedisIdsKey, item.Id)
+		return err
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if e.format == JSON {
+		prefix := ",\n\t"
+		if e.count == 0 {
+			prefix = "[\n\t"
+		}
+		_, err = fmt.Fprintf(e.w, "%s%s", prefix, data)
+		return err
+	}
+	_, err = fmt.Fprintf(e.w, "%s\n", data)
+	return err
+}
+
+// Count returns the number of items written so far
+func (e *Encoder) Count() int {
+	return e.count
+}
+
+// Close finishes the output
+func (e *Encoder) Close() error {
+	switch e.format {
+	case CSV:
+		e.csv.Flush()
+		return e.csv.Error()
+	case JSON:
+		end := "\n]\n"
+		if e.count == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(e.w, end)
+		return err
+	}
+	return nil
+}
+
+// formatTime writes an optional time for CSV, an empty cell means no time
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,224 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"drexel.edu/todo/db"
+)
+
+// ConflictPolicy decides what an import does with an item whose id is
+// already in the database
+type ConflictPolicy string
+
+const (
+	// Upsert replaces the existing item with the imported one
+	Upsert ConflictPolicy = "upsert"
+	// SkipExisting keeps the existing item and ignores the imported one
+	SkipExisting ConflictPolicy = "skip"
+	// FailOnConflict stops the import at the first existing item
+	FailOnConflict ConflictPolicy = "fail"
+)
+
+// Policies lists every conflict policy
+var Policies = []ConflictPolicy{Upsert, SkipExisting, FailOnConflict}
+
+// ParsePolicy checks a conflict policy name
+func ParsePolicy(name string) (ConflictPolicy, error) {
+	for _, p := range Policies {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, the policies are upsert, skip and fail", name)
+}
+
+// Action is what an import did, or in a dry run would do, with an item
+type Action string
+
+const (
+	Added     Action = "add"
+	Updated   Action = "update"
+	Unchanged Action = "unchanged"
+	Skipped   Action = "skip"
+)
+
+// Change records the action taken for one imported item
+type Change struct {
+	Id     int    `json:"id"`
+	Action Action `json:"action"`
+}
+
+// Report summarizes an import
+type Report struct {
+	DryRun  bool     `json:"dryRun"`
+	Read    int      `json:"read"`
+	Counts  Counts   `json:"counts"`
+	Changes []Change `json:"changes"`
+}
+
+// Counts is the number of items per action
+type Counts struct {
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"`
+}
+
+func (r Report) String() string {
+	s := fmt.Sprintf("Read %d items: %d added, %d updated, %d unchanged, %d skipped",
+		r.Read, r.Counts.Added, r.Counts.Updated, r.Counts.Unchanged, r.Counts.Skipped)
+	if r.DryRun {
+		s += " (dry run, nothing was written)"
+	}
+	return s
+}
+
+// Importer writes items into a store one at a time following a conflict
+// policy.  In a dry run the store is only read, the report shows what
+// would have happened.
+type Importer struct {
+	store  db.Store
+	policy ConflictPolicy
+	report Report
+
+	//In a dry run nothing is written, so remember the ids that would
+	//have been written to report duplicates in the input correctly
+	written map[int]db.ToDoItem
+}
+
+// NewImporter creates an Importer for store
+func NewImporter(store db.Store, policy ConflictPolicy, dryRun bool) *Importer {
+	return &Importer{
+		store:   store,
+		policy:  policy,
+		report:  Report{DryRun: dryRun, Changes: []Change{}},
+		written: make(map[int]db.ToDoItem),
+	}
+}
+
+// Import imports one item
+func (im *Importer) Import(item db.ToDoItem) error {
+	im.report.Read++
+	if item.Id <= 0 {
+		return fmt.Errorf("item %d of the input has an invalid id %d", im.report.Read, item.Id)
+	}
+	if item.Title == "" {
+		return fmt.Errorf("item %d of the input (id %d) has no title", im.report.Read, item.Id)
+	}
+
+	existing, found, err := im.lookup(item.Id)
+	if err != nil {
+		return err
+	}
+
+	var action Action
+	switch {
+	case !found:
+		action = Added
+	case existing.SameContent(item):
+		action = Unchanged
+	case im.policy == SkipExisting:
+		action = Skipped
+	case im.policy == FailOnConflict:
+		return fmt.Errorf("item %d: %w", item.Id, db.ErrItemExists)
+	default:
+		action = Updated
+	}
+
+	if !im.report.DryRun {
+		switch action {
+		case Added:
+			err = im.store.AddItem(item)
+		case Updated:
+			//The imported item replaces whatever version is stored
+			item.Version = 0
+			err = im.store.UpdateItem(item)
+		}
+		if err != nil {
+			return fmt.Errorf("item %d: %w", item.Id, err)
+		}
+	}
+	if action == Added || action == Updated {
+		im.written[item.Id] = item
+	}
+
+	im.record(item.Id, action)
+	return nil
+}
+
+// Report returns the report of everything imported so far
+func (im *Importer) Report() Report {
+	return im.report
+}
+
+func (im *Importer) lookup(id int) (db.ToDoItem, bool, error) {
+	if item, ok := im.written[id]; ok {
+		return item, true, nil
+	}
+	item, err := im.store.GetItem(id)
+	if errors.Is(err, db.ErrItemNotFound) {
+		return db.ToDoItem{}, false, nil
+	}
+	if err != nil {
+		return db.ToDoItem{}, false, err
+	}
+	return item, true, nil
+}
+
+func (im *Importer) record(id int, action Action) {
+	im.report.Changes = append(im.report.Changes, Change{Id: id, Action: action})
+	switch action {
+	case Added:
+		im.report.Counts.Added++
+	case Updated:
+		im.report.Counts.Updated++
+	case Unchanged:
+		im.report.Counts.Unchanged++
+	case Skipped:
+		im.report.Counts.Skipped++
+	}
+}
+
+// Import reads items in a format and imports them into store
+func Import(store db.Store, r io.Reader, format Format, policy ConflictPolicy, dryRun bool) (Report, error) {
+	im := NewImporter(store, policy, dryRun)
+	err := Decode(r, format, im.Import)
+	return im.Report(), err
+}
+
+// Export writes every item in store to w in a format and returns the
+// number of items written
+func Export(store db.Store, w io.Writer, format Format) (int, error) {
+	enc, err := NewEncoder(w, format)
+	if err != nil {
+		return 0, err
+	}
+	items, err := store.GetAllItems()
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			return enc.Count(), err
+		}
+	}
+	return enc.Count(), enc.Close()
+}
+
+// Copy imports every item in one store into another, for example from
+// the JSON file database into redis
+func Copy(from db.Store, to db.Store, policy ConflictPolicy, dryRun bool) (Report, error) {
+	im := NewImporter(to, policy, dryRun)
+	items, err := from.GetAllItems()
+	if err != nil {
+		return im.Report(), err
+	}
+	for _, item := range items {
+		if err := im.Import(item); err != nil {
+			return im.Report(), err
+		}
+	}
+	return im.Report(), nil
+}
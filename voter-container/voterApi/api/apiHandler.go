@@ -1,12 +1,19 @@
 package api
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"drexel.edu/jsonpatch"
+	"drexel.edu/middleware/webhooks"
 	"github.com/cs-681-cloud-native-software-engineering/todo-api/voterApi/db"
 	"github.com/gin-gonic/gin"
 )
@@ -16,8 +23,12 @@ const VOTER_API_VERSION = "1.0.0"
 var (
 	startTime     time.Time
 	errorsCounted uint
+	eventSeq      atomic.Uint64
 )
 
+// WebhookEventTypes are the events a webhook can ask for
+var WebhookEventTypes = []string{"voter.add", "voter.update", "voter.delete"}
+
 func uptime() time.Duration {
 	return time.Since(startTime) / time.Second
 }
@@ -30,7 +41,8 @@ func countedErrors(err error) {
 
 // VoterAPI creates and maintains a reference to the data handler
 type VoterAPI struct {
-	db *db.Voter
+	db    *db.Voter
+	hooks *webhooks.Manager
 }
 
 // New allows the start of a new api handler
@@ -46,6 +58,29 @@ func New() (*VoterAPI, error) {
 	return &VoterAPI{db: dbHandler}, nil
 }
 
+// AddWebhooks sends the voter changes to the webhooks of the manager
+func (api *VoterAPI) AddWebhooks(hooks *webhooks.Manager) {
+	api.hooks = hooks
+}
+
+// notifyWebhooks sends a voter event to the webhooks, if there are any.
+// It is called after a change is saved, a failed change is not sent.
+func (api *VoterAPI) notifyWebhooks(eventType string, data any) {
+	if api.hooks == nil {
+		return
+	}
+	now := time.Now().UTC()
+	err := api.hooks.Dispatch(webhooks.Event{
+		Id:        fmt.Sprintf("%d-%d", now.UnixMilli(), eventSeq.Add(1)),
+		Type:      eventType,
+		Timestamp: now,
+		Data:      data,
+	})
+	if err != nil {
+		log.Println("Error sending webhooks: ", err)
+	}
+}
+
 // ListAllVoters implements a GET /voter to grab all voters and their data
 func (api *VoterAPI) ListAllVoters(ctx *gin.Context) {
 	voterList, err := api.db.GetAllVoters()
@@ -221,6 +256,7 @@ func (api *VoterAPI) AddVoter(ctx *gin.Context) {
 		return
 	}
 
+	api.notifyWebhooks("voter.add", voterData)
 	ctx.JSON(http.StatusOK, voterData)
 }
 
@@ -242,6 +278,7 @@ func (api *VoterAPI) UpdateVoter(ctx *gin.Context) {
 		return
 	}
 
+	api.notifyWebhooks("voter.update", voterData)
 	ctx.JSON(http.StatusOK, voterData)
 }
 
@@ -257,12 +294,72 @@ func (api *VoterAPI) ChangeDoneStatus(ctx *gin.Context) {
 	if err := api.db.ChangeDoneStatus(voterData.VoterId, voterData.IsDone); err != nil {
 		countedErrors(err)
 		log.Println("Error updating voter isDone: ", err)
+		if errors.Is(err, db.ErrVoterNotFound) {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	api.notifyWebhooks("voter.update", voterData)
 	ctx.JSON(http.StatusOK, voterData)
 }
 
+// PatchVoter implements PATCH /voter/:voterId
+// changes part of a voter.  The body is a JSON Merge Patch sent as
+// application/merge-patch+json, for example {"lastName": "Smith"}, or a
+// JSON Patch sent as application/json-patch+json, for example
+// [{"op": "add", "path": "/voterHistory/-", "value": {...}}].  Plain
+// application/json is read as a JSON Patch if it is an array and a merge
+// patch otherwise.  Returns the patched voter.
+func (api *VoterAPI) PatchVoter(ctx *gin.Context) {
+	convertIdToInt64, err := strconv.ParseInt(ctx.Param("voterId"), 10, 32)
+	countedErrors(err)
+	if err != nil {
+		log.Println("Error Converting voterId to int64", err)
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	countedErrors(err)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	contentType := ctx.ContentType()
+	if contentType == "application/json" {
+		contentType = jsonpatch.MergePatchType
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+			contentType = jsonpatch.JSONPatchType
+		}
+	}
+	if contentType != jsonpatch.MergePatchType && contentType != jsonpatch.JSONPatchType {
+		ctx.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "use " + jsonpatch.MergePatchType + " or " + jsonpatch.JSONPatchType})
+		return
+	}
+
+	voter, err := api.db.PatchVoter(uint(convertIdToInt64), contentType, body)
+	countedErrors(err)
+	switch {
+	case err == nil:
+		api.notifyWebhooks("voter.update", voter)
+		ctx.JSON(http.StatusOK, voter)
+	case errors.Is(err, db.ErrVoterNotFound):
+		ctx.AbortWithStatus(http.StatusNotFound)
+	case errors.Is(err, jsonpatch.ErrInvalidPatch):
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, jsonpatch.ErrPatchFailed):
+		ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrContention):
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Println("Error patching voter: ", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
+
 // DeleteVoter implements DELETE /voter/:voterId
 // deletes a single voter
 func (api *VoterAPI) DeleteVoter(ctx *gin.Context) {
@@ -276,11 +373,12 @@ func (api *VoterAPI) DeleteVoter(ctx *gin.Context) {
 		return
 	}
 
+	api.notifyWebhooks("voter.delete", gin.H{"voterId": convertIdToInt64})
 	ctx.Status(http.StatusOK)
 
 }
 
-// DeleteAllVoters implements DELETE /voter
+// DeleteAllVoters implements DELETE /admin/voter
 // deletes all voter
 func (api *VoterAPI) DeleteAllVoters(ctx *gin.Context) {
 
@@ -291,6 +389,7 @@ func (api *VoterAPI) DeleteAllVoters(ctx *gin.Context) {
 		return
 	}
 
+	api.notifyWebhooks("voter.delete", gin.H{"all": true})
 	ctx.Status(http.StatusOK)
 }
 
@@ -6,10 +6,13 @@ import (
 	"errors"
 	"fmt"
 
+	"drexel.edu/jsonpatch"
 	"github.com/nitishm/go-rejson/v4"
 	"github.com/redis/go-redis/v9"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,6 +20,26 @@ const (
 	RedisNilError        = "redis: nil"
 	RedisDefaultLocation = "0.0.0.0:6379"
 	RedisKeyPrefix       = "voter:"
+
+	// RedisIdsKey is a set of every voter id, listing walks this set
+	// rather than running KEYS over the whole keyspace
+	RedisIdsKey = RedisKeyPrefix + "ids"
+
+	// redisBatchSize is the COUNT hint for SCAN and SSCAN and the most
+	// voters fetched by one JSON.MGET
+	redisBatchSize = 100
+)
+
+// watchRetries is how many times a patch is tried again when the voter
+// changes while it is being applied
+const watchRetries = 5
+
+var (
+	// ErrVoterNotFound is returned when a voter does not exist
+	ErrVoterNotFound = errors.New("voter does not exist")
+	// ErrContention is returned when a voter kept changing while it was
+	// being patched
+	ErrContention = errors.New("the voter kept changing, try again")
 )
 
 type cache struct {
@@ -96,14 +119,25 @@ func NewWithCacheInstance(location string) (*Voter, error) {
 	jsonHelper := rejson.NewReJSONHandler()
 	jsonHelper.SetGoRedisClientWithContext(ctx, client)
 
-	//Return a pointer to a new Voter struct
-	return &Voter{
+	voter := &Voter{
 		cache: cache{
 			cacheClient: client,
 			jsonHelper:  jsonHelper,
 			context:     ctx,
 		},
-	}, nil
+	}
+
+	// voters loaded straight into redis are not in the id set yet
+	if n, err := client.Exists(ctx, RedisIdsKey).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if err := voter.RebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	//Return a pointer to a new Voter struct
+	return voter, nil
 }
 
 // func to be used later
@@ -133,6 +167,85 @@ func (v *Voter) getVoterFromRedis(key string, voter *VoterData) error {
 	return nil
 }
 
+// scanVoterKeys calls fn with batches of voter:<id> keys found with SCAN,
+// other keys under the prefix like the id set are skipped
+func (v *Voter) scanVoterKeys(fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := v.cacheClient.Scan(v.context, cursor, RedisKeyPrefix+"*", redisBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		var voterKeys []string
+		for _, key := range keys {
+			if _, err := strconv.Atoi(strings.TrimPrefix(key, RedisKeyPrefix)); err == nil {
+				voterKeys = append(voterKeys, key)
+			}
+		}
+		if len(voterKeys) > 0 {
+			if err := fn(voterKeys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// getVotersFromRedis fetches a batch of voters with one JSON.MGET,
+// ids whose voter is gone are dropped from the id set
+func (v *Voter) getVotersFromRedis(ids []string) ([]VoterData, error) {
+	args := []interface{}{"JSON.MGET"}
+	for _, id := range ids {
+		args = append(args, RedisKeyPrefix+id)
+	}
+	args = append(args, ".")
+	docs, err := v.cacheClient.Do(v.context, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	var voters []VoterData
+	var missing []interface{}
+	for i, doc := range docs {
+		data, ok := doc.(string)
+		if !ok {
+			missing = append(missing, ids[i])
+			continue
+		}
+		var voter VoterData
+		if err := json.Unmarshal([]byte(data), &voter); err != nil {
+			return nil, err
+		}
+		voters = append(voters, voter)
+	}
+	if len(missing) > 0 {
+		if err := v.cacheClient.SRem(v.context, RedisIdsKey, missing...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return voters, nil
+}
+
+// RebuildIndex adds the id of every voter:<id> key to the id set
+func (v *Voter) RebuildIndex() error {
+	return v.scanVoterKeys(func(keys []string) error {
+		var ids []interface{}
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, RedisKeyPrefix))
+		}
+		return v.cacheClient.SAdd(v.context, RedisIdsKey, ids...).Err()
+	})
+}
+
+// CountVoters returns the number of voters without reading any of them
+func (v *Voter) CountVoters() (int, error) {
+	n, err := v.cacheClient.SCard(v.context, RedisIdsKey).Result()
+	return int(n), err
+}
+
 // AddVoter allows voter information to be added to the DB
 func (v *Voter) AddVoter(voter VoterData) error {
 
@@ -148,7 +261,8 @@ func (v *Voter) AddVoter(voter VoterData) error {
 		return err
 	}
 
-	return nil
+	// index the voter so GetAllVoters can find it
+	return v.cacheClient.SAdd(v.context, RedisIdsKey, voter.VoterId).Err()
 }
 
 // DeleteVoter allows deletion of voter by VoterId
@@ -156,11 +270,16 @@ func (v *Voter) DeleteVoter(voterId uint) error {
 
 	pattern := redisKeyFromId(int(voterId))
 
-	numDeleted, err := v.cacheClient.Del(v.context, pattern).Result()
+	// the voter and its id in the id set go in one transaction
+	var del *redis.IntCmd
+	_, err := v.cacheClient.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(v.context, pattern)
+		return pipe.SRem(v.context, RedisIdsKey, voterId).Err()
+	})
 	if err != nil {
-		return nil
+		return err
 	}
-	if numDeleted == 0 {
+	if del.Val() == 0 {
 		return errors.New("attempted to delete non-existent item")
 	}
 
@@ -171,20 +290,15 @@ func (v *Voter) DeleteVoter(voterId uint) error {
 // to be exposed via /voters
 func (v *Voter) DeleteAll() error {
 
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := v.cacheClient.Keys(v.context, pattern).Result()
-
-	numDeleted, err := v.cacheClient.Del(v.context, ks...).Result()
-
+	// SCAN finds voters that never made it into the id set too
+	err := v.scanVoterKeys(func(keys []string) error {
+		return v.cacheClient.Del(v.context, keys...).Err()
+	})
 	if err != nil {
 		return err
 	}
 
-	if numDeleted != int64(len(ks)) {
-		return errors.New("one or more items could not be deleted")
-	}
-
-	return nil
+	return v.cacheClient.Del(v.context, RedisIdsKey).Err()
 }
 
 // UpdateVoter changes voter information
@@ -255,39 +369,108 @@ func (v *Voter) GetVoterPoll(voterId uint, pollId uint) (VoterHistory, error) {
 	return voterHistoryMap[pollId], nil
 }
 
-// ChangeDoneStatus is not yet implemented
+// ChangeDoneStatus sets the isDone field of a voter.  Only that path
+// of the document is written, XX makes JSON.SET fail instead of creating
+// a document when the voter does not exist.
 func (v *Voter) ChangeDoneStatus(voterId uint, isDone bool) error {
 
-	var voter VoterData
-
 	redisKey := redisKeyFromId(int(voterId))
-	err := v.getVoterFromRedis(redisKey, &voter)
+	err := v.cacheClient.Do(v.context, "JSON.SET", redisKey, "$.isDone", strconv.FormatBool(isDone), "XX").Err()
 	if err != nil {
-		return errors.New("isDone status error")
-	}
-
-	if _, err := v.jsonHelper.JSONSet(redisKey, ".", isDone); err != nil {
+		if isRedisNilError(err) {
+			return ErrVoterNotFound
+		}
 		return err
 	}
 
 	return nil
 }
 
+// PatchVoter applies a JSON Merge Patch or a JSON Patch, named by its
+// content type, to a voter and returns the voter as it is after the
+// patch.  Only the paths the patch touches are written, and the voter
+// is WATCHed so the patch is applied all or nothing, see the jsonpatch module.
+func (v *Voter) PatchVoter(voterId uint, contentType string, patch []byte) (VoterData, error) {
+	key := redisKeyFromId(int(voterId))
+	var patched VoterData
+
+	for try := 0; try < watchRetries; try++ {
+		err := v.cacheClient.Watch(v.context, func(tx *redis.Tx) error {
+			// Tx has no Do, so the command is built and run by hand
+			get := redis.NewCmd(v.context, "JSON.GET", key, ".")
+			_ = tx.Process(v.context, get)
+			data, err := get.Text()
+			if err != nil {
+				if isRedisNilError(err) {
+					return ErrVoterNotFound
+				}
+				return err
+			}
+			var doc interface{}
+			if err := json.Unmarshal([]byte(data), &doc); err != nil {
+				return err
+			}
+
+			newDoc, cmds, err := jsonpatch.Apply(doc, contentType, patch)
+			if err != nil {
+				return err
+			}
+			patched = VoterData{}
+			if err := jsonpatch.Decode(newDoc, &patched); err != nil {
+				return err
+			}
+			if patched.VoterId != voterId {
+				return fmt.Errorf("%w: the voterId cannot be changed", jsonpatch.ErrPatchFailed)
+			}
+
+			_, err = tx.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+				for _, cmd := range cmds {
+					pipe.Do(v.context, cmd.ForKey(key)...)
+				}
+				return nil
+			})
+			return err
+		}, key)
+
+		// TxFailedErr means the voter changed after it was read
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return patched, err
+	}
+	return VoterData{}, ErrContention
+}
+
 // GetAllVoters grabs all voters in the database
 func (v *Voter) GetAllVoters() ([]VoterData, error) {
 
 	var voterList []VoterData
-	var voterData VoterData
-
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := v.cacheClient.Keys(v.context, pattern).Result()
 
-	for _, key := range ks {
-		err := v.getVoterFromRedis(key, &voterData)
+	// walk the id set with SSCAN and fetch each batch with JSON.MGET,
+	// SSCAN may return an id twice so repeats are skipped
+	seen := make(map[uint]bool)
+	var cursor uint64
+	for {
+		ids, next, err := v.cacheClient.SScan(v.context, RedisIdsKey, cursor, "", redisBatchSize).Result()
 		if err != nil {
 			return nil, err
 		}
-		voterList = append(voterList, voterData)
+		if len(ids) > 0 {
+			voters, err := v.getVotersFromRedis(ids)
+			if err != nil {
+				return nil, err
+			}
+			for _, voter := range voters {
+				if !seen[voter.VoterId] {
+					seen[voter.VoterId] = true
+					voterList = append(voterList, voter)
+				}
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
 	}
 
 	return voterList, nil
@@ -3,10 +3,11 @@ module github.com/cs-681-cloud-native-software-engineering/todo-api/voterApi
 go 1.21.6
 
 require (
+	drexel.edu/jsonpatch v0.0.0
+	drexel.edu/middleware v0.0.0
 	github.com/brianvoe/gofakeit/v6 v6.28.0
 	github.com/gin-contrib/cors v1.5.0
 	github.com/gin-gonic/gin v1.9.1
-	github.com/go-redis/redis/v8 v8.11.5
 	github.com/go-resty/resty/v2 v2.11.0
 	github.com/nitishm/go-rejson/v4 v4.2.0
 	github.com/redis/go-redis/v9 v9.5.1
@@ -25,6 +26,7 @@ require (
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.15.5 // indirect
+	github.com/go-redis/redis/v8 v8.11.5 // indirect
 	github.com/goccy/go-json v0.10.2 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.5 // indirect
@@ -45,3 +47,10 @@ require (
 	google.golang.org/protobuf v1.31.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+// The gin middleware and the patch to RedisJSON mapping are shared
+// with the other services
+replace (
+	drexel.edu/jsonpatch => ../../jsonpatch
+	drexel.edu/middleware => ../../middleware
+)
@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"os"
 
+	"drexel.edu/middleware/admin"
+	"drexel.edu/middleware/auth"
+	"drexel.edu/middleware/ratelimit"
+	"drexel.edu/middleware/webhooks"
 	"github.com/cs-681-cloud-native-software-engineering/todo-api/voterApi/api"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -14,8 +18,21 @@ const VOTERAPIVERSION = 1.0
 
 // global variables from the cli as flags
 var (
-	hostFlag string
-	portFlag uint
+	hostFlag   string
+	portFlag   uint
+	jwksFlag   string
+	apiKeyFlag string
+	noAuthFlag bool
+
+	adminHostFlag   string
+	adminPortFlag   uint
+	adminPolicyFlag string
+	enableChaosFlag bool
+
+	rateLimitsFlag string
+	rateRedisFlag  string
+
+	webhooksPrivateFlag bool
 )
 
 // initializeClientFlags parses flags provided from the cli
@@ -23,6 +40,28 @@ func initializeFlags() {
 
 	flag.StringVar(&hostFlag, "h", "0.0.0.0", "Listens on all interfaces")
 	flag.UintVar(&portFlag, "p", 8080, "Default port is set to 8080")
+	flag.StringVar(&jwksFlag, "jwks", "", "JWKS file with the keys tokens are signed with")
+	flag.StringVar(&apiKeyFlag, "auth-redis", "", "Location of the redis the API keys are kept in")
+	flag.BoolVar(&noAuthFlag, "insecure-no-auth", false, "Run without authentication, every route is open")
+
+	// The admin routes have their own listener, by default only
+	// on the loopback interface.  The chaos routes that kill or
+	// crash the server are off unless --enable-chaos is given
+	flag.StringVar(&adminHostFlag, "admin-h", "127.0.0.1", "Interface the admin routes listen on")
+	flag.UintVar(&adminPortFlag, "admin-p", 8081, "Port of the admin routes")
+	flag.StringVar(&adminPolicyFlag, "admin-policy", "", "YAML file with the RBAC policy of the admin routes")
+	flag.BoolVar(&enableChaosFlag, "enable-chaos", false, "Turn on the chaos routes, /admin/kill and /admin/crash")
+
+	// Requests are rate limited per client, with the limits of
+	// defaultRateLimits unless a YAML file is given.  The counts
+	// are kept in redis so they hold across replicas,
+	// RATELIMIT_FILE and RATELIMIT_REDIS_URL work too
+	flag.StringVar(&rateLimitsFlag, "rate-limits", "", "YAML file with the rate limits of the routes")
+	flag.StringVar(&rateRedisFlag, "ratelimit-redis", "", "Location of the redis the rate limit counts are kept in")
+
+	// Webhooks are not sent to loopback, link-local or private
+	// addresses unless --webhooks-allow-private is given
+	flag.BoolVar(&webhooksPrivateFlag, "webhooks-allow-private", false, "Allow webhooks to loopback, link-local and private addresses")
 
 	flag.Parse()
 }
@@ -43,23 +82,152 @@ func main() {
 		os.Exit(1)
 	}
 
-	instance.GET("/voter", apiHandler.ListAllVoters)
-	instance.GET("/voter/:voterId", apiHandler.GetVoter)
-	instance.GET("/voter/:voterId/polls", apiHandler.GetAllVoterPolls)
-	instance.GET("/voter/:voterId/polls/:pollId", apiHandler.GetVoterPoll)
-	instance.POST("/voter", apiHandler.AddVoter)
-	instance.PUT("/voter", apiHandler.UpdateVoter)
-	instance.PUT("/voter/status", apiHandler.ChangeDoneStatus)
-	instance.DELETE("/voter/:voterId", apiHandler.DeleteVoter)
-	instance.DELETE("/voter", apiHandler.DeleteAllVoters)
-
-	instance.GET("/kill", apiHandler.KillSim)
-	instance.GET("/crash", apiHandler.CrashSimulator)
+	// Authentication is on when there is a JWKS to check tokens
+	// against or a redis to look API keys up in, AUTH_JWKS_FILE
+	// and AUTH_REDIS_URL work too.  Without either the API does
+	// not start unless --insecure-no-auth is given.  Each route
+	// says the scope it needs, the roles of a token map to the
+	// voter scopes
+	authn, err := auth.New(auth.OptionsFromEnv(auth.Options{
+		JWKSFile:      jwksFlag,
+		RedisLocation: apiKeyFlag,
+		Resource:      "voter",
+		Insecure:      noAuthFlag,
+	}))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	read := authn.Require(auth.ReadScope("voter"))
+	write := authn.Require(auth.WriteScope("voter"))
+	adminOnly := authn.Require(auth.Admin)
+
+	// Every route is rate limited, per caller when the request has
+	// credentials that check out and per client address otherwise
+	limiter, err := newRateLimiter()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	instance.Use(authn.Identify(), limiter.Middleware())
+
+	instance.GET("/voter", read, apiHandler.ListAllVoters)
+	instance.GET("/voter/:voterId", read, apiHandler.GetVoter)
+	instance.GET("/voter/:voterId/polls", read, apiHandler.GetAllVoterPolls)
+	instance.GET("/voter/:voterId/polls/:pollId", read, apiHandler.GetVoterPoll)
+	instance.POST("/voter", write, apiHandler.AddVoter)
+	instance.PUT("/voter", write, apiHandler.UpdateVoter)
+	instance.PUT("/voter/status", write, apiHandler.ChangeDoneStatus)
+	instance.PATCH("/voter/:voterId", write, apiHandler.PatchVoter)
+	instance.DELETE("/voter/:voterId", write, apiHandler.DeleteVoter)
+
+	//Other services register a URL here to be sent voter changes
+	hooks := webhooks.NewWithOptions(api.WebhookEventTypes, webhooks.Options{AllowPrivateTargets: webhooksPrivateFlag})
+	defer hooks.Close()
+	apiHandler.AddWebhooks(hooks)
+	webhookRoutes := instance.Group("/webhooks", adminOnly)
+	webhookRoutes.POST("", hooks.RegisterWebhook)
+	webhookRoutes.GET("", hooks.ListWebhooks)
+	webhookRoutes.GET("/dead-letters", hooks.ListDeadLetters)
+	webhookRoutes.POST("/dead-letters/:deliveryId/retry", hooks.RetryDelivery)
+	webhookRoutes.GET("/:id", hooks.GetWebhook)
+	webhookRoutes.DELETE("/:id", hooks.DeleteWebhook)
+	webhookRoutes.GET("/:id/deliveries", hooks.ListDeliveries)
+
+	// API keys are made and deleted by admins
+	instance.POST("/apikeys", adminOnly, authn.CreateAPIKey)
+	instance.GET("/apikeys", adminOnly, authn.ListAPIKeys)
+	instance.DELETE("/apikeys/:id", adminOnly, authn.DeleteAPIKey)
+	instance.GET("/whoami", authn.Require(), authn.WhoAmI)
+
 	instance.GET("/health", apiHandler.HealthCheck)
 
 	v2 := instance.Group("/v2")
-	v2.GET("/voter", apiHandler.ListSelectVoters)
+	v2.GET("/voter", read, apiHandler.ListSelectVoters)
+
+	// Deleting every voter, /kill and /crash are on the admin
+	// listener, not next to the normal routes
+	adminInstance, err := adminRoutes(apiHandler, authn)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go func() {
+		adminPath := fmt.Sprintf("%s:%d", adminHostFlag, adminPortFlag)
+		if err := adminInstance.Run(adminPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
 
 	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
 	instance.Run(serverPath)
 }
+
+// defaultRateLimits are the limits when there is no -rate-limits
+// file.  GET /voter reads every voter, so it has a lower limit
+func defaultRateLimits() ratelimit.Config {
+	return ratelimit.Config{
+		Default: ratelimit.MustParseLimit("600/m"),
+		Routes: map[string]ratelimit.Rule{
+			"GET /voter":    ratelimit.MustParseLimit("60/m"),
+			"GET /v2/voter": ratelimit.MustParseLimit("60/m"),
+			"/health":       {},
+		},
+	}
+}
+
+// newRateLimiter returns the rate limiter of the public routes
+func newRateLimiter() (*ratelimit.Limiter, error) {
+	options, err := ratelimit.OptionsFromEnv(ratelimit.Options{
+		Config:        defaultRateLimits(),
+		RedisLocation: rateRedisFlag,
+		Identify:      auth.Subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitsFlag != "" {
+		if options.Config, err = ratelimit.LoadConfig(rateLimitsFlag); err != nil {
+			return nil, err
+		}
+	}
+	return ratelimit.New(options)
+}
+
+// adminRoutes returns the router of the admin listener.  Every
+// route needs a caller the RBAC policy allows and an
+// X-Audit-Reason header, and is logged, see the admin package
+func adminRoutes(apiHandler *api.VoterAPI, authn *auth.Authenticator) (*gin.Engine, error) {
+	policy := admin.DefaultPolicy(authn.Enabled())
+	if adminPolicyFlag != "" {
+		var err error
+		if policy, err = admin.LoadPolicy(adminPolicyFlag); err != nil {
+			return nil, err
+		}
+	}
+	adm := admin.New(admin.Options{Policy: policy, EnableChaos: enableChaosFlag, Identify: identify})
+
+	instance := gin.Default()
+	group := instance.Group("/admin", authn.Require())
+	group.GET("/whoami", adm.WhoAmI)
+	group.DELETE("/voter", adm.Allow(admin.ActionDeleteVoters), apiHandler.DeleteAllVoters)
+	group.GET("/kill", adm.Chaos(admin.ActionKill), apiHandler.KillSim)
+	group.GET("/crash", adm.Chaos(admin.ActionCrash), apiHandler.CrashSimulator)
+	return instance, nil
+}
+
+// identify returns the caller of an admin route from the
+// principal the auth middleware found, Anonymous when
+// authentication is off
+func identify(c *gin.Context) admin.Identity {
+	principal, ok := auth.PrincipalFrom(c)
+	if !ok {
+		return admin.Anonymous
+	}
+	identity := admin.Identity{Subject: principal.Subject}
+	for _, scope := range principal.Scopes {
+		identity.Scopes = append(identity.Scopes, string(scope))
+	}
+	return identity
+}
@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cs-681-cloud-native-software-engineering/todo-api/voterApi/db"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"testing"
+)
+
+// benchVoters is how many voters the listing benchmarks load
+const benchVoters = 1000
+
+// loadBenchVoters fills the database with benchVoters random voters
+func loadBenchVoters(b *testing.B) {
+	b.Helper()
+	if err := database.DeleteAll(); err != nil {
+		b.Fatal(err)
+	}
+	for i := 1; i <= benchVoters; i++ {
+		if err := database.AddVoter(createRandomPerson(uint(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetAllVoters lists voters with the id set, SSCAN and JSON.MGET
+func BenchmarkGetAllVoters(b *testing.B) {
+	loadBenchVoters(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		voters, err := database.GetAllVoters()
+		if err != nil || len(voters) != benchVoters {
+			b.Fatalf("got %d voters, %v", len(voters), err)
+		}
+	}
+}
+
+// BenchmarkGetAllVotersWithKeys lists voters the way the store used to,
+// KEYS followed by one JSON.GET per voter, for comparison
+func BenchmarkGetAllVotersWithKeys(b *testing.B) {
+	loadBenchVoters(b)
+	location := os.Getenv("REDIS_URL")
+	if location == "" {
+		location = db.RedisDefaultLocation
+	}
+	client := redis.NewClient(&redis.Options{Addr: location})
+	defer client.Close()
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		keys, err := client.Keys(ctx, db.RedisKeyPrefix+"[0-9]*").Result()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var voters []db.VoterData
+		for _, key := range keys {
+			data, err := client.Do(ctx, "JSON.GET", key, ".").Text()
+			if err != nil {
+				b.Fatal(err)
+			}
+			var voter db.VoterData
+			if err := json.Unmarshal([]byte(data), &voter); err != nil {
+				b.Fatal(err)
+			}
+			voters = append(voters, voter)
+		}
+		if len(voters) != benchVoters {
+			b.Fatalf("got %d voters", len(voters))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"drexel.edu/jsonpatch"
 	"fmt"
 	fake "github.com/brianvoe/gofakeit/v6"
 	"github.com/cs-681-cloud-native-software-engineering/todo-api/voterApi/db"
@@ -179,6 +180,36 @@ func TestDbChangeDoneStatus(t *testing.T) {
 	assert.Equal(t, true, vData.IsDone, "Error, did not find same isDone value.")
 }
 
+// TestDbPatchVoter changes a voter with a merge patch and with a JSON Patch
+func TestDbPatchVoter(t *testing.T) {
+	person := createRandomPerson(uint(1))
+	_ = database.DeleteVoter(person.VoterId)
+
+	err := database.AddVoter(person)
+	assert.NoError(t, err, "Error, was not able to add random data to database.")
+
+	voter, err := database.PatchVoter(person.VoterId, jsonpatch.MergePatchType, []byte(`{"lastName": "Smith"}`))
+	assert.NoError(t, err, "Error, was not able to merge patch the voter.")
+	assert.Equal(t, "Smith", voter.LastName, "Error, merge patch did not change the last name.")
+	assert.Equal(t, person.FirstName, voter.FirstName, "Error, merge patch changed a field it did not name.")
+
+	patch := `[{"op": "test", "path": "/lastName", "value": "Smith"},
+		{"op": "remove", "path": "/voterHistory/0"},
+		{"op": "replace", "path": "/isDone", "value": true}]`
+	voter, err = database.PatchVoter(person.VoterId, jsonpatch.JSONPatchType, []byte(patch))
+	assert.NoError(t, err, "Error, was not able to JSON patch the voter.")
+	assert.Len(t, voter.VoterHistory, 1, "Error, JSON patch did not remove the poll.")
+
+	stored, err := database.GetVoter(person.VoterId)
+	assert.NoError(t, err)
+	assert.Equal(t, voter, stored, "Error, the stored voter does not match the patched voter.")
+
+	_, err = database.PatchVoter(person.VoterId, jsonpatch.JSONPatchType, []byte(`[{"op": "test", "path": "/isDone", "value": false}]`))
+	assert.ErrorIs(t, err, jsonpatch.ErrPatchFailed, "Error, a failed test should fail the patch.")
+	_, err = database.PatchVoter(person.VoterId, jsonpatch.MergePatchType, []byte(`{"voterId": 7}`))
+	assert.ErrorIs(t, err, jsonpatch.ErrPatchFailed, "Error, a patch should not change the voterId.")
+}
+
 // TestDbPrintVoter creates a person and returns the information in a pretty JSON format
 func TestDbPrintVoter(t *testing.T) {
 	person := createRandomPerson(uint(1))